@@ -7,6 +7,9 @@ then
     exit $?
 fi
 
+# The integration tests create their own namespaces for each test, this sets up
+# the same topologies for manual testing.
+#
 # Topology: with one or 3 netns
 #
 # * 3-netns, for relay operations
@@ -10,6 +10,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/coredhcp/coredhcp/config"
@@ -17,17 +19,24 @@ import (
 	"github.com/coredhcp/coredhcp/server"
 
 	"github.com/coredhcp/coredhcp/plugins"
+	pl_authorize "github.com/coredhcp/coredhcp/plugins/authorize"
 	pl_dns "github.com/coredhcp/coredhcp/plugins/dns"
 	pl_file "github.com/coredhcp/coredhcp/plugins/file"
+	pl_fingerprint "github.com/coredhcp/coredhcp/plugins/fingerprint"
+	pl_hostsexport "github.com/coredhcp/coredhcp/plugins/hostsexport"
+	pl_keamirror "github.com/coredhcp/coredhcp/plugins/keamirror"
 	pl_leasetime "github.com/coredhcp/coredhcp/plugins/leasetime"
 	pl_nbp "github.com/coredhcp/coredhcp/plugins/nbp"
 	pl_netmask "github.com/coredhcp/coredhcp/plugins/netmask"
 	pl_prefix "github.com/coredhcp/coredhcp/plugins/prefix"
 	pl_range "github.com/coredhcp/coredhcp/plugins/range"
+	pl_refreshtime "github.com/coredhcp/coredhcp/plugins/refreshtime"
+	pl_rfc2131 "github.com/coredhcp/coredhcp/plugins/rfc2131"
 	pl_router "github.com/coredhcp/coredhcp/plugins/router"
 	pl_searchdomains "github.com/coredhcp/coredhcp/plugins/searchdomains"
 	pl_serverid "github.com/coredhcp/coredhcp/plugins/serverid"
 	pl_sleep "github.com/coredhcp/coredhcp/plugins/sleep"
+	pl_v6only "github.com/coredhcp/coredhcp/plugins/v6only"
 
 	"github.com/sirupsen/logrus"
 	flag "github.com/spf13/pflag"
@@ -39,6 +48,9 @@ var (
 	flagLogLevel    = flag.StringP("loglevel", "L", "info", fmt.Sprintf("Log level. One of %v", getLogLevels()))
 	flagConfig      = flag.StringP("conf", "c", "", "Use this configuration file instead of the default location")
 	flagPlugins     = flag.BoolP("plugins", "P", false, "list plugins")
+	flagReplay      = flag.String("replay", "", "Replay the requests recorded in this file against the configuration, report the responses that differ, and exit")
+	flagReplaySpeed = flag.Float64("replay-speed", 0, "Pace replayed requests as recorded, this many times faster. Default: no pacing")
+	flagValidate    = flag.Bool("validate", false, "Check the plugins of the configuration without side effects, report all the errors, and exit")
 )
 
 var logLevels = map[string]func(*logrus.Logger){
@@ -59,17 +71,55 @@ func getLogLevels() []string {
 }
 
 var desiredPlugins = []*plugins.Plugin{
+	&pl_authorize.Plugin,
 	&pl_dns.Plugin,
 	&pl_file.Plugin,
+	&pl_fingerprint.Plugin,
+	&pl_hostsexport.Plugin,
+	&pl_keamirror.Plugin,
 	&pl_leasetime.Plugin,
 	&pl_nbp.Plugin,
 	&pl_netmask.Plugin,
 	&pl_prefix.Plugin,
 	&pl_range.Plugin,
+	&pl_refreshtime.Plugin,
+	&pl_rfc2131.Plugin,
 	&pl_router.Plugin,
 	&pl_searchdomains.Plugin,
 	&pl_serverid.Plugin,
 	&pl_sleep.Plugin,
+	&pl_v6only.Plugin,
+}
+
+// replay replays a recording against conf, prints the responses that differ
+// from the recorded ones, and returns how many requests got such responses
+func replay(conf *config.Config, filename string, speed float64) (int, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	events, err := server.ReadRecording(f)
+	f.Close()
+	if err != nil {
+		return 0, err
+	}
+	divergences, err := server.Replay(conf, events, speed)
+	if err != nil {
+		return 0, err
+	}
+	for _, d := range divergences {
+		fmt.Printf("Request from %s at %s:\n%s\n", d.Request.Peer, d.Request.Time.Format(time.RFC3339Nano), d.Request.Summary())
+		fmt.Printf("Recorded %d responses:\n", len(d.Recorded))
+		for _, r := range d.Recorded {
+			fmt.Println(r)
+		}
+		fmt.Printf("Replayed %d responses:\n", len(d.Replayed))
+		for _, r := range d.Replayed {
+			fmt.Println(r)
+		}
+	}
+	fmt.Printf("%d of the replayed requests got different responses\n", len(divergences))
+	return len(divergences), nil
 }
 
 func main() {
@@ -97,7 +147,7 @@ func main() {
 		log.Infof("Disabling logging to stdout/stderr")
 		logger.WithNoStdOutErr(log)
 	}
-	config, err := config.Load(*flagConfig)
+	confs, err := config.LoadInstances(*flagConfig)
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
@@ -108,13 +158,67 @@ func main() {
 		}
 	}
 
-	// start server
-	srv, err := server.Start(config)
-	if err != nil {
-		log.Fatal(err)
+	if *flagValidate {
+		failed := false
+		for _, conf := range confs {
+			if err := plugins.ValidatePlugins(conf); err != nil {
+				if conf.Name != "" {
+					fmt.Printf("Instance %s:\n", conf.Name)
+				}
+				fmt.Println(err)
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		fmt.Println("Configuration OK")
+		os.Exit(0)
+	}
+	if *flagReplay != "" {
+		if len(confs) != 1 {
+			log.Fatalf("Cannot replay against %d server instances, configure a single one", len(confs))
+		}
+		divergences, err := replay(confs[0], *flagReplay, *flagReplaySpeed)
+		if err != nil {
+			log.Fatalf("Failed to replay %s: %v", *flagReplay, err)
+		}
+		if divergences > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// start the server of each instance
+	var servers []*server.Servers
+	closeAll := func() {
+		for _, srv := range servers {
+			srv.Close()
+		}
+	}
+	for _, conf := range confs {
+		srv, err := server.Start(conf)
+		if err != nil {
+			closeAll()
+			log.Fatal(err)
+		}
+		servers = append(servers, srv)
+	}
+	// Shut down through Close, so that the plugins write out their state
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		log.Printf("Got %s, shutting down", <-sigs)
+		closeAll()
+	}()
+	// The instances stop together
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *server.Servers) { errs <- srv.Wait() }(srv)
 	}
-	if err := srv.Wait(); err != nil {
+	if err := <-errs; err != nil {
 		log.Print(err)
 	}
+	closeAll()
 	time.Sleep(time.Second)
 }
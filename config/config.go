@@ -7,15 +7,19 @@ package config
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/coredhcp/coredhcp/logger"
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv6"
 	"github.com/spf13/cast"
 	"github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v3"
 )
 
 var log = logger.GetLogger("config")
@@ -29,7 +33,10 @@ const (
 
 // Config holds the DHCPv6/v4 server configuration
 type Config struct {
-	v       *viper.Viper
+	v *viper.Viper
+	// Name is the name of the server instance the configuration is for, see
+	// LoadInstances. It is empty for files without instances
+	Name    string
 	Server6 *ServerConfig
 	Server4 *ServerConfig
 }
@@ -44,43 +51,295 @@ func New() *Config {
 type ServerConfig struct {
 	Addresses []net.UDPAddr
 	Plugins   []PluginConfig
+	// LoadShedding is nil if load shedding is disabled
+	LoadShedding *LoadSheddingConfig
+	Limits       Limits
+	// RequestTimeout is the time after which the server gives up handling a
+	// request. Zero selects the server default
+	RequestTimeout time.Duration
+	// Unicast is the address DHCPv6 clients may unicast their requests to,
+	// advertised in the Server Unicast option (RFC8415 §21.12). It is nil if
+	// clients must use multicast
+	Unicast net.IP
+	// ClientLockStripes is the number of locks requests are serialized on,
+	// by client identifier, so that one client's requests are handled one at
+	// a time. Zero disables serialization
+	ClientLockStripes int
+	// PluginPanics is what the server does when a plugin panics
+	PluginPanics PanicPolicy
+	// Timers is what the server does with the renewal timers of a response
+	// that are inconsistent with its lease times
+	Timers TimersAction
+	// Record is nil unless the traffic of the server is recorded for replay
+	Record *RecordConfig
+	// Socket holds the options set on the sockets of the listeners
+	Socket SocketOptions
 }
 
+// SocketOptions are set on the sockets the server listens on. Zero values
+// leave the system defaults
+type SocketOptions struct {
+	// ReceiveBuffer is the size of the receive buffer, in bytes. The kernel
+	// may clamp it
+	ReceiveBuffer int
+	// TrafficClass is the ToS byte of DHCPv4 responses, or the Traffic Class
+	// of DHCPv6 responses
+	TrafficClass int
+	// MulticastHopLimit is the hop limit of multicast DHCPv6 responses
+	MulticastHopLimit int
+}
+
+// RecordConfig holds the configuration for recording the requests a server
+// receives and the responses it sends
+type RecordConfig struct {
+	// File is the file the datagrams are appended to
+	File string
+	// HostnameChars is the number of characters of client host names kept
+	// in the recording, or -1 to keep them whole
+	HostnameChars int
+	// MaxSize is the size in bytes past which the recording is rotated, or 0
+	// for the server default
+	MaxSize int64
+}
+
+// PanicAction is what happens to a request during which a plugin panicked
+type PanicAction int
+
+// The panic actions. PanicDisable drops the request like PanicDrop, and
+// disables the plugin when it panics too often
+const (
+	PanicDrop PanicAction = iota
+	PanicSkip
+	PanicDisable
+)
+
+// TimersAction is what the server does with the renewal timers of a response
+// that are inconsistent with its lease times, once the plugins ran
+type TimersAction int
+
+// The timers actions. TimersFix clamps the timers, keeping the ratios suggested
+// by RFC2131 §4.4.5 and RFC8415 §21.4; TimersDrop removes them, letting the
+// client pick its own
+const (
+	TimersFix TimersAction = iota
+	TimersDrop
+)
+
+// PanicPolicy holds the configuration for handling panics in plugins
+type PanicPolicy struct {
+	Action PanicAction
+	// MaxPanics is the number of panics within Window after which a plugin
+	// is disabled, with PanicDisable
+	MaxPanics int
+	Window    time.Duration
+}
+
+// Limits bounds the requests the server accepts. Requests exceeding them are
+// dropped before any plugin sees them. Zero values select the server defaults
+type Limits struct {
+	// MaxMessageSize is the maximum size of a request datagram, in bytes
+	MaxMessageSize int
+	// MaxRelayDepth is the maximum number of relay messages a DHCPv6
+	// request can be encapsulated in
+	MaxRelayDepth int
+	// MaxIAOptions is the maximum number of IA_NA, IA_TA and IA_PD options
+	// in a DHCPv6 request
+	MaxIAOptions int
+}
+
+// LoadSheddingConfig holds the configuration for dropping requests from new
+// clients when the server is overloaded, so clients that have been retrying for
+// a while get served first
+type LoadSheddingConfig struct {
+	// MaxInFlight is the number of requests being handled above which
+	// shedding starts
+	MaxInFlight int
+	// MinSecs is the time a client must have been trying to get a lease for
+	// (secs field in DHCPv4, elapsed time option in DHCPv6) for its
+	// DISCOVER or SOLICIT not to be shed
+	MinSecs time.Duration
+	// Action is what happens to the requests shed
+	Action ShedAction
+	// Delay is how long ShedDelay holds requests back
+	Delay time.Duration
+}
+
+// ShedAction is what happens to a request shed by load shedding
+type ShedAction int
+
+// The load shedding actions. ShedDelay holds the request back for a while, and
+// drops it like ShedDrop only if the server is still overloaded by then
+const (
+	ShedDrop ShedAction = iota
+	ShedDelay
+)
+
 // PluginConfig holds the configuration of a plugin
 type PluginConfig struct {
 	Name string
 	Args []string
+	// Position is where the plugin is configured, if it was loaded from a
+	// file
+	Position Position
+}
+
+// Position is a position in a configuration file
+type Position struct {
+	File         string
+	Line, Column int
+}
+
+// String returns the position as file:line:column, or an empty string if it
+// is unknown
+func (p Position) String() string {
+	if p.Line == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
 }
 
 // Load reads a configuration file and returns a Config object, or an error if
-// any.
+// any. Files configuring several server instances are read with LoadInstances
 func Load(pathOverride string) (*Config, error) {
+	confs, err := LoadInstances(pathOverride)
+	if err != nil {
+		return nil, err
+	}
+	if len(confs) != 1 {
+		return nil, ConfigErrorFromString("%d server instances configured, expected one", len(confs))
+	}
+	return confs[0], nil
+}
+
+// LoadInstances reads a configuration file and returns a Config object for
+// each server instance it configures, or an error if any. Files without an
+// `instances` section configure a single instance, with an empty name.
+// Otherwise each key of the section names an instance, and holds its server4
+// and server6 sections. Names are lowercased, like the other keys, and
+// instances are returned sorted by name
+func LoadInstances(pathOverride string) ([]*Config, error) {
 	log.Print("Loading configuration")
-	c := New()
-	c.v.SetConfigType("yml")
+	v := viper.New()
+	v.SetConfigType("yml")
 	if pathOverride != "" {
-		c.v.SetConfigFile(pathOverride)
+		v.SetConfigFile(pathOverride)
 	} else {
-		c.v.SetConfigName("config")
-		c.v.AddConfigPath(".")
-		c.v.AddConfigPath("$XDG_CONFIG_HOME/coredhcp/")
-		c.v.AddConfigPath("$HOME/.coredhcp/")
-		c.v.AddConfigPath("/etc/coredhcp/")
+		v.SetConfigName("config")
+		v.AddConfigPath(".")
+		v.AddConfigPath("$XDG_CONFIG_HOME/coredhcp/")
+		v.AddConfigPath("$HOME/.coredhcp/")
+		v.AddConfigPath("/etc/coredhcp/")
 	}
 
-	if err := c.v.ReadInConfig(); err != nil {
+	if err := v.ReadInConfig(); err != nil {
 		return nil, err
 	}
+	// Positions are only used to report errors, so they are best effort
+	file := v.ConfigFileUsed()
+	var doc *yaml.Node
+	if data, err := ioutil.ReadFile(file); err != nil {
+		log.Debugf("Could not read %s for plugin positions: %v", file, err)
+	} else if doc, err = documentRoot(data); err != nil {
+		log.Debugf("Could not find plugin positions in %s: %v", file, err)
+	}
+
+	if v.Get("instances") == nil {
+		c := &Config{v: v}
+		if err := c.parse(); err != nil {
+			return nil, err
+		}
+		c.locatePlugins(file, doc)
+		return []*Config{c}, nil
+	}
+	if v.Get("server6") != nil || v.Get("server4") != nil {
+		return nil, ConfigErrorFromString("server6 and server4 must be configured in instances when there are instances")
+	}
+	var names []string
+	for name := range cast.ToStringMap(v.Get("instances")) {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil, ConfigErrorFromString("instances: need at least one instance")
+	}
+	sort.Strings(names)
+	confs := make([]*Config, 0, len(names))
+	for _, name := range names {
+		if strings.Contains(name, ".") {
+			return nil, ConfigErrorFromString("instances: invalid instance name %q", name)
+		}
+		sub := v.Sub("instances." + name)
+		if sub == nil {
+			return nil, ConfigErrorFromString("instances: instance %s is not a mapping", name)
+		}
+		c := &Config{v: sub, Name: name}
+		if err := c.parse(); err != nil {
+			return nil, ConfigErrorFromString("instance %s: %v", name, err)
+		}
+		c.locatePlugins(file, mappingValue(mappingValue(doc, "instances"), name))
+		confs = append(confs, c)
+	}
+	return confs, nil
+}
+
+// parse reads the server configurations of c
+func (c *Config) parse() error {
 	if err := c.parseConfig(protocolV6); err != nil {
-		return nil, err
+		return err
 	}
 	if err := c.parseConfig(protocolV4); err != nil {
-		return nil, err
+		return err
 	}
 	if c.Server6 == nil && c.Server4 == nil {
-		return nil, ConfigErrorFromString("need at least one valid config for DHCPv6 or DHCPv4")
+		return ConfigErrorFromString("need at least one valid config for DHCPv6 or DHCPv4")
 	}
-	return c, nil
+	return nil
+}
+
+// documentRoot returns the top-level node of a YAML document, nil if it is
+// empty
+func documentRoot(data []byte) (*yaml.Node, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+		return nil, nil
+	}
+	return root.Content[0], nil
+}
+
+// locatePlugins sets the position of the configured plugins, from doc, the
+// mapping node holding the server sections of the configuration file
+func (c *Config) locatePlugins(file string, doc *yaml.Node) {
+	for _, server := range []struct {
+		key  string
+		conf *ServerConfig
+	}{{"server6", c.Server6}, {"server4", c.Server4}} {
+		if server.conf == nil {
+			continue
+		}
+		list := mappingValue(mappingValue(doc, server.key), "plugins")
+		if list == nil || list.Kind != yaml.SequenceNode || len(list.Content) != len(server.conf.Plugins) {
+			continue
+		}
+		for i, item := range list.Content {
+			server.conf.Plugins[i].Position = Position{File: file, Line: item.Line, Column: item.Column}
+		}
+	}
+}
+
+// mappingValue returns the value of key in the YAML mapping n, or nil. Keys
+// are matched case-insensitively, like viper does
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if strings.EqualFold(n.Content[i].Value, key) {
+			return n.Content[i+1]
+		}
+	}
+	return nil
 }
 
 func protoVersionCheck(v protocolVersion) error {
@@ -228,9 +487,75 @@ func (c *Config) parseConfig(ver protocolVersion) error {
 		return err
 	}
 
+	shedding, err := c.parseLoadShedding(ver)
+	if err != nil {
+		return err
+	}
+
+	limits, err := c.parseLimits(ver)
+	if err != nil {
+		return err
+	}
+
+	var timeout time.Duration
+	if t := c.v.Get(fmt.Sprintf("server%d.request_timeout", ver)); t != nil {
+		timeout, err = time.ParseDuration(cast.ToString(t))
+		if err != nil || timeout <= 0 {
+			return ConfigErrorFromString("dhcpv%d: request_timeout must be a positive duration", ver)
+		}
+	}
+
+	unicast, err := c.parseUnicast(ver)
+	if err != nil {
+		return err
+	}
+
+	var stripes int
+	if v := c.v.Get(fmt.Sprintf("server%d.serialize_clients", ver)); v != nil {
+		stripes, err = cast.ToIntE(v)
+		if err != nil || stripes <= 0 {
+			return ConfigErrorFromString("dhcpv%d: serialize_clients must be a positive number of locks", ver)
+		}
+	}
+
+	panics, err := c.parsePanicPolicy(ver)
+	if err != nil {
+		return err
+	}
+
+	timers := TimersFix
+	if v := c.v.Get(fmt.Sprintf("server%d.timers", ver)); v != nil {
+		switch cast.ToString(v) {
+		case "fix":
+		case "drop":
+			timers = TimersDrop
+		default:
+			return ConfigErrorFromString("dhcpv%d: timers must be one of fix or drop", ver)
+		}
+	}
+
+	record, err := c.parseRecord(ver)
+	if err != nil {
+		return err
+	}
+
+	socket, err := c.parseSocketOptions(ver)
+	if err != nil {
+		return err
+	}
+
 	sc := ServerConfig{
-		Addresses: listeners,
-		Plugins:   plugins,
+		Addresses:         listeners,
+		Plugins:           plugins,
+		LoadShedding:      shedding,
+		Limits:            limits,
+		RequestTimeout:    timeout,
+		Unicast:           unicast,
+		ClientLockStripes: stripes,
+		PluginPanics:      panics,
+		Timers:            timers,
+		Record:            record,
+		Socket:            socket,
 	}
 	if ver == protocolV6 {
 		c.Server6 = &sc
@@ -240,6 +565,21 @@ func (c *Config) parseConfig(ver protocolVersion) error {
 	return nil
 }
 
+func (c *Config) parseUnicast(ver protocolVersion) (net.IP, error) {
+	u := c.v.Get(fmt.Sprintf("server%d.unicast", ver))
+	if u == nil {
+		return nil, nil
+	}
+	if ver != protocolV6 {
+		return nil, ConfigErrorFromString("dhcpv%d: unicast is only supported for DHCPv6", ver)
+	}
+	ip := net.ParseIP(cast.ToString(u))
+	if ip == nil || ip.To4() != nil || ip.IsMulticast() || ip.IsUnspecified() {
+		return nil, ConfigErrorFromString("dhcpv6: unicast must be a unicast IPv6 address, got %v", u)
+	}
+	return ip, nil
+}
+
 // BUG(Natolumin): When listening on link-local multicast addresses without
 // binding to a specific interface, new interfaces coming up after the server
 // starts will not be taken into account.
@@ -339,3 +679,174 @@ func (c *Config) parseListen(ver protocolVersion) ([]net.UDPAddr, error) {
 	}
 	return listeners, nil
 }
+
+func (c *Config) parseLoadShedding(ver protocolVersion) (*LoadSheddingConfig, error) {
+	if err := protoVersionCheck(ver); err != nil {
+		return nil, err
+	}
+	if c.v.Get(fmt.Sprintf("server%d.load_shedding", ver)) == nil {
+		return nil, nil
+	}
+
+	maxInFlight, err := cast.ToIntE(c.v.Get(fmt.Sprintf("server%d.load_shedding.max_in_flight", ver)))
+	if err != nil || maxInFlight <= 0 {
+		return nil, ConfigErrorFromString("dhcpv%d: load_shedding: max_in_flight must be a positive integer", ver)
+	}
+	minSecs, err := time.ParseDuration(cast.ToString(c.v.Get(fmt.Sprintf("server%d.load_shedding.min_secs", ver))))
+	if err != nil || minSecs <= 0 {
+		return nil, ConfigErrorFromString("dhcpv%d: load_shedding: min_secs must be a positive duration", ver)
+	}
+	ls := LoadSheddingConfig{MaxInFlight: maxInFlight, MinSecs: minSecs}
+	switch action := c.v.Get(fmt.Sprintf("server%d.load_shedding.action", ver)); cast.ToString(action) {
+	case "", "drop":
+	case "delay":
+		ls.Action = ShedDelay
+		ls.Delay, err = time.ParseDuration(cast.ToString(c.v.Get(fmt.Sprintf("server%d.load_shedding.delay", ver))))
+		if err != nil || ls.Delay <= 0 {
+			return nil, ConfigErrorFromString("dhcpv%d: load_shedding: delay must be a positive duration", ver)
+		}
+	default:
+		return nil, ConfigErrorFromString("dhcpv%d: load_shedding: action must be one of drop or delay", ver)
+	}
+	return &ls, nil
+}
+
+// DefaultPanicPolicy is the policy used when the configuration does not give
+// one, and the defaults for the settings of a configured policy
+var DefaultPanicPolicy = PanicPolicy{Action: PanicDrop, MaxPanics: 3, Window: time.Minute}
+
+func (c *Config) parsePanicPolicy(ver protocolVersion) (PanicPolicy, error) {
+	p := DefaultPanicPolicy
+	if err := protoVersionCheck(ver); err != nil {
+		return p, err
+	}
+	key := fmt.Sprintf("server%d.on_plugin_panic", ver)
+	if v := c.v.Get(key + ".action"); v != nil {
+		switch cast.ToString(v) {
+		case "drop":
+			p.Action = PanicDrop
+		case "skip":
+			p.Action = PanicSkip
+		case "disable":
+			p.Action = PanicDisable
+		default:
+			return p, ConfigErrorFromString("dhcpv%d: on_plugin_panic: action must be one of drop, skip or disable", ver)
+		}
+	}
+	if v := c.v.Get(key + ".max_panics"); v != nil {
+		n, err := cast.ToIntE(v)
+		if err != nil || n <= 0 {
+			return p, ConfigErrorFromString("dhcpv%d: on_plugin_panic: max_panics must be a positive integer", ver)
+		}
+		p.MaxPanics = n
+	}
+	if v := c.v.Get(key + ".window"); v != nil {
+		d, err := time.ParseDuration(cast.ToString(v))
+		if err != nil || d <= 0 {
+			return p, ConfigErrorFromString("dhcpv%d: on_plugin_panic: window must be a positive duration", ver)
+		}
+		p.Window = d
+	}
+	return p, nil
+}
+
+func (c *Config) parseRecord(ver protocolVersion) (*RecordConfig, error) {
+	if err := protoVersionCheck(ver); err != nil {
+		return nil, err
+	}
+	if c.v.Get(fmt.Sprintf("server%d.record", ver)) == nil {
+		return nil, nil
+	}
+	r := RecordConfig{
+		File:          cast.ToString(c.v.Get(fmt.Sprintf("server%d.record.file", ver))),
+		HostnameChars: -1,
+	}
+	if r.File == "" {
+		return nil, ConfigErrorFromString("dhcpv%d: record: file is required", ver)
+	}
+	if v := c.v.Get(fmt.Sprintf("server%d.record.hostname_chars", ver)); v != nil {
+		n, err := cast.ToIntE(v)
+		if err != nil || n < 0 {
+			return nil, ConfigErrorFromString("dhcpv%d: record: hostname_chars must be a positive integer or 0", ver)
+		}
+		r.HostnameChars = n
+	}
+	if v := c.v.Get(fmt.Sprintf("server%d.record.max_size", ver)); v != nil {
+		n, err := cast.ToInt64E(v)
+		if err != nil || n <= 0 {
+			return nil, ConfigErrorFromString("dhcpv%d: record: max_size must be a positive integer", ver)
+		}
+		r.MaxSize = n
+	}
+	return &r, nil
+}
+
+func (c *Config) parseSocketOptions(ver protocolVersion) (SocketOptions, error) {
+	var o SocketOptions
+	if err := protoVersionCheck(ver); err != nil {
+		return o, err
+	}
+	key := fmt.Sprintf("server%d.socket", ver)
+	if v := c.v.Get(key + ".receive_buffer"); v != nil {
+		n, err := cast.ToIntE(v)
+		if err != nil || n <= 0 {
+			return o, ConfigErrorFromString("dhcpv%d: socket: receive_buffer must be a positive integer", ver)
+		}
+		o.ReceiveBuffer = n
+	}
+	// The byte is called ToS in IPv4, and Traffic Class in IPv6
+	tcKey, otherKey := "tos", "traffic_class"
+	if ver == protocolV6 {
+		tcKey, otherKey = otherKey, tcKey
+	}
+	if c.v.Get(key+"."+otherKey) != nil {
+		return o, ConfigErrorFromString("dhcpv%d: socket: %s is not available, use %s", ver, otherKey, tcKey)
+	}
+	if v := c.v.Get(key + "." + tcKey); v != nil {
+		n, err := cast.ToIntE(v)
+		if err != nil || n < 0 || n > 255 {
+			return o, ConfigErrorFromString("dhcpv%d: socket: %s must be an integer between 0 and 255", ver, tcKey)
+		}
+		o.TrafficClass = n
+	}
+	if v := c.v.Get(key + ".multicast_hop_limit"); v != nil {
+		if ver != protocolV6 {
+			return o, ConfigErrorFromString("dhcpv%d: socket: multicast_hop_limit is only available for DHCPv6", ver)
+		}
+		n, err := cast.ToIntE(v)
+		if err != nil || n < 1 || n > 255 {
+			return o, ConfigErrorFromString("dhcpv%d: socket: multicast_hop_limit must be an integer between 1 and 255", ver)
+		}
+		o.MulticastHopLimit = n
+	}
+	return o, nil
+}
+
+func (c *Config) parseLimits(ver protocolVersion) (Limits, error) {
+	var l Limits
+	if err := protoVersionCheck(ver); err != nil {
+		return l, err
+	}
+	// A slice rather than a map, so that the first invalid limit in this
+	// order is the one reported
+	for _, limit := range []struct {
+		key string
+		dst *int
+	}{
+		{"max_message_size", &l.MaxMessageSize},
+		{"max_relay_depth", &l.MaxRelayDepth},
+		{"max_ia_options", &l.MaxIAOptions},
+	} {
+		key, dst := limit.key, limit.dst
+		v := c.v.Get(fmt.Sprintf("server%d.limits.%s", ver, key))
+		if v == nil {
+			continue
+		}
+		n, err := cast.ToIntE(v)
+		if err != nil || n <= 0 {
+			return l, ConfigErrorFromString("dhcpv%d: limits: %s must be a positive integer", ver, key)
+		}
+		*dst = n
+	}
+	return l, nil
+}
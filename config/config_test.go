@@ -4,7 +4,15 @@
 
 package config
 
-import "testing"
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestSplitHostPort(t *testing.T) {
 	testcases := []struct {
@@ -50,3 +58,389 @@ func TestSplitHostPort(t *testing.T) {
 		}
 	}
 }
+
+func TestParseLoadShedding(t *testing.T) {
+	testcases := []struct {
+		name        string
+		maxInFlight interface{}
+		minSecs     interface{}
+		err         bool
+	}{
+		{"valid", 100, "4s", false},
+		{"string count", "100", "4s", false},
+		{"missing max_in_flight", nil, "4s", true},
+		{"zero max_in_flight", 0, "4s", true},
+		{"missing min_secs", 100, nil, true},
+		{"min_secs without unit", 100, 4, true},
+		{"negative min_secs", 100, "-4s", true},
+	}
+
+	for _, tc := range testcases {
+		c := New()
+		if tc.maxInFlight != nil {
+			c.v.Set("server4.load_shedding.max_in_flight", tc.maxInFlight)
+		}
+		if tc.minSecs != nil {
+			c.v.Set("server4.load_shedding.min_secs", tc.minSecs)
+		}
+		ls, err := c.parseLoadShedding(protocolV4)
+		if tc.err != (err != nil) {
+			t.Errorf("%s: unexpected error state, got err: %v", tc.name, err)
+			continue
+		}
+		if err == nil && (ls == nil || ls.MaxInFlight != 100 || ls.MinSecs.Seconds() != 4) {
+			t.Errorf("%s: got %+v, expected 100 in flight and 4s", tc.name, ls)
+		}
+	}
+
+	if ls, err := New().parseLoadShedding(protocolV4); ls != nil || err != nil {
+		t.Errorf("load shedding should be disabled by default, got %+v, %v", ls, err)
+	}
+
+	for _, tc := range []struct {
+		action, delay interface{}
+		expected      *LoadSheddingConfig
+	}{
+		{nil, nil, &LoadSheddingConfig{Action: ShedDrop}},
+		{"drop", nil, &LoadSheddingConfig{Action: ShedDrop}},
+		{"delay", "500ms", &LoadSheddingConfig{Action: ShedDelay, Delay: 500 * time.Millisecond}},
+		{"delay", nil, nil},
+		{"delay", "0s", nil},
+		{"queue", nil, nil},
+	} {
+		c := New()
+		c.v.Set("server4.load_shedding.max_in_flight", 100)
+		c.v.Set("server4.load_shedding.min_secs", "4s")
+		if tc.action != nil {
+			c.v.Set("server4.load_shedding.action", tc.action)
+		}
+		if tc.delay != nil {
+			c.v.Set("server4.load_shedding.delay", tc.delay)
+		}
+		ls, err := c.parseLoadShedding(protocolV4)
+		if tc.expected == nil {
+			if err == nil {
+				t.Errorf("action %v, delay %v: expected an error, got %+v", tc.action, tc.delay, ls)
+			}
+			continue
+		}
+		if err != nil || ls.Action != tc.expected.Action || ls.Delay != tc.expected.Delay {
+			t.Errorf("action %v, delay %v: got %+v, %v, expected %+v", tc.action, tc.delay, ls, err, tc.expected)
+		}
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	c := New()
+	c.v.Set("server6.limits.max_relay_depth", 4)
+	l, err := c.parseLimits(protocolV6)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if l != (Limits{MaxRelayDepth: 4}) {
+		t.Errorf("got %+v, expected only the relay depth to be set", l)
+	}
+
+	c.v.Set("server6.limits.max_ia_options", -1)
+	if _, err := c.parseLimits(protocolV6); err == nil {
+		t.Errorf("negative limits should be refused")
+	}
+
+	// With several invalid limits, the same one is always reported
+	c.v.Set("server6.limits.max_message_size", 0)
+	c.v.Set("server6.limits.max_relay_depth", "deep")
+	for i := 0; i < 20; i++ {
+		_, err := c.parseLimits(protocolV6)
+		if err == nil || !strings.Contains(err.Error(), "max_message_size") {
+			t.Fatalf("got %v, expected max_message_size to be reported", err)
+		}
+	}
+}
+
+func TestParseUnicast(t *testing.T) {
+	c := New()
+	if ip, err := c.parseUnicast(protocolV6); err != nil || ip != nil {
+		t.Errorf("unicast should be disabled by default, got %v, %v", ip, err)
+	}
+	c.v.Set("server6.unicast", "2001:db8::1")
+	ip, err := c.parseUnicast(protocolV6)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("got %v, expected 2001:db8::1", ip)
+	}
+
+	for _, bad := range []string{"ff02::1:2", "::", "192.0.2.1", "not an address"} {
+		c.v.Set("server6.unicast", bad)
+		if _, err := c.parseUnicast(protocolV6); err == nil {
+			t.Errorf("%s should be refused", bad)
+		}
+	}
+	c.v.Set("server4.unicast", "192.0.2.1")
+	if _, err := c.parseUnicast(protocolV4); err == nil {
+		t.Errorf("unicast should be refused for DHCPv4")
+	}
+}
+
+func TestParseSerializeClients(t *testing.T) {
+	c := New()
+	c.v.Set("server4.listen", []string{"0.0.0.0:67"})
+	c.v.Set("server4.plugins", []interface{}{map[string]interface{}{"server_id": "192.0.2.1"}})
+	c.v.Set("server4.serialize_clients", 64)
+	if err := c.parseConfig(protocolV4); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.Server4.ClientLockStripes != 64 {
+		t.Errorf("got %d lock stripes, expected 64", c.Server4.ClientLockStripes)
+	}
+
+	c.v.Set("server4.serialize_clients", 0)
+	if err := c.parseConfig(protocolV4); err == nil {
+		t.Errorf("zero lock stripes should be refused")
+	}
+}
+
+func TestParseTimers(t *testing.T) {
+	c := New()
+	c.v.Set("server6.listen", []string{"[::]:547"})
+	c.v.Set("server6.plugins", []interface{}{map[string]interface{}{"server_id": "LL 11:22:33:44:55:66"}})
+	if err := c.parseConfig(protocolV6); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.Server6.Timers != TimersFix {
+		t.Errorf("inconsistent timers should be fixed by default")
+	}
+
+	c.v.Set("server6.timers", "drop")
+	if err := c.parseConfig(protocolV6); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.Server6.Timers != TimersDrop {
+		t.Errorf("got timers action %d, expected drop", c.Server6.Timers)
+	}
+
+	c.v.Set("server6.timers", "clamp")
+	if err := c.parseConfig(protocolV6); err == nil {
+		t.Errorf("unknown timers action should be refused")
+	}
+}
+
+func TestParsePanicPolicy(t *testing.T) {
+	p, err := New().parsePanicPolicy(protocolV4)
+	if err != nil || p != DefaultPanicPolicy {
+		t.Errorf("got %+v, %v, expected the default policy", p, err)
+	}
+
+	c := New()
+	c.v.Set("server6.on_plugin_panic.action", "disable")
+	c.v.Set("server6.on_plugin_panic.max_panics", 5)
+	p, err = c.parsePanicPolicy(protocolV6)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p != (PanicPolicy{Action: PanicDisable, MaxPanics: 5, Window: DefaultPanicPolicy.Window}) {
+		t.Errorf("got %+v, expected disabling after 5 panics within the default window", p)
+	}
+
+	for key, v := range map[string]interface{}{
+		"action":     "crash",
+		"max_panics": 0,
+		"window":     "-1m",
+	} {
+		c := New()
+		c.v.Set("server4.on_plugin_panic."+key, v)
+		if _, err := c.parsePanicPolicy(protocolV4); err == nil {
+			t.Errorf("%s: %v should be refused", key, v)
+		}
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	if r, err := New().parseRecord(protocolV4); r != nil || err != nil {
+		t.Errorf("recording should be disabled by default, got %+v, %v", r, err)
+	}
+
+	c := New()
+	c.v.Set("server4.record.file", "/tmp/coredhcp.rec")
+	r, err := c.parseRecord(protocolV4)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *r != (RecordConfig{File: "/tmp/coredhcp.rec", HostnameChars: -1}) {
+		t.Errorf("got %+v, expected host names to be kept whole", r)
+	}
+
+	c.v.Set("server4.record.hostname_chars", 0)
+	if r, err = c.parseRecord(protocolV4); err != nil || r.HostnameChars != 0 {
+		t.Errorf("got %+v, %v, expected host names to be removed", r, err)
+	}
+
+	c.v.Set("server4.record.max_size", 1<<20)
+	if r, err = c.parseRecord(protocolV4); err != nil || r.MaxSize != 1<<20 {
+		t.Errorf("got %+v, %v, expected a maximum size of 1MiB", r, err)
+	}
+	c.v.Set("server4.record.max_size", 0)
+	if _, err := c.parseRecord(protocolV4); err == nil {
+		t.Errorf("a zero maximum size should be refused")
+	}
+
+	c = New()
+	c.v.Set("server6.record.hostname_chars", 3)
+	if _, err := c.parseRecord(protocolV6); err == nil {
+		t.Errorf("a recording without a file should be refused")
+	}
+}
+
+func TestParseSocketOptions(t *testing.T) {
+	if o, err := New().parseSocketOptions(protocolV4); o != (SocketOptions{}) || err != nil {
+		t.Errorf("got %+v, %v, expected the system defaults", o, err)
+	}
+
+	c := New()
+	c.v.Set("server6.socket.receive_buffer", 4194304)
+	c.v.Set("server6.socket.traffic_class", 0xb8)
+	c.v.Set("server6.socket.multicast_hop_limit", 8)
+	o, err := c.parseSocketOptions(protocolV6)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if o != (SocketOptions{ReceiveBuffer: 4194304, TrafficClass: 0xb8, MulticastHopLimit: 8}) {
+		t.Errorf("got %+v", o)
+	}
+
+	c = New()
+	c.v.Set("server4.socket.tos", 0x10)
+	if o, err = c.parseSocketOptions(protocolV4); err != nil || o.TrafficClass != 0x10 {
+		t.Errorf("got %+v, %v, expected a ToS of 0x10", o, err)
+	}
+
+	for _, tc := range []struct {
+		ver protocolVersion
+		key string
+		v   interface{}
+	}{
+		{protocolV4, "receive_buffer", 0},
+		{protocolV4, "receive_buffer", "large"},
+		{protocolV4, "tos", 256},
+		{protocolV4, "traffic_class", 0x10},
+		{protocolV6, "tos", 0x10},
+		{protocolV6, "traffic_class", -1},
+		{protocolV4, "multicast_hop_limit", 8},
+		{protocolV6, "multicast_hop_limit", 0},
+	} {
+		c := New()
+		c.v.Set(fmt.Sprintf("server%d.socket.%s", tc.ver, tc.key), tc.v)
+		if _, err := c.parseSocketOptions(tc.ver); err == nil {
+			t.Errorf("dhcpv%d: %s: %v should be refused", tc.ver, tc.key, tc.v)
+		}
+	}
+}
+
+func TestLocatePlugins(t *testing.T) {
+	data := []byte(`Server4:
+  plugins:
+    - server_id: 10.10.10.1
+    -   range: leases.txt 10.10.10.100 10.10.10.200 60s
+server6:
+  plugins: []
+`)
+	c := New()
+	c.Server4 = &ServerConfig{Plugins: []PluginConfig{{Name: "server_id"}, {Name: "range"}}}
+	// Configurations and files that do not match are left alone
+	c.Server6 = &ServerConfig{Plugins: []PluginConfig{{Name: "dns"}}}
+	doc, err := documentRoot(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c.locatePlugins("config.yml", doc)
+	for i, expected := range []string{"config.yml:3:7", "config.yml:4:9"} {
+		if pos := c.Server4.Plugins[i].Position.String(); pos != expected {
+			t.Errorf("plugin %d is at %q, expected %q", i, pos, expected)
+		}
+	}
+	if pos := c.Server6.Plugins[0].Position; pos != (Position{}) {
+		t.Errorf("got position %v for a plugin missing from the file", pos)
+	}
+
+	if _, err := documentRoot([]byte("server4: [")); err == nil {
+		t.Errorf("invalid YAML should be refused")
+	}
+}
+
+func TestLoadInstances(t *testing.T) {
+	f, err := ioutil.TempFile("", "coredhcp-*.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`instances:
+  Customer-B:
+    server4:
+      listen: "127.0.0.1:6767"
+      plugins:
+        - server_id: 198.51.100.1
+  customer-a:
+    server4:
+      plugins:
+        - server_id: 192.0.2.1
+        - dns: 192.0.2.53
+    server6:
+      plugins:
+        - server_id: LL 00:de:ad:be:ef:00
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	confs, err := LoadInstances(f.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(confs) != 2 {
+		t.Fatalf("got %d instances, expected 2", len(confs))
+	}
+	a, b := confs[0], confs[1]
+	if a.Name != "customer-a" || b.Name != "customer-b" {
+		t.Errorf("got instances %q and %q, expected customer-a and customer-b", a.Name, b.Name)
+	}
+	if a.Server6 == nil || b.Server6 != nil {
+		t.Errorf("DHCPv6 servers are not configured per instance")
+	}
+	if len(a.Server4.Plugins) != 2 || a.Server4.Plugins[1].Args[0] != "192.0.2.53" {
+		t.Errorf("unexpected plugins for customer-a: %v", a.Server4.Plugins)
+	}
+	if b.Server4.Addresses[0].Port != 6767 {
+		t.Errorf("unexpected addresses for customer-b: %v", b.Server4.Addresses)
+	}
+	if pos := a.Server4.Plugins[1].Position; pos.Line != 11 {
+		t.Errorf("dns plugin of customer-a is at %v, expected line 11", pos)
+	}
+	if _, err := Load(f.Name()); err == nil {
+		t.Errorf("Load should refuse several instances")
+	}
+}
+
+func TestLoadInstancesInvalid(t *testing.T) {
+	for _, content := range []string{
+		// Servers outside of the instances
+		"instances:\n  a:\n    server4:\n      plugins: []\nserver4:\n  plugins: []\n",
+		"instances: {}\n",
+		// No server in an instance
+		"instances:\n  a:\n    server5: {}\n",
+	} {
+		f, err := ioutil.TempFile("", "coredhcp-*.yml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		if _, err := f.WriteString(content); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if _, err := LoadInstances(f.Name()); err == nil {
+			t.Errorf("%q should be refused", content)
+		}
+	}
+}
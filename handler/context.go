@@ -0,0 +1,45 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package handler
+
+import (
+	"context"
+	"sync"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// contexts holds the contexts of the requests being handled, by request
+var contexts sync.Map
+
+// Bind attaches ctx to req, a *dhcpv4.DHCPv4 or a dhcpv6.DHCPv6 as given to
+// the handlers, until the returned function is called. The server binds a
+// context with the deadline for answering each request while its handlers run
+func Bind(req interface{}, ctx context.Context) (unbind func()) {
+	contexts.Store(req, ctx)
+	return func() { contexts.Delete(req) }
+}
+
+func lookup(req interface{}) context.Context {
+	if ctx, ok := contexts.Load(req); ok {
+		return ctx.(context.Context)
+	}
+	return context.Background()
+}
+
+// Context4 returns the context of a DHCPv4 request, which is done once the
+// client stopped waiting for the response. Handlers can use it to skip work,
+// such as writing out a lease, that would be wasted. Requests that are not
+// being handled by a server get a context that is never done
+func Context4(req *dhcpv4.DHCPv4) context.Context {
+	return lookup(req)
+}
+
+// Context6 is the DHCPv6 equivalent of Context4. req is the request given to
+// the handlers, relayed or not
+func Context6(req dhcpv6.DHCPv6) context.Context {
+	return lookup(req)
+}
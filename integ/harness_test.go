@@ -0,0 +1,222 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// +build integration
+
+package e2e_test
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/vishvananda/netns"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/coredhcp/coredhcp/server"
+
+	// Plugins
+	"github.com/coredhcp/coredhcp/plugins/file"
+	"github.com/coredhcp/coredhcp/plugins/serverid"
+)
+
+// Interface names are limited to 15 chars (IFNAMSIZ=16). They only need to be
+// unique within a namespace, so every topology uses the same
+const (
+	ifServer = "cdhcp_srv"
+	ifClient = "cdhcp_cli"
+)
+
+// directTopology is a server namespace and a client namespace created for one
+// test, linked by a veth pair (cdhcp_srv in serverNS, cdhcp_cli in clientNS).
+// This is the direct-attach topology of .ci/setup-integ.sh
+type directTopology struct {
+	serverNS, clientNS string
+	// serverIP and clientIP are the global addresses of the interfaces
+	serverIP, clientIP net.IP
+}
+
+func ulaPrefix() string {
+	if p := os.Getenv("ULA_PREFIX"); p != "" {
+		return p
+	}
+	return "fd4f:6b37:542c:b643"
+}
+
+// nsName returns a network namespace name for role in the test t, unique
+// among tests and readable in `ip netns`
+func nsName(t *testing.T, role string) string {
+	h := fnv.New32a()
+	h.Write([]byte(t.Name()))
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '-'
+	}, t.Name())
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	// Subtests and truncation can make names collide, the hash does not
+	return fmt.Sprintf("coredhcp-%s-%08x-%s", name, h.Sum32(), role)
+}
+
+// requireNetAdmin skips t unless it can create network namespaces
+func requireNetAdmin(t *testing.T) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("integration tests need root to create network namespaces")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("integration tests need the ip command from iproute2")
+	}
+}
+
+// ip runs the ip command with args, failing t if it fails
+func ip(t *testing.T, args ...string) {
+	t.Helper()
+	if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		t.Fatalf("ip %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+}
+
+// newDirectTopology creates the namespaces of a direct topology for t, and
+// deletes them when t ends, even if it panics
+func newDirectTopology(t *testing.T) *directTopology {
+	t.Helper()
+	requireNetAdmin(t)
+	topo := &directTopology{
+		serverNS: nsName(t, "srv"),
+		clientNS: nsName(t, "cli"),
+		serverIP: net.ParseIP(ulaPrefix() + ":a::1"),
+		clientIP: net.ParseIP(ulaPrefix() + ":b::1"),
+	}
+	for _, ns := range []string{topo.serverNS, topo.clientNS} {
+		// Leftovers of an interrupted run
+		_ = exec.Command("ip", "netns", "delete", ns).Run()
+		ip(t, "netns", "add", ns)
+		ns := ns
+		t.Cleanup(func() {
+			if out, err := exec.Command("ip", "netns", "delete", ns).CombinedOutput(); err != nil {
+				t.Errorf("could not delete netns %s: %v: %s", ns, err, out)
+			}
+		})
+	}
+
+	// Create the links in one of the namespaces, to ensure we don't pollute
+	// the main one
+	ip(t, "-n", topo.clientNS, "link", "add", ifClient, "type", "veth", "peer", "name", ifServer)
+	ip(t, "-n", topo.clientNS, "link", "set", ifServer, "netns", topo.serverNS)
+	ip(t, "-n", topo.serverNS, "addr", "add", topo.serverIP.String()+"/64", "dev", ifServer, "nodad")
+	ip(t, "-n", topo.serverNS, "addr", "add", "10.0.1.1/16", "dev", ifServer)
+	ip(t, "-n", topo.serverNS, "link", "set", ifServer, "up")
+	ip(t, "-n", topo.clientNS, "addr", "add", topo.clientIP.String()+"/64", "dev", ifClient, "nodad")
+	ip(t, "-n", topo.clientNS, "addr", "add", "10.0.2.1/16", "dev", ifClient)
+	ip(t, "-n", topo.clientNS, "link", "set", ifClient, "up")
+
+	// Link-local addresses cannot be used until duplicate address detection
+	// is done
+	for _, ns := range []string{topo.serverNS, topo.clientNS} {
+		waitNoTentative(t, ns)
+	}
+	return topo
+}
+
+// waitNoTentative waits until the IPv6 addresses of the namespace ns are
+// usable
+func waitNoTentative(t *testing.T, ns string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		out, err := exec.Command("ip", "-n", ns, "-6", "addr", "show", "tentative").CombinedOutput()
+		if err != nil {
+			t.Fatalf("could not list tentative addresses in %s: %v: %s", ns, err, out)
+		}
+		if len(strings.TrimSpace(string(out))) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("addresses in %s still tentative: %s", ns, out)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// server6Config returns a DHCPv6 server configuration listening on the
+// multicast group of the server interface, and on the unicast address of the
+// server
+func (topo *directTopology) server6Config() *config.Config {
+	return &config.Config{
+		Server6: &config.ServerConfig{
+			Addresses: []net.UDPAddr{
+				{IP: net.ParseIP("ff02::1:2"), Port: dhcpv6.DefaultServerPort, Zone: ifServer},
+				{IP: topo.serverIP, Port: dhcpv6.DefaultServerPort},
+			},
+			Plugins: []config.PluginConfig{
+				{Name: "server_id", Args: []string{"LL", "11:22:33:44:55:66"}},
+				{Name: "file", Args: []string{"./leases-dhcpv6-test.txt"}},
+			},
+		},
+	}
+}
+
+var registerOnce sync.Once
+
+// startServer registers the plugins the first time it is called, and starts a
+// server with conf in the server namespace, until the end of t
+func (topo *directTopology) startServer(t *testing.T, conf *config.Config) {
+	t.Helper()
+	registerOnce.Do(func() {
+		for _, pl := range []*plugins.Plugin{&serverid.Plugin, &file.Plugin} {
+			if err := plugins.RegisterPlugin(pl); err != nil {
+				t.Fatalf("Failed to register plugin `%s`: %v", pl.Name, err)
+			}
+		}
+	})
+	var srv *server.Servers
+	// Sockets stay in the namespace they are created in, so the server can
+	// run on any thread once started
+	if err := runInNs(topo.serverNS, func() error {
+		var err error
+		srv, err = server.Start(conf)
+		return err
+	}); err != nil {
+		t.Fatalf("Server could not start: %v", err)
+	}
+	t.Cleanup(srv.Close)
+}
+
+// runInNs runs f with the calling goroutine switched to the namespace nsName
+func runInNs(nsName string, f func() error) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	backupNS, err := netns.Get()
+	if err != nil {
+		return fmt.Errorf("could not save handle to original NS: %v", err)
+	}
+	defer backupNS.Close()
+	ns, err := netns.GetFromName(nsName)
+	if err != nil {
+		return fmt.Errorf("netns `%s` not set up: %v", nsName, err)
+	}
+	defer ns.Close()
+	if err := netns.Set(ns); err != nil {
+		return fmt.Errorf("couldn't switch to test NS: %v", err)
+	}
+	defer func() {
+		if netns.Set(backupNS) != nil {
+			panic("couldn't switch back to original NS")
+		}
+	}()
+	return f()
+}
@@ -7,118 +7,37 @@
 package e2e_test
 
 import (
-	"fmt"
-	"log"
 	"net"
-	"runtime"
 	"testing"
+	"time"
 
 	"github.com/insomniacslk/dhcp/dhcpv6"
 	"github.com/insomniacslk/dhcp/dhcpv6/client6"
 	"github.com/insomniacslk/dhcp/iana"
 	"github.com/stretchr/testify/require"
-	"github.com/vishvananda/netns"
-
-	"github.com/coredhcp/coredhcp/config"
-	"github.com/coredhcp/coredhcp/plugins"
-	"github.com/coredhcp/coredhcp/server"
-
-	// Plugins
-	"github.com/coredhcp/coredhcp/plugins/file"
-	"github.com/coredhcp/coredhcp/plugins/serverid"
 )
 
-var serverConfig = config.Config{
-	Server6: &config.ServerConfig{
-		Addresses: []net.UDPAddr{
-			{
-				IP:   net.ParseIP("ff02::1:2"),
-				Port: dhcpv6.DefaultServerPort,
-				Zone: "cdhcp_srv",
-			},
-		},
-		Plugins: []config.PluginConfig{
-			{Name: "server_id", Args: []string{"LL", "11:22:33:44:55:66"}},
-			{Name: "file", Args: []string{"./leases-dhcpv6-test.txt"}},
-		},
-	},
-}
-
-// This function *must* be run in its own routine
-// For now this assumes ns are created outside.
-// TODO: dynamically create NS and interfaces directly in the test program
-func runServer(readyCh chan<- struct{}, nsName string, desiredPlugins []*plugins.Plugin) {
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
-	ns, err := netns.GetFromName(nsName)
-	if err != nil {
-		log.Panicf("Netns `%s` not set up: %v", nsName, err)
-	}
-	if err := netns.Set(ns); err != nil {
-		log.Panicf("Failed to switch to netns `%s`: %v", nsName, err)
-	}
-	// register plugins
-	for _, pl := range desiredPlugins {
-		if err := plugins.RegisterPlugin(pl); err != nil {
-			log.Panicf("Failed to register plugin `%s`: %v", pl.Name, err)
-		}
-	}
-	// start DHCP server
-	srv, err := server.Start(&serverConfig)
-	if err != nil {
-		log.Panicf("Server could not start: %v", err)
-	}
-	readyCh <- struct{}{}
-	if err := srv.Wait(); err != nil {
-		log.Panicf("Server errored during run: %v", err)
-	}
-}
-
-// runInNs will execute the provided cmd in the namespace nsName.
-// It returns the error status of the cmd. Errors in NS management will panic
+// runClient6 runs a DHCPv6 exchange from iface in the namespace nsName
 func runClient6(nsName, iface string, modifiers ...dhcpv6.Modifier) error {
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
-	backupNS, err := netns.Get()
-	if err != nil {
-		panic("Could not save handle to original NS")
-	}
-
-	ns, err := netns.GetFromName(nsName)
-	if err != nil {
-		panic("netns not set up")
-	}
-	if err := netns.Set(ns); err != nil {
-		panic(fmt.Sprintf("Couldn't switch to test NS: %v", err))
-	}
-
-	client := client6.NewClient()
-	_, cErr := client.Exchange(iface, modifiers...)
-
-	if netns.Set(backupNS) != nil {
-		panic("couldn't switch back to original NS")
-	}
-
-	return cErr
+	return runInNs(nsName, func() error {
+		client := client6.NewClient()
+		_, err := client.Exchange(iface, modifiers...)
+		return err
+	})
 }
 
-// TestDora creates a server and attempts to connect to it
+// TestDora creates a server and attempts to connect to it. The client
+// multicasts its requests, so this checks the server joined ff02::1:2
 func TestDora(t *testing.T) {
-	readyCh := make(chan struct{}, 1)
-	go runServer(readyCh,
-		"coredhcp-direct-upper",
-		[]*plugins.Plugin{
-			&serverid.Plugin, &file.Plugin,
-		},
-	)
-	// wait for server to be ready before sending DHCP request
-	<-readyCh
+	t.Parallel()
+	topo := newDirectTopology(t)
+	topo.startServer(t, topo.server6Config())
 	mac, err := net.ParseMAC("de:ad:be:ef:00:00")
 	if err != nil {
 		panic(err)
 	}
 	require.NoError(t, runClient6(
-		"coredhcp-direct-lower", "cdhcp_cli",
+		topo.clientNS, ifClient,
 		dhcpv6.WithClientID(dhcpv6.Duid{
 			Type:          dhcpv6.DUID_LL,
 			HwType:        iana.HWTypeEthernet,
@@ -126,3 +45,55 @@ func TestDora(t *testing.T) {
 		}),
 	))
 }
+
+// TestUseMulticast sends a RENEW by unicast to a server that did not allow it,
+// and checks the server asks the client to use multicast instead
+func TestUseMulticast(t *testing.T) {
+	t.Parallel()
+	topo := newDirectTopology(t)
+	topo.startServer(t, topo.server6Config())
+	mac, err := net.ParseMAC("de:ad:be:ef:00:00")
+	require.NoError(t, err)
+	renew, err := dhcpv6.NewMessage()
+	require.NoError(t, err)
+	renew.MessageType = dhcpv6.MessageTypeRenew
+	renew.AddOption(dhcpv6.OptClientID(dhcpv6.Duid{
+		Type:          dhcpv6.DUID_LL,
+		HwType:        iana.HWTypeEthernet,
+		LinkLayerAddr: mac,
+	}))
+	renew.AddOption(dhcpv6.OptServerID(dhcpv6.Duid{
+		Type:          dhcpv6.DUID_LL,
+		HwType:        iana.HWTypeEthernet,
+		LinkLayerAddr: net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66},
+	}))
+
+	var resp dhcpv6.DHCPv6
+	require.NoError(t, runInNs(topo.clientNS, func() error {
+		conn, err := net.DialUDP("udp6",
+			&net.UDPAddr{IP: topo.clientIP, Port: dhcpv6.DefaultClientPort},
+			&net.UDPAddr{IP: topo.serverIP, Port: dhcpv6.DefaultServerPort})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if _, err := conn.Write(renew.ToBytes()); err != nil {
+			return err
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			return err
+		}
+		buf := make([]byte, 1500)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		resp, err = dhcpv6.FromBytes(buf[:n])
+		return err
+	}))
+
+	require.Equal(t, dhcpv6.MessageTypeReply, resp.Type())
+	status := resp.GetOneOption(dhcpv6.OptionStatusCode)
+	require.NotNil(t, status, "reply has no status code")
+	require.Equal(t, []byte{0, byte(iana.StatusUseMulticast)}, status.ToBytes()[:2])
+}
@@ -0,0 +1,51 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package atomicfile
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredhcp-atomicfile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "state")
+
+	require.NoError(t, Write(filename, 0644, func(w io.Writer) error {
+		_, err := io.WriteString(w, "first\n")
+		return err
+	}))
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "first\n", string(data))
+	info, err := os.Stat(filename)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	failure := errors.New("failed")
+	err = Write(filename, 0644, func(w io.Writer) error {
+		if _, err := io.WriteString(w, "partial"); err != nil {
+			return err
+		}
+		return failure
+	})
+	assert.Equal(t, failure, err)
+	data, err = ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "first\n", string(data), "a failed write should leave the file untouched")
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 1, "temporary files were left behind")
+}
@@ -0,0 +1,70 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package testpackets
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// testdata returns the directory of the captures, wherever the tests using
+// them run from
+func testdata(t testing.TB) string {
+	t.Helper()
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Fatal("testpackets: could not find the captures")
+	}
+	return filepath.Join(filepath.Dir(file), "testdata")
+}
+
+// Captures4 returns the names of the DHCPv4 packets captured from real devices,
+// for tests running over all of them
+func Captures4(t testing.TB) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(testdata(t), "*.hex"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("testpackets: no captures found: %v", err)
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		names = append(names, strings.TrimSuffix(filepath.Base(f), ".hex"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Capture4 returns the DHCPv4 packet captured from a real device as name, see
+// Captures4, along with its raw bytes. The captures are hex dumps of the UDP
+// payloads, after comment lines starting with # giving their origin
+func Capture4(t testing.TB, name string) (*dhcpv4.DHCPv4, []byte) {
+	t.Helper()
+	contents, err := ioutil.ReadFile(filepath.Join(testdata(t), name+".hex"))
+	if err != nil {
+		t.Fatalf("testpackets: could not read capture: %v", err)
+	}
+	var dump strings.Builder
+	for _, line := range strings.Split(string(contents), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			dump.WriteString(strings.TrimSpace(line))
+		}
+	}
+	raw, err := hex.DecodeString(dump.String())
+	if err != nil {
+		t.Fatalf("testpackets: invalid capture %s: %v", name, err)
+	}
+	m, err := dhcpv4.FromBytes(raw)
+	if err != nil {
+		t.Fatalf("testpackets: could not parse capture %s: %v", name, err)
+	}
+	return m, raw
+}
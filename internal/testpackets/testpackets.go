@@ -0,0 +1,176 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// Package testpackets builds DHCPv4 and DHCPv6 requests for tests.
+//
+// Each builder returns the request as it would be received by the server:
+// serialized, then parsed back, along with the raw bytes. Options given as
+// modifiers are applied before serialization, so malformed options survive as
+// they would on the wire. Builders call t.Fatal if the packet cannot be built.
+//
+// Capture4 returns DHCPv4 packets captured from real devices, kept as hex
+// dumps in testdata, for tests that should not only see what the library
+// builds.
+package testpackets
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// DefaultMAC is the hardware address used by the builders given a nil one
+var DefaultMAC = net.HardwareAddr{0xde, 0xad, 0xbe, 0xef, 0x00, 0x00}
+
+func orDefault(mac net.HardwareAddr) net.HardwareAddr {
+	if mac == nil {
+		return DefaultMAC
+	}
+	return mac
+}
+
+func wire4(t testing.TB, m *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, []byte) {
+	t.Helper()
+	raw := m.ToBytes()
+	parsed, err := dhcpv4.FromBytes(raw)
+	if err != nil {
+		t.Fatalf("testpackets: could not parse back DHCPv4 packet: %v", err)
+	}
+	return parsed, raw
+}
+
+func wire6(t testing.TB, d dhcpv6.DHCPv6) (dhcpv6.DHCPv6, []byte) {
+	t.Helper()
+	raw := d.ToBytes()
+	parsed, err := dhcpv6.FromBytes(raw)
+	if err != nil {
+		t.Fatalf("testpackets: could not parse back DHCPv6 packet: %v", err)
+	}
+	return parsed, raw
+}
+
+func new4(t testing.TB, mac net.HardwareAddr, mt dhcpv4.MessageType, mods []dhcpv4.Modifier) (*dhcpv4.DHCPv4, []byte) {
+	t.Helper()
+	m, err := dhcpv4.New(append([]dhcpv4.Modifier{
+		dhcpv4.WithHwAddr(orDefault(mac)),
+		dhcpv4.WithMessageType(mt),
+	}, mods...)...)
+	if err != nil {
+		t.Fatalf("testpackets: could not build DHCPv4 %s: %v", mt, err)
+	}
+	return wire4(t, m)
+}
+
+// V4Discover returns a DHCPDISCOVER from mac
+func V4Discover(t testing.TB, mac net.HardwareAddr, mods ...dhcpv4.Modifier) (*dhcpv4.DHCPv4, []byte) {
+	t.Helper()
+	return new4(t, mac, dhcpv4.MessageTypeDiscover, mods)
+}
+
+// V4RequestSelecting returns a DHCPREQUEST from mac answering an offer of
+// requested by serverID (RFC2131 §4.3.2, SELECTING state)
+func V4RequestSelecting(t testing.TB, mac net.HardwareAddr, serverID, requested net.IP, mods ...dhcpv4.Modifier) (*dhcpv4.DHCPv4, []byte) {
+	t.Helper()
+	return new4(t, mac, dhcpv4.MessageTypeRequest, append([]dhcpv4.Modifier{
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverID)),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(requested)),
+	}, mods...))
+}
+
+// V4RequestInitReboot returns a DHCPREQUEST from mac verifying its previous
+// address after a reboot (INIT-REBOOT state)
+func V4RequestInitReboot(t testing.TB, mac net.HardwareAddr, requested net.IP, mods ...dhcpv4.Modifier) (*dhcpv4.DHCPv4, []byte) {
+	t.Helper()
+	return new4(t, mac, dhcpv4.MessageTypeRequest, append([]dhcpv4.Modifier{
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(requested)),
+	}, mods...))
+}
+
+// V4RequestRenewing returns a DHCPREQUEST from mac extending its lease on
+// ciaddr (RENEWING or REBINDING state)
+func V4RequestRenewing(t testing.TB, mac net.HardwareAddr, ciaddr net.IP, mods ...dhcpv4.Modifier) (*dhcpv4.DHCPv4, []byte) {
+	t.Helper()
+	return new4(t, mac, dhcpv4.MessageTypeRequest, append([]dhcpv4.Modifier{
+		dhcpv4.WithClientIP(ciaddr),
+	}, mods...))
+}
+
+// V4Relayed returns m as relayed by giaddr, with an option 82 holding a
+// Circuit ID sub-option (RFC3046) if circuitID is not empty
+func V4Relayed(t testing.TB, m *dhcpv4.DHCPv4, giaddr net.IP, circuitID []byte) (*dhcpv4.DHCPv4, []byte) {
+	t.Helper()
+	relayed, err := dhcpv4.New(dhcpv4.WithHwAddr(m.ClientHWAddr))
+	if err != nil {
+		t.Fatalf("testpackets: %v", err)
+	}
+	*relayed = *m
+	relayed.Options = dhcpv4.Options{}
+	for code, value := range m.Options {
+		relayed.Options[code] = value
+	}
+	relayed.GatewayIPAddr = giaddr
+	relayed.HopCount++
+	if len(circuitID) > 0 {
+		rai := append([]byte{1, byte(len(circuitID))}, circuitID...)
+		relayed.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionRelayAgentInformation, rai))
+	}
+	return wire4(t, relayed)
+}
+
+// V6Solicit returns a SOLICIT from a client with a DUID-LL based on mac,
+// requesting one IA_NA
+func V6Solicit(t testing.TB, mac net.HardwareAddr, mods ...dhcpv6.Modifier) (*dhcpv6.Message, []byte) {
+	t.Helper()
+	m, err := dhcpv6.NewSolicit(orDefault(mac), mods...)
+	if err != nil {
+		t.Fatalf("testpackets: could not build SOLICIT: %v", err)
+	}
+	d, raw := wire6(t, m)
+	return d.(*dhcpv6.Message), raw
+}
+
+// V6SolicitWithIANAandIAPD returns a SOLICIT like V6Solicit, also requesting
+// one IA_PD
+func V6SolicitWithIANAandIAPD(t testing.TB, mac net.HardwareAddr, mods ...dhcpv6.Modifier) (*dhcpv6.Message, []byte) {
+	t.Helper()
+	return V6Solicit(t, mac, append([]dhcpv6.Modifier{func(d dhcpv6.DHCPv6) {
+		d.AddOption(&dhcpv6.OptIAPD{IaId: [4]byte{0, 0, 0, 1}})
+	}}, mods...)...)
+}
+
+// V6InformationRequest returns an INFORMATION-REQUEST, with a client ID based
+// on mac unless mac is nil (the client ID is optional in this message)
+func V6InformationRequest(t testing.TB, mac net.HardwareAddr, mods ...dhcpv6.Modifier) (*dhcpv6.Message, []byte) {
+	t.Helper()
+	m, err := dhcpv6.NewMessage(mods...)
+	if err != nil {
+		t.Fatalf("testpackets: could not build INFORMATION-REQUEST: %v", err)
+	}
+	m.MessageType = dhcpv6.MessageTypeInformationRequest
+	if mac != nil {
+		m.AddOption(dhcpv6.OptClientID(dhcpv6.Duid{
+			Type:          dhcpv6.DUID_LL,
+			HwType:        1, // Ethernet
+			LinkLayerAddr: mac,
+		}))
+	}
+	d, raw := wire6(t, m)
+	return d.(*dhcpv6.Message), raw
+}
+
+// RelayWrap returns d encapsulated in depth RELAY-FORW messages, as relayed
+// from peer by a relay on link
+func RelayWrap(t testing.TB, d dhcpv6.DHCPv6, depth int, link, peer net.IP) (dhcpv6.DHCPv6, []byte) {
+	t.Helper()
+	for i := 0; i < depth; i++ {
+		r, err := dhcpv6.EncapsulateRelay(d, dhcpv6.MessageTypeRelayForward, link, peer)
+		if err != nil {
+			t.Fatalf("testpackets: could not encapsulate relay message: %v", err)
+		}
+		d = r
+	}
+	return wire6(t, d)
+}
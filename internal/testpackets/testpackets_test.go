@@ -0,0 +1,103 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package testpackets
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestV4Requests(t *testing.T) {
+	serverID, addr := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 100)
+
+	m, raw := V4Discover(t, nil)
+	assert.Equal(t, dhcpv4.MessageTypeDiscover, m.MessageType())
+	assert.Equal(t, DefaultMAC, m.ClientHWAddr)
+	assert.Equal(t, raw, m.ToBytes())
+
+	m, _ = V4RequestSelecting(t, nil, serverID, addr)
+	assert.Equal(t, dhcpv4.MessageTypeRequest, m.MessageType())
+	assert.True(t, m.ServerIdentifier().Equal(serverID))
+	assert.True(t, m.RequestedIPAddress().Equal(addr))
+
+	m, _ = V4RequestInitReboot(t, nil, addr)
+	assert.Nil(t, m.ServerIdentifier())
+	assert.True(t, m.RequestedIPAddress().Equal(addr))
+
+	m, _ = V4RequestRenewing(t, nil, addr)
+	assert.Nil(t, m.RequestedIPAddress())
+	assert.True(t, m.ClientIPAddr.Equal(addr))
+
+	giaddr := net.IPv4(192, 0, 2, 254)
+	relayed, _ := V4Relayed(t, m, giaddr, []byte("eth0"))
+	assert.True(t, relayed.GatewayIPAddr.Equal(giaddr))
+	assert.Equal(t, []byte{1, 4, 'e', 't', 'h', '0'}, relayed.Options.Get(dhcpv4.OptionRelayAgentInformation))
+	assert.Nil(t, m.Options.Get(dhcpv4.OptionRelayAgentInformation), "original message modified")
+}
+
+func TestV6Requests(t *testing.T) {
+	m, _ := V6Solicit(t, nil)
+	assert.Equal(t, dhcpv6.MessageTypeSolicit, m.MessageType)
+	assert.Len(t, m.Options.Get(dhcpv6.OptionIANA), 1)
+	assert.Empty(t, m.Options.Get(dhcpv6.OptionIAPD))
+
+	m, _ = V6SolicitWithIANAandIAPD(t, nil)
+	assert.Len(t, m.Options.Get(dhcpv6.OptionIANA), 1)
+	assert.Len(t, m.Options.Get(dhcpv6.OptionIAPD), 1)
+
+	m, _ = V6InformationRequest(t, nil)
+	assert.Equal(t, dhcpv6.MessageTypeInformationRequest, m.MessageType)
+	assert.Nil(t, m.Options.ClientID())
+	m, _ = V6InformationRequest(t, DefaultMAC)
+	assert.NotNil(t, m.Options.ClientID())
+
+	relayed, _ := RelayWrap(t, m, 3, net.ParseIP("2001:db8::1"), net.ParseIP("fe80::1"))
+	require.True(t, relayed.IsRelay())
+	inner, err := relayed.GetInnerMessage()
+	require.NoError(t, err)
+	assert.Equal(t, m.TransactionID, inner.TransactionID)
+}
+
+func TestCaptures4(t *testing.T) {
+	phone := net.HardwareAddr{0x00, 0x0b, 0x82, 0x01, 0xfc, 0x42}
+	for _, tc := range []struct {
+		name     string
+		mt       dhcpv4.MessageType
+		hwaddr   net.HardwareAddr
+		xid      dhcpv4.TransactionID
+		yiaddr   net.IP
+		prl      []byte
+		hostname string
+	}{
+		{"grandstream-ack", dhcpv4.MessageTypeAck, phone, dhcpv4.TransactionID{0, 0, 0x3d, 0x1e}, net.IPv4(192, 168, 0, 10), nil, ""},
+		{"grandstream-discover", dhcpv4.MessageTypeDiscover, phone, dhcpv4.TransactionID{0, 0, 0x3d, 0x1d}, net.IPv4zero, []byte{1, 3, 6, 42}, ""},
+		{"grandstream-offer", dhcpv4.MessageTypeOffer, phone, dhcpv4.TransactionID{0, 0, 0x3d, 0x1d}, net.IPv4(192, 168, 0, 10), nil, ""},
+		{"grandstream-request", dhcpv4.MessageTypeRequest, phone, dhcpv4.TransactionID{0, 0, 0x3d, 0x1e}, net.IPv4zero, []byte{1, 3, 6, 42}, ""},
+		{"macosx-discover", dhcpv4.MessageTypeDiscover, net.HardwareAddr{0x00, 0x19, 0xe3, 0xd3, 0x53, 0x52}, dhcpv4.TransactionID{0x13, 0x1f, 0x8c, 0x43}, net.IPv4zero, []byte{1, 3, 6, 15, 119, 95, 252, 44, 46, 47}, "Macintosh-4"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m, raw := Capture4(t, tc.name)
+			assert.Equal(t, tc.mt, m.MessageType())
+			assert.Equal(t, tc.hwaddr, m.ClientHWAddr)
+			assert.Equal(t, tc.xid, m.TransactionID)
+			assert.True(t, tc.yiaddr.Equal(m.YourIPAddr), "got %s", m.YourIPAddr)
+			assert.Equal(t, tc.prl, m.Options.Get(dhcpv4.OptionParameterRequestList), "the request list should keep its order")
+			assert.Equal(t, tc.hostname, m.HostName())
+
+			// What the library serializes back parses the same
+			again, err := dhcpv4.FromBytes(m.ToBytes())
+			require.NoError(t, err)
+			assert.Equal(t, m.Options, again.Options)
+			assert.Equal(t, m.ClientHWAddr, again.ClientHWAddr)
+			assert.Equal(t, raw[:236], m.ToBytes()[:236], "fixed fields changed")
+		})
+	}
+	assert.Len(t, Captures4(t), 5, "every capture should be checked")
+}
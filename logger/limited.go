@@ -0,0 +1,157 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package logger
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MaxLimitedKeys is the number of keys a Limiter keeps track of. The least
+// recently used keys are forgotten beyond it
+const MaxLimitedKeys = 1024
+
+// Limiter rate-limits log messages by key, so that an error repeated for every
+// request does not flood the logs. At most burst messages are logged per key
+// in each interval; the number of messages suppressed is logged when the
+// interval ends.
+// It is safe for concurrent use
+type Limiter struct {
+	log      *logrus.Entry
+	burst    int
+	interval time.Duration
+
+	mu sync.Mutex
+	// keys indexes the elements of lru, which are *window, most recently
+	// used first
+	keys map[string]*list.Element
+	lru  *list.List
+}
+
+// window counts the messages logged for a key in the current interval
+type window struct {
+	key        string
+	start      time.Time
+	emitted    int
+	suppressed int
+}
+
+// NewLimiter returns a Limiter logging to log at most burst messages per key
+// in each interval
+func NewLimiter(log *logrus.Entry, burst int, interval time.Duration) *Limiter {
+	return &Limiter{
+		log:      log,
+		burst:    burst,
+		interval: interval,
+		keys:     make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Limited returns a logger for the messages of key, typically one per call
+// site or per error condition
+func (l *Limiter) Limited(key string) *LimitedEntry {
+	return &LimitedEntry{l: l, key: key}
+}
+
+// LimitedEntry logs the messages of one key of a Limiter
+type LimitedEntry struct {
+	l   *Limiter
+	key string
+}
+
+// Debugf logs a message at level Debug, if allowed by the limiter
+func (e *LimitedEntry) Debugf(format string, args ...interface{}) {
+	e.l.logf(e.key, logrus.DebugLevel, format, args...)
+}
+
+// Printf logs a message at level Info, if allowed by the limiter
+func (e *LimitedEntry) Printf(format string, args ...interface{}) {
+	e.l.logf(e.key, logrus.InfoLevel, format, args...)
+}
+
+// Warningf logs a message at level Warn, if allowed by the limiter
+func (e *LimitedEntry) Warningf(format string, args ...interface{}) {
+	e.l.logf(e.key, logrus.WarnLevel, format, args...)
+}
+
+// Errorf logs a message at level Error, if allowed by the limiter
+func (e *LimitedEntry) Errorf(format string, args ...interface{}) {
+	e.l.logf(e.key, logrus.ErrorLevel, format, args...)
+}
+
+func (l *Limiter) logf(key string, level logrus.Level, format string, args ...interface{}) {
+	if !l.log.Logger.IsLevelEnabled(level) {
+		return
+	}
+	now := time.Now()
+	var summaries []window
+	l.mu.Lock()
+	w, evicted := l.window(key)
+	if evicted != nil && evicted.suppressed > 0 {
+		summaries = append(summaries, *evicted)
+		evicted.suppressed = 0
+	}
+	if now.Sub(w.start) >= l.interval {
+		if w.suppressed > 0 {
+			summaries = append(summaries, *w)
+		}
+		*w = window{key: key, start: now}
+	}
+	emit := w.emitted < l.burst
+	if emit {
+		w.emitted++
+	} else {
+		w.suppressed++
+		if w.suppressed == 1 {
+			time.AfterFunc(w.start.Add(l.interval).Sub(now), func() { l.flush(w) })
+		}
+	}
+	l.mu.Unlock()
+
+	for _, s := range summaries {
+		l.summarize(s)
+	}
+	if emit {
+		l.log.Logf(level, format, args...)
+	}
+}
+
+// window returns the window of key, creating it if needed, and the window it
+// evicted if there were too many keys. It must be called with l.mu held
+func (l *Limiter) window(key string) (w, evicted *window) {
+	if elem, ok := l.keys[key]; ok {
+		l.lru.MoveToFront(elem)
+		return elem.Value.(*window), nil
+	}
+	w = &window{key: key}
+	l.keys[key] = l.lru.PushFront(w)
+	if l.lru.Len() > MaxLimitedKeys {
+		oldest := l.lru.Back()
+		l.lru.Remove(oldest)
+		evicted = oldest.Value.(*window)
+		delete(l.keys, evicted.key)
+	}
+	return w, evicted
+}
+
+// flush logs the messages suppressed in w at the end of its interval, unless
+// they were already summarized
+func (l *Limiter) flush(w *window) {
+	l.mu.Lock()
+	s := *w
+	w.suppressed = 0
+	l.mu.Unlock()
+	if s.suppressed > 0 {
+		l.summarize(s)
+	}
+}
+
+func (l *Limiter) summarize(w window) {
+	l.log.Warningf("Suppressed %d similar messages (%s) since %s", w.suppressed, w.key, w.start.Format(time.RFC3339))
+}
@@ -0,0 +1,111 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package logger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// recorder is a logrus hook recording the messages logged
+type recorder struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (r *recorder) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (r *recorder) Fire(e *logrus.Entry) error {
+	r.mu.Lock()
+	r.messages = append(r.messages, e.Message)
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *recorder) count(prefix string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, m := range r.messages {
+		if strings.HasPrefix(m, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func newTestLimiter(burst int, interval time.Duration) (*Limiter, *recorder) {
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	r := &recorder{}
+	log.AddHook(r)
+	return NewLimiter(log.WithField("prefix", "test"), burst, interval), r
+}
+
+func TestLimiter(t *testing.T) {
+	l, r := newTestLimiter(3, 100*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		l.Limited("a").Errorf("backend down: %d", i)
+	}
+	l.Limited("b").Warningf("other")
+	assert.Equal(t, 3, r.count("backend down"))
+	assert.Equal(t, 1, r.count("other"))
+	assert.Equal(t, 0, r.count("Suppressed"))
+
+	// The summary is logged when the window closes, without further messages
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 1, r.count("Suppressed 7 similar messages (a)"))
+	assert.Equal(t, 0, r.count("Suppressed 0"))
+
+	// A new window allows a new burst
+	l.Limited("a").Errorf("backend down: again")
+	assert.Equal(t, 4, r.count("backend down"))
+}
+
+func TestLimiterDisabledLevel(t *testing.T) {
+	l, r := newTestLimiter(1, time.Minute)
+	for i := 0; i < 5; i++ {
+		l.Limited("a").Debugf("debug")
+	}
+	l.Limited("a").Errorf("error")
+	assert.Equal(t, 0, r.count("debug"))
+	assert.Equal(t, 1, r.count("error"), "disabled levels should not use up the burst")
+}
+
+func TestLimiterKeys(t *testing.T) {
+	l, r := newTestLimiter(1, time.Minute)
+	l.Limited("first").Errorf("first")
+	l.Limited("first").Errorf("first")
+	for i := 0; i < MaxLimitedKeys+10; i++ {
+		l.Limited(fmt.Sprint(i)).Errorf("flood")
+	}
+	assert.Len(t, l.keys, MaxLimitedKeys)
+	assert.Equal(t, MaxLimitedKeys, l.lru.Len())
+	// Suppressed messages of evicted keys are summarized
+	assert.Equal(t, 1, r.count("Suppressed 1 similar messages (first)"))
+}
+
+func TestLimiterConcurrent(t *testing.T) {
+	l, r := newTestLimiter(5, time.Minute)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				l.Limited("shared").Errorf("flood")
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 5, r.count("flood"))
+}
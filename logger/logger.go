@@ -44,3 +44,12 @@ func WithFile(log *logrus.Entry, logfile string) {
 func WithNoStdOutErr(log *logrus.Entry) {
 	log.Logger.SetOutput(ioutil.Discard)
 }
+
+// WithInstance returns log, tagged with the name of the server instance the
+// messages are about. It returns log itself for unnamed instances
+func WithInstance(log *logrus.Entry, instance string) *logrus.Entry {
+	if instance == "" {
+		return log
+	}
+	return log.WithField("instance", instance)
+}
@@ -28,6 +28,13 @@ type IPv4Allocator struct {
 	start uint32
 	end   uint32
 
+	// spread allocators pick addresses across the whole range rather than the
+	// lowest available one: they start looking at cursor, which moves by
+	// stride (coprime with the size of the range) after each allocation
+	spread bool
+	stride uint
+	cursor uint
+
 	// This bitset implementation isn't goroutine-safe, we protect it with a mutex for now
 	// until we can swap for another concurrent implementation
 	bitmap *bitset.BitSet
@@ -62,18 +69,21 @@ func (a *IPv4Allocator) Allocate(hint net.IPNet) (n net.IPNet, err error) {
 	n.Mask = net.CIDRMask(32, 32)
 
 	// This is just a hint, ignore any error with it
-	hintOffset, _ := a.toOffset(hint.IP)
+	hintOffset, hintErr := a.toOffset(hint.IP)
 
 	a.l.Lock()
 	defer a.l.Unlock()
 
 	var next uint
 	// First try the exact match
-	if !a.bitmap.Test(hintOffset) {
+	if hintErr == nil && !a.bitmap.Test(hintOffset) {
 		next = hintOffset
 	} else {
 		// Then any available address
-		avail, ok := a.bitmap.NextClear(0)
+		avail, ok := a.bitmap.NextClear(a.first())
+		if !ok {
+			avail, ok = a.bitmap.NextClear(0)
+		}
 		if !ok {
 			return n, allocators.ErrNoAddrAvail
 		}
@@ -85,6 +95,17 @@ func (a *IPv4Allocator) Allocate(hint net.IPNet) (n net.IPNet, err error) {
 	return
 }
 
+// first returns the offset to start looking for an available address from. It
+// must be called with the lock held
+func (a *IPv4Allocator) first() uint {
+	if !a.spread {
+		return 0
+	}
+	first := a.cursor
+	a.cursor = (a.cursor + a.stride) % (uint(a.end-a.start) + 1)
+	return first
+}
+
 // Free releases the given IP
 func (a *IPv4Allocator) Free(n net.IPNet) error {
 	offset, err := a.toOffset(n.IP)
@@ -120,3 +141,33 @@ func NewIPv4Allocator(start, end net.IP) (*IPv4Allocator, error) {
 
 	return &alloc, nil
 }
+
+// NewIPv4SpreadAllocator creates an allocator like NewIPv4Allocator, but which
+// spreads the addresses it gives out over the whole range instead of giving
+// out the lowest available address. This keeps dynamic clients away from the
+// bottom of the range, where static addresses are usually configured
+func NewIPv4SpreadAllocator(start, end net.IP) (*IPv4Allocator, error) {
+	alloc, err := NewIPv4Allocator(start, end)
+	if err != nil {
+		return nil, err
+	}
+	size := uint(alloc.end-alloc.start) + 1
+	// Successive allocations land about 0.618 of the range apart, so that
+	// they are evenly spread at any point (the three-distance theorem)
+	stride := uint(float64(size) * 0.6180339887)
+	for stride > 1 && gcd(stride, size) != 1 {
+		stride--
+	}
+	if stride == 0 {
+		stride = 1
+	}
+	alloc.spread, alloc.stride = true, stride
+	return alloc, nil
+}
+
+func gcd(a, b uint) uint {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
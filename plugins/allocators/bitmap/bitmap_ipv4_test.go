@@ -61,3 +61,47 @@ func Test4OutOfPool(t *testing.T) {
 		t.Fatalf("Prefixes have wrong size %d/%d", prefLen, totalLen)
 	}
 }
+
+func Test4SpreadDistribution(t *testing.T) {
+	alloc, err := NewIPv4SpreadAllocator(net.IPv4(192, 0, 2, 0), net.IPv4(192, 0, 2, 255))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A quarter of the pool, in sixteenths of the pool
+	var buckets [16]int
+	for i := 0; i < 64; i++ {
+		n, err := alloc.Allocate(net.IPNet{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		buckets[n.IP.To4()[3]/16]++
+	}
+	for i, count := range buckets {
+		if count < 3 || count > 5 {
+			t.Errorf("Got %d allocations in sixteenth %d of the pool, want 3 to 5: %v", count, i, buckets)
+		}
+	}
+}
+
+func Test4SpreadExhaust(t *testing.T) {
+	alloc, err := NewIPv4SpreadAllocator(net.IPv4(192, 0, 2, 0), net.IPv4(192, 0, 2, 9))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		n, err := alloc.Allocate(net.IPNet{})
+		if err != nil {
+			t.Fatalf("Allocation %d failed: %v", i, err)
+		}
+		if seen[n.IP.String()] {
+			t.Fatalf("%s was allocated twice", n.IP)
+		}
+		seen[n.IP.String()] = true
+	}
+	if _, err := alloc.Allocate(net.IPNet{}); err == nil {
+		t.Fatal("Expected an error allocating from a full pool")
+	}
+}
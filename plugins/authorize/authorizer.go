@@ -0,0 +1,215 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package authorize
+
+import (
+	"container/list"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Decision is the answer of an Authorizer about a client
+type Decision struct {
+	Allow bool
+	// Classes are the tags the authorization system attached to the client,
+	// such as RADIUS Class attributes
+	Classes []string
+	// Address and Pool are hints of the address the client should get, and
+	// of the pool to take it from, such as the RADIUS Framed-IP-Address and
+	// Framed-Pool attributes. They are nil and empty without a hint.
+	// Classes and hints are only logged for now
+	Address net.IP
+	Pool    string
+}
+
+// ClientID identifies a client to an Authorizer. Decisions are cached per
+// ClientID, address family and relay address, see cacheKey
+type ClientID struct {
+	// HWAddr is the hardware address of the client. It may be nil for
+	// DHCPv6 clients, whose requests do not always carry it
+	HWAddr net.HardwareAddr
+	// DUID is the DHCPv6 client identifier, nil for DHCPv4 clients
+	DUID []byte
+}
+
+func (id ClientID) String() string {
+	if id.DUID == nil {
+		return id.HWAddr.String()
+	}
+	if id.HWAddr == nil {
+		return "duid " + hex.EncodeToString(id.DUID)
+	}
+	return id.HWAddr.String() + " duid " + hex.EncodeToString(id.DUID)
+}
+
+// RequestContext describes the request a client is authorized for. A decision
+// is reused for the following requests of the client from the same family and
+// relay, whatever their message type and host name
+type RequestContext struct {
+	// IPv6 is true for DHCPv6 requests
+	IPv6 bool
+	// MessageType is the type of the request, e.g. DISCOVER or SOLICIT
+	MessageType string
+	// HostName is the host name option of DHCPv4 requests, if any
+	HostName string
+	// RelayAddr is the address of the relay agent of DHCPv4 requests (giaddr),
+	// nil if the request was not relayed
+	RelayAddr net.IP
+}
+
+// Authorizer asks an external system whether a client may get a lease.
+// Authorize should return once ctx is done, but a checker does not rely on it
+type Authorizer interface {
+	Authorize(ctx context.Context, id ClientID, rc RequestContext) (Decision, error)
+}
+
+// maxCachedDecisions is the number of decisions a checker caches. The least
+// recently used ones are forgotten beyond it, so that a flood of client
+// addresses cannot grow the cache without bound
+const maxCachedDecisions = 16384
+
+// maxInFlight is the number of authorizations a checker waits for at once.
+// Authorizers hanging past the timeout keep counting until they return, so
+// that an unresponsive backend cannot pile up goroutines
+const maxInFlight = 64
+
+var errTooManyInFlight = errors.New("too many authorizations in flight")
+
+// cacheKey returns the key of the decision about id in the context rc. The
+// message type and host name are left out, so that a DISCOVER and the REQUEST
+// following it, or the renewals of a client, share one decision
+func cacheKey(id ClientID, rc RequestContext) string {
+	return fmt.Sprintf("%s|%t|%s", id, rc.IPv6, rc.RelayAddr)
+}
+
+type cacheEntry struct {
+	key      string
+	decision Decision
+	expires  time.Time
+}
+
+// checker wraps an Authorizer with a timeout, a policy for when it fails, and
+// a cache of its decisions so renewal storms do not reach the backend
+type checker struct {
+	auth     Authorizer
+	timeout  time.Duration
+	failOpen bool
+	ttl      time.Duration
+	now      func() time.Time
+	// maxCached is the size of the cache
+	maxCached int
+	// inFlight holds a token per authorization not returned yet
+	inFlight chan struct{}
+
+	mu sync.Mutex
+	// cache indexes the elements of lru, which are *cacheEntry, most
+	// recently used first
+	cache map[string]*list.Element
+	lru   *list.List
+}
+
+func newChecker(auth Authorizer, timeout, ttl time.Duration, failOpen bool) *checker {
+	return &checker{
+		auth:      auth,
+		timeout:   timeout,
+		failOpen:  failOpen,
+		ttl:       ttl,
+		now:       time.Now,
+		maxCached: maxCachedDecisions,
+		inFlight:  make(chan struct{}, maxInFlight),
+		cache:     make(map[string]*list.Element),
+		lru:       list.New(),
+	}
+}
+
+type result struct {
+	d   Decision
+	err error
+}
+
+// check returns the decision for id, from the cache if possible. Errors,
+// timeouts and authorizations refused for too many in flight are not cached,
+// and result in a decision following the failure policy
+func (c *checker) check(id ClientID, rc RequestContext) Decision {
+	key := cacheKey(id, rc)
+	c.mu.Lock()
+	if elem, ok := c.cache[key]; ok {
+		e := elem.Value.(*cacheEntry)
+		if c.now().Before(e.expires) {
+			c.lru.MoveToFront(elem)
+			c.mu.Unlock()
+			return e.decision
+		}
+		c.lru.Remove(elem)
+		delete(c.cache, key)
+	}
+	c.mu.Unlock()
+
+	r := c.authorize(id, rc)
+	if r.err != nil {
+		log.Warningf("%s: authorization failed, %s: %v", id, c.policy(), r.err)
+		return Decision{Allow: c.failOpen}
+	}
+
+	if c.ttl > 0 {
+		c.mu.Lock()
+		c.store(&cacheEntry{key: key, decision: r.d, expires: c.now().Add(c.ttl)})
+		c.mu.Unlock()
+	}
+	return r.d
+}
+
+// authorize asks the Authorizer about id, waiting for the timeout at most
+func (c *checker) authorize(id ClientID, rc RequestContext) result {
+	select {
+	case c.inFlight <- struct{}{}:
+	default:
+		return result{err: errTooManyInFlight}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	// Buffered, so a late answer does not block the goroutine forever
+	ch := make(chan result, 1)
+	go func() {
+		d, err := c.auth.Authorize(ctx, id, rc)
+		<-c.inFlight
+		ch <- result{d, err}
+	}()
+	select {
+	case r := <-ch:
+		return r
+	case <-ctx.Done():
+		return result{err: ctx.Err()}
+	}
+}
+
+// store caches e, evicting the least recently used decision if the cache is
+// full. It must be called with c.mu held
+func (c *checker) store(e *cacheEntry) {
+	if elem, ok := c.cache[e.key]; ok {
+		// Concurrent checks of the same client
+		elem.Value = e
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.cache[e.key] = c.lru.PushFront(e)
+	if c.lru.Len() > c.maxCached {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.cache, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *checker) policy() string {
+	if c.failOpen {
+		return "allowing"
+	}
+	return "denying"
+}
@@ -0,0 +1,152 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package authorize
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testMAC = net.HardwareAddr{0xde, 0xad, 0xbe, 0xef, 0x00, 0x01}
+	testID  = ClientID{HWAddr: testMAC}
+)
+
+// fakeAuthorizer answers with decision or err, after waiting for delay. It
+// ignores the context, to check the checker does not rely on it
+type fakeAuthorizer struct {
+	decision Decision
+	err      error
+	delay    time.Duration
+	calls    int32
+	// last is the last client asked about
+	last atomic.Value
+}
+
+func (f *fakeAuthorizer) Authorize(_ context.Context, id ClientID, _ RequestContext) (Decision, error) {
+	atomic.AddInt32(&f.calls, 1)
+	f.last.Store(id)
+	time.Sleep(f.delay)
+	return f.decision, f.err
+}
+
+func TestCheckerTimeout(t *testing.T) {
+	hanging := &fakeAuthorizer{decision: Decision{Allow: true}, delay: time.Hour}
+	for _, failOpen := range []bool{false, true} {
+		c := newChecker(hanging, 50*time.Millisecond, time.Minute, failOpen)
+		start := time.Now()
+		d := c.check(testID, RequestContext{})
+		assert.Less(t, int64(time.Since(start)), int64(time.Second), "checker waited for the hanging authorizer")
+		assert.Equal(t, failOpen, d.Allow, "timeout with fail open %v", failOpen)
+		assert.Empty(t, c.cache, "timeout was cached")
+	}
+}
+
+func TestCheckerError(t *testing.T) {
+	failing := &fakeAuthorizer{err: errors.New("backend down")}
+	c := newChecker(failing, time.Second, time.Minute, false)
+	assert.False(t, c.check(testID, RequestContext{}).Allow)
+	assert.False(t, c.check(testID, RequestContext{}).Allow)
+	assert.Equal(t, int32(2), failing.calls, "errors should not be cached")
+
+	c.failOpen = true
+	assert.True(t, c.check(testID, RequestContext{}).Allow)
+}
+
+func TestCheckerCache(t *testing.T) {
+	auth := &fakeAuthorizer{decision: Decision{Allow: false, Classes: []string{"guests"}}}
+	c := newChecker(auth, time.Second, time.Minute, true)
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	assert.Equal(t, auth.decision, c.check(testID, RequestContext{}))
+	now = now.Add(59 * time.Second)
+	assert.Equal(t, auth.decision, c.check(testID, RequestContext{}))
+	assert.Equal(t, int32(1), auth.calls, "decision was not cached")
+
+	now = now.Add(time.Second)
+	c.check(testID, RequestContext{})
+	assert.Equal(t, int32(2), auth.calls, "decision was not expired")
+
+	other := net.HardwareAddr{0xde, 0xad, 0xbe, 0xef, 0x00, 0x02}
+	c.check(ClientID{HWAddr: other}, RequestContext{})
+	assert.Equal(t, int32(3), auth.calls, "decisions are per client")
+
+	c.check(testID, RequestContext{MessageType: "REQUEST", HostName: "printer"})
+	assert.Equal(t, int32(3), auth.calls, "decisions are shared across message types and host names")
+	c.check(testID, RequestContext{RelayAddr: net.IPv4(192, 0, 2, 1)})
+	c.check(testID, RequestContext{IPv6: true})
+	assert.Equal(t, int32(5), auth.calls, "decisions are per family and relay")
+
+	c = newChecker(auth, time.Second, 0, true)
+	c.check(testID, RequestContext{})
+	c.check(testID, RequestContext{})
+	assert.Equal(t, int32(7), auth.calls, "a zero ttl should disable the cache")
+}
+
+func TestCheckerCacheSize(t *testing.T) {
+	auth := &fakeAuthorizer{decision: Decision{Allow: true}}
+	c := newChecker(auth, time.Second, time.Minute, false)
+	c.maxCached = 2
+	macs := []net.HardwareAddr{
+		{0xde, 0xad, 0xbe, 0xef, 0x00, 0x01},
+		{0xde, 0xad, 0xbe, 0xef, 0x00, 0x02},
+		{0xde, 0xad, 0xbe, 0xef, 0x00, 0x03},
+	}
+
+	c.check(ClientID{HWAddr: macs[0]}, RequestContext{})
+	c.check(ClientID{HWAddr: macs[1]}, RequestContext{})
+	// Use the first one again, so the second is the least recently used
+	c.check(ClientID{HWAddr: macs[0]}, RequestContext{})
+	assert.Equal(t, int32(2), auth.calls)
+	c.check(ClientID{HWAddr: macs[2]}, RequestContext{})
+	assert.Len(t, c.cache, 2, "the cache grew beyond its size")
+	assert.Equal(t, c.lru.Len(), len(c.cache))
+
+	c.check(ClientID{HWAddr: macs[0]}, RequestContext{})
+	assert.Equal(t, int32(3), auth.calls, "recently used decision was evicted")
+	c.check(ClientID{HWAddr: macs[1]}, RequestContext{})
+	assert.Equal(t, int32(4), auth.calls, "least recently used decision was not evicted")
+}
+
+func TestCheckerInFlight(t *testing.T) {
+	hanging := &fakeAuthorizer{decision: Decision{Allow: true}, delay: time.Hour}
+	c := newChecker(hanging, 10*time.Millisecond, time.Minute, true)
+	c.inFlight = make(chan struct{}, 2)
+
+	for i := 0; i < 2; i++ {
+		assert.True(t, c.check(testID, RequestContext{}).Allow, "timeouts should fail open")
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hanging.calls))
+	// The two hanging authorizations are still in flight
+	c.failOpen = false
+	assert.False(t, c.check(testID, RequestContext{}).Allow)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hanging.calls), "the authorizer was called past the cap")
+
+	quick := &fakeAuthorizer{decision: Decision{Allow: true}}
+	c = newChecker(quick, time.Second, 0, false)
+	c.inFlight = make(chan struct{}, 1)
+	for i := 0; i < 3; i++ {
+		assert.True(t, c.check(testID, RequestContext{}).Allow, "returned authorizations should not count")
+	}
+}
+
+func TestClientID(t *testing.T) {
+	duid := []byte{0, 3, 0, 1, 0xde, 0xad, 0xbe, 0xef, 0, 1}
+	auth := &fakeAuthorizer{decision: Decision{Allow: true}}
+	c := newChecker(auth, time.Second, time.Minute, false)
+
+	c.check(ClientID{HWAddr: testMAC}, RequestContext{})
+	c.check(ClientID{DUID: duid}, RequestContext{IPv6: true})
+	c.check(ClientID{HWAddr: testMAC, DUID: duid}, RequestContext{IPv6: true})
+	assert.Equal(t, int32(3), auth.calls, "decisions are per client identifier")
+	assert.Equal(t, ClientID{HWAddr: testMAC, DUID: duid}, auth.last.Load())
+}
@@ -0,0 +1,214 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package authorize
+
+// This plugin asks an external authorization system whether a client may get
+// a lease, before any address is allocated to it. The only system supported is
+// RADIUS MAC authentication; others can be added by implementing Authorizer.
+//
+// Example configuration:
+//
+// server4:
+//   plugins:
+//     - server_id: 10.10.10.1
+//     - authorize: radius 10.10.10.2:1812 s3cr3t timeout=2s ttl=1m on_error=allow deny=nak
+//     - range: leases.txt 10.10.10.100 10.10.10.200 60s
+//
+// The first arguments are the RADIUS server address and the shared secret.
+// They are followed by optional settings:
+//   - timeout: how long to wait for the RADIUS server (default 2s)
+//   - ttl: how long decisions are cached, so renewals do not all reach the
+//     RADIUS server; 0 disables the cache (default 1m)
+//   - on_error: allow or deny clients when the RADIUS server cannot be
+//     reached or times out (default deny)
+//   - deny: drop requests from denied clients, or answer DHCPREQUESTs with a
+//     DHCPNAK (default drop). DHCPv6 requests are always dropped
+//
+// Release and Information-request in DHCPv6 grant no lease and are not
+// checked; the DHCPv4 plugins only see DHCPDISCOVERs and DHCPREQUESTs.
+// Decisions are cached per client, address family and relay, so a DISCOVER
+// and the REQUEST following it share one. Up to 16384 decisions are cached,
+// the least recently seen ones are forgotten first. DHCPv6 clients are
+// identified by their DUID, and by their MAC when it can be found, which
+// RADIUS needs.
+//
+// At most 64 authorizations are in flight, including those past their timeout
+// the RADIUS server has not answered yet. Further requests are handled as if
+// the RADIUS server could not be reached.
+//
+// Every request waits for the decision, so the timeout must stay well below
+// the server request timeout.
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/coredhcp/coredhcp/plugins/rfc2131"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger("plugins/authorize")
+
+// Plugin wraps plugin registration information
+var Plugin = plugins.Plugin{
+	Name:           "authorize",
+	Setup6:         setup6,
+	Setup4:         setup4,
+	SideEffectFree: true,
+	// Deny clients before they get a lease, and after the server identifier
+	// is set for DHCPNAKs
+	RunsAfter:  []string{"server_id"},
+	RunsBefore: []string{"file", "prefix", "range"},
+}
+
+type config struct {
+	checker *checker
+	nak     bool
+}
+
+func parseArgs(args ...string) (*config, error) {
+	if len(args) < 3 {
+		return nil, errors.New("want at least 3 arguments: radius, the server address and the shared secret")
+	}
+	if args[0] != "radius" {
+		return nil, plugins.ArgErrorf("authorizer", "unknown authorizer %q, only radius is supported", args[0])
+	}
+	if _, _, err := net.SplitHostPort(args[1]); err != nil {
+		return nil, plugins.ArgErrorf("server", "invalid RADIUS server address %q: %v", args[1], err)
+	}
+	auth := &RADIUS{Server: args[1], Secret: []byte(args[2])}
+
+	var (
+		timeout  = 2 * time.Second
+		ttl      = time.Minute
+		failOpen bool
+		nak      bool
+		err      error
+	)
+	for _, arg := range args[3:] {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, plugins.ArgErrorf(arg, "expected key=value")
+		}
+		switch kv[0] {
+		case "timeout":
+			timeout, err = time.ParseDuration(kv[1])
+			if err != nil || timeout <= 0 {
+				return nil, plugins.ArgErrorf("timeout", "%q is not a positive duration", kv[1])
+			}
+		case "ttl":
+			ttl, err = time.ParseDuration(kv[1])
+			if err != nil || ttl < 0 {
+				return nil, plugins.ArgErrorf("ttl", "%q is not a duration", kv[1])
+			}
+		case "on_error":
+			switch kv[1] {
+			case "allow":
+				failOpen = true
+			case "deny":
+				failOpen = false
+			default:
+				return nil, plugins.ArgErrorf("on_error", "%q is not allow or deny", kv[1])
+			}
+		case "deny":
+			switch kv[1] {
+			case "drop":
+				nak = false
+			case "nak":
+				nak = true
+			default:
+				return nil, plugins.ArgErrorf("deny", "%q is not drop or nak", kv[1])
+			}
+		default:
+			return nil, plugins.ArgErrorf(kv[0], "unknown setting")
+		}
+	}
+	return &config{checker: newChecker(auth, timeout, ttl, failOpen), nak: nak}, nil
+}
+
+func setup6(args ...string) (handler.Handler6, error) {
+	c, err := parseArgs(args...)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("loaded plugin for DHCPv6.")
+	return makeHandler6(c.checker), nil
+}
+
+func setup4(args ...string) (handler.Handler4, error) {
+	c, err := parseArgs(args...)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("loaded plugin for DHCPv4.")
+	return makeHandler4(c.checker, c.nak), nil
+}
+
+func allowed(c *checker, id ClientID, rc RequestContext) bool {
+	d := c.check(id, rc)
+	if d.Allow {
+		log.Debugf("%s: authorized, classes %v, address hint %v, pool hint %q", id, d.Classes, d.Address, d.Pool)
+	} else {
+		log.Infof("%s: not authorized", id)
+	}
+	return d.Allow
+}
+
+// makeHandler6 returns a handler for DHCPv6 packets dropping requests from
+// clients c does not allow
+func makeHandler6(c *checker) handler.Handler6 {
+	return func(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+		msg, err := req.GetInnerMessage()
+		if err != nil {
+			log.Errorf("could not decapsulate request: %v", err)
+			return nil, true
+		}
+		switch msg.Type() {
+		case dhcpv6.MessageTypeInformationRequest, dhcpv6.MessageTypeRelease:
+			// No lease is granted
+			return resp, false
+		}
+		var id ClientID
+		if duid := msg.Options.ClientID(); duid != nil {
+			id.DUID = duid.ToBytes()
+		}
+		// Not all requests carry the MAC, the Authorizer decides whether
+		// the DUID is enough
+		id.HWAddr, _ = dhcpv6.ExtractMAC(req)
+		if id.DUID == nil && id.HWAddr == nil {
+			log.Warningf("could not identify the client, dropping request")
+			return nil, true
+		}
+		if !allowed(c, id, RequestContext{IPv6: true, MessageType: msg.Type().String()}) {
+			return nil, true
+		}
+		return resp, false
+	}
+}
+
+// makeHandler4 returns a handler for DHCPv4 packets rejecting requests from
+// clients c does not allow. DHCPREQUESTs get a DHCPNAK if nak is true
+func makeHandler4(c *checker, nak bool) handler.Handler4 {
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		rc := RequestContext{MessageType: req.MessageType().String(), HostName: req.HostName()}
+		if !req.GatewayIPAddr.IsUnspecified() {
+			rc.RelayAddr = req.GatewayIPAddr
+		}
+		if allowed(c, ClientID{HWAddr: req.ClientHWAddr}, rc) {
+			return resp, false
+		}
+		if !nak || req.MessageType() != dhcpv4.MessageTypeRequest {
+			return nil, true
+		}
+		rfc2131.Nak(resp)
+		return resp, true
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package authorize
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseArgs(t *testing.T) {
+	c, err := parseArgs("radius", "192.0.2.1:1812", "secret")
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Second, c.checker.timeout)
+	assert.Equal(t, time.Minute, c.checker.ttl)
+	assert.False(t, c.checker.failOpen)
+	assert.False(t, c.nak)
+
+	c, err = parseArgs("radius", "192.0.2.1:1812", "secret", "timeout=500ms", "ttl=0s", "on_error=allow", "deny=nak")
+	require.NoError(t, err)
+	assert.Equal(t, 500*time.Millisecond, c.checker.timeout)
+	assert.Equal(t, time.Duration(0), c.checker.ttl)
+	assert.True(t, c.checker.failOpen)
+	assert.True(t, c.nak)
+
+	for _, args := range [][]string{
+		{"radius", "192.0.2.1:1812"},
+		{"ldap", "192.0.2.1:389", "secret"},
+		{"radius", "192.0.2.1", "secret"},
+		{"radius", "192.0.2.1:1812", "secret", "timeout=0s"},
+		{"radius", "192.0.2.1:1812", "secret", "on_error=maybe"},
+		{"radius", "192.0.2.1:1812", "secret", "deny"},
+		{"radius", "192.0.2.1:1812", "secret", "retries=3"},
+	} {
+		_, err := parseArgs(args...)
+		assert.Error(t, err, "args %v should be refused", args)
+	}
+}
+
+func TestHandler4(t *testing.T) {
+	deny := newChecker(&fakeAuthorizer{decision: Decision{Allow: false}}, time.Second, 0, false)
+	allow := newChecker(&fakeAuthorizer{decision: Decision{Allow: true}}, time.Second, 0, false)
+
+	discover, err := dhcpv4.NewDiscovery(testMAC)
+	require.NoError(t, err)
+	request, err := dhcpv4.New(dhcpv4.WithHwAddr(testMAC),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(192, 0, 2, 100))))
+	require.NoError(t, err)
+
+	for _, nak := range []bool{false, true} {
+		resp, err := dhcpv4.NewReplyFromRequest(request, dhcpv4.WithMessageType(dhcpv4.MessageTypeAck),
+			dhcpv4.WithLeaseTime(3600))
+		require.NoError(t, err)
+		result, stop := makeHandler4(allow, nak)(request, resp)
+		assert.Equal(t, resp, result)
+		assert.False(t, stop)
+
+		result, stop = makeHandler4(deny, nak)(request, resp)
+		assert.True(t, stop)
+		if nak {
+			require.NotNil(t, result)
+			assert.Equal(t, dhcpv4.MessageTypeNak, result.MessageType())
+			assert.False(t, result.Options.Has(dhcpv4.OptionIPAddressLeaseTime), "a NAK has no lease time")
+		} else {
+			assert.Nil(t, result)
+		}
+
+		resp, err = dhcpv4.NewReplyFromRequest(discover, dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer))
+		require.NoError(t, err)
+		result, stop = makeHandler4(deny, nak)(discover, resp)
+		assert.Nil(t, result, "denied DISCOVERs are always dropped")
+		assert.True(t, stop)
+	}
+}
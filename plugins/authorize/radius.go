@@ -0,0 +1,242 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package authorize
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// RADIUS codes and attribute types used for MAC authentication (RFC2865)
+const (
+	radiusAccessRequest   = 1
+	radiusAccessAccept    = 2
+	radiusAccessReject    = 3
+	radiusAccessChallenge = 11
+
+	radiusAttrUserName             = 1
+	radiusAttrUserPassword         = 2
+	radiusAttrFramedIPAddress      = 8
+	radiusAttrClass                = 25
+	radiusAttrMessageAuthenticator = 80 // RFC3579 §3.2
+	radiusAttrFramedPool           = 88 // RFC2869 §5.18
+
+	radiusHeaderLen = 20
+	radiusMaxLen    = 4096
+)
+
+// RADIUS is an Authorizer doing RADIUS MAC authentication: it sends an
+// Access-Request with the client MAC address, lowercase hex without separators,
+// as both the user name and the password, as most RADIUS servers expect.
+// Access-Accept allows the client, Access-Reject denies it, and the Class
+// attributes of the answer become the classes of the decision. The
+// Framed-IP-Address and Framed-Pool attributes become its address and pool
+// hints. Clients without a hardware address cannot be authorized.
+//
+// Responses must carry a valid Message-Authenticator, which protects them
+// against forgery by a man in the middle (BlastRADIUS, CVE-2024-3596). The
+// RADIUS server must be configured to send it
+type RADIUS struct {
+	// Server is the UDP address of the RADIUS server
+	Server string
+	Secret []byte
+
+	id uint32
+}
+
+// Authorize implements Authorizer
+func (r *RADIUS) Authorize(ctx context.Context, id ClientID, _ RequestContext) (Decision, error) {
+	if len(id.HWAddr) == 0 {
+		return Decision{}, errors.New("RADIUS MAC authentication needs a hardware address")
+	}
+	req, err := r.accessRequest(byte(atomic.AddUint32(&r.id, 1)), id.HWAddr)
+	if err != nil {
+		return Decision{}, err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", r.Server)
+	if err != nil {
+		return Decision{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return Decision{}, err
+		}
+	}
+	if _, err := conn.Write(req); err != nil {
+		return Decision{}, err
+	}
+	buf := make([]byte, radiusMaxLen)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return Decision{}, err
+		}
+		d, err := r.parseResponse(buf[:n], req)
+		if err == errRADIUSMismatch {
+			// RFC2865 §3: silently discard responses that do not
+			// authenticate, and keep waiting
+			continue
+		}
+		return d, err
+	}
+}
+
+func macUserName(mac net.HardwareAddr) string {
+	return strings.Replace(mac.String(), ":", "", -1)
+}
+
+func appendAttr(b []byte, typ byte, value []byte) ([]byte, error) {
+	if len(value) > 253 {
+		return nil, fmt.Errorf("RADIUS attribute %d too long", typ)
+	}
+	return append(append(b, typ, byte(2+len(value))), value...), nil
+}
+
+// hidePassword hides a User-Password attribute value (RFC2865 §5.2)
+func hidePassword(password, secret, authenticator []byte) []byte {
+	padded := make([]byte, (len(password)+15)/16*16)
+	if len(padded) == 0 {
+		padded = make([]byte, 16)
+	}
+	copy(padded, password)
+	prev := authenticator
+	for i := 0; i < len(padded); i += 16 {
+		h := md5.New()
+		h.Write(secret)
+		h.Write(prev)
+		sum := h.Sum(nil)
+		for j := range sum {
+			padded[i+j] ^= sum[j]
+		}
+		prev = padded[i : i+16]
+	}
+	return padded
+}
+
+func (r *RADIUS) accessRequest(id byte, mac net.HardwareAddr) ([]byte, error) {
+	pkt := make([]byte, radiusHeaderLen, 128)
+	pkt[0] = radiusAccessRequest
+	pkt[1] = id
+	if _, err := rand.Read(pkt[4:radiusHeaderLen]); err != nil {
+		return nil, err
+	}
+	name := []byte(macUserName(mac))
+	var err error
+	if pkt, err = appendAttr(pkt, radiusAttrUserName, name); err != nil {
+		return nil, err
+	}
+	if pkt, err = appendAttr(pkt, radiusAttrUserPassword, hidePassword(name, r.Secret, pkt[4:radiusHeaderLen])); err != nil {
+		return nil, err
+	}
+	if pkt, err = appendAttr(pkt, radiusAttrMessageAuthenticator, make([]byte, md5.Size)); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	copy(pkt[len(pkt)-md5.Size:], messageAuthenticator(pkt, pkt[4:radiusHeaderLen], len(pkt)-md5.Size, r.Secret))
+	return pkt, nil
+}
+
+// messageAuthenticator computes the Message-Authenticator of pkt (RFC3579
+// §3.2): the HMAC-MD5 of the packet with the request authenticator auth in its
+// authenticator field, and the value of the attribute, at offset, zeroed
+func messageAuthenticator(pkt, auth []byte, offset int, secret []byte) []byte {
+	b := append([]byte(nil), pkt...)
+	copy(b[4:radiusHeaderLen], auth)
+	copy(b[offset:offset+md5.Size], make([]byte, md5.Size))
+	h := hmac.New(md5.New, secret)
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+var errRADIUSMismatch = errors.New("RADIUS response does not match the request")
+
+// responseAuthenticator computes the authenticator of a response to a request
+// with authenticator reqAuth (RFC2865 §3)
+func responseAuthenticator(resp, reqAuth, secret []byte) []byte {
+	h := md5.New()
+	h.Write(resp[:4])
+	h.Write(reqAuth)
+	h.Write(resp[radiusHeaderLen:])
+	h.Write(secret)
+	return h.Sum(nil)
+}
+
+func (r *RADIUS) parseResponse(resp, req []byte) (Decision, error) {
+	if len(resp) < radiusHeaderLen {
+		return Decision{}, errRADIUSMismatch
+	}
+	// Octets past the length are padding (RFC2865 §3). A bad length is
+	// ignored like any other answer that does not match the request
+	length := int(binary.BigEndian.Uint16(resp[2:4]))
+	if length < radiusHeaderLen || length > len(resp) {
+		return Decision{}, errRADIUSMismatch
+	}
+	resp = resp[:length]
+	if resp[1] != req[1] {
+		return Decision{}, errRADIUSMismatch
+	}
+	if !hmac.Equal(resp[4:radiusHeaderLen], responseAuthenticator(resp, req[4:radiusHeaderLen], r.Secret)) {
+		// Either a forged answer, or a wrong shared secret
+		return Decision{}, errRADIUSMismatch
+	}
+
+	var d Decision
+	// authOffset is the offset of the Message-Authenticator value in resp
+	authOffset := 0
+	for attrs := resp[radiusHeaderLen:]; len(attrs) > 0; {
+		if len(attrs) < 2 || attrs[1] < 2 || int(attrs[1]) > len(attrs) {
+			return Decision{}, errors.New("malformed RADIUS attribute")
+		}
+		value := attrs[2:attrs[1]]
+		switch attrs[0] {
+		case radiusAttrMessageAuthenticator:
+			if authOffset != 0 || len(value) != md5.Size {
+				return Decision{}, errRADIUSMismatch
+			}
+			authOffset = len(resp) - len(attrs) + 2
+		case radiusAttrClass:
+			d.Classes = append(d.Classes, string(bytes.TrimRight(value, "\x00")))
+		case radiusAttrFramedIPAddress:
+			// RFC2865 §5.8: 255.255.255.254 and 255.255.255.255 leave
+			// the address to the NAS, they are no hint
+			ip := net.IP(append([]byte(nil), value...))
+			if len(ip) == net.IPv4len && !ip.Equal(net.IPv4bcast) && !ip.Equal(net.IPv4(255, 255, 255, 254)) {
+				d.Address = ip
+			}
+		case radiusAttrFramedPool:
+			d.Pool = string(value)
+		}
+		attrs = attrs[attrs[1]:]
+	}
+	// RFC3579 §3.2 and the BlastRADIUS mitigations: every Access-Accept,
+	// Access-Reject and Access-Challenge must carry a valid
+	// Message-Authenticator, or be discarded
+	if authOffset == 0 ||
+		!hmac.Equal(resp[authOffset:authOffset+md5.Size], messageAuthenticator(resp, req[4:radiusHeaderLen], authOffset, r.Secret)) {
+		return Decision{}, errRADIUSMismatch
+	}
+	switch resp[0] {
+	case radiusAccessAccept:
+		d.Allow = true
+	case radiusAccessReject:
+		d.Allow = false
+	case radiusAccessChallenge:
+		return Decision{}, errors.New("RADIUS challenges are not supported for MAC authentication")
+	default:
+		return Decision{}, fmt.Errorf("unexpected RADIUS response code %d", resp[0])
+	}
+	return d, nil
+}
@@ -0,0 +1,230 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package authorize
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRADIUS answers Access-Requests on a loopback socket. Clients whose
+// password, once revealed with secret, is in accept are accepted with the
+// given classes. Others are rejected
+type fakeRADIUS struct {
+	conn    net.PacketConn
+	secret  []byte
+	accept  map[string][]string
+	request chan []byte
+}
+
+func newFakeRADIUS(t *testing.T, secret string, accept map[string][]string) *fakeRADIUS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f := &fakeRADIUS{conn: conn, secret: []byte(secret), accept: accept, request: make(chan []byte, 10)}
+	go f.serve()
+	return f
+}
+
+func (f *fakeRADIUS) serve() {
+	buf := make([]byte, radiusMaxLen)
+	for {
+		n, peer, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := append([]byte(nil), buf[:n]...)
+		f.request <- req
+
+		var password []byte
+		for attrs := req[radiusHeaderLen:]; len(attrs) >= 2; attrs = attrs[attrs[1]:] {
+			if attrs[0] == radiusAttrUserPassword {
+				// Hiding is its own inverse for passwords of one block
+				password = hidePassword(attrs[2:attrs[1]], f.secret, req[4:radiusHeaderLen])
+			}
+		}
+		resp := []byte{radiusAccessReject, req[1], 0, 0}
+		resp = append(resp, make([]byte, 16)...)
+		if classes, ok := f.accept[string(trimNUL(password))]; ok {
+			resp[0] = radiusAccessAccept
+			for _, c := range classes {
+				resp, _ = appendAttr(resp, radiusAttrClass, []byte(c))
+			}
+		}
+		_, _ = f.conn.WriteTo(signResponse(resp, req, f.secret), peer)
+	}
+}
+
+// signResponse appends a Message-Authenticator to resp, the header and
+// attributes of a response to req, and fills in its length and authenticators
+func signResponse(resp, req, secret []byte) []byte {
+	resp, _ = appendAttr(resp, radiusAttrMessageAuthenticator, make([]byte, md5.Size))
+	binary.BigEndian.PutUint16(resp[2:4], uint16(len(resp)))
+	offset := len(resp) - md5.Size
+	copy(resp[offset:], messageAuthenticator(resp, req[4:radiusHeaderLen], offset, secret))
+	copy(resp[4:radiusHeaderLen], responseAuthenticator(resp, req[4:radiusHeaderLen], secret))
+	return resp
+}
+
+func trimNUL(b []byte) []byte {
+	for len(b) > 0 && b[len(b)-1] == 0 {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+func TestRADIUS(t *testing.T) {
+	f := newFakeRADIUS(t, "s3cr3t", map[string][]string{"deadbeef0001": {"staff", "vlan10"}})
+	defer f.conn.Close()
+	r := &RADIUS{Server: f.conn.LocalAddr().String(), Secret: []byte("s3cr3t")}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	d, err := r.Authorize(ctx, ClientID{HWAddr: testMAC}, RequestContext{})
+	require.NoError(t, err)
+	assert.Equal(t, Decision{Allow: true, Classes: []string{"staff", "vlan10"}}, d)
+
+	req := <-f.request
+	assert.Equal(t, byte(radiusAccessRequest), req[0])
+	assert.Equal(t, []byte{radiusAttrUserName, 14, 'd', 'e', 'a', 'd', 'b', 'e', 'e', 'f', '0', '0', '0', '1'},
+		req[radiusHeaderLen:radiusHeaderLen+14])
+	// Check the Message-Authenticator, the last attribute
+	auth := append([]byte(nil), req[len(req)-md5.Size:]...)
+	copy(req[len(req)-md5.Size:], make([]byte, md5.Size))
+	h := hmac.New(md5.New, []byte("s3cr3t"))
+	h.Write(req)
+	assert.Equal(t, h.Sum(nil), auth, "invalid Message-Authenticator")
+
+	d, err = r.Authorize(ctx, ClientID{HWAddr: net.HardwareAddr{0xde, 0xad, 0xbe, 0xef, 0x00, 0x02}}, RequestContext{})
+	require.NoError(t, err)
+	assert.False(t, d.Allow)
+}
+
+func TestRADIUSWrongSecret(t *testing.T) {
+	f := newFakeRADIUS(t, "other", map[string][]string{"deadbeef0001": nil})
+	defer f.conn.Close()
+	r := &RADIUS{Server: f.conn.LocalAddr().String(), Secret: []byte("s3cr3t")}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// The answer does not authenticate, so it is ignored until the timeout
+	_, err := r.Authorize(ctx, ClientID{HWAddr: testMAC}, RequestContext{})
+	assert.Error(t, err)
+}
+
+func TestRADIUSNoHWAddr(t *testing.T) {
+	r := &RADIUS{Server: "127.0.0.1:1812", Secret: []byte("s3cr3t")}
+	_, err := r.Authorize(context.Background(), ClientID{DUID: []byte{0, 3, 0, 1, 0xde, 0xad, 0xbe, 0xef, 0, 1}}, RequestContext{IPv6: true})
+	assert.Error(t, err)
+}
+
+func TestRADIUSHints(t *testing.T) {
+	r := &RADIUS{Secret: []byte("s3cr3t")}
+	req, err := r.accessRequest(7, testMAC)
+	require.NoError(t, err)
+	for _, tt := range []struct {
+		name        string
+		address     []byte
+		wantAddress net.IP
+	}{
+		{"address", []byte{192, 0, 2, 100}, net.IPv4(192, 0, 2, 100).To4()},
+		{"NAS assigns", []byte{255, 255, 255, 254}, nil},
+		{"user chooses", []byte{255, 255, 255, 255}, nil},
+		{"malformed", []byte{192, 0, 2}, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := append([]byte{radiusAccessAccept, 7, 0, 0}, make([]byte, 16)...)
+			resp, err = appendAttr(resp, radiusAttrFramedIPAddress, tt.address)
+			require.NoError(t, err)
+			resp, err = appendAttr(resp, radiusAttrFramedPool, []byte("guests"))
+			require.NoError(t, err)
+			resp = signResponse(resp, req, r.Secret)
+
+			d, err := r.parseResponse(resp, req)
+			require.NoError(t, err)
+			assert.True(t, d.Allow)
+			assert.Equal(t, tt.wantAddress, d.Address)
+			assert.Equal(t, "guests", d.Pool)
+		})
+	}
+}
+
+func TestRADIUSBadLength(t *testing.T) {
+	r := &RADIUS{Secret: []byte("s3cr3t")}
+	req, err := r.accessRequest(7, testMAC)
+	require.NoError(t, err)
+	resp := signResponse(append([]byte{radiusAccessAccept, 7, 0, 0}, make([]byte, 16)...), req, r.Secret)
+	length := len(resp)
+	for _, bad := range []int{radiusHeaderLen - 1, length + 1} {
+		binary.BigEndian.PutUint16(resp[2:4], uint16(bad))
+		_, err := r.parseResponse(resp, req)
+		assert.Equal(t, errRADIUSMismatch, err, "length %d", bad)
+	}
+
+	// Padding past the length is allowed
+	binary.BigEndian.PutUint16(resp[2:4], uint16(length))
+	d, err := r.parseResponse(append(resp, 0, 0), req)
+	require.NoError(t, err)
+	assert.True(t, d.Allow)
+}
+
+// TestRADIUSMessageAuthenticator checks that responses are discarded unless
+// they carry a valid Message-Authenticator, even with a valid Response
+// Authenticator, as a BlastRADIUS forgery would
+func TestRADIUSMessageAuthenticator(t *testing.T) {
+	r := &RADIUS{Secret: []byte("s3cr3t")}
+	req, err := r.accessRequest(7, testMAC)
+	require.NoError(t, err)
+	header := func(code byte) []byte {
+		return append([]byte{code, 7, 0, 0}, make([]byte, 16)...)
+	}
+
+	for _, code := range []byte{radiusAccessAccept, radiusAccessReject} {
+		_, err := r.parseResponse(signResponse(header(code), req, r.Secret), req)
+		assert.NoError(t, err, "code %d", code)
+
+		// No Message-Authenticator
+		resp := header(code)
+		binary.BigEndian.PutUint16(resp[2:4], uint16(len(resp)))
+		copy(resp[4:radiusHeaderLen], responseAuthenticator(resp, req[4:radiusHeaderLen], r.Secret))
+		_, err = r.parseResponse(resp, req)
+		assert.Equal(t, errRADIUSMismatch, err, "code %d without Message-Authenticator", code)
+
+		// A forged Message-Authenticator, and a Response Authenticator
+		// matching it
+		resp = signResponse(header(code), req, r.Secret)
+		resp[len(resp)-1] ^= 0xff
+		copy(resp[4:radiusHeaderLen], responseAuthenticator(resp, req[4:radiusHeaderLen], r.Secret))
+		_, err = r.parseResponse(resp, req)
+		assert.Equal(t, errRADIUSMismatch, err, "code %d with a forged Message-Authenticator", code)
+
+		// Two Message-Authenticators
+		resp, err = appendAttr(header(code), radiusAttrMessageAuthenticator, make([]byte, md5.Size))
+		require.NoError(t, err)
+		_, err = r.parseResponse(signResponse(resp, req, r.Secret), req)
+		assert.Equal(t, errRADIUSMismatch, err, "code %d with two Message-Authenticators", code)
+	}
+
+	// Challenges are authenticated, but cannot be answered
+	_, err = r.parseResponse(signResponse(header(radiusAccessChallenge), req, r.Secret), req)
+	assert.Error(t, err)
+	assert.NotEqual(t, errRADIUSMismatch, err)
+}
+
+func TestHidePassword(t *testing.T) {
+	secret, reqAuth := []byte("xyzzy5461"), make([]byte, 16)
+	for _, password := range []string{"", "short", "exactly16bytes!!", "a password longer than one block"} {
+		hidden := hidePassword([]byte(password), secret, reqAuth)
+		assert.Equal(t, 0, len(hidden)%16)
+		assert.NotEqual(t, []byte(password), trimNUL(hidden))
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugins
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// Chain is the plugin chain of one server, as set up by LoadChains
+type Chain struct {
+	// Instance is the name of the server instance the chain is set up for,
+	// empty unless the configuration names its instances. Plugins tag their
+	// messages with it through logger.WithInstance
+	Instance string
+
+	// Handlers4 and Handlers6 are the handlers of the plugins, in order.
+	// Only the ones of the protocol of the server are set
+	Handlers4 []handler.Handler4
+	Handlers6 []handler.Handler6
+
+	// ServerID is the DUID of a DHCPv6 server, published by the plugin
+	// setting it up. The server uses it for the messages it answers
+	// without running the plugins
+	ServerID *dhcpv6.Duid
+
+	// guards recover from the panics of the handlers
+	guards []*guard
+	// instances holds the state plugins share with the other plugins of the
+	// chain, by plugin name, see Register
+	instances map[string][]interface{}
+	// ready is run once every plugin of the chain is set up
+	ready []func()
+	// closers release the resources of the plugins, see OnClose
+	closers   []func() error
+	closeOnce sync.Once
+}
+
+// Register publishes state, the state of an instance of the plugin called
+// name, to the other plugins of the chain. It must be called during the setup
+// of the plugin
+func (c *Chain) Register(name string, state interface{}) {
+	if c.instances == nil {
+		c.instances = make(map[string][]interface{})
+	}
+	c.instances[name] = append(c.instances[name], state)
+}
+
+// Instances returns the states the instances of the plugin called name
+// registered, in chain order. Plugins after them in the chain can call it
+// during their setup; others must wait for OnReady
+func (c *Chain) Instances(name string) []interface{} {
+	return c.instances[name]
+}
+
+// OnReady registers f to be called once every plugin of the chain is set up,
+// for plugins resolving the state of the plugins after them
+func (c *Chain) OnReady(f func()) {
+	c.ready = append(c.ready, f)
+}
+
+// OnClose registers f to be called when the chain is closed, for plugins
+// holding resources such as files or buffered writes. It must be called during
+// the setup of the plugin
+func (c *Chain) OnClose(f func() error) {
+	c.closers = append(c.closers, f)
+}
+
+// Close calls the functions registered with OnClose, in reverse order, once
+// the server stopped using the chain. It returns the first error
+func (c *Chain) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		for i := len(c.closers) - 1; i >= 0; i-- {
+			if cerr := c.closers[i](); err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+// setupDone runs the functions registered with OnReady
+func (c *Chain) setupDone() {
+	for _, f := range c.ready {
+		f()
+	}
+}
+
+// Panics returns the number of panics recovered from in the plugins of the
+// chain
+func (c *Chain) Panics() uint64 {
+	var n uint64
+	for _, g := range c.guards {
+		n += atomic.LoadUint64(&g.panics)
+	}
+	return n
+}
+
+// Disabled returns the plugins of the chain disabled for panicking too often,
+// e.g. "DHCPv4: range". The server is degraded when it is not empty
+func (c *Chain) Disabled() []string {
+	var names []string
+	for _, g := range c.guards {
+		if g.isDisabled() {
+			names = append(names, g.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -7,6 +7,7 @@ package dns
 import (
 	"errors"
 	"net"
+	"time"
 
 	"github.com/coredhcp/coredhcp/handler"
 	"github.com/coredhcp/coredhcp/logger"
@@ -17,31 +18,51 @@ import (
 
 var log = logger.GetLogger("plugins/dns")
 
+// limited logs the errors that can repeat for every packet
+var limited = logger.NewLimiter(log, 10, time.Minute)
+
 // Plugin wraps the DNS plugin information.
 var Plugin = plugins.Plugin{
-	Name:   "dns",
-	Setup6: setup6,
-	Setup4: setup4,
+	Name:           "dns",
+	Setup6:         setup6,
+	Setup4:         setup4,
+	SideEffectFree: true,
 }
 
-var (
-	dnsServers6 []net.IP
-	dnsServers4 []net.IP
-)
+// Handler6 was the handler of the plugin when it kept a single list of DNS
+// servers. It drops every packet, with an error.
+//
+// Deprecated: each instance of the plugin has its own DNS servers, use the
+// handler returned by its setup function.
+func Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	limited.Limited("deprecated").Errorf("BUG: dns.Handler6 has no DNS servers, dropping packet")
+	return nil, true
+}
+
+// Handler4 was the handler of the plugin when it kept a single list of DNS
+// servers. It drops every packet, with an error.
+//
+// Deprecated: each instance of the plugin has its own DNS servers, use the
+// handler returned by its setup function.
+func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	limited.Limited("deprecated").Errorf("BUG: dns.Handler4 has no DNS servers, dropping packet")
+	return nil, true
+}
 
 func setup6(args ...string) (handler.Handler6, error) {
 	if len(args) < 1 {
 		return nil, errors.New("need at least one DNS server")
 	}
+	var dnsServers6 []net.IP
 	for _, arg := range args {
 		server := net.ParseIP(arg)
 		if server.To16() == nil {
-			return Handler6, errors.New("expected an DNS server address, got: " + arg)
+			return nil, plugins.ArgErrorf(arg, "expected a DNS server address")
 		}
 		dnsServers6 = append(dnsServers6, server)
 	}
 	log.Infof("loaded %d DNS servers.", len(dnsServers6))
-	return Handler6, nil
+	return makeHandler6(dnsServers6), nil
 }
 
 func setup4(args ...string) (handler.Handler4, error) {
@@ -49,35 +70,40 @@ func setup4(args ...string) (handler.Handler4, error) {
 	if len(args) < 1 {
 		return nil, errors.New("need at least one DNS server")
 	}
+	var dnsServers4 []net.IP
 	for _, arg := range args {
 		DNSServer := net.ParseIP(arg)
 		if DNSServer.To4() == nil {
-			return Handler4, errors.New("expected an DNS server address, got: " + arg)
+			return nil, plugins.ArgErrorf(arg, "expected a DNS server address")
 		}
 		dnsServers4 = append(dnsServers4, DNSServer)
 	}
 	log.Infof("loaded %d DNS servers.", len(dnsServers4))
-	return Handler4, nil
+	return makeHandler4(dnsServers4), nil
 }
 
-// Handler6 handles DHCPv6 packets for the dns plugin
-func Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
-	decap, err := req.GetInnerMessage()
-	if err != nil {
-		log.Errorf("Could not decapsulate relayed message, aborting: %v", err)
-		return nil, true
-	}
+// makeHandler6 returns a handler for DHCPv6 packets advertising dnsServers6
+func makeHandler6(dnsServers6 []net.IP) handler.Handler6 {
+	return func(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+		decap, err := req.GetInnerMessage()
+		if err != nil {
+			log.Errorf("Could not decapsulate relayed message, aborting: %v", err)
+			return nil, true
+		}
 
-	if decap.IsOptionRequested(dhcpv6.OptionDNSRecursiveNameServer) {
-		resp.UpdateOption(dhcpv6.OptDNS(dnsServers6...))
+		if decap.IsOptionRequested(dhcpv6.OptionDNSRecursiveNameServer) {
+			resp.UpdateOption(dhcpv6.OptDNS(dnsServers6...))
+		}
+		return resp, false
 	}
-	return resp, false
 }
 
-//Handler4 handles DHCPv4 packets for the dns plugin
-func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	if req.IsOptionRequested(dhcpv4.OptionDomainNameServer) {
-		resp.Options.Update(dhcpv4.OptDNS(dnsServers4...))
+// makeHandler4 returns a handler for DHCPv4 packets advertising dnsServers4
+func makeHandler4(dnsServers4 []net.IP) handler.Handler4 {
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		if req.IsOptionRequested(dhcpv4.OptionDomainNameServer) {
+			resp.Options.Update(dhcpv4.OptDNS(dnsServers4...))
+		}
+		return resp, false
 	}
-	return resp, false
 }
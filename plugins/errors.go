@@ -0,0 +1,75 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugins
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/config"
+)
+
+// SetupError is an error setting up a plugin, or the chain of plugins of a
+// server when Plugin is empty
+type SetupError struct {
+	// Server is DHCPv4 or DHCPv6
+	Server   string
+	Plugin   string
+	Position config.Position
+	Err      error
+}
+
+func (e *SetupError) Error() string {
+	var b strings.Builder
+	if pos := e.Position.String(); pos != "" {
+		b.WriteString(pos + ": ")
+	}
+	b.WriteString(e.Server + ": ")
+	if e.Plugin != "" {
+		fmt.Fprintf(&b, "plugin `%s`: ", e.Plugin)
+	}
+	b.WriteString(e.Err.Error())
+	return b.String()
+}
+
+// Unwrap returns the error of the plugin
+func (e *SetupError) Unwrap() error {
+	return e.Err
+}
+
+// SetupErrors holds all the errors setting up the plugins of a configuration,
+// in the order of the configuration
+type SetupErrors []*SetupError
+
+func (errs SetupErrors) Error() string {
+	if len(errs) == 1 {
+		return errs[0].Error()
+	}
+	lines := []string{fmt.Sprintf("%d errors setting up plugins:", len(errs))}
+	for _, e := range errs {
+		lines = append(lines, "\t"+e.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ArgError is an invalid argument of a plugin. Setup functions return it to
+// tell which argument is wrong, for example:
+//
+//	return nil, plugins.ArgErrorf("ttl", "%q is shorter than a second", v)
+type ArgError struct {
+	// Arg is the name of the argument, or its position for positional
+	// arguments
+	Arg    string
+	Reason string
+}
+
+func (e *ArgError) Error() string {
+	return fmt.Sprintf("argument `%s`: %s", e.Arg, e.Reason)
+}
+
+// ArgErrorf returns an *ArgError for arg, with a formatted reason
+func ArgErrorf(arg, format string, args ...interface{}) error {
+	return &ArgError{Arg: arg, Reason: fmt.Sprintf(format, args...)}
+}
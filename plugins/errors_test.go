@@ -0,0 +1,323 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugins
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/handler"
+)
+
+const brokenConfig = `server6:
+    listen: "[::1]:547"
+    plugins:
+        - errtest_args: ttl=soon
+server4:
+    listen: "127.0.0.1:67"
+    plugins:
+        - errtest_fine:
+        - errtest_args: ttl=soon
+        - errtest_missing: a b
+`
+
+var errtestPlugins = []*Plugin{
+	{
+		Name: "errtest_fine",
+		Setup4: func(args ...string) (handler.Handler4, error) {
+			return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) { return resp, false }, nil
+		},
+	},
+	{
+		Name: "errtest_args",
+		Setup6: func(args ...string) (handler.Handler6, error) {
+			return nil, ArgErrorf("ttl", "%q is not a duration", strings.TrimPrefix(args[0], "ttl="))
+		},
+		Setup4: func(args ...string) (handler.Handler4, error) {
+			return nil, ArgErrorf("ttl", "%q is not a duration", strings.TrimPrefix(args[0], "ttl="))
+		},
+	},
+}
+
+// TestLoadPluginsErrors checks that all the plugins failing to set up are
+// reported, with their position in the configuration file
+func TestLoadPluginsErrors(t *testing.T) {
+	for _, p := range errtestPlugins {
+		RegisteredPlugins[p.Name] = p
+	}
+	defer func() {
+		for _, p := range errtestPlugins {
+			delete(RegisteredPlugins, p.Name)
+		}
+	}()
+
+	f, err := ioutil.TempFile("", "coredhcp-*.yml")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(brokenConfig)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	conf, err := config.Load(f.Name())
+	require.NoError(t, err)
+
+	_, _, err = LoadPlugins(conf)
+	var errs SetupErrors
+	require.True(t, errors.As(err, &errs), "got %v, expected SetupErrors", err)
+	require.Len(t, errs, 3, "got %v", err)
+
+	expected := []struct {
+		server, plugin string
+		line           int
+	}{
+		{"DHCPv6", "errtest_args", 4},
+		{"DHCPv4", "errtest_args", 9},
+		{"DHCPv4", "errtest_missing", 10},
+	}
+	for i, e := range expected {
+		assert.Equal(t, e.server, errs[i].Server)
+		assert.Equal(t, e.plugin, errs[i].Plugin)
+		assert.Equal(t, config.Position{File: f.Name(), Line: e.line, Column: 11}, errs[i].Position)
+	}
+
+	var argErr *ArgError
+	require.True(t, errors.As(errs[1], &argErr))
+	assert.Equal(t, "ttl", argErr.Arg)
+	assert.Contains(t, err.Error(), f.Name()+":9:11: DHCPv4: plugin `errtest_args`: argument `ttl`: \"soon\" is not a duration")
+	assert.Contains(t, err.Error(), f.Name()+":10:11: DHCPv4: plugin `errtest_missing`: unknown plugin")
+}
+
+func TestSetupErrorsFormat(t *testing.T) {
+	single := SetupErrors{{Server: "DHCPv4", Err: errors.New("circular constraints")}}
+	assert.Equal(t, "DHCPv4: circular constraints", single.Error())
+
+	several := append(single, &SetupError{
+		Server:   "DHCPv6",
+		Plugin:   "dns",
+		Position: config.Position{File: "config.yml", Line: 3, Column: 5},
+		Err:      ArgErrorf("1", "invalid IPv6 address"),
+	})
+	assert.Equal(t, "2 errors setting up plugins:\n"+
+		"\tDHCPv4: circular constraints\n"+
+		"\tconfig.yml:3:5: DHCPv6: plugin `dns`: argument `1`: invalid IPv6 address", several.Error())
+}
+
+// TestValidatePlugins checks that plugins with a validation function are not
+// set up when validating a configuration
+func TestValidatePlugins(t *testing.T) {
+	setUp := false
+	validating := &Plugin{
+		Name: "errtest_validating",
+		Setup4: func(args ...string) (handler.Handler4, error) {
+			setUp = true
+			return nil, errors.New("should not be set up")
+		},
+		Validate4: func(args ...string) error {
+			if len(args) != 1 {
+				return errors.New("want one argument")
+			}
+			return nil
+		},
+	}
+	RegisteredPlugins[validating.Name] = validating
+	RegisteredPlugins[errtestPlugins[0].Name] = errtestPlugins[0]
+	defer delete(RegisteredPlugins, validating.Name)
+	defer delete(RegisteredPlugins, errtestPlugins[0].Name)
+
+	conf := &config.Config{Server4: &config.ServerConfig{Plugins: []config.PluginConfig{
+		{Name: "errtest_fine"},
+		{Name: "errtest_validating", Args: []string{"a"}},
+	}}}
+	require.NoError(t, ValidatePlugins(conf))
+
+	conf.Server4.Plugins = append(conf.Server4.Plugins,
+		config.PluginConfig{Name: "errtest_validating"},
+		config.PluginConfig{Name: "errtest_missing"})
+	var errs SetupErrors
+	require.True(t, errors.As(ValidatePlugins(conf), &errs))
+	assert.Len(t, errs, 2)
+	assert.False(t, setUp, "plugins with a validation function should not be set up")
+}
+
+// TestValidatePluginsSideEffects checks that plugins without a validation
+// function are only set up when validating if they are side effect free
+func TestValidatePluginsSideEffects(t *testing.T) {
+	setUps := make(map[string]int)
+	failing := func(name string, free bool) *Plugin {
+		return &Plugin{
+			Name: name,
+			ChainSetup4: func(chain *Chain, args ...string) (handler.Handler4, error) {
+				setUps[name]++
+				return nil, errors.New("bad arguments")
+			},
+			SideEffectFree: free,
+		}
+	}
+	for _, p := range []*Plugin{failing("errtest_free", true), failing("errtest_effects", false)} {
+		RegisteredPlugins[p.Name] = p
+		defer delete(RegisteredPlugins, p.Name)
+	}
+
+	conf := &config.Config{Server4: &config.ServerConfig{Plugins: []config.PluginConfig{
+		{Name: "errtest_free"},
+		{Name: "errtest_effects"},
+	}}}
+	var errs SetupErrors
+	require.True(t, errors.As(ValidatePlugins(conf), &errs))
+	require.Len(t, errs, 1, "only the side effect free plugin should be checked")
+	assert.Equal(t, "errtest_free", errs[0].Plugin)
+	assert.Equal(t, map[string]int{"errtest_free": 1}, setUps)
+}
+
+// TestLoadChainsSetsUpOnce checks that every plugin is set up once, even those
+// without a validation function, and that the setup errors of all the plugins
+// are reported, the plugins set up after a failing one being closed too
+func TestLoadChainsSetsUpOnce(t *testing.T) {
+	setUps := make(map[string]int)
+	var closed []string
+	counting := func(name string, fail bool) *Plugin {
+		return &Plugin{
+			Name: name,
+			ChainSetup4: func(chain *Chain, args ...string) (handler.Handler4, error) {
+				setUps[name]++
+				if fail {
+					return nil, errors.New("cannot open file")
+				}
+				chain.OnClose(func() error {
+					closed = append(closed, name)
+					return nil
+				})
+				return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) { return resp, false }, nil
+			},
+		}
+	}
+	for _, p := range []*Plugin{
+		counting("errtest_failing", true),
+		counting("errtest_later", false),
+		counting("errtest_failing_too", true),
+	} {
+		RegisteredPlugins[p.Name] = p
+		defer delete(RegisteredPlugins, p.Name)
+	}
+
+	conf := &config.Config{Server4: &config.ServerConfig{Plugins: []config.PluginConfig{
+		{Name: "errtest_later"},
+	}}}
+	_, _, err := LoadChains(conf)
+	require.NoError(t, err)
+	assert.Equal(t, 1, setUps["errtest_later"], "plugins should be set up once")
+
+	setUps = make(map[string]int)
+	conf.Server4.Plugins = []config.PluginConfig{
+		{Name: "errtest_failing"},
+		{Name: "errtest_later"},
+		{Name: "errtest_failing_too"},
+	}
+	_, _, err = LoadChains(conf)
+	var errs SetupErrors
+	require.True(t, errors.As(err, &errs), "got %v, expected SetupErrors", err)
+	require.Len(t, errs, 2)
+	assert.Equal(t, "errtest_failing", errs[0].Plugin)
+	assert.Equal(t, "errtest_failing_too", errs[1].Plugin)
+	assert.Equal(t, map[string]int{"errtest_failing": 1, "errtest_later": 1, "errtest_failing_too": 1}, setUps)
+	assert.Equal(t, []string{"errtest_later"}, closed)
+}
+
+// TestLoadChainsValidatesFirst checks that plugins failing their validation
+// are not set up
+func TestLoadChainsValidatesFirst(t *testing.T) {
+	setUp := false
+	invalid := &Plugin{
+		Name: "errtest_invalid",
+		Setup4: func(args ...string) (handler.Handler4, error) {
+			setUp = true
+			return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) { return resp, false }, nil
+		},
+		Validate4: func(args ...string) error { return ArgErrorf("ttl", "missing") },
+	}
+	RegisteredPlugins[invalid.Name] = invalid
+	defer delete(RegisteredPlugins, invalid.Name)
+
+	conf := &config.Config{Server4: &config.ServerConfig{Plugins: []config.PluginConfig{
+		{Name: "errtest_invalid"},
+	}}}
+	_, _, err := LoadChains(conf)
+	var errs SetupErrors
+	require.True(t, errors.As(err, &errs), "got %v, expected SetupErrors", err)
+	require.Len(t, errs, 1)
+	assert.False(t, setUp, "plugins failing their validation should not be set up")
+}
+
+// TestLoadPluginsClosesOnSetupError checks that the plugins set up before one
+// fails to are closed, in reverse order
+func TestLoadPluginsClosesOnSetupError(t *testing.T) {
+	var closed []string
+	closing := func(name string) *Plugin {
+		return &Plugin{
+			Name: name,
+			ChainSetup4: func(chain *Chain, args ...string) (handler.Handler4, error) {
+				chain.OnClose(func() error {
+					closed = append(closed, name)
+					return nil
+				})
+				return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) { return resp, false }, nil
+			},
+			Validate4: func(args ...string) error { return nil },
+		}
+	}
+	failing := &Plugin{
+		Name: "errtest_failing",
+		Setup4: func(args ...string) (handler.Handler4, error) {
+			return nil, errors.New("cannot open file")
+		},
+		Validate4: func(args ...string) error { return nil },
+	}
+	for _, p := range []*Plugin{closing("errtest_first"), closing("errtest_second"), failing} {
+		RegisteredPlugins[p.Name] = p
+		defer delete(RegisteredPlugins, p.Name)
+	}
+
+	conf := &config.Config{Server4: &config.ServerConfig{Plugins: []config.PluginConfig{
+		{Name: "errtest_first"},
+		{Name: "errtest_second"},
+	}}}
+	chain4, _, err := LoadChains(conf)
+	require.NoError(t, err)
+	assert.Empty(t, closed, "plugins closed before the chain is")
+	require.NoError(t, chain4.Close())
+	require.NoError(t, chain4.Close())
+	assert.Equal(t, []string{"errtest_second", "errtest_first"}, closed)
+
+	closed = nil
+	conf.Server4.Plugins = append(conf.Server4.Plugins, config.PluginConfig{Name: "errtest_failing"})
+	_, _, err = LoadChains(conf)
+	require.Error(t, err)
+	assert.Equal(t, []string{"errtest_second", "errtest_first"}, closed)
+}
+
+// TestLoadPluginsHandlers checks that LoadPlugins returns the handlers of the
+// chains, and empty lists for the servers that are not configured
+func TestLoadPluginsHandlers(t *testing.T) {
+	for _, p := range errtestPlugins {
+		RegisteredPlugins[p.Name] = p
+		defer delete(RegisteredPlugins, p.Name)
+	}
+	conf := &config.Config{Server4: &config.ServerConfig{Plugins: []config.PluginConfig{
+		{Name: "errtest_fine"},
+		{Name: "errtest_fine"},
+	}}}
+	handlers4, handlers6, err := LoadPlugins(conf)
+	require.NoError(t, err)
+	assert.Len(t, handlers4, 2)
+	assert.NotNil(t, handlers6)
+	assert.Empty(t, handlers6)
+}
@@ -51,6 +51,17 @@ var log = logger.GetLogger("plugins/example")
 // A `nil` setup function means that that protocol won't be handled by this
 // plugin.
 //
+// If your plugin only works when some other plugins run before or after it,
+// declare it with the optional `Requires`, `RunsAfter` and `RunsBefore`
+// fields, so that misordered configurations are refused at startup.
+//
+// If your setup function has side effects, such as writing files, connecting
+// to other services or starting goroutines, also provide `Validate6` and
+// `Validate4` functions that only check the arguments, so that `--validate`
+// can check a configuration while a server runs with it. If it has none, like
+// this one, set `SideEffectFree` instead, so that `--validate` checks the
+// arguments by calling it; plugins with neither are not validated.
+//
 // Note that importing the plugin is not enough to use it: you have to
 // explicitly specify the intention to use it in the `config.yml` file, in the
 // plugins section. For example:
@@ -62,9 +73,10 @@ var log = logger.GetLogger("plugins/example")
 //   - file: "leases.txt"
 //
 var Plugin = plugins.Plugin{
-	Name:   "example",
-	Setup6: setup6,
-	Setup4: setup4,
+	Name:           "example",
+	Setup6:         setup6,
+	Setup4:         setup4,
+	SideEffectFree: true,
 }
 
 // setup6 is the setup function to initialize the handler for DHCPv6
@@ -74,6 +86,10 @@ var Plugin = plugins.Plugin{
 // `exampleHandler6` function. Such function will be called for every DHCPv6
 // packet that the server receives. Remember that a handler may not be called
 // for each packet, if the handler chain is interrupted before reaching it.
+// The setup function can be called several times, for example when several
+// servers run in the same process, so any state derived from the arguments
+// should be kept in the returned handler (a closure, or a method value on a
+// struct) rather than in package-level variables.
 func setup6(args ...string) (handler.Handler6, error) {
 	log.Printf("loaded plugin for DHCPv6.")
 	return exampleHandler6, nil
@@ -44,24 +44,32 @@ var log = logger.GetLogger("plugins/file")
 
 // Plugin wraps plugin registration information
 var Plugin = plugins.Plugin{
-	Name:   "file",
-	Setup6: setup6,
-	Setup4: setup4,
+	Name:           "file",
+	Setup6:         setup6,
+	Setup4:         setup4,
+	SideEffectFree: true,
 }
 
-// StaticRecords holds a MAC -> IP address mapping
+// StaticRecords holds a MAC -> IP address mapping, served by Handler4 and
+// Handler6.
+//
+// Deprecated: each instance of the plugin serves the records of its own file,
+// and none sets StaticRecords anymore. It is only used by callers setting it
+// themselves.
 var StaticRecords map[string]net.IP
 
 // DHCPv6Records and DHCPv4Records are mappings between MAC addresses in
 // form of a string, to network configurations.
+//
+// Deprecated: they are not set by the plugin, see LoadDHCPv4Records and
+// LoadDHCPv6Records.
 var (
 	DHCPv6Records map[string]net.IP
 	DHCPv4Records map[string]net.IP
 )
 
-// LoadDHCPv4Records loads the DHCPv4Records global map with records stored on
-// the specified file. The records have to be one per line, a mac address and an
-// IPv4 address.
+// LoadDHCPv4Records returns the records stored in the specified file. The
+// records have to be one per line, a mac address and an IPv4 address.
 func LoadDHCPv4Records(filename string) (map[string]net.IP, error) {
 	log.Infof("reading leases from %s", filename)
 	data, err := ioutil.ReadFile(filename)
@@ -92,9 +100,8 @@ func LoadDHCPv4Records(filename string) (map[string]net.IP, error) {
 	return records, nil
 }
 
-// LoadDHCPv6Records loads the DHCPv6Records global map with records stored on
-// the specified file. The records have to be one per line, a mac address and an
-// IPv6 address.
+// LoadDHCPv6Records returns the records stored in the specified file. The
+// records have to be one per line, a mac address and an IPv6 address.
 func LoadDHCPv6Records(filename string) (map[string]net.IP, error) {
 	log.Infof("reading leases from %s", filename)
 	data, err := ioutil.ReadFile(filename)
@@ -125,56 +132,79 @@ func LoadDHCPv6Records(filename string) (map[string]net.IP, error) {
 	return records, nil
 }
 
-// Handler6 handles DHCPv6 packets for the file plugin
-func Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
-	m, err := req.GetInnerMessage()
-	if err != nil {
-		log.Errorf("BUG: could not decapsulate: %v", err)
-		return nil, true
-	}
+// makeHandler6 returns a handler for DHCPv6 packets serving the static
+// records in staticRecords
+func makeHandler6(staticRecords map[string]net.IP) handler.Handler6 {
+	return func(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+		m, err := req.GetInnerMessage()
+		if err != nil {
+			log.Errorf("BUG: could not decapsulate: %v", err)
+			return nil, true
+		}
 
-	if m.Options.OneIANA() == nil {
-		log.Debug("No address requested")
-		return resp, false
-	}
+		// Information-Request is for stateless configuration only, RFC8415 §18.2.6
+		if m.MessageType == dhcpv6.MessageTypeInformationRequest || m.Options.OneIANA() == nil {
+			log.Debug("No address requested")
+			return resp, false
+		}
 
-	mac, err := dhcpv6.ExtractMAC(req)
-	if err != nil {
-		log.Warningf("Could not find client MAC, passing")
+		mac, err := dhcpv6.ExtractMAC(req)
+		if err != nil {
+			log.Warningf("Could not find client MAC, passing")
+			return resp, false
+		}
+		log.Debugf("looking up an IP address for MAC %s", mac.String())
+
+		ipaddr, ok := staticRecords[mac.String()]
+		if !ok {
+			log.Warningf("MAC address %s is unknown", mac.String())
+			return resp, false
+		}
+		log.Debugf("found IP address %s for MAC %s", ipaddr, mac.String())
+
+		resp.AddOption(&dhcpv6.OptIANA{
+			IaId: m.Options.OneIANA().IaId,
+			Options: dhcpv6.IdentityOptions{Options: []dhcpv6.Option{
+				&dhcpv6.OptIAAddress{
+					IPv6Addr:          ipaddr,
+					PreferredLifetime: 3600 * time.Second,
+					ValidLifetime:     3600 * time.Second,
+				},
+			}},
+		})
 		return resp, false
 	}
-	log.Debugf("looking up an IP address for MAC %s", mac.String())
+}
 
-	ipaddr, ok := StaticRecords[mac.String()]
-	if !ok {
-		log.Warningf("MAC address %s is unknown", mac.String())
-		return resp, false
+// makeHandler4 returns a handler for DHCPv4 packets serving the static
+// records in staticRecords
+func makeHandler4(staticRecords map[string]net.IP) handler.Handler4 {
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		ipaddr, ok := staticRecords[req.ClientHWAddr.String()]
+		if !ok {
+			log.Warningf("MAC address %s is unknown", req.ClientHWAddr.String())
+			return resp, false
+		}
+		resp.YourIPAddr = ipaddr
+		log.Debugf("found IP address %s for MAC %s", ipaddr, req.ClientHWAddr.String())
+		return resp, true
 	}
-	log.Debugf("found IP address %s for MAC %s", ipaddr, mac.String())
-
-	resp.AddOption(&dhcpv6.OptIANA{
-		IaId: m.Options.OneIANA().IaId,
-		Options: dhcpv6.IdentityOptions{Options: []dhcpv6.Option{
-			&dhcpv6.OptIAAddress{
-				IPv6Addr:          ipaddr,
-				PreferredLifetime: 3600 * time.Second,
-				ValidLifetime:     3600 * time.Second,
-			},
-		}},
-	})
-	return resp, false
 }
 
-// Handler4 handles DHCPv4 packets for the file plugin
+// Handler6 serves the records in StaticRecords.
+//
+// Deprecated: the plugin no longer sets StaticRecords, configure it to get a
+// handler serving the records of a file.
+func Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	return makeHandler6(StaticRecords)(req, resp)
+}
+
+// Handler4 serves the records in StaticRecords.
+//
+// Deprecated: the plugin no longer sets StaticRecords, configure it to get a
+// handler serving the records of a file.
 func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	ipaddr, ok := StaticRecords[req.ClientHWAddr.String()]
-	if !ok {
-		log.Warningf("MAC address %s is unknown", req.ClientHWAddr.String())
-		return resp, false
-	}
-	resp.YourIPAddr = ipaddr
-	log.Debugf("found IP address %s for MAC %s", ipaddr, req.ClientHWAddr.String())
-	return resp, true
+	return makeHandler4(StaticRecords)(req, resp)
 }
 
 func setup6(args ...string) (handler.Handler6, error) {
@@ -195,7 +225,7 @@ func setupFile(v6 bool, args ...string) (handler.Handler6, handler.Handler4, err
 	}
 	filename := args[0]
 	if filename == "" {
-		return nil, nil, errors.New("got empty file name")
+		return nil, nil, plugins.ArgErrorf("file", "cannot be empty")
 	}
 	if v6 {
 		records, err = LoadDHCPv6Records(filename)
@@ -205,7 +235,6 @@ func setupFile(v6 bool, args ...string) (handler.Handler6, handler.Handler4, err
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to load DHCPv6 records: %v", err)
 	}
-	StaticRecords = records
 	log.Infof("loaded %d leases from %s", len(records), filename)
-	return Handler6, Handler4, nil
+	return makeHandler6(records), makeHandler4(records), nil
 }
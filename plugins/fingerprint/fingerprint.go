@@ -0,0 +1,229 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package fingerprint
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// builtin4 holds the DHCPv4 fingerprints of a few common systems, for any
+// vendor class
+var builtin4 = signatures{
+	{options: "1,3,6,15,31,33,43,44,46,47,119,121,249,252"}: "windows",
+	{options: "1,121,3,6,15,119,252,95,44,46"}:              "macos",
+	{options: "1,3,6,15,119,95,252,44,46,47"}:               "macos",
+	{options: "1,121,3,6,15,119,252"}:                       "ios",
+	{options: "1,3,6,15,26,28,51,58,59,43"}:                 "android",
+	{options: "1,28,2,3,15,6,119,12,44,47,26,121,42"}:       "linux",
+}
+
+// fingerprint is what identifies a client: the options it requests, in the
+// order it requests them, and its vendor class if any
+type fingerprint struct {
+	options string
+	vendor  string
+}
+
+// fingerprint4 returns the fingerprint of a DHCPv4 request: its Parameter
+// Request List and its Vendor Class Identifier
+func fingerprint4(req *dhcpv4.DHCPv4) fingerprint {
+	prl := req.Options.Get(dhcpv4.OptionParameterRequestList)
+	codes := make([]string, 0, len(prl))
+	for _, code := range prl {
+		codes = append(codes, strconv.Itoa(int(code)))
+	}
+	return fingerprint{
+		options: strings.Join(codes, ","),
+		vendor:  string(req.Options.Get(dhcpv4.OptionClassIdentifier)),
+	}
+}
+
+// fingerprint6 returns the fingerprint of a DHCPv6 message: its Option
+// Request option, and the enterprise number of its Vendor Class option
+func fingerprint6(msg *dhcpv6.Message) fingerprint {
+	var fp fingerprint
+	if oro := msg.GetOneOption(dhcpv6.OptionORO); oro != nil {
+		data := oro.ToBytes()
+		codes := make([]string, 0, len(data)/2)
+		for i := 0; i+1 < len(data); i += 2 {
+			codes = append(codes, strconv.Itoa(int(binary.BigEndian.Uint16(data[i:]))))
+		}
+		fp.options = strings.Join(codes, ",")
+	}
+	if vc := msg.GetOneOption(dhcpv6.OptionVendorClass); vc != nil {
+		if data := vc.ToBytes(); len(data) >= 4 {
+			fp.vendor = strconv.FormatUint(uint64(binary.BigEndian.Uint32(data)), 10)
+		}
+	}
+	return fp
+}
+
+// signatures maps fingerprints to device classes. Signatures with an empty
+// vendor class match any vendor class
+type signatures map[fingerprint]string
+
+// lookup returns the device class of fp: that of the signature with its
+// option list and vendor class, or else that of the signature with its option
+// list for any vendor class
+func (sigs signatures) lookup(fp fingerprint) (string, bool) {
+	if class, ok := sigs[fp]; ok {
+		return class, true
+	}
+	class, ok := sigs[fingerprint{options: fp.options}]
+	return class, ok
+}
+
+// unquotePrefix returns the Go-quoted string at the start of s, as written to
+// the unknown fingerprints, and what follows it
+func unquotePrefix(s string) (value, rest string, err error) {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			value, err = strconv.Unquote(s[:i+1])
+			return value, s[i+1:], err
+		}
+	}
+	return "", "", fmt.Errorf("unterminated vendor class %s", s)
+}
+
+// parseSignatures reads a signature file: one signature per line, an option
+// list as in "1,3,6,15", optionally a quoted vendor class as in "MSFT 5.0",
+// then the device class. Empty lines and lines starting with # are ignored
+func parseSignatures(r io.Reader) (signatures, error) {
+	sigs := make(signatures)
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexFunc(line, unicode.IsSpace)
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: want an option list and a device class", lineno)
+		}
+		fields := []string{line[:i], line[i:]}
+		for _, code := range strings.Split(fields[0], ",") {
+			if _, err := strconv.ParseUint(code, 10, 16); err != nil {
+				return nil, fmt.Errorf("line %d: invalid option code %q", lineno, code)
+			}
+		}
+		fp, rest := fingerprint{options: fields[0]}, strings.TrimSpace(fields[1])
+		if strings.HasPrefix(rest, `"`) {
+			var err error
+			fp.vendor, rest, err = unquotePrefix(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineno, err)
+			}
+		}
+		class := strings.Join(strings.Fields(rest), " ")
+		if class == "" {
+			return nil, fmt.Errorf("line %d: want a device class", lineno)
+		}
+		sigs[fp] = class
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return sigs, nil
+}
+
+// maxUnknown bounds the number of distinct unknown fingerprints counted, so
+// clients cannot make the server use unbounded memory by varying theirs
+const maxUnknown = 1024
+
+// database matches fingerprints against signatures, and counts the
+// fingerprints it does not know
+type database struct {
+	mu       sync.Mutex
+	sigs     signatures
+	unknown  map[fingerprint]uint64
+	overflow uint64
+}
+
+func newDatabase(sigs signatures) *database {
+	return &database{sigs: sigs, unknown: make(map[fingerprint]uint64)}
+}
+
+// replace swaps the signatures, after a reload
+func (db *database) replace(sigs signatures) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.sigs = sigs
+	// Fingerprints counted as unknown may be known now
+	for fp := range db.unknown {
+		if _, ok := sigs.lookup(fp); ok {
+			delete(db.unknown, fp)
+		}
+	}
+}
+
+// match returns the device class of a fingerprint, or false if it is unknown
+func (db *database) match(fp fingerprint) (string, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if class, ok := db.sigs.lookup(fp); ok {
+		return class, true
+	}
+	if _, ok := db.unknown[fp]; ok || len(db.unknown) < maxUnknown {
+		db.unknown[fp]++
+	} else {
+		db.overflow++
+	}
+	return "", false
+}
+
+// writeUnknown writes the unknown fingerprints, most seen first, one per line:
+// the number of requests seen, the option list and the vendor class
+func (db *database) writeUnknown(w io.Writer) error {
+	type count struct {
+		fingerprint
+		n uint64
+	}
+	db.mu.Lock()
+	counts := make([]count, 0, len(db.unknown))
+	for fp, n := range db.unknown {
+		counts = append(counts, count{fp, n})
+	}
+	overflow := db.overflow
+	db.mu.Unlock()
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].n != counts[j].n {
+			return counts[i].n > counts[j].n
+		}
+		if counts[i].options != counts[j].options {
+			return counts[i].options < counts[j].options
+		}
+		return counts[i].vendor < counts[j].vendor
+	})
+	if overflow > 0 {
+		if _, err := fmt.Fprintf(w, "# %d requests with other fingerprints were not counted\n", overflow); err != nil {
+			return err
+		}
+	}
+	for _, c := range counts {
+		options := c.options
+		if options == "" {
+			options = "-"
+		}
+		if _, err := fmt.Fprintf(w, "%d %s %q\n", c.n, options, c.vendor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
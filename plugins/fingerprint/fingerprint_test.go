@@ -0,0 +1,187 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package fingerprint
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/coredhcp/coredhcp/internal/testpackets"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// request4 returns a DHCPDISCOVER as received from the wire, with the given
+// Parameter Request List and Vendor Class Identifier
+func request4(t *testing.T, prl []byte, vendor string) *dhcpv4.DHCPv4 {
+	mods := []dhcpv4.Modifier{
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover),
+		dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionParameterRequestList, prl)),
+	}
+	if vendor != "" {
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionClassIdentifier, []byte(vendor))))
+	}
+	m, err := dhcpv4.New(mods...)
+	require.NoError(t, err)
+	m, err = dhcpv4.FromBytes(m.ToBytes())
+	require.NoError(t, err)
+	return m
+}
+
+// Option lists of common systems, as found in fingerprint databases
+func TestFingerprint4Devices(t *testing.T) {
+	for _, tc := range []struct {
+		device string
+		prl    []byte
+		vendor string
+		class  string
+	}{
+		{"Windows 10", []byte{1, 3, 6, 15, 31, 33, 43, 44, 46, 47, 119, 121, 249, 252}, "MSFT 5.0", "windows"},
+		{"macOS", []byte{1, 121, 3, 6, 15, 119, 252, 95, 44, 46}, "", "macos"},
+		{"iPhone", []byte{1, 121, 3, 6, 15, 119, 252}, "", "ios"},
+		{"Android", []byte{1, 3, 6, 15, 26, 28, 51, 58, 59, 43}, "android-dhcp-10", "android"},
+		{"Ubuntu dhclient", []byte{1, 28, 2, 3, 15, 6, 119, 12, 44, 47, 26, 121, 42}, "", "linux"},
+	} {
+		t.Run(tc.device, func(t *testing.T) {
+			fp := fingerprint4(request4(t, tc.prl, tc.vendor))
+			assert.Equal(t, tc.vendor, fp.vendor)
+			class, ok := newDatabase(builtin4).match(fp)
+			assert.True(t, ok, "fingerprint %s not matched", fp.options)
+			assert.Equal(t, tc.class, class)
+		})
+	}
+}
+
+// TestFingerprint4Captures checks the fingerprints of requests captured from
+// real devices, with their options in the order they sent them
+func TestFingerprint4Captures(t *testing.T) {
+	db := newDatabase(builtin4)
+	for _, tc := range []struct {
+		capture, options, class string
+	}{
+		{"macosx-discover", "1,3,6,15,119,95,252,44,46,47", "macos"},
+		{"grandstream-discover", "1,3,6,42", ""},
+		{"grandstream-request", "1,3,6,42", ""},
+	} {
+		t.Run(tc.capture, func(t *testing.T) {
+			req, _ := testpackets.Capture4(t, tc.capture)
+			fp := fingerprint4(req)
+			assert.Equal(t, tc.options, fp.options)
+			class, ok := db.match(fp)
+			assert.Equal(t, tc.class != "", ok)
+			assert.Equal(t, tc.class, class)
+		})
+	}
+}
+
+func TestFingerprint4Order(t *testing.T) {
+	fp := fingerprint4(request4(t, []byte{1, 3, 6}, ""))
+	assert.Equal(t, "1,3,6", fp.options)
+	fp = fingerprint4(request4(t, []byte{6, 3, 1}, ""))
+	assert.Equal(t, "6,3,1", fp.options, "the order of requested options is part of the fingerprint")
+}
+
+func TestFingerprint6(t *testing.T) {
+	msg, err := dhcpv6.NewMessage()
+	require.NoError(t, err)
+	msg.MessageType = dhcpv6.MessageTypeSolicit
+	// Option Request option asking for options 17, 23, 24 and 39
+	msg.AddOption(&dhcpv6.OptionGeneric{
+		OptionCode: dhcpv6.OptionORO,
+		OptionData: []byte{0, 17, 0, 23, 0, 24, 0, 39},
+	})
+	// Vendor Class with enterprise number 311 (Microsoft)
+	msg.AddOption(&dhcpv6.OptionGeneric{
+		OptionCode: dhcpv6.OptionVendorClass,
+		OptionData: []byte{0, 0, 1, 55, 0, 8, 'M', 'S', 'F', 'T', ' ', '5', '.', '0'},
+	})
+	parsed, err := dhcpv6.FromBytes(msg.ToBytes())
+	require.NoError(t, err)
+
+	fp := fingerprint6(parsed.(*dhcpv6.Message))
+	assert.Equal(t, "17,23,24,39", fp.options)
+	assert.Equal(t, "311", fp.vendor)
+}
+
+func TestParseSignatures(t *testing.T) {
+	sigs, err := parseSignatures(strings.NewReader(`
+# Printers
+1,3,6,15,44,47 hp printer
+
+1,3,6 embedded
+1,3,6 "acme \"v2\"" acme  router
+`))
+	require.NoError(t, err)
+	assert.Equal(t, signatures{
+		{options: "1,3,6,15,44,47"}:             "hp printer",
+		{options: "1,3,6"}:                      "embedded",
+		{options: "1,3,6", vendor: `acme "v2"`}: "acme router",
+	}, sigs)
+
+	for _, bad := range []string{"1,3,6", "1,a,6 printer", "1,,6 printer", "1,3,65536 printer", `1,3,6 "acme`, `1,3,6 "acme"`} {
+		_, err := parseSignatures(strings.NewReader(bad))
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestUnknown(t *testing.T) {
+	db := newDatabase(signatures{{options: "1,3,6"}: "embedded"})
+	_, ok := db.match(fingerprint{options: "1,3,6,15"})
+	assert.False(t, ok)
+	db.match(fingerprint{options: "1,3,6,15"})
+	db.match(fingerprint{options: "1,3,6,15", vendor: "acme"})
+
+	var out bytes.Buffer
+	require.NoError(t, db.writeUnknown(&out))
+	assert.Equal(t, "2 1,3,6,15 \"\"\n1 1,3,6,15 \"acme\"\n", out.String())
+
+	// Known after a reload: no longer reported
+	db.replace(signatures{{options: "1,3,6,15"}: "printer"})
+	class, ok := db.match(fingerprint{options: "1,3,6,15"})
+	assert.True(t, ok)
+	assert.Equal(t, "printer", class)
+	out.Reset()
+	require.NoError(t, db.writeUnknown(&out))
+	assert.Empty(t, out.String())
+}
+
+func TestMatchVendor(t *testing.T) {
+	db := newDatabase(signatures{
+		{options: "1,3,6"}:                  "embedded",
+		{options: "1,3,6", vendor: "acme"}:  "acme router",
+		{options: "1,3,15", vendor: "acme"}: "acme printer",
+	})
+	for _, tc := range []struct {
+		fp    fingerprint
+		class string
+	}{
+		{fingerprint{options: "1,3,6"}, "embedded"},
+		{fingerprint{options: "1,3,6", vendor: "other"}, "embedded"},
+		{fingerprint{options: "1,3,6", vendor: "acme"}, "acme router"},
+		{fingerprint{options: "1,3,15", vendor: "acme"}, "acme printer"},
+		{fingerprint{options: "1,3,15", vendor: "other"}, ""},
+		{fingerprint{options: "1,3,15"}, ""},
+	} {
+		class, ok := db.match(tc.fp)
+		assert.Equal(t, tc.class != "", ok, "%+v", tc.fp)
+		assert.Equal(t, tc.class, class, "%+v", tc.fp)
+	}
+}
+
+func TestUnknownBounded(t *testing.T) {
+	db := newDatabase(nil)
+	for i := 0; i < maxUnknown+10; i++ {
+		db.match(fingerprint{options: fmt.Sprint(i)})
+	}
+	assert.Len(t, db.unknown, maxUnknown)
+	assert.Equal(t, uint64(10), db.overflow)
+	// Fingerprints already counted still are
+	db.match(fingerprint{options: "0"})
+	assert.Equal(t, uint64(2), db.unknown[fingerprint{options: "0"}])
+}
@@ -0,0 +1,266 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package fingerprint
+
+// This plugin identifies the type of device of clients from their DHCP
+// requests. The options a client requests, in the order it requests them,
+// together with its vendor class, form a fingerprint that is matched against
+// a database of signatures, fingerbank-style.
+//
+// Example configuration:
+//
+// server4:
+//   plugins:
+//     - fingerprint: signatures.txt refresh=1m unknown=unknown.txt
+//     - server_id: 10.10.10.1
+//     - range: leases.txt 10.10.10.100 10.10.10.200 60s
+//
+// All arguments are optional:
+//   - the signature file, with one signature per line: an option list, as in
+//     "1,3,6,15", optionally a quoted vendor class, as in "MSFT 5.0", then a
+//     device class. Signatures without a vendor class match any, those with
+//     one take precedence. In DHCPv6, the vendor class is the enterprise
+//     number of the Vendor Class option. Lines starting with # are comments.
+//     For DHCPv4, signatures for a few common systems are built in, and the
+//     file adds to or overrides them
+//   - refresh: how often the signature file is checked for changes and
+//     reloaded, and the unknown fingerprints written (default 1m)
+//   - unknown: a file where the fingerprints that matched no signature are
+//     written, with the number of requests they were seen in and the vendor
+//     class, so they can be identified and added to the signatures
+//
+// The device class of each request is logged at the debug level. This plugin
+// does not change responses.
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/internal/atomicfile"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger("plugins/fingerprint")
+
+// Plugin wraps plugin registration information
+var Plugin = plugins.Plugin{
+	Name:      "fingerprint",
+	Setup6:    setup6,
+	Setup4:    setup4,
+	Validate6: validate6,
+	Validate4: validate4,
+	// See every client, before plugins that may end the chain
+	RunsBefore: []string{"authorize", "file", "prefix", "range", "v6only"},
+}
+
+// state is the signature database of a plugin instance, and where it is
+// loaded from and exported to
+type state struct {
+	db          *database
+	builtin     signatures
+	filename    string
+	unknownFile string
+
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+func parseArgs(builtin signatures, args ...string) (*state, time.Duration, error) {
+	s := &state{builtin: builtin}
+	refresh := time.Minute
+	for i, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			if i != 0 {
+				return nil, 0, plugins.ArgErrorf(arg, "expected key=value")
+			}
+			s.filename = arg
+			continue
+		}
+		switch kv[0] {
+		case "refresh":
+			var err error
+			refresh, err = time.ParseDuration(kv[1])
+			if err != nil || refresh <= 0 {
+				return nil, 0, plugins.ArgErrorf("refresh", "%q is not a positive duration", kv[1])
+			}
+		case "unknown":
+			if kv[1] == "" {
+				return nil, 0, plugins.ArgErrorf("unknown", "got empty file name")
+			}
+			s.unknownFile = kv[1]
+		default:
+			return nil, 0, plugins.ArgErrorf(kv[0], "unknown setting")
+		}
+	}
+	sigs, err := s.load()
+	if err != nil {
+		return nil, 0, err
+	}
+	s.db = newDatabase(sigs)
+	log.Infof("loaded %d signatures", len(sigs))
+	return s, refresh, nil
+}
+
+// load returns the built-in signatures, with those of the signature file
+// added if there is one
+func (s *state) load() (signatures, error) {
+	sigs := make(signatures, len(s.builtin))
+	for fp, class := range s.builtin {
+		sigs[fp] = class
+	}
+	if s.filename == "" {
+		return sigs, nil
+	}
+	f, err := os.Open(s.filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	fileSigs, err := parseSignatures(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", s.filename, err)
+	}
+	for fp, class := range fileSigs {
+		sigs[fp] = class
+	}
+	s.mu.Lock()
+	s.modTime = info.ModTime()
+	s.mu.Unlock()
+	return sigs, nil
+}
+
+// reload loads the signature file again if it changed. On errors, the
+// current signatures are kept
+func (s *state) reload() {
+	if s.filename == "" {
+		return
+	}
+	info, err := os.Stat(s.filename)
+	if err != nil {
+		log.Errorf("could not check %s for changes: %v", s.filename, err)
+		return
+	}
+	s.mu.Lock()
+	changed := !info.ModTime().Equal(s.modTime)
+	s.mu.Unlock()
+	if !changed {
+		return
+	}
+	sigs, err := s.load()
+	if err != nil {
+		log.Errorf("could not reload signatures, keeping the current ones: %v", err)
+		return
+	}
+	s.db.replace(sigs)
+	log.Infof("reloaded %d signatures from %s", len(sigs), s.filename)
+}
+
+// export writes the unknown fingerprints to their file, replacing it
+// atomically
+func (s *state) export() error {
+	if s.unknownFile == "" {
+		return nil
+	}
+	return atomicfile.Write(s.unknownFile, 0600, s.db.writeUnknown)
+}
+
+// watch periodically reloads the signatures and exports the unknown
+// fingerprints. It runs for the lifetime of the server
+func (s *state) watch(refresh time.Duration) {
+	for range time.Tick(refresh) {
+		s.reload()
+		if err := s.export(); err != nil {
+			log.Errorf("could not write unknown fingerprints: %v", err)
+		}
+	}
+}
+
+func (s *state) identify(client string, fp fingerprint) {
+	if fp.options == "" && fp.vendor == "" {
+		return
+	}
+	if class, ok := s.db.match(fp); ok {
+		log.Debugf("%s: device class %s", client, class)
+	} else {
+		log.Debugf("%s: unknown fingerprint %s, vendor class %q", client, fp.options, fp.vendor)
+	}
+}
+
+func makeHandler6(s *state) handler.Handler6 {
+	return func(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+		msg, err := req.GetInnerMessage()
+		if err != nil {
+			log.Errorf("BUG: could not decapsulate: %v", err)
+			return nil, true
+		}
+		client := "unknown client"
+		if cid := msg.Options.ClientID(); cid != nil {
+			client = cid.String()
+		}
+		s.identify(client, fingerprint6(msg))
+		return resp, false
+	}
+}
+
+func makeHandler4(s *state) handler.Handler4 {
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		s.identify(req.ClientHWAddr.String(), fingerprint4(req))
+		return resp, false
+	}
+}
+
+func setup(builtin signatures, args ...string) (*state, error) {
+	s, refresh, err := parseArgs(builtin, args...)
+	if err != nil {
+		return nil, err
+	}
+	if s.filename != "" || s.unknownFile != "" {
+		go s.watch(refresh)
+	}
+	return s, nil
+}
+
+// validate6 checks the arguments and the signature file of the plugin, without
+// starting to watch the files
+func validate6(args ...string) error {
+	_, _, err := parseArgs(nil, args...)
+	return err
+}
+
+// validate4 is validate6 for DHCPv4
+func validate4(args ...string) error {
+	_, _, err := parseArgs(builtin4, args...)
+	return err
+}
+
+func setup6(args ...string) (handler.Handler6, error) {
+	log.Printf("loading `fingerprint` plugin for DHCPv6 with args: %v", args)
+	s, err := setup(nil, args...)
+	if err != nil {
+		return nil, err
+	}
+	return makeHandler6(s), nil
+}
+
+func setup4(args ...string) (handler.Handler4, error) {
+	log.Printf("loading `fingerprint` plugin for DHCPv4 with args: %v", args)
+	s, err := setup(builtin4, args...)
+	if err != nil {
+		return nil, err
+	}
+	return makeHandler4(s), nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package fingerprint
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseArgs(t *testing.T) {
+	s, refresh, err := parseArgs(builtin4)
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, refresh)
+	assert.Len(t, s.db.sigs, len(builtin4))
+
+	_, refresh, err = parseArgs(nil, "refresh=10s", "unknown=/tmp/unknown.txt")
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Second, refresh)
+
+	for _, args := range [][]string{
+		{"refresh=0s"},
+		{"refresh=soon"},
+		{"unknown="},
+		{"ttl=1m"},
+		{"refresh=1m", "signatures.txt"},
+		{"/nonexistent/signatures.txt"},
+	} {
+		_, _, err := parseArgs(nil, args...)
+		assert.Error(t, err, args)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredhcp-fingerprint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "signatures.txt")
+	unknown := filepath.Join(dir, "unknown.txt")
+
+	// The file overrides the built-in signatures
+	require.NoError(t, ioutil.WriteFile(filename, []byte("1,121,3,6,15,119,252 apple\n"), 0644))
+	s, _, err := parseArgs(builtin4, filename, "unknown="+unknown)
+	require.NoError(t, err)
+	class, _ := s.db.match(fingerprint{options: "1,121,3,6,15,119,252"})
+	assert.Equal(t, "apple", class)
+	_, ok := s.db.match(fingerprint{options: "1,3,6,15,44,47"})
+	assert.False(t, ok)
+	require.NoError(t, s.export())
+	data, err := ioutil.ReadFile(unknown)
+	require.NoError(t, err)
+	assert.Equal(t, "1 1,3,6,15,44,47 \"\"\n", string(data))
+
+	// Unchanged files are not read again
+	s.reload()
+	class, _ = s.db.match(fingerprint{options: "1,121,3,6,15,119,252"})
+	assert.Equal(t, "apple", class)
+
+	// Invalid files are not loaded
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, ioutil.WriteFile(filename, []byte("invalid\n"), 0644))
+	require.NoError(t, os.Chtimes(filename, later, later))
+	s.reload()
+	class, _ = s.db.match(fingerprint{options: "1,121,3,6,15,119,252"})
+	assert.Equal(t, "apple", class)
+
+	later = later.Add(time.Minute)
+	require.NoError(t, ioutil.WriteFile(filename, []byte("1,3,6,15,44,47 hp printer\n"), 0644))
+	require.NoError(t, os.Chtimes(filename, later, later))
+	s.reload()
+	class, ok = s.db.match(fingerprint{options: "1,3,6,15,44,47"})
+	assert.True(t, ok)
+	assert.Equal(t, "hp printer", class)
+	class, _ = s.db.match(fingerprint{options: "1,121,3,6,15,119,252"})
+	assert.Equal(t, "ios", class, "built-in signatures are kept on reload")
+	require.NoError(t, s.export())
+	data, err = ioutil.ReadFile(unknown)
+	require.NoError(t, err)
+	assert.Empty(t, string(data))
+}
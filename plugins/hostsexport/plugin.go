@@ -0,0 +1,505 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package hostsexport
+
+// This plugin writes the active leases of clients that send a host name to a
+// hosts(5) file and/or a DNS zone fragment, for name resolution on networks
+// without dynamic DNS. The files can be included by dnsmasq or unbound.
+//
+// Example configuration:
+//
+// server4:
+//   plugins:
+//     - server_id: 10.10.10.1
+//     - range: leases.txt 10.10.10.100 10.10.10.200 60s
+//     - hosts_export: hosts=/var/lib/coredhcp/hosts zone=/var/lib/coredhcp/lan.zone domain=lan
+//
+// The settings are:
+//   - hosts: the hosts file to write
+//   - zone: the zone fragment to write, with A, AAAA and PTR records
+//   - domain: the domain suffix of the names, required for zone. In the hosts
+//     file, names are also given unqualified
+//   - ttl: the TTL of the records in the zone fragment (default 5m)
+//   - interval: how often the files are rewritten, if the leases changed
+//     (default 1m)
+//   - restore: how long the names read back from the files at startup are
+//     kept for the leases not stored by the range plugin (default 1h)
+//
+// At least one of hosts or zone must be given. The files are replaced
+// atomically. Host names come from the Host Name option in DHCPv4 and from the
+// first label of the Client FQDN option in DHCPv6, reduced to letters, digits
+// and hyphens. When several clients claim the same name in the same address
+// family, each gets the name suffixed with a hash of its identifier, its
+// hardware address in DHCPv4 and its DUID in DHCPv6. A dual-stack host keeps
+// its name for both its A and AAAA records.
+//
+// The DHCPv4 and DHCPv6 servers share the files when configured with the same
+// settings, and instances with other settings cannot write them. The leases
+// of the range instances of the DHCPv4 chain are streamed from them, so they
+// leave the files when they expire there. Other leases, such as the DHCPv6
+// ones, are only kept in memory. At startup, the names are read back from the
+// files: leases stored by range keep them until their clients send another
+// name, others until restore elapses or their clients renew.
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/internal/atomicfile"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	rangeplugin "github.com/coredhcp/coredhcp/plugins/range"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger("plugins/hosts_export")
+
+// Plugin wraps plugin registration information
+var Plugin = plugins.Plugin{
+	Name:        "hosts_export",
+	ChainSetup6: setup6,
+	ChainSetup4: setup4,
+	Validate6:   validate,
+	Validate4:   validate,
+	// Export the final leases, after the plugins granting them or changing
+	// their lifetimes
+	RunsAfter: []string{"file", "lease_time", "prefix", "range"},
+}
+
+type config struct {
+	hostsFile, zoneFile    string
+	domain                 string
+	ttl, interval, restore time.Duration
+}
+
+// files returns the files to write
+func (c *config) files() []string {
+	var files []string
+	for _, filename := range []string{c.hostsFile, c.zoneFile} {
+		if filename != "" {
+			files = append(files, filename)
+		}
+	}
+	return files
+}
+
+func parseArgs(args ...string) (*config, error) {
+	c := &config{ttl: 5 * time.Minute, interval: time.Minute, restore: time.Hour}
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, plugins.ArgErrorf(arg, "expected key=value")
+		}
+		var err error
+		switch kv[0] {
+		case "hosts":
+			c.hostsFile = filepath.Clean(kv[1])
+		case "zone":
+			c.zoneFile = filepath.Clean(kv[1])
+		case "domain":
+			c.domain = strings.Trim(kv[1], ".")
+		case "ttl":
+			c.ttl, err = time.ParseDuration(kv[1])
+			if err != nil || c.ttl < time.Second {
+				return nil, plugins.ArgErrorf("ttl", "%q is not a duration of at least a second", kv[1])
+			}
+		case "interval":
+			c.interval, err = time.ParseDuration(kv[1])
+			if err != nil || c.interval <= 0 {
+				return nil, plugins.ArgErrorf("interval", "%q is not a positive duration", kv[1])
+			}
+		case "restore":
+			c.restore, err = time.ParseDuration(kv[1])
+			if err != nil || c.restore < 0 {
+				return nil, plugins.ArgErrorf("restore", "%q is not a duration", kv[1])
+			}
+		default:
+			return nil, plugins.ArgErrorf(kv[0], "unknown setting")
+		}
+	}
+	if c.hostsFile == "" && c.zoneFile == "" {
+		return nil, errors.New("need a hosts file, a zone file, or both")
+	}
+	if c.hostsFile == c.zoneFile {
+		return nil, plugins.ArgErrorf("zone", "the zone and hosts files must differ")
+	}
+	if c.zoneFile != "" && c.domain == "" {
+		return nil, plugins.ArgErrorf("domain", "required with a zone file")
+	}
+	return c, nil
+}
+
+// exporter holds the active leases with a host name, and writes them out
+type exporter struct {
+	c *config
+	// users is the number of plugin chains using the exporter. It is
+	// guarded by exportersMu
+	users int
+	// stop stops run, which closes done once it returned
+	stop, done chan struct{}
+
+	mu sync.Mutex
+	// leases maps addresses to the leases seen in responses, and to the
+	// ones read back from the files at startup
+	leases map[string]entry
+	// names holds the name each DHCPv4 client last sent, empty if it sent
+	// none, for the leases stored by the pools
+	names map[string]string
+	// restored holds the names read back from the files at startup, by
+	// address, for the leases stored by the pools whose clients did not
+	// send a name since
+	restored map[string]string
+	// pools are the instances of the range plugin of the DHCPv4 chains
+	// using the exporter, which store the leases across restarts
+	pools map[*plugins.Chain][]*rangeplugin.PluginState
+	// written holds the contents last written to each file
+	written map[string][]byte
+}
+
+// exporters holds the running exporters by the files they write, so that the
+// DHCPv4 and DHCPv6 servers share files. Exporters are removed once the plugin
+// chains using them are closed
+var (
+	exportersMu sync.Mutex
+	exporters   = make(map[string]*exporter)
+)
+
+func newExporter(c *config) *exporter {
+	return &exporter{
+		c:        c,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		leases:   make(map[string]entry),
+		names:    make(map[string]string),
+		restored: make(map[string]string),
+		pools:    make(map[*plugins.Chain][]*rangeplugin.PluginState),
+		written:  make(map[string][]byte),
+	}
+}
+
+// startExporter returns the exporter writing the files in args, starting it if
+// no other chain uses it. Chains can only share an exporter with the same
+// settings. It is released when chain is closed
+func startExporter(chain *plugins.Chain, args ...string) (*exporter, error) {
+	c, err := parseArgs(args...)
+	if err != nil {
+		return nil, err
+	}
+	exportersMu.Lock()
+	defer exportersMu.Unlock()
+	var x *exporter
+	for _, filename := range c.files() {
+		if other, ok := exporters[filename]; ok {
+			if *other.c != *c {
+				return nil, fmt.Errorf("%s is already exported to with other settings", filename)
+			}
+			x = other
+		}
+	}
+	if x == nil {
+		x = newExporter(c)
+		x.restore(time.Now())
+		for _, filename := range c.files() {
+			exporters[filename] = x
+		}
+		go x.run()
+	}
+	x.users++
+	chain.OnReady(func() {
+		if pools := rangeplugin.Instances(chain); len(pools) > 0 {
+			x.mu.Lock()
+			x.pools[chain] = pools
+			x.mu.Unlock()
+		}
+	})
+	chain.OnClose(func() error { return x.release(chain) })
+	return x, nil
+}
+
+// release stops using the pools of chain, and stops the exporter once no chain
+// uses it anymore, writing out the leases a last time
+func (x *exporter) release(chain *plugins.Chain) error {
+	exportersMu.Lock()
+	x.users--
+	last := x.users == 0
+	if last {
+		for _, filename := range x.c.files() {
+			delete(exporters, filename)
+		}
+	}
+	exportersMu.Unlock()
+	if !last {
+		x.mu.Lock()
+		delete(x.pools, chain)
+		x.mu.Unlock()
+		return nil
+	}
+	close(x.stop)
+	<-x.done
+	return x.flush(time.Now())
+}
+
+// restore reads back the names of the previous run from the files, so that
+// the first write after a restart does not drop the clients that did not
+// renew their leases yet. The leases stored by the pools keep their names
+// until they expire; the others for the restore setting
+func (x *exporter) restore(now time.Time) {
+	for _, filename := range x.c.files() {
+		contents, err := ioutil.ReadFile(filename)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Warningf("could not read back the leases from %s: %v", filename, err)
+			}
+			continue
+		}
+		x.written[filename] = contents
+	}
+	var restored map[string]string
+	if contents, ok := x.written[x.c.hostsFile]; ok {
+		restored = parseHosts(contents)
+	} else if contents, ok := x.written[x.c.zoneFile]; ok {
+		restored = parseZone(contents, x.c.domain)
+	}
+	for ip, name := range restored {
+		x.restored[ip] = name
+		// The client is unknown, the name stands for it to resolve
+		// collisions
+		x.leases[ip] = entry{client: name, name: name, ip: net.ParseIP(ip), expires: now.Add(x.c.restore)}
+	}
+}
+
+// update records a lease granted to client, or forgets it if the client gave
+// no usable name
+func (x *exporter) update(client, hostname string, ip net.IP, leaseTime time.Duration) {
+	name := sanitizeName(hostname)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if ip.To4() != nil {
+		x.names[client] = name
+	}
+	if name == "" {
+		delete(x.leases, ip.String())
+		return
+	}
+	x.leases[ip.String()] = entry{client: client, name: name, ip: ip, expires: time.Now().Add(leaseTime)}
+}
+
+// remove forgets the lease on ip
+func (x *exporter) remove(ip net.IP) {
+	x.mu.Lock()
+	delete(x.leases, ip.String())
+	x.mu.Unlock()
+}
+
+// dump streams the leases active at now to f: the leases stored by the pools,
+// named after what their clients last sent or the names restored at startup,
+// then the other leases seen in responses. It drops the leases that expired
+// and the names no longer needed
+func (x *exporter) dump(now time.Time, f func(entry) error) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	pooled, names, restored := make(map[string]bool), make(map[string]string), make(map[string]string)
+	for _, pools := range x.pools {
+		for _, p := range pools {
+			err := p.Dump(now, func(hwaddr net.HardwareAddr, ip net.IP, expires time.Time) error {
+				client := hwaddr.String()
+				pooled[client], pooled[ip.String()] = true, true
+				name, ok := x.names[client]
+				if ok {
+					names[client] = name
+				} else if name, ok = x.restored[ip.String()]; ok {
+					restored[ip.String()] = name
+				}
+				if name == "" {
+					return nil
+				}
+				return f(entry{client: client, name: name, ip: ip, expires: expires})
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	x.names, x.restored = names, restored
+	for ip, e := range x.leases {
+		if e.expires.Before(now) {
+			delete(x.leases, ip)
+			continue
+		}
+		// The pools know better whether their leases are active
+		if pooled[ip] || pooled[e.client] {
+			continue
+		}
+		if err := f(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush writes out the leases active at now, to the files that would change
+func (x *exporter) flush(now time.Time) error {
+	dump := func(f func(entry) error) error { return x.dump(now, f) }
+	if x.c.hostsFile != "" {
+		var b bytes.Buffer
+		if err := renderHosts(&b, dump, x.c.domain); err != nil {
+			return err
+		}
+		if err := x.write(x.c.hostsFile, b.Bytes()); err != nil {
+			return err
+		}
+	}
+	if x.c.zoneFile != "" {
+		var b bytes.Buffer
+		if err := renderZone(&b, dump, x.c.domain, x.c.ttl); err != nil {
+			return err
+		}
+		if err := x.write(x.c.zoneFile, b.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write replaces filename atomically with contents, unless it was last written
+// with the same contents. It is only called from flush, which does not run
+// concurrently: release only flushes once run returned
+func (x *exporter) write(filename string, contents []byte) error {
+	if last, ok := x.written[filename]; ok && bytes.Equal(last, contents) {
+		return nil
+	}
+	// Leave the files readable by the DNS server
+	err := atomicfile.Write(filename, 0644, func(w io.Writer) error {
+		_, err := w.Write(contents)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	x.written[filename] = contents
+	return nil
+}
+
+// run periodically writes out the leases, until the exporter is stopped
+func (x *exporter) run() {
+	defer close(x.done)
+	ticker := time.NewTicker(x.c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := x.flush(now); err != nil {
+				log.Errorf("could not export leases: %v", err)
+			}
+		case <-x.stop:
+			return
+		}
+	}
+}
+
+// fqdnName returns the first label of the name in the Client FQDN option of
+// msg, RFC4704 §4, or an empty string
+func fqdnName(msg *dhcpv6.Message) string {
+	opt := msg.Options.GetOne(dhcpv6.OptionFQDN)
+	if opt == nil {
+		return ""
+	}
+	// A flags byte, then the name in DNS wire format
+	b := opt.ToBytes()
+	if len(b) < 2 || int(b[1]) == 0 || len(b) < 2+int(b[1]) {
+		return ""
+	}
+	return string(b[2 : 2+int(b[1])])
+}
+
+func makeHandler6(x *exporter) handler.Handler6 {
+	return func(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+		msg, err := req.GetInnerMessage()
+		if err != nil {
+			log.Errorf("BUG: could not decapsulate: %v", err)
+			return nil, true
+		}
+		if msg.MessageType == dhcpv6.MessageTypeRelease {
+			for _, iana := range msg.Options.IANA() {
+				for _, addr := range iana.Options.Addresses() {
+					x.remove(addr.IPv6Addr)
+				}
+			}
+			return resp, false
+		}
+		reply, ok := resp.(*dhcpv6.Message)
+		if !ok || reply.MessageType != dhcpv6.MessageTypeReply {
+			return resp, false
+		}
+		cid := msg.Options.ClientID()
+		if cid == nil {
+			return resp, false
+		}
+		client, name := hex.EncodeToString(cid.ToBytes()), fqdnName(msg)
+		for _, iana := range reply.Options.IANA() {
+			for _, addr := range iana.Options.Addresses() {
+				if addr.ValidLifetime == 0 {
+					x.remove(addr.IPv6Addr)
+					continue
+				}
+				x.update(client, name, addr.IPv6Addr, addr.ValidLifetime)
+			}
+		}
+		return resp, false
+	}
+}
+
+func makeHandler4(x *exporter) handler.Handler4 {
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		if req.MessageType() != dhcpv4.MessageTypeRequest || resp.MessageType() != dhcpv4.MessageTypeAck {
+			return resp, false
+		}
+		if resp.YourIPAddr == nil || resp.YourIPAddr.IsUnspecified() {
+			return resp, false
+		}
+		leaseTime := resp.IPAddressLeaseTime(0)
+		if leaseTime == 0 {
+			return resp, false
+		}
+		x.update(req.ClientHWAddr.String(), req.HostName(), resp.YourIPAddr.To4(), leaseTime)
+		return resp, false
+	}
+}
+
+// validate checks the arguments of the plugin, without writing the files
+func validate(args ...string) error {
+	_, err := parseArgs(args...)
+	return err
+}
+
+func setup6(chain *plugins.Chain, args ...string) (handler.Handler6, error) {
+	log.Printf("loading `hosts_export` plugin for DHCPv6")
+	x, err := startExporter(chain, args...)
+	if err != nil {
+		return nil, err
+	}
+	return makeHandler6(x), nil
+}
+
+func setup4(chain *plugins.Chain, args ...string) (handler.Handler4, error) {
+	log.Printf("loading `hosts_export` plugin for DHCPv4")
+	x, err := startExporter(chain, args...)
+	if err != nil {
+		return nil, err
+	}
+	return makeHandler4(x), nil
+}
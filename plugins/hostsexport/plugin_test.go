@@ -0,0 +1,259 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package hostsexport
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	coreconfig "github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/plugins"
+	rangeplugin "github.com/coredhcp/coredhcp/plugins/range"
+)
+
+func TestParseArgs(t *testing.T) {
+	c, err := parseArgs("hosts=/tmp/hosts", "zone=/tmp/lan.zone", "domain=lan.", "ttl=1m", "interval=10s", "restore=10m")
+	require.NoError(t, err)
+	assert.Equal(t, &config{
+		hostsFile: "/tmp/hosts",
+		zoneFile:  "/tmp/lan.zone",
+		domain:    "lan",
+		ttl:       time.Minute,
+		interval:  10 * time.Second,
+		restore:   10 * time.Minute,
+	}, c)
+
+	for _, bad := range [][]string{
+		{},
+		{"domain=lan"},
+		{"zone=/tmp/lan.zone"},
+		{"hosts=/tmp/hosts", "ttl=0s"},
+		{"hosts=/tmp/hosts", "interval=soon"},
+		{"hosts=/tmp/hosts", "color=blue"},
+		{"hosts=/tmp/hosts", "restore=-1h"},
+		{"hosts=/tmp/lan", "zone=/tmp/./lan", "domain=lan"},
+		{"/tmp/hosts"},
+	} {
+		_, err := parseArgs(bad...)
+		assert.Error(t, err, "%v should be refused", bad)
+	}
+}
+
+// active returns the leases x would write out at now
+func active(t *testing.T, x *exporter, now time.Time) []entry {
+	entries, err := collect(func(f func(entry) error) error { return x.dump(now, f) })
+	require.NoError(t, err)
+	return entries
+}
+
+// ack4 runs a DHCPREQUEST from mac with hostname through h, answered with a
+// DHCPACK for ip
+func ack4(t *testing.T, x *exporter, mac net.HardwareAddr, hostname string, ip net.IP) {
+	mods := []dhcpv4.Modifier{dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest), dhcpv4.WithHwAddr(mac)}
+	if hostname != "" {
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptHostName(hostname)))
+	}
+	req, err := dhcpv4.New(mods...)
+	require.NoError(t, err)
+	resp, err := dhcpv4.NewReplyFromRequest(req,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeAck),
+		dhcpv4.WithYourIP(ip),
+		dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(time.Hour)),
+	)
+	require.NoError(t, err)
+	out, stop := makeHandler4(x)(req, resp)
+	assert.Equal(t, resp, out)
+	assert.False(t, stop)
+}
+
+func TestExport4(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredhcp-hosts-export")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	hosts := filepath.Join(dir, "hosts")
+
+	c, err := parseArgs("hosts="+hosts, "domain=lan")
+	require.NoError(t, err)
+	x := newExporter(c)
+	ack4(t, x, net.HardwareAddr{0x02, 0, 0, 0, 0, 1}, "Laptop", net.IPv4(192, 0, 2, 10))
+	ack4(t, x, net.HardwareAddr{0x02, 0, 0, 0, 0, 2}, "", net.IPv4(192, 0, 2, 11))
+
+	require.NoError(t, x.flush(time.Now()))
+	b, err := ioutil.ReadFile(hosts)
+	require.NoError(t, err)
+	assert.Equal(t, "# "+header+"\n192.0.2.10\tlaptop.lan laptop\n", string(b))
+
+	// Clients that stop sending a name are removed, and expired leases too
+	ack4(t, x, net.HardwareAddr{0x02, 0, 0, 0, 0, 1}, "", net.IPv4(192, 0, 2, 10))
+	ack4(t, x, net.HardwareAddr{0x02, 0, 0, 0, 0, 2}, "desktop", net.IPv4(192, 0, 2, 11))
+	assert.Len(t, active(t, x, time.Now()), 1)
+	assert.Empty(t, active(t, x, time.Now().Add(2*time.Hour)))
+	require.NoError(t, x.flush(time.Now()))
+	b, err = ioutil.ReadFile(hosts)
+	require.NoError(t, err)
+	assert.Equal(t, "# "+header+"\n", string(b))
+}
+
+// TestRelease checks that the DHCPv4 and DHCPv6 chains share an exporter, which
+// writes out the leases and is forgotten once both are closed
+func TestRelease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredhcp-hosts-export")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	hosts := filepath.Join(dir, "hosts")
+
+	chain4, chain6 := &plugins.Chain{}, &plugins.Chain{}
+	x, err := startExporter(chain4, "hosts="+hosts, "interval=1h")
+	require.NoError(t, err)
+	x6, err := startExporter(chain6, "hosts="+hosts, "interval=1h")
+	require.NoError(t, err)
+	assert.Equal(t, x, x6, "the servers should share the exporter")
+	ack4(t, x, net.HardwareAddr{0x02, 0, 0, 0, 0, 1}, "laptop", net.IPv4(192, 0, 2, 10))
+
+	require.NoError(t, chain4.Close())
+	_, err = os.Stat(hosts)
+	assert.True(t, os.IsNotExist(err), "the exporter was stopped while DHCPv6 uses it")
+
+	require.NoError(t, chain6.Close())
+	b, err := ioutil.ReadFile(hosts)
+	require.NoError(t, err)
+	assert.Equal(t, "# "+header+"\n192.0.2.10\tlaptop\n", string(b))
+	exportersMu.Lock()
+	assert.Empty(t, exporters)
+	exportersMu.Unlock()
+}
+
+func TestSharing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredhcp-hosts-export")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	hosts, zone := filepath.Join(dir, "hosts"), filepath.Join(dir, "lan.zone")
+
+	chain4, chain6 := &plugins.Chain{}, &plugins.Chain{}
+	defer chain4.Close()
+	defer chain6.Close()
+	_, err = startExporter(chain4, "hosts="+hosts, "zone="+zone, "domain=lan", "interval=1h")
+	require.NoError(t, err)
+	for _, args := range [][]string{
+		{"hosts=" + hosts, "domain=home", "interval=1h"},
+		{"hosts=" + dir + "/./hosts", "zone=" + zone, "domain=lan", "interval=1m"},
+		{"hosts=" + filepath.Join(dir, "other"), "zone=" + zone, "domain=lan", "interval=1h"},
+		{"zone=" + hosts, "domain=lan", "interval=1h"},
+	} {
+		_, err := startExporter(chain6, args...)
+		assert.Error(t, err, "%v should conflict with the DHCPv4 exporter", args)
+	}
+	_, err = startExporter(chain6, "hosts="+filepath.Join(dir, "other"), "interval=1h")
+	assert.NoError(t, err, "other files can be exported to with other settings")
+}
+
+// TestRestart checks that the names written before a restart are kept for the
+// clients that did not renew their leases since
+func TestRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredhcp-hosts-export")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	hosts, leases := filepath.Join(dir, "hosts"), filepath.Join(dir, "leases.txt")
+
+	expires := time.Now().Add(time.Hour).Format(time.RFC3339)
+	require.NoError(t, ioutil.WriteFile(leases, []byte(
+		"02:00:00:00:00:01 192.0.2.10 "+expires+"\n"+
+			"02:00:00:00:00:02 192.0.2.11 "+expires+"\n"+
+			"02:00:00:00:00:03 192.0.2.12 "+expires+"\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(hosts, []byte("# "+header+"\n"+
+		"192.0.2.10\tlaptop\n"+
+		"192.0.2.11\tandroid-0384e7\n"+
+		"192.0.2.13\tgone\n"+
+		"2001:db8::5\tnas\n"), 0644))
+
+	for _, p := range []*plugins.Plugin{&Plugin, &rangeplugin.Plugin} {
+		if _, ok := plugins.RegisteredPlugins[p.Name]; !ok {
+			require.NoError(t, plugins.RegisterPlugin(p))
+		}
+	}
+	chain4, _, err := plugins.LoadChains(&coreconfig.Config{Server4: &coreconfig.ServerConfig{
+		Plugins: []coreconfig.PluginConfig{
+			{Name: "range", Args: []string{leases, "192.0.2.10", "192.0.2.19", "1h"}},
+			{Name: "hosts_export", Args: []string{"hosts=" + hosts, "interval=1h", "restore=30m"}},
+		},
+	}})
+	require.NoError(t, err)
+	exportersMu.Lock()
+	x := exporters[hosts]
+	exportersMu.Unlock()
+	require.NotNil(t, x)
+
+	// A client renewing without a name loses it
+	ack4(t, x, net.HardwareAddr{0x02, 0, 0, 0, 0, 1}, "", net.IPv4(192, 0, 2, 10))
+	require.NoError(t, x.flush(time.Now()))
+	b, err := ioutil.ReadFile(hosts)
+	require.NoError(t, err)
+	assert.Equal(t, "# "+header+"\n"+
+		"192.0.2.11\tandroid-0384e7\n"+
+		"192.0.2.13\tgone\n"+
+		"2001:db8::5\tnas\n", string(b))
+
+	// The leases of the pool keep their names past the restore time, the
+	// others do not
+	require.NoError(t, x.flush(time.Now().Add(45*time.Minute)))
+	b, err = ioutil.ReadFile(hosts)
+	require.NoError(t, err)
+	assert.Equal(t, "# "+header+"\n192.0.2.11\tandroid-0384e7\n", string(b))
+	require.NoError(t, chain4.Close())
+}
+
+func TestExport6(t *testing.T) {
+	c, err := parseArgs("hosts=/nonexistent/hosts")
+	require.NoError(t, err)
+	x := newExporter(c)
+	h := makeHandler6(x)
+
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	solicit, err := dhcpv6.NewSolicit(mac)
+	require.NoError(t, err)
+	solicit.MessageType = dhcpv6.MessageTypeRequest
+	// Client FQDN with the S flag, for nas.example.com
+	solicit.AddOption(&dhcpv6.OptionGeneric{
+		OptionCode: dhcpv6.OptionFQDN,
+		OptionData: append([]byte{0x01, 3, 'n', 'a', 's', 7}, []byte("example\x03com\x00")...),
+	})
+	assert.Equal(t, "nas", fqdnName(solicit))
+
+	reply, err := dhcpv6.NewReplyFromMessage(solicit)
+	require.NoError(t, err)
+	addr := net.ParseIP("2001:db8::5")
+	reply.AddOption(&dhcpv6.OptIANA{
+		IaId: [4]byte{0, 0, 0, 1},
+		Options: dhcpv6.IdentityOptions{Options: []dhcpv6.Option{
+			&dhcpv6.OptIAAddress{IPv6Addr: addr, PreferredLifetime: time.Hour, ValidLifetime: time.Hour},
+		}},
+	})
+	h(solicit, reply)
+	entries := active(t, x, time.Now())
+	require.Len(t, entries, 1)
+	assert.Equal(t, "nas", entries[0].name)
+	assert.True(t, addr.Equal(entries[0].ip))
+
+	release, err := dhcpv6.NewSolicit(mac)
+	require.NoError(t, err)
+	release.MessageType = dhcpv6.MessageTypeRelease
+	release.AddOption(&dhcpv6.OptIANA{
+		IaId: [4]byte{0, 0, 0, 1},
+		Options: dhcpv6.IdentityOptions{Options: []dhcpv6.Option{
+			&dhcpv6.OptIAAddress{IPv6Addr: addr},
+		}},
+	})
+	h(release, release)
+	assert.Empty(t, active(t, x, time.Now()))
+}
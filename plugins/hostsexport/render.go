@@ -0,0 +1,217 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package hostsexport
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// entry is an active lease with a host name
+type entry struct {
+	// client identifies the client holding the lease: its hardware address
+	// in DHCPv4, its DUID in DHCPv6
+	client  string
+	name    string
+	ip      net.IP
+	expires time.Time
+}
+
+// dumpFunc streams leases to f, one at a time, and returns the first error f
+// returns
+type dumpFunc func(f func(entry) error) error
+
+// collect returns the leases dump streams, with names resolved
+func collect(dump dumpFunc) ([]entry, error) {
+	var entries []entry
+	err := dump(func(e entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resolveNames(entries), nil
+}
+
+// sanitizeName turns a host name sent by a client into a DNS label, or returns
+// an empty string if nothing usable is left. Only the first label of a fully
+// qualified name is kept
+func sanitizeName(s string) string {
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		s = s[:i]
+	}
+	var b strings.Builder
+	for _, c := range strings.ToLower(s) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-':
+			b.WriteRune(c)
+		case c == '_' || c == ' ':
+			b.WriteByte('-')
+		}
+	}
+	name := strings.Trim(b.String(), "-")
+	if len(name) > 63 {
+		name = strings.TrimRight(name[:63], "-")
+	}
+	return name
+}
+
+// shortHash returns a short, stable hash of a client identifier
+func shortHash(client string) string {
+	h := sha256.Sum256([]byte(client))
+	return hex.EncodeToString(h[:3])
+}
+
+// claim is a name in an address family. Names are only disambiguated among
+// clients of the same family: a dual-stack host is identified by its hardware
+// address in DHCPv4 and by its DUID in DHCPv6, but its A and AAAA records
+// should share a name
+type claim struct {
+	name string
+	v4   bool
+}
+
+// resolveNames returns entries sorted by name and address, with names claimed
+// by several clients of the same address family disambiguated with a hash of
+// the client identifier. The result only depends on the set of entries, not on
+// the order leases were granted in
+func resolveNames(entries []entry) []entry {
+	claims := make(map[claim]map[string]struct{})
+	for _, e := range entries {
+		c := claim{e.name, e.ip.To4() != nil}
+		if claims[c] == nil {
+			claims[c] = make(map[string]struct{})
+		}
+		claims[c][e.client] = struct{}{}
+	}
+	resolved := make([]entry, len(entries))
+	for i, e := range entries {
+		if len(claims[claim{e.name, e.ip.To4() != nil}]) > 1 {
+			// Label length limits leave room for the suffix
+			name := e.name
+			if len(name) > 56 {
+				name = name[:56]
+			}
+			e.name = name + "-" + shortHash(e.client)
+		}
+		resolved[i] = e
+	}
+	sort.Slice(resolved, func(i, j int) bool {
+		if resolved[i].name != resolved[j].name {
+			return resolved[i].name < resolved[j].name
+		}
+		return bytes.Compare(resolved[i].ip.To16(), resolved[j].ip.To16()) < 0
+	})
+	return resolved
+}
+
+const header = "Generated by coredhcp from the active leases, do not edit"
+
+// renderHosts writes the leases dump streams in the hosts(5) format. Names are
+// qualified with domain if it is not empty
+func renderHosts(w io.Writer, dump dumpFunc, domain string) error {
+	entries, err := collect(dump)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	bw.WriteString("# " + header + "\n")
+	for _, e := range entries {
+		if domain != "" {
+			fmt.Fprintf(bw, "%s\t%s.%s %s\n", e.ip, e.name, domain, e.name)
+		} else {
+			fmt.Fprintf(bw, "%s\t%s\n", e.ip, e.name)
+		}
+	}
+	return bw.Flush()
+}
+
+// renderZone writes the leases dump streams as A, AAAA and PTR records in the
+// DNS zone file format, with fully qualified names so that the fragment can be
+// included in any zone
+func renderZone(w io.Writer, dump dumpFunc, domain string, ttl time.Duration) error {
+	entries, err := collect(dump)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	bw.WriteString("; " + header + "\n")
+	secs := int64(ttl / time.Second)
+	for _, e := range entries {
+		fqdn := e.name + "." + domain + "."
+		rtype := "AAAA"
+		if e.ip.To4() != nil {
+			rtype = "A"
+		}
+		fmt.Fprintf(bw, "%s\t%d\tIN\t%s\t%s\n", fqdn, secs, rtype, e.ip)
+		fmt.Fprintf(bw, "%s\t%d\tIN\tPTR\t%s\n", reverseName(e.ip), secs, fqdn)
+	}
+	return bw.Flush()
+}
+
+// reverseName returns the name of the PTR record of ip, RFC1035 §3.5 and
+// RFC3596 §2.5
+func reverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	const digits = "0123456789abcdef"
+	var b strings.Builder
+	ip16 := ip.To16()
+	for i := len(ip16) - 1; i >= 0; i-- {
+		b.WriteByte(digits[ip16[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(digits[ip16[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa.")
+	return b.String()
+}
+
+// parseHosts returns the names by address of a hosts file written by
+// renderHosts. Lines that could not have been written are skipped
+func parseHosts(contents []byte) map[string]string {
+	names := make(map[string]string)
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		// The unqualified name comes last
+		ip, name := net.ParseIP(fields[0]), fields[len(fields)-1]
+		if ip == nil || sanitizeName(name) != name {
+			continue
+		}
+		names[ip.String()] = name
+	}
+	return names
+}
+
+// parseZone returns the names by address of the A and AAAA records of a zone
+// fragment written by renderZone for domain
+func parseZone(contents []byte, domain string) map[string]string {
+	names := make(map[string]string)
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 5 || fields[3] != "A" && fields[3] != "AAAA" {
+			continue
+		}
+		ip, name := net.ParseIP(fields[4]), strings.TrimSuffix(fields[0], "."+domain+".")
+		if ip == nil || name == fields[0] || sanitizeName(name) != name {
+			continue
+		}
+		names[ip.String()] = name
+	}
+	return names
+}
@@ -0,0 +1,121 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package hostsexport
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// goldenEntries are leases of clients with a name collision, in an order the
+// output must not depend on
+var goldenEntries = []entry{
+	{client: "02:00:00:00:00:03", name: "android", ip: net.IPv4(192, 0, 2, 12)},
+	{client: "02:00:00:00:00:01", name: "laptop", ip: net.IPv4(192, 0, 2, 10)},
+	{client: "000300010200000000aa", name: "nas", ip: net.ParseIP("2001:db8::5")},
+	{client: "02:00:00:00:00:02", name: "android", ip: net.IPv4(192, 0, 2, 11)},
+}
+
+// dumpEntries streams entries, in order
+func dumpEntries(entries []entry) dumpFunc {
+	return func(f func(entry) error) error {
+		for _, e := range entries {
+			if err := f(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func checkGolden(t *testing.T, name string, got []byte) {
+	golden := filepath.Join("testdata", name)
+	if *update {
+		require.NoError(t, ioutil.WriteFile(golden, got, 0644))
+	}
+	want, err := ioutil.ReadFile(golden)
+	require.NoError(t, err)
+	assert.Equal(t, string(want), string(got))
+}
+
+func TestRenderHosts(t *testing.T) {
+	var b bytes.Buffer
+	require.NoError(t, renderHosts(&b, dumpEntries(goldenEntries), "lan"))
+	checkGolden(t, "hosts.golden", b.Bytes())
+
+	// The output does not depend on the order of the leases
+	reversed := make([]entry, len(goldenEntries))
+	for i, e := range goldenEntries {
+		reversed[len(goldenEntries)-1-i] = e
+	}
+	var r bytes.Buffer
+	require.NoError(t, renderHosts(&r, dumpEntries(reversed), "lan"))
+	assert.Equal(t, b.String(), r.String())
+}
+
+func TestRenderZone(t *testing.T) {
+	var b bytes.Buffer
+	require.NoError(t, renderZone(&b, dumpEntries(goldenEntries), "lan", 5*time.Minute))
+	checkGolden(t, "zone.golden", b.Bytes())
+}
+
+func TestResolveNames(t *testing.T) {
+	// A client holding several addresses does not collide with itself
+	entries := resolveNames([]entry{
+		{client: "a", name: "host", ip: net.IPv4(192, 0, 2, 1)},
+		{client: "a", name: "host", ip: net.IPv4(192, 0, 2, 2)},
+	})
+	assert.Equal(t, "host", entries[0].name)
+	assert.Equal(t, "host", entries[1].name)
+
+	// Disambiguated names stay valid labels
+	long := "a123456789b123456789c123456789d123456789e123456789f123456789abc"
+	entries = resolveNames([]entry{
+		{client: "a", name: long, ip: net.IPv4(192, 0, 2, 1)},
+		{client: "b", name: long, ip: net.IPv4(192, 0, 2, 2)},
+	})
+	assert.Len(t, entries[0].name, 63)
+	assert.NotEqual(t, entries[0].name, entries[1].name)
+
+	// A dual-stack host has different identifiers in DHCPv4 and DHCPv6
+	entries = resolveNames([]entry{
+		{client: "02:00:00:00:00:01", name: "host", ip: net.IPv4(192, 0, 2, 1)},
+		{client: "000300010200000000aa", name: "host", ip: net.ParseIP("2001:db8::1")},
+	})
+	assert.Equal(t, "host", entries[0].name, "dual-stack host seen as a collision")
+	assert.Equal(t, "host", entries[1].name, "dual-stack host seen as a collision")
+}
+
+func TestSanitizeName(t *testing.T) {
+	for in, out := range map[string]string{
+		"laptop":             "laptop",
+		"Johns-iPhone":       "johns-iphone",
+		"John's iPhone":      "johns-iphone",
+		"host.example.com":   "host",
+		"-_weird_-":          "weird",
+		"../../etc/passwd":   "",
+		"":                   "",
+		"émile":              "mile",
+		"bad\nname\tin file": "badnamein-file",
+	} {
+		assert.Equal(t, out, sanitizeName(in), "sanitizing %q", in)
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	assert.Equal(t, "1.2.0.192.in-addr.arpa.", reverseName(net.IPv4(192, 0, 2, 1)))
+	assert.Equal(t, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+		reverseName(net.ParseIP("2001:db8::1")))
+}
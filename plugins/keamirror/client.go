@@ -0,0 +1,269 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package keamirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Kea control channel result codes
+const (
+	resultSuccess = 0
+	// resultEmpty is returned when deleting a lease Kea does not have
+	resultEmpty = 3
+)
+
+// result is the answer of Kea to a command
+type result struct {
+	Result int    `json:"result"`
+	Text   string `json:"text"`
+}
+
+// sender sends commands to Kea
+type sender interface {
+	send(cmd []byte) ([]byte, error)
+}
+
+// unixSender sends commands to the control socket of a Kea server
+type unixSender struct {
+	path    string
+	timeout time.Duration
+}
+
+func (u *unixSender) send(cmd []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", u.path, u.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(u.timeout)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(cmd); err != nil {
+		return nil, err
+	}
+	// Kea answers with a single JSON document, and may keep the connection
+	// open after it
+	var answer json.RawMessage
+	if err := json.NewDecoder(conn).Decode(&answer); err != nil {
+		return nil, fmt.Errorf("could not read answer: %v", err)
+	}
+	return answer, nil
+}
+
+// httpSender sends commands to a Kea Control Agent, which requires the
+// service a command is for
+type httpSender struct {
+	url                string
+	username, password string
+	client             *http.Client
+}
+
+func (h *httpSender) send(cmd []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(cmd))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.username != "" {
+		req.SetBasicAuth(h.username, h.password)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("control agent answered %s", resp.Status)
+	}
+	var answer json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return nil, fmt.Errorf("could not read answer: %v", err)
+	}
+	return answer, nil
+}
+
+// checkAnswer returns an error if Kea did not carry out a command. The
+// Control Agent answers with one result per service, Kea servers with one
+// result
+func checkAnswer(answer []byte) error {
+	var results []result
+	if bytes.HasPrefix(bytes.TrimSpace(answer), []byte("[")) {
+		if err := json.Unmarshal(answer, &results); err != nil {
+			return fmt.Errorf("invalid answer: %v", err)
+		}
+	} else {
+		var r result
+		if err := json.Unmarshal(answer, &r); err != nil {
+			return fmt.Errorf("invalid answer: %v", err)
+		}
+		results = []result{r}
+	}
+	if len(results) == 0 {
+		return errors.New("empty answer")
+	}
+	for _, r := range results {
+		if r.Result != resultSuccess && r.Result != resultEmpty {
+			return fmt.Errorf("command failed with result %d: %s", r.Result, r.Text)
+		}
+	}
+	return nil
+}
+
+// mirror sends commands to Kea in the background, so that requests are not
+// slowed down by it. Commands that cannot be sent after the given number of
+// retries, or that do not fit in the queue, are logged as dead letters
+type mirror struct {
+	sender  sender
+	service string
+	queue   chan command
+	retries int
+	// backoff is the delay before the first retry, doubled for each of the
+	// following ones
+	backoff time.Duration
+	dryRun  bool
+	// stopping is closed by close: commands are no longer retried, and once
+	// one fails the remaining ones are dead-lettered without being sent
+	stopping chan struct{}
+	// done is closed once run returned
+	done chan struct{}
+}
+
+// errStopped is the error of the commands left when the server stops, after
+// one failed
+var errStopped = errors.New("not sent before the server stopped")
+
+func newMirror(s sender, service string, size, retries int, dryRun bool) *mirror {
+	return &mirror{
+		sender:   s,
+		service:  service,
+		queue:    make(chan command, size),
+		retries:  retries,
+		backoff:  time.Second,
+		dryRun:   dryRun,
+		stopping: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// enqueue queues cmds, without blocking
+func (m *mirror) enqueue(cmds []command) {
+	for _, cmd := range cmds {
+		if m.service != "" {
+			cmd.Service = []string{m.service}
+		}
+		select {
+		case m.queue <- cmd:
+		default:
+			m.deadLetter(cmd, errors.New("queue full"))
+		}
+	}
+}
+
+// run sends the queued commands until the queue is closed
+func (m *mirror) run() {
+	defer close(m.done)
+	// failed is set once a command failed while stopping, Kea is likely down
+	failed := false
+	for cmd := range m.queue {
+		if failed {
+			m.deadLetter(cmd, errStopped)
+			continue
+		}
+		data, err := json.Marshal(cmd)
+		if err != nil {
+			log.Errorf("BUG: could not encode command: %v", err)
+			continue
+		}
+		if m.dryRun {
+			log.Infof("dry run, not sending: %s", data)
+			continue
+		}
+		if err := m.send(data); err != nil {
+			m.deadLetter(cmd, err)
+			select {
+			case <-m.stopping:
+				failed = true
+			default:
+			}
+		}
+	}
+}
+
+// close stops queueing commands, and waits for the queued ones to be sent. It
+// does not wait for retries: once a command fails, the remaining ones are
+// dead-lettered, so that the server stops within about two timeouts whether
+// or not Kea answers. No command can be enqueued afterwards
+func (m *mirror) close() error {
+	close(m.stopping)
+	close(m.queue)
+	<-m.done
+	return nil
+}
+
+// send sends a command, retrying on failures
+func (m *mirror) send(data []byte) error {
+	var err error
+	delay := m.backoff
+	for attempt := 0; ; attempt++ {
+		var answer []byte
+		answer, err = m.sender.send(data)
+		if err == nil {
+			if err = checkAnswer(answer); err == nil {
+				log.Debugf("sent %s", data)
+				return nil
+			}
+		}
+		if attempt == m.retries {
+			return err
+		}
+		log.Warningf("could not send %s, retrying in %s: %v", data, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-m.stopping:
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// deadLetter logs a command that could not be mirrored, with enough details
+// to replay it by hand
+func (m *mirror) deadLetter(cmd command, err error) {
+	data, _ := json.Marshal(cmd)
+	log.Errorf("dead letter, lease not mirrored (%v): %s", err, data)
+}
+
+// newSender returns a sender for a Kea control socket, given as
+// unix:<path>, or a Control Agent URL
+func newSender(target, username, password string, timeout time.Duration) (sender, error) {
+	switch {
+	case strings.HasPrefix(target, "unix:"):
+		path := strings.TrimPrefix(target, "unix:")
+		if path == "" {
+			return nil, errors.New("empty control socket path")
+		}
+		if username != "" {
+			return nil, errors.New("authentication is only supported through the control agent")
+		}
+		return &unixSender{path: path, timeout: timeout}, nil
+	case strings.HasPrefix(target, "http://"), strings.HasPrefix(target, "https://"):
+		return &httpSender{
+			url:      target,
+			username: username,
+			password: password,
+			client:   &http.Client{Timeout: timeout},
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid Kea target %q, expected unix:<path> or a control agent URL", target)
+	}
+}
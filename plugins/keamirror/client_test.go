@@ -0,0 +1,291 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package keamirror
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coredhcp/coredhcp/plugins"
+)
+
+var testCommand = command{
+	Command:   "lease6-del",
+	Arguments: leaseDel{IPAddress: "2001:db8::10", Type: typeNA},
+}
+
+// fakeKea is a Kea control socket answering each command with the next of
+// answers, and success once they run out
+type fakeKea struct {
+	listener net.Listener
+	received chan map[string]interface{}
+
+	mu      sync.Mutex
+	answers []string
+}
+
+func newFakeKea(t *testing.T, answers ...string) (*fakeKea, func()) {
+	dir, err := ioutil.TempDir("", "coredhcp-kea")
+	require.NoError(t, err)
+	l, err := net.Listen("unix", filepath.Join(dir, "kea.sock"))
+	require.NoError(t, err)
+	k := &fakeKea{listener: l, received: make(chan map[string]interface{}, 16), answers: answers}
+	go k.serve()
+	return k, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func (k *fakeKea) serve() {
+	for {
+		conn, err := k.listener.Accept()
+		if err != nil {
+			return
+		}
+		var cmd map[string]interface{}
+		if err := json.NewDecoder(conn).Decode(&cmd); err == nil {
+			k.received <- cmd
+			k.mu.Lock()
+			answer := `{"result": 0, "text": "Lease updated."}`
+			if len(k.answers) > 0 {
+				answer, k.answers = k.answers[0], k.answers[1:]
+			}
+			k.mu.Unlock()
+			conn.Write([]byte(answer))
+		}
+		conn.Close()
+	}
+}
+
+func (k *fakeKea) next(t *testing.T) map[string]interface{} {
+	select {
+	case cmd := <-k.received:
+		return cmd
+	case <-time.After(5 * time.Second):
+		t.Fatal("no command received")
+		return nil
+	}
+}
+
+func TestUnixSender(t *testing.T) {
+	kea, cleanup := newFakeKea(t)
+	defer cleanup()
+
+	s, err := newSender("unix:"+kea.listener.Addr().String(), "", "", time.Second)
+	require.NoError(t, err)
+	m := newMirror(s, "", 8, 0, false)
+	go m.run()
+	defer close(m.queue)
+
+	m.enqueue([]command{testCommand})
+	cmd := kea.next(t)
+	assert.Equal(t, "lease6-del", cmd["command"])
+	assert.NotContains(t, cmd, "service", "the service is implicit on a control socket")
+	assert.Equal(t, map[string]interface{}{"ip-address": "2001:db8::10", "type": "IA_NA"}, cmd["arguments"])
+}
+
+func TestHTTPSender(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "coredhcp" || password != "s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var cmd map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- cmd
+		w.Write([]byte(`[{"result": 0, "text": "Lease updated."}]`))
+	}))
+	defer srv.Close()
+
+	s, err := newSender(srv.URL, "coredhcp", "s3cr3t", time.Second)
+	require.NoError(t, err)
+	m := newMirror(s, "dhcp6", 8, 0, false)
+	cmd := testCommand
+	cmd.Service = []string{m.service}
+	data, err := json.Marshal(cmd)
+	require.NoError(t, err)
+	require.NoError(t, m.send(data))
+	got := <-received
+	assert.Equal(t, []interface{}{"dhcp6"}, got["service"])
+
+	s, err = newSender(srv.URL, "coredhcp", "wrong", time.Second)
+	require.NoError(t, err)
+	_, err = s.send(data)
+	assert.Error(t, err, "authentication failures should be errors")
+}
+
+func TestRetries(t *testing.T) {
+	kea, cleanup := newFakeKea(t,
+		`{"result": 1, "text": "database unavailable"}`,
+		`{"result": 1, "text": "database unavailable"}`,
+	)
+	defer cleanup()
+
+	s, err := newSender("unix:"+kea.listener.Addr().String(), "", "", time.Second)
+	require.NoError(t, err)
+	data, err := json.Marshal(testCommand)
+	require.NoError(t, err)
+
+	m := newMirror(s, "", 8, 2, false)
+	m.backoff = time.Millisecond
+	assert.NoError(t, m.send(data), "the command should succeed on the last retry")
+	for i := 0; i < 3; i++ {
+		kea.next(t)
+	}
+
+	kea.mu.Lock()
+	kea.answers = []string{`{"result": 1, "text": "error"}`, `{"result": 1, "text": "error"}`}
+	kea.mu.Unlock()
+	m.retries = 1
+	assert.Error(t, m.send(data), "the command should fail once the retries are exhausted")
+	kea.next(t)
+	kea.next(t)
+	select {
+	case <-kea.received:
+		t.Error("the command was retried too many times")
+	default:
+	}
+}
+
+type countingSender struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (c *countingSender) send([]byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	return nil, errors.New("not sent")
+}
+
+func TestDryRun(t *testing.T) {
+	s := &countingSender{}
+	m := newMirror(s, "", 8, 0, true)
+	m.enqueue([]command{testCommand, testCommand})
+	close(m.queue)
+	m.run()
+	assert.Equal(t, 0, s.calls)
+}
+
+// TestCloseUnreachable checks that closing the mirror does not wait for the
+// retries of the queued commands when Kea cannot be reached
+func TestCloseUnreachable(t *testing.T) {
+	s := &countingSender{}
+	m := newMirror(s, "", 8, 3, false)
+	m.backoff = time.Hour
+	go m.run()
+	m.enqueue([]command{testCommand, testCommand, testCommand, testCommand})
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.calls > 0
+	}, time.Second, time.Millisecond, "the first command was not sent")
+
+	closed := make(chan error)
+	go func() { closed <- m.close() }()
+	select {
+	case err := <-closed:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("close waited for the retries")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.Equal(t, 1, s.calls, "commands were sent after one failed while stopping")
+}
+
+func TestQueueFull(t *testing.T) {
+	m := newMirror(&countingSender{}, "", 1, 0, false)
+	// Nothing runs the queue: the second command is dropped
+	m.enqueue([]command{testCommand, testCommand})
+	assert.Len(t, m.queue, 1)
+}
+
+// TestCloseDrains checks that closing the chain sends the queued commands, and
+// stops the mirror
+func TestCloseDrains(t *testing.T) {
+	kea, cleanup := newFakeKea(t)
+	defer cleanup()
+
+	c, err := parseArgs("unix:" + kea.listener.Addr().String())
+	require.NoError(t, err)
+	chain := &plugins.Chain{}
+	m, err := c.start(chain, "dhcp6")
+	require.NoError(t, err)
+	m.enqueue([]command{testCommand, testCommand, testCommand})
+	require.NoError(t, chain.Close())
+
+	assert.Len(t, kea.received, 3, "the queued commands were not sent")
+	select {
+	case <-m.done:
+	default:
+		t.Error("the mirror is still running")
+	}
+}
+
+func TestCheckAnswer(t *testing.T) {
+	assert.NoError(t, checkAnswer([]byte(`{"result": 0, "text": "ok"}`)))
+	assert.NoError(t, checkAnswer([]byte(`[{"result": 0}]`)))
+	assert.NoError(t, checkAnswer([]byte(`{"result": 3, "text": "IPv6 lease not found."}`)), "deleting a missing lease is not an error")
+	assert.Error(t, checkAnswer([]byte(`{"result": 1, "text": "error"}`)))
+	assert.Error(t, checkAnswer([]byte(`[{"result": 0}, {"result": 2}]`)))
+	assert.Error(t, checkAnswer([]byte(`[]`)))
+	assert.Error(t, checkAnswer([]byte(`not json`)))
+}
+
+func TestParseArgs(t *testing.T) {
+	c, err := parseArgs("http://127.0.0.1:8000/", "user=coredhcp", "password=s3cr3t", "subnet=1", "retries=0", "dry_run=true")
+	require.NoError(t, err)
+	assert.Equal(t, &config{
+		target:   "http://127.0.0.1:8000/",
+		username: "coredhcp",
+		password: "s3cr3t",
+		subnetID: 1,
+		timeout:  5 * time.Second,
+		retries:  0,
+		queue:    1024,
+		dryRun:   true,
+	}, c)
+
+	for _, args := range [][]string{
+		{},
+		{"unix:/run/kea.sock", "subnet=0"},
+		{"unix:/run/kea.sock", "timeout=0s"},
+		{"unix:/run/kea.sock", "retries=-1"},
+		{"unix:/run/kea.sock", "queue=0"},
+		{"unix:/run/kea.sock", "dry_run=maybe"},
+		{"unix:/run/kea.sock", "password=s3cr3t"},
+		{"unix:/run/kea.sock", "ttl=1m"},
+		{"unix:/run/kea.sock", "dry_run"},
+	} {
+		_, err := parseArgs(args...)
+		assert.Error(t, err, args)
+	}
+
+	for _, target := range []string{"unix:", "kea.sock", "tcp://127.0.0.1:8000"} {
+		_, err := newSender(target, "", "", time.Second)
+		assert.Error(t, err, target)
+	}
+	_, err = newSender("unix:/run/kea.sock", "coredhcp", "s3cr3t", time.Second)
+	assert.Error(t, err, "authentication needs the control agent")
+}
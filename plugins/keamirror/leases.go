@@ -0,0 +1,242 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package keamirror
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// command is a Kea control channel command
+type command struct {
+	Command string `json:"command"`
+	// Service is only needed through the Kea Control Agent
+	Service   []string    `json:"service,omitempty"`
+	Arguments interface{} `json:"arguments"`
+}
+
+// lease4 is the argument of lease4-update
+type lease4 struct {
+	IPAddress   string `json:"ip-address"`
+	HWAddress   string `json:"hw-address"`
+	ValidLft    uint32 `json:"valid-lft"`
+	SubnetID    uint32 `json:"subnet-id,omitempty"`
+	ForceCreate bool   `json:"force-create"`
+}
+
+// lease6 is the argument of lease6-update
+type lease6 struct {
+	IPAddress    string `json:"ip-address"`
+	Type         string `json:"type"`
+	PrefixLen    int    `json:"prefix-len,omitempty"`
+	DUID         string `json:"duid"`
+	IAID         uint32 `json:"iaid"`
+	ValidLft     uint32 `json:"valid-lft"`
+	PreferredLft uint32 `json:"preferred-lft"`
+	SubnetID     uint32 `json:"subnet-id,omitempty"`
+	ForceCreate  bool   `json:"force-create"`
+}
+
+// leaseDel is the argument of lease4-del and lease6-del
+type leaseDel struct {
+	IPAddress string `json:"ip-address"`
+	Type      string `json:"type,omitempty"`
+}
+
+// leaseDelByID is the argument of lease6-del for the lease of a client's IA,
+// whatever its address
+type leaseDelByID struct {
+	IdentifierType string `json:"identifier-type"`
+	Identifier     string `json:"identifier"`
+	IAID           uint32 `json:"iaid"`
+	Type           string `json:"type"`
+	SubnetID       uint32 `json:"subnet-id"`
+}
+
+// Lease types of Kea
+const (
+	typeNA = "IA_NA"
+	typePD = "IA_PD"
+)
+
+// hexString formats b as colon-separated hexadecimal, as Kea does for DUIDs
+func hexString(b []byte) string {
+	return net.HardwareAddr(b).String()
+}
+
+func seconds(d time.Duration) uint32 {
+	return uint32(d / time.Second)
+}
+
+// commands4 returns the commands mirroring the lease granted by resp, if it
+// is a DHCPACK for a lease
+func commands4(req, resp *dhcpv4.DHCPv4, subnetID uint32) []command {
+	if req.MessageType() != dhcpv4.MessageTypeRequest || resp.MessageType() != dhcpv4.MessageTypeAck {
+		return nil
+	}
+	if resp.YourIPAddr == nil || resp.YourIPAddr.IsUnspecified() {
+		// A DHCPACK to a DHCPINFORM, or to a client renewing an address
+		// the server does not manage
+		return nil
+	}
+	leaseTime := resp.IPAddressLeaseTime(0)
+	if leaseTime == 0 {
+		return nil
+	}
+	return []command{{
+		Command: "lease4-update",
+		Arguments: lease4{
+			IPAddress:   resp.YourIPAddr.String(),
+			HWAddress:   req.ClientHWAddr.String(),
+			ValidLft:    seconds(leaseTime),
+			SubnetID:    subnetID,
+			ForceCreate: true,
+		},
+	}}
+}
+
+// commands6 returns the commands mirroring the leases granted by resp, or
+// released by req
+func commands6(msg *dhcpv6.Message, resp dhcpv6.DHCPv6, subnetID uint32) []command {
+	if msg.MessageType == dhcpv6.MessageTypeRelease {
+		return releases6(msg, resp, subnetID)
+	}
+	switch msg.MessageType {
+	case dhcpv6.MessageTypeSolicit, dhcpv6.MessageTypeRequest,
+		dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind:
+	default:
+		return nil
+	}
+	reply, ok := resp.(*dhcpv6.Message)
+	if !ok || reply.MessageType != dhcpv6.MessageTypeReply {
+		// Advertisements grant no lease
+		return nil
+	}
+	cid := msg.Options.ClientID()
+	if cid == nil {
+		return nil
+	}
+	duid := hexString(cid.ToBytes())
+
+	var cmds []command
+	for _, iana := range reply.Options.IANA() {
+		iaid := binary.BigEndian.Uint32(iana.IaId[:])
+		for _, addr := range iana.Options.Addresses() {
+			if addr.ValidLifetime == 0 {
+				cmds = append(cmds, command{
+					Command:   "lease6-del",
+					Arguments: leaseDel{IPAddress: addr.IPv6Addr.String(), Type: typeNA},
+				})
+				continue
+			}
+			cmds = append(cmds, command{
+				Command: "lease6-update",
+				Arguments: lease6{
+					IPAddress:    addr.IPv6Addr.String(),
+					Type:         typeNA,
+					DUID:         duid,
+					IAID:         iaid,
+					ValidLft:     seconds(addr.ValidLifetime),
+					PreferredLft: seconds(addr.PreferredLifetime),
+					SubnetID:     subnetID,
+					ForceCreate:  true,
+				},
+			})
+		}
+	}
+	for _, iapd := range reply.Options.IAPD() {
+		iaid := binary.BigEndian.Uint32(iapd.IaId[:])
+		for _, prefix := range iapd.Options.Prefixes() {
+			if prefix.Prefix == nil {
+				continue
+			}
+			if prefix.ValidLifetime == 0 {
+				cmds = append(cmds, command{
+					Command:   "lease6-del",
+					Arguments: leaseDel{IPAddress: prefix.Prefix.IP.String(), Type: typePD},
+				})
+				continue
+			}
+			ones, _ := prefix.Prefix.Mask.Size()
+			cmds = append(cmds, command{
+				Command: "lease6-update",
+				Arguments: lease6{
+					IPAddress:    prefix.Prefix.IP.String(),
+					Type:         typePD,
+					PrefixLen:    ones,
+					DUID:         duid,
+					IAID:         iaid,
+					ValidLft:     seconds(prefix.ValidLifetime),
+					PreferredLft: seconds(prefix.PreferredLifetime),
+					SubnetID:     subnetID,
+					ForceCreate:  true,
+				},
+			})
+		}
+	}
+	return cmds
+}
+
+// releases6 returns the commands deleting the leases a client releases.
+// Leases are deleted by the DUID and IAID of the client rather than by
+// address, so Kea only removes leases the sender owns, and only for the IAs
+// the server did not answer with NoBinding. This needs the subnet ID, without
+// which released leases are left to expire in Kea
+func releases6(msg *dhcpv6.Message, resp dhcpv6.DHCPv6, subnetID uint32) []command {
+	reply, ok := resp.(*dhcpv6.Message)
+	if !ok || reply.MessageType != dhcpv6.MessageTypeReply || subnetID == 0 {
+		return nil
+	}
+	if status := reply.Options.Status(); status != nil && status.StatusCode != iana.StatusSuccess {
+		return nil
+	}
+	cid := msg.Options.ClientID()
+	if cid == nil {
+		return nil
+	}
+	// IAs are identified by their type and IAID, and rejected when the reply
+	// has a status other than success for them
+	rejected := make(map[string]bool)
+	for _, ia := range reply.Options.IANA() {
+		if status := ia.Options.Status(); status != nil && status.StatusCode != iana.StatusSuccess {
+			rejected[typeNA+string(ia.IaId[:])] = true
+		}
+	}
+	for _, ia := range reply.Options.IAPD() {
+		if status := ia.Options.Status(); status != nil && status.StatusCode != iana.StatusSuccess {
+			rejected[typePD+string(ia.IaId[:])] = true
+		}
+	}
+	del := func(leaseType string, iaid [4]byte) command {
+		return command{
+			Command: "lease6-del",
+			Arguments: leaseDelByID{
+				IdentifierType: "duid",
+				Identifier:     hexString(cid.ToBytes()),
+				IAID:           binary.BigEndian.Uint32(iaid[:]),
+				Type:           leaseType,
+				SubnetID:       subnetID,
+			},
+		}
+	}
+
+	var cmds []command
+	for _, ia := range msg.Options.IANA() {
+		if !rejected[typeNA+string(ia.IaId[:])] {
+			cmds = append(cmds, del(typeNA, ia.IaId))
+		}
+	}
+	for _, ia := range msg.Options.IAPD() {
+		if !rejected[typePD+string(ia.IaId[:])] {
+			cmds = append(cmds, del(typePD, ia.IaId))
+		}
+	}
+	return cmds
+}
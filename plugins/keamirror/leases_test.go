@@ -0,0 +1,160 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package keamirror
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coredhcp/coredhcp/internal/testpackets"
+)
+
+func marshal(t *testing.T, cmds []command) []string {
+	var out []string
+	for _, cmd := range cmds {
+		data, err := json.Marshal(cmd)
+		require.NoError(t, err)
+		out = append(out, string(data))
+	}
+	return out
+}
+
+func TestCommands4(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	req, _ := testpackets.V4RequestSelecting(t, mac, net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 10))
+	resp, err := dhcpv4.NewReplyFromRequest(req,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeAck),
+		dhcpv4.WithYourIP(net.IPv4(192, 0, 2, 10)),
+		dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(time.Hour)),
+	)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		`{"command":"lease4-update","arguments":{"ip-address":"192.0.2.10","hw-address":"02:00:00:00:00:01","valid-lft":3600,"subnet-id":7,"force-create":true}}`,
+	}, marshal(t, commands4(req, resp, 7)))
+	assert.Equal(t, []string{
+		`{"command":"lease4-update","arguments":{"ip-address":"192.0.2.10","hw-address":"02:00:00:00:00:01","valid-lft":3600,"force-create":true}}`,
+	}, marshal(t, commands4(req, resp, 0)), "subnet-id should be left to Kea")
+
+	resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeNak))
+	assert.Empty(t, commands4(req, resp, 0), "DHCPNAKs grant no lease")
+
+	discover, _ := testpackets.V4Discover(t, mac)
+	resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer))
+	assert.Empty(t, commands4(discover, resp, 0), "offers grant no lease")
+}
+
+// reply6 returns a Reply to msg, with an address in an IA_NA and a prefix in an
+// IA_PD, with the given valid lifetime
+func reply6(t *testing.T, msg *dhcpv6.Message, valid time.Duration) *dhcpv6.Message {
+	resp, err := dhcpv6.NewReplyFromMessage(msg)
+	require.NoError(t, err)
+	resp.AddOption(&dhcpv6.OptIANA{
+		IaId: [4]byte{0, 0, 0, 1},
+		Options: dhcpv6.IdentityOptions{Options: []dhcpv6.Option{
+			&dhcpv6.OptIAAddress{
+				IPv6Addr:          net.ParseIP("2001:db8::10"),
+				PreferredLifetime: valid / 2,
+				ValidLifetime:     valid,
+			},
+		}},
+	})
+	resp.AddOption(&dhcpv6.OptIAPD{
+		IaId: [4]byte{0, 0, 0, 2},
+		Options: dhcpv6.PDOptions{Options: []dhcpv6.Option{
+			&dhcpv6.OptIAPrefix{
+				PreferredLifetime: valid / 2,
+				ValidLifetime:     valid,
+				Prefix: &net.IPNet{
+					IP:   net.ParseIP("2001:db8:1:100::"),
+					Mask: net.CIDRMask(56, 128),
+				},
+			},
+		}},
+	})
+	return resp
+}
+
+// request6 returns a Request for an IA_NA and an IA_PD
+func request6(t *testing.T) *dhcpv6.Message {
+	req, _ := testpackets.V6SolicitWithIANAandIAPD(t, net.HardwareAddr{0x02, 0, 0, 0, 0, 1})
+	req.MessageType = dhcpv6.MessageTypeRequest
+	return req
+}
+
+func TestCommands6(t *testing.T) {
+	req := request6(t)
+	duid := hexString(req.Options.ClientID().ToBytes())
+
+	assert.Equal(t, []string{
+		`{"command":"lease6-update","arguments":{"ip-address":"2001:db8::10","type":"IA_NA","duid":"` + duid + `","iaid":1,"valid-lft":3600,"preferred-lft":1800,"force-create":true}}`,
+		`{"command":"lease6-update","arguments":{"ip-address":"2001:db8:1:100::","type":"IA_PD","prefix-len":56,"duid":"` + duid + `","iaid":2,"valid-lft":3600,"preferred-lft":1800,"force-create":true}}`,
+	}, marshal(t, commands6(req, reply6(t, req, time.Hour), 0)))
+
+	assert.Equal(t, []string{
+		`{"command":"lease6-del","arguments":{"ip-address":"2001:db8::10","type":"IA_NA"}}`,
+		`{"command":"lease6-del","arguments":{"ip-address":"2001:db8:1:100::","type":"IA_PD"}}`,
+	}, marshal(t, commands6(req, reply6(t, req, 0), 0)), "leases with a zero valid lifetime should be deleted")
+
+	solicit, _ := testpackets.V6SolicitWithIANAandIAPD(t, nil)
+	advertise, err := dhcpv6.NewAdvertiseFromSolicit(solicit)
+	require.NoError(t, err)
+	assert.Empty(t, commands6(solicit, advertise, 0), "advertisements grant no lease")
+}
+
+func TestCommands6Release(t *testing.T) {
+	release := reply6(t, request6(t), time.Hour)
+	release.MessageType = dhcpv6.MessageTypeRelease
+	resp, err := dhcpv6.NewReplyFromMessage(release)
+	require.NoError(t, err)
+	duid := hexString(release.Options.ClientID().ToBytes())
+
+	assert.Equal(t, []string{
+		`{"command":"lease6-del","arguments":{"identifier-type":"duid","identifier":"` + duid + `","iaid":1,"type":"IA_NA","subnet-id":7}}`,
+		`{"command":"lease6-del","arguments":{"identifier-type":"duid","identifier":"` + duid + `","iaid":2,"type":"IA_PD","subnet-id":7}}`,
+	}, marshal(t, commands6(release, resp, 7)))
+	assert.Empty(t, commands6(release, resp, 0), "releases cannot be mirrored without a subnet")
+
+	resp.AddOption(&dhcpv6.OptIAPD{
+		IaId:    [4]byte{0, 0, 0, 2},
+		Options: dhcpv6.PDOptions{Options: []dhcpv6.Option{&dhcpv6.OptStatusCode{StatusCode: iana.StatusNoBinding}}},
+	})
+	assert.Equal(t, []string{
+		`{"command":"lease6-del","arguments":{"identifier-type":"duid","identifier":"` + duid + `","iaid":1,"type":"IA_NA","subnet-id":7}}`,
+	}, marshal(t, commands6(release, resp, 7)), "IAs without a binding should not be deleted")
+
+	resp.AddOption(&dhcpv6.OptStatusCode{StatusCode: iana.StatusUnspecFail})
+	assert.Empty(t, commands6(release, resp, 7), "failed releases should not be mirrored")
+}
+
+func TestCommands6ReleaseNotOwner(t *testing.T) {
+	// Another client releases the address of the owner of request6
+	release := reply6(t, request6(t), time.Hour)
+	release.MessageType = dhcpv6.MessageTypeRelease
+	other := dhcpv6.Duid{
+		Type:          dhcpv6.DUID_LL,
+		HwType:        iana.HWTypeEthernet,
+		LinkLayerAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+	}
+	release.UpdateOption(dhcpv6.OptClientID(other))
+	resp, err := dhcpv6.NewReplyFromMessage(release)
+	require.NoError(t, err)
+
+	cmds := commands6(release, resp, 7)
+	require.Len(t, cmds, 2)
+	for _, cmd := range cmds {
+		del, ok := cmd.Arguments.(leaseDelByID)
+		require.True(t, ok, "releases should not delete leases by address: %+v", cmd.Arguments)
+		assert.Equal(t, hexString(other.ToBytes()), del.Identifier, "only the leases of the sender should be deleted")
+	}
+}
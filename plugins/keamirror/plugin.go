@@ -0,0 +1,212 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package keamirror
+
+// This plugin mirrors the leases granted by coredhcp into a running Kea
+// server, so that during a migration either server can answer a client with
+// the same state. Mirroring is one-way: coredhcp is the source of truth, and
+// leases are only ever written to Kea.
+//
+// Example configuration:
+//
+// server4:
+//   plugins:
+//     - server_id: 10.10.10.1
+//     - range: leases.txt 10.10.10.100 10.10.10.200 60s
+//     - kea_mirror: http://127.0.0.1:8000/ user=coredhcp password=s3cr3t subnet=1
+//
+// The first argument is where to send the Kea control commands: the control
+// socket of the Kea server, as unix:<path>, or the URL of a Kea Control Agent.
+// It is followed by optional settings:
+//   - user and password: HTTP basic authentication for the Control Agent
+//   - subnet: the Kea subnet ID of the leases; by default Kea selects the
+//     subnet from the address
+//   - timeout: how long to wait for Kea (default 5s)
+//   - retries: how many times to retry a failed command, with an exponential
+//     backoff from 1s (default 3)
+//   - queue: how many commands can wait to be sent (default 1024)
+//   - dry_run: with dry_run=true, commands are logged instead of sent
+//
+// Each lease in a DHCPACK or in a DHCPv6 Reply, including delegated prefixes,
+// is sent as a lease4-update or lease6-update command creating it if needed.
+// Leases given a valid lifetime of 0 are deleted with lease6-del. Leases
+// released by DHCPv6 clients are deleted by DUID and IAID, so that a client
+// can only release its own leases, which needs the subnet setting. Commands
+// are sent in the background; those that still fail after the retries, or do
+// not fit in the queue, are logged as dead letters with the command, so they
+// can be replayed. The queued commands are sent before the server stops,
+// without retries; if one fails, the rest are logged as dead letters.
+//
+// The plugin only sees the responses of the plugins before it, so it must come
+// last. Requests answered by a plugin that ends the chain, such as file, are
+// not mirrored.
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger("plugins/kea_mirror")
+
+// Plugin wraps plugin registration information
+var Plugin = plugins.Plugin{
+	Name:        "kea_mirror",
+	ChainSetup6: setup6,
+	ChainSetup4: setup4,
+	Validate6:   validate,
+	Validate4:   validate,
+	// Mirror the final leases, after the plugins granting them or changing
+	// their lifetimes
+	RunsAfter: []string{"file", "lease_time", "prefix", "range"},
+}
+
+type config struct {
+	target             string
+	username, password string
+	subnetID           uint32
+	timeout            time.Duration
+	retries            int
+	queue              int
+	dryRun             bool
+}
+
+func parseArgs(args ...string) (*config, error) {
+	if len(args) < 1 {
+		return nil, plugins.ArgErrorf("target", "need the Kea control socket or control agent URL")
+	}
+	c := &config{
+		target:  args[0],
+		timeout: 5 * time.Second,
+		retries: 3,
+		queue:   1024,
+	}
+	for _, arg := range args[1:] {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, plugins.ArgErrorf(arg, "expected key=value")
+		}
+		var err error
+		switch kv[0] {
+		case "user":
+			c.username = kv[1]
+		case "password":
+			c.password = kv[1]
+		case "subnet":
+			var id uint64
+			id, err = strconv.ParseUint(kv[1], 10, 32)
+			if err != nil || id == 0 {
+				return nil, plugins.ArgErrorf("subnet", "invalid subnet ID %q", kv[1])
+			}
+			c.subnetID = uint32(id)
+		case "timeout":
+			c.timeout, err = time.ParseDuration(kv[1])
+			if err != nil || c.timeout <= 0 {
+				return nil, plugins.ArgErrorf("timeout", "%q is not a positive duration", kv[1])
+			}
+		case "retries":
+			c.retries, err = strconv.Atoi(kv[1])
+			if err != nil || c.retries < 0 {
+				return nil, plugins.ArgErrorf("retries", "invalid number of retries %q", kv[1])
+			}
+		case "queue":
+			c.queue, err = strconv.Atoi(kv[1])
+			if err != nil || c.queue < 1 {
+				return nil, plugins.ArgErrorf("queue", "invalid queue size %q", kv[1])
+			}
+		case "dry_run":
+			c.dryRun, err = strconv.ParseBool(kv[1])
+			if err != nil {
+				return nil, plugins.ArgErrorf("dry_run", "%q is not true or false", kv[1])
+			}
+		default:
+			return nil, plugins.ArgErrorf(kv[0], "unknown setting")
+		}
+	}
+	if c.password != "" && c.username == "" {
+		return nil, plugins.ArgErrorf("password", "needs a user")
+	}
+	return c, nil
+}
+
+// start returns a mirror sending commands as configured by c, for the given
+// Kea service, and starts it. The mirror is stopped when chain is closed
+func (c *config) start(chain *plugins.Chain, service string) (*mirror, error) {
+	s, err := newSender(c.target, c.username, c.password, c.timeout)
+	if err != nil {
+		return nil, plugins.ArgErrorf("target", "%v", err)
+	}
+	if _, ok := s.(*httpSender); !ok {
+		// The server behind a control socket is implicit
+		service = ""
+	}
+	m := newMirror(s, service, c.queue, c.retries, c.dryRun)
+	go m.run()
+	chain.OnClose(m.close)
+	return m, nil
+}
+
+func makeHandler6(m *mirror, subnetID uint32) handler.Handler6 {
+	return func(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+		msg, err := req.GetInnerMessage()
+		if err != nil {
+			log.Errorf("BUG: could not decapsulate: %v", err)
+			return nil, true
+		}
+		m.enqueue(commands6(msg, resp, subnetID))
+		return resp, false
+	}
+}
+
+func makeHandler4(m *mirror, subnetID uint32) handler.Handler4 {
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		m.enqueue(commands4(req, resp, subnetID))
+		return resp, false
+	}
+}
+
+// validate checks the arguments of the plugin, without connecting to Kea
+func validate(args ...string) error {
+	c, err := parseArgs(args...)
+	if err != nil {
+		return err
+	}
+	if _, err := newSender(c.target, c.username, c.password, c.timeout); err != nil {
+		return plugins.ArgErrorf("target", "%v", err)
+	}
+	return nil
+}
+
+func setup6(chain *plugins.Chain, args ...string) (handler.Handler6, error) {
+	log.Printf("loading `kea_mirror` plugin for DHCPv6")
+	c, err := parseArgs(args...)
+	if err != nil {
+		return nil, err
+	}
+	m, err := c.start(chain, "dhcp6")
+	if err != nil {
+		return nil, err
+	}
+	return makeHandler6(m, c.subnetID), nil
+}
+
+func setup4(chain *plugins.Chain, args ...string) (handler.Handler4, error) {
+	log.Printf("loading `kea_mirror` plugin for DHCPv4")
+	c, err := parseArgs(args...)
+	if err != nil {
+		return nil, err
+	}
+	m, err := c.start(chain, "dhcp4")
+	if err != nil {
+		return nil, err
+	}
+	return makeHandler4(m, c.subnetID), nil
+}
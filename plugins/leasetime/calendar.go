@@ -0,0 +1,103 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasetime
+
+import (
+	"strings"
+	"time"
+
+	"github.com/coredhcp/coredhcp/plugins"
+)
+
+// calendarRule makes leases expire at a fixed wall-clock time, every day or
+// on a given day of the week
+type calendarRule struct {
+	hour, minute int
+	// weekday is only used if weekly is true
+	weekday time.Weekday
+	weekly  bool
+	loc     *time.Location
+	// minLease is the shortest lease to give out. A request arriving closer
+	// than this to a boundary gets a lease until the following one
+	minLease time.Duration
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// parseCalendarRule parses the arguments following "until":
+// <HH:MM> [on <weekday>] [in <timezone>] [min <duration>]
+func parseCalendarRule(args []string) (*calendarRule, error) {
+	if len(args) < 1 {
+		return nil, plugins.ArgErrorf("until", "missing time of day")
+	}
+	t, err := time.Parse("15:04", args[0])
+	if err != nil {
+		return nil, plugins.ArgErrorf("until", "invalid time of day %q, expected HH:MM", args[0])
+	}
+	r := calendarRule{hour: t.Hour(), minute: t.Minute(), loc: time.Local}
+
+	for rest := args[1:]; len(rest) > 0; rest = rest[2:] {
+		if len(rest) < 2 {
+			return nil, plugins.ArgErrorf(rest[0], "missing value")
+		}
+		switch kw, val := rest[0], rest[1]; kw {
+		case "on":
+			wd, ok := weekdays[strings.ToLower(val)]
+			if !ok {
+				return nil, plugins.ArgErrorf("on", "invalid day of the week %q", val)
+			}
+			r.weekday, r.weekly = wd, true
+		case "in":
+			r.loc, err = time.LoadLocation(val)
+			if err != nil {
+				return nil, plugins.ArgErrorf("in", "invalid timezone %q: %v", val, err)
+			}
+		case "min":
+			r.minLease, err = time.ParseDuration(val)
+			if err != nil || r.minLease < 0 {
+				return nil, plugins.ArgErrorf("min", "invalid minimum lease time %q", val)
+			}
+		default:
+			return nil, plugins.ArgErrorf(kw, "unknown keyword, expected on, in or min")
+		}
+	}
+	return &r, nil
+}
+
+// next returns the first boundary strictly after now
+func (r *calendarRule) next(now time.Time) time.Time {
+	now = now.In(r.loc)
+	// Build the boundary from the calendar date rather than adding durations,
+	// so that it stays at the same wall-clock time across DST changes
+	for days := 0; ; days++ {
+		b := time.Date(now.Year(), now.Month(), now.Day()+days, r.hour, r.minute, 0, 0, r.loc)
+		if b.After(now) && (!r.weekly || b.Weekday() == r.weekday) {
+			return b
+		}
+	}
+}
+
+// expiry returns the boundary a lease granted at now expires at
+func (r *calendarRule) expiry(now time.Time) time.Time {
+	b := r.next(now)
+	if b.Sub(now) < r.minLease {
+		b = r.next(b)
+	}
+	return b
+}
+
+// leaseTime returns the lease time for a request received at now
+func (r *calendarRule) leaseTime(now time.Time) time.Duration {
+	// Whole seconds, as in option 51, without going past the boundary
+	return r.expiry(now).Sub(now).Truncate(time.Second)
+}
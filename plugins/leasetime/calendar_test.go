@@ -0,0 +1,109 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasetime
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustRule(t *testing.T, rule string) *calendarRule {
+	r, err := parseCalendarRule(strings.Fields(rule))
+	if err != nil {
+		t.Skipf("Could not parse rule %q (missing timezone data?): %v", rule, err)
+	}
+	return r
+}
+
+func TestCalendarLeaseTime(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skipf("Timezone data not available: %v", err)
+	}
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04:05", s, paris)
+		require.NoError(t, err)
+		return tm
+	}
+
+	for _, tc := range []struct {
+		rule string
+		now  string
+		want time.Duration
+	}{
+		// Same day, and the next day once the boundary is passed
+		{"18:00 in Europe/Paris", "2021-03-10 09:00:00", 9 * time.Hour},
+		{"18:00 in Europe/Paris", "2021-03-10 18:00:00", 24 * time.Hour},
+		{"18:00 in Europe/Paris", "2021-03-10 17:59:30", 30 * time.Second},
+		// Minutes before the boundary, the minimum pushes to the next one
+		{"18:00 in Europe/Paris min 30m", "2021-03-10 17:57:00", 24*time.Hour + 3*time.Minute},
+		{"18:00 in Europe/Paris min 30m", "2021-03-10 17:30:00", 30 * time.Minute},
+		// DST starts on 2021-03-28 at 02:00 and ends on 2021-10-31 at 03:00
+		{"18:00 in Europe/Paris", "2021-03-27 19:00:00", 22 * time.Hour},
+		{"18:00 in Europe/Paris", "2021-10-30 19:00:00", 24 * time.Hour},
+		{"03:00 in Europe/Paris", "2021-03-28 01:00:00", time.Hour},
+		// Weekly boundaries: Sunday 2021-03-14 at midnight
+		{"00:00 on Monday in Europe/Paris", "2021-03-10 12:00:00", 4*24*time.Hour + 12*time.Hour},
+		{"00:00 on Monday in Europe/Paris", "2021-03-15 00:00:00", 7 * 24 * time.Hour},
+		{"00:00 on monday in Europe/Paris min 24h", "2021-03-14 12:00:00", 7*24*time.Hour + 12*time.Hour},
+		// The week containing the DST change is one hour shorter
+		{"00:00 on Monday in Europe/Paris", "2021-03-22 00:00:00", 7*24*time.Hour - time.Hour},
+	} {
+		r := mustRule(t, tc.rule)
+		assert.Equal(t, tc.want, r.leaseTime(at(tc.now)), "%s at %s", tc.rule, tc.now)
+	}
+}
+
+func TestParseCalendarRule(t *testing.T) {
+	for _, bad := range []string{
+		"",
+		"25:00",
+		"6pm",
+		"18:00 on Someday",
+		"18:00 in Nowhere/Atlantis",
+		"18:00 min soon",
+		"18:00 min",
+		"18:00 at noon",
+	} {
+		_, err := parseCalendarRule(strings.Fields(bad))
+		assert.Error(t, err, "rule %q should be refused", bad)
+	}
+}
+
+func TestCalendarHandler(t *testing.T) {
+	r := mustRule(t, "18:00 in UTC")
+	now := func() time.Time { return time.Date(2021, 3, 10, 17, 0, 0, 0, time.UTC) }
+	h := makeCalendarHandler4(r, now)
+
+	req, err := dhcpv4.New()
+	require.NoError(t, err)
+	resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(dhcpv4.MessageTypeAck))
+	require.NoError(t, err)
+	result, stop := h(req, resp)
+	require.NotNil(t, result)
+	assert.False(t, stop)
+	assert.Equal(t, time.Hour, result.IPAddressLeaseTime(0))
+
+	// A shorter lease time set by an earlier plugin is kept
+	resp.Options.Update(dhcpv4.OptIPAddressLeaseTime(time.Minute))
+	result, _ = h(req, resp)
+	assert.Equal(t, time.Minute, result.IPAddressLeaseTime(0))
+
+	// A longer one, such as that of range, is cut at the boundary
+	resp.Options.Update(dhcpv4.OptIPAddressLeaseTime(24 * time.Hour))
+	result, _ = h(req, resp)
+	assert.Equal(t, time.Hour, result.IPAddressLeaseTime(0))
+
+	// DHCPNAKs grant no lease
+	nak, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(dhcpv4.MessageTypeNak))
+	require.NoError(t, err)
+	result, _ = h(req, nak)
+	assert.False(t, result.Options.Has(dhcpv4.OptionIPAddressLeaseTime))
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/coredhcp/coredhcp/handler"
 	"github.com/coredhcp/coredhcp/logger"
 	"github.com/coredhcp/coredhcp/plugins"
+	rangeplugin "github.com/coredhcp/coredhcp/plugins/range"
 	"github.com/insomniacslk/dhcp/dhcpv4"
 )
 
@@ -18,40 +19,93 @@ import (
 var Plugin = plugins.Plugin{
 	Name: "lease_time",
 	// currently not supported for DHCPv6
-	Setup6: nil,
-	Setup4: setup4,
+	Setup6:         nil,
+	ChainSetup4:    setup4,
+	SideEffectFree: true,
 }
 
-var (
-	log         = logger.GetLogger("plugins/lease_time")
-	v4LeaseTime time.Duration
-)
+var log = logger.GetLogger("plugins/lease_time")
 
-// Handler4 handles DHCPv4 packets for the lease_time plugin.
-func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	if req.OpCode != dhcpv4.OpcodeBootRequest {
+// limited logs the errors that can repeat for every packet
+var limited = logger.NewLimiter(log, 10, time.Minute)
+
+// makeHandler4 returns a handler for DHCPv4 packets setting a lease time of
+// v4LeaseTime
+func makeHandler4(v4LeaseTime time.Duration) handler.Handler4 {
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		if req.OpCode != dhcpv4.OpcodeBootRequest {
+			return resp, false
+		}
+		// Set lease time unless it has already been set
+		if !resp.Options.Has(dhcpv4.OptionIPAddressLeaseTime) {
+			resp.Options.Update(dhcpv4.OptIPAddressLeaseTime(v4LeaseTime))
+		}
 		return resp, false
 	}
-	// Set lease time unless it has already been set
-	if !resp.Options.Has(dhcpv4.OptionIPAddressLeaseTime) {
-		resp.Options.Update(dhcpv4.OptIPAddressLeaseTime(v4LeaseTime))
+}
+
+// makeCalendarHandler4 returns a handler for DHCPv4 packets making leases end
+// at the next boundary of rule at the latest. Unlike fixed lease times, it
+// shortens the lease time set by earlier plugins; later plugins may set a
+// longer one. The range plugin is told the boundary at setup instead, see
+// setup4. now is time.Now outside of tests
+func makeCalendarHandler4(rule *calendarRule, now func() time.Time) handler.Handler4 {
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		if req.OpCode != dhcpv4.OpcodeBootRequest {
+			return resp, false
+		}
+		switch resp.MessageType() {
+		case dhcpv4.MessageTypeOffer, dhcpv4.MessageTypeAck:
+		default:
+			// No lease is granted
+			return resp, false
+		}
+		leaseTime := rule.leaseTime(now())
+		if set := resp.IPAddressLeaseTime(0); set == 0 || set > leaseTime {
+			resp.Options.Update(dhcpv4.OptIPAddressLeaseTime(leaseTime))
+		}
+		return resp, false
 	}
-	return resp, false
 }
 
-func setup4(args ...string) (handler.Handler4, error) {
+// Handler4 was the handler of the plugin when it kept a single lease time. It
+// drops every packet, with an error.
+//
+// Deprecated: each instance of the plugin has its own lease time, use the
+// handler returned by its setup function.
+func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	limited.Limited("deprecated").Errorf("BUG: leasetime.Handler4 has no lease time, dropping packet")
+	return nil, true
+}
+
+// setup4 accepts either a fixed lease time, "<duration>", or a wall-clock time
+// at which all leases expire, every day or every week:
+// "until <HH:MM> [on <weekday>] [in <timezone>] [min <duration>]".
+// The range plugins of chain, wherever they are, end their leases at that time
+// too, so that the expiry they store is the one sent to the client
+func setup4(chain *plugins.Chain, args ...string) (handler.Handler4, error) {
 	log.Print("loading `lease_time` plugin for DHCPv4")
 	if len(args) < 1 {
 		log.Error("No default lease time provided")
 		return nil, errors.New("lease_time failed to initialize")
 	}
 
+	if args[0] == "until" {
+		rule, err := parseCalendarRule(args[1:])
+		if err != nil {
+			return nil, err
+		}
+		chain.OnReady(func() {
+			for _, p := range rangeplugin.Instances(chain) {
+				p.LimitExpiry(rule.expiry)
+			}
+		})
+		return makeCalendarHandler4(rule, time.Now), nil
+	}
+
 	leaseTime, err := time.ParseDuration(args[0])
 	if err != nil {
-		log.Errorf("invalid duration: %v", args[0])
-		return nil, errors.New("lease_time failed to initialize")
+		return nil, plugins.ArgErrorf("lease time", "invalid duration: %v", args[0])
 	}
-	v4LeaseTime = leaseTime
-
-	return Handler4, nil
+	return makeHandler4(leaseTime), nil
 }
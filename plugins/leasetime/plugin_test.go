@@ -0,0 +1,80 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package leasetime
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/internal/testpackets"
+	"github.com/coredhcp/coredhcp/plugins"
+	rangeplugin "github.com/coredhcp/coredhcp/plugins/range"
+)
+
+// TestCalendarRange checks that the leases of the range plugin end at the
+// boundary, in the lease file as on the wire, whatever the order of the
+// plugins
+func TestCalendarRange(t *testing.T) {
+	require.NoError(t, plugins.RegisterPlugin(&Plugin))
+	require.NoError(t, plugins.RegisterPlugin(&rangeplugin.Plugin))
+
+	until := []string{"until", time.Now().UTC().Add(2 * time.Hour).Format("15:04"), "in", "UTC"}
+	rule := mustRule(t, strings.Join(until[1:], " "))
+	renewing := net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+	for _, leaseTimeFirst := range []bool{true, false} {
+		t.Run(fmt.Sprintf("lease_time first: %v", leaseTimeFirst), func(t *testing.T) {
+			// A client holding a lease past the boundary
+			leases, err := ioutil.TempFile("", "coredhcp-leasetime")
+			require.NoError(t, err)
+			defer os.Remove(leases.Name())
+			_, err = fmt.Fprintf(leases, "%s 192.0.2.110 %s\n", renewing, time.Now().Add(20*time.Hour).Format(time.RFC3339))
+			require.NoError(t, err)
+			leases.Close()
+
+			confs := []config.PluginConfig{
+				{Name: "lease_time", Args: until},
+				{Name: "range", Args: []string{leases.Name(), "192.0.2.100", "192.0.2.110", "24h"}},
+			}
+			if !leaseTimeFirst {
+				confs[0], confs[1] = confs[1], confs[0]
+			}
+			chain4, _, err := plugins.LoadChains(&config.Config{Server4: &config.ServerConfig{Plugins: confs}})
+			require.NoError(t, err)
+			defer chain4.Close()
+
+			selecting, _ := testpackets.V4RequestSelecting(t, net.HardwareAddr{0x02, 0, 0, 0, 0, 1}, net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 100))
+			renew, _ := testpackets.V4RequestRenewing(t, renewing, net.IPv4(192, 0, 2, 110))
+			for _, req := range []*dhcpv4.DHCPv4{selecting, renew} {
+				resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(dhcpv4.MessageTypeAck))
+				require.NoError(t, err)
+				for _, h := range chain4.Handlers4 {
+					resp, _ = h(req, resp)
+				}
+				now := time.Now()
+				expiry := rule.expiry(now)
+				require.NotNil(t, resp)
+				assert.InDelta(t, expiry.Sub(now).Seconds(), resp.IPAddressLeaseTime(0).Seconds(), 2,
+					"lease time sent to %s", req.ClientHWAddr)
+
+				b, err := ioutil.ReadFile(leases.Name())
+				require.NoError(t, err)
+				lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+				stored := strings.Fields(lines[len(lines)-1])
+				require.Equal(t, req.ClientHWAddr.String(), stored[0], "lease of %s not stored", req.ClientHWAddr)
+				assert.Equal(t, expiry.Format(time.RFC3339), stored[2], "expiry stored for %s", req.ClientHWAddr)
+			}
+		})
+	}
+}
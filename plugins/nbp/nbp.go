@@ -43,16 +43,12 @@ var log = logger.GetLogger("plugins/nbp")
 
 // Plugin wraps plugin registration information
 var Plugin = plugins.Plugin{
-	Name:   "nbp",
-	Setup6: setup6,
-	Setup4: setup4,
+	Name:           "nbp",
+	Setup6:         setup6,
+	Setup4:         setup4,
+	SideEffectFree: true,
 }
 
-var (
-	opt59, opt60 dhcpv6.Option
-	opt66, opt67 *dhcpv4.Option
-)
-
 func parseArgs(args ...string) (*url.URL, error) {
 	if len(args) != 1 {
 		return nil, fmt.Errorf("Exactly one argument must be passed to NBP plugin, got %d", len(args))
@@ -65,7 +61,8 @@ func setup6(args ...string) (handler.Handler6, error) {
 	if err != nil {
 		return nil, err
 	}
-	opt59 = dhcpv6.OptBootFileURL(u.String())
+	var opt60 dhcpv6.Option
+	opt59 := dhcpv6.OptBootFileURL(u.String())
 	params := u.Query().Get("params")
 	if params != "" {
 		opt60 = &dhcpv6.OptionGeneric{
@@ -74,7 +71,7 @@ func setup6(args ...string) (handler.Handler6, error) {
 		}
 	}
 	log.Printf("loaded NBP plugin for DHCPv6.")
-	return nbpHandler6, nil
+	return makeNbpHandler6(opt59, opt60), nil
 }
 
 func setup4(args ...string) (handler.Handler4, error) {
@@ -83,50 +80,52 @@ func setup4(args ...string) (handler.Handler4, error) {
 		return nil, err
 	}
 	otsn := dhcpv4.OptTFTPServerName(u.Host)
-	opt66 = &otsn
 	obfn := dhcpv4.OptBootFileName(u.Path)
-	opt67 = &obfn
 	log.Printf("loaded NBP plugin for DHCPv4.")
-	return nbpHandler4, nil
+	return makeNbpHandler4(&otsn, &obfn), nil
 }
 
-func nbpHandler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
-	if opt59 == nil {
-		// nothing to do
-		return resp, true
-	}
-	decap, err := req.GetInnerMessage()
-	if err != nil {
-		log.Errorf("Could not decapsulate request: %v", err)
-		// drop the request, this is probably a critical error in the packet.
-		return nil, true
-	}
-	for _, code := range decap.Options.RequestedOptions() {
-		if code == dhcpv6.OptionBootfileURL {
-			// bootfile URL is requested
-			resp.AddOption(opt59)
-		} else if code == dhcpv6.OptionBootfileParam {
-			// optionally add opt60, bootfile params, if requested
-			if opt60 != nil {
-				resp.AddOption(opt60)
+func makeNbpHandler6(opt59, opt60 dhcpv6.Option) handler.Handler6 {
+	return func(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+		if opt59 == nil {
+			// nothing to do
+			return resp, true
+		}
+		decap, err := req.GetInnerMessage()
+		if err != nil {
+			log.Errorf("Could not decapsulate request: %v", err)
+			// drop the request, this is probably a critical error in the packet.
+			return nil, true
+		}
+		for _, code := range decap.Options.RequestedOptions() {
+			if code == dhcpv6.OptionBootfileURL {
+				// bootfile URL is requested
+				resp.AddOption(opt59)
+			} else if code == dhcpv6.OptionBootfileParam {
+				// optionally add opt60, bootfile params, if requested
+				if opt60 != nil {
+					resp.AddOption(opt60)
+				}
 			}
 		}
+		log.Debugf("Added NBP %s to request", opt59)
+		return resp, true
 	}
-	log.Debugf("Added NBP %s to request", opt59)
-	return resp, true
 }
 
-func nbpHandler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	if opt66 == nil || opt67 == nil {
-		// nothing to do
+func makeNbpHandler4(opt66, opt67 *dhcpv4.Option) handler.Handler4 {
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		if opt66 == nil || opt67 == nil {
+			// nothing to do
+			return resp, true
+		}
+		if req.IsOptionRequested(dhcpv4.OptionTFTPServerName) {
+			resp.Options.Update(*opt66)
+		}
+		if req.IsOptionRequested(dhcpv4.OptionBootfileName) {
+			resp.Options.Update(*opt67)
+		}
+		log.Debugf("Added NBP %s / %s to request", opt66, opt67)
 		return resp, true
 	}
-	if req.IsOptionRequested(dhcpv4.OptionTFTPServerName) {
-		resp.Options.Update(*opt66)
-	}
-	if req.IsOptionRequested(dhcpv4.OptionBootfileName) {
-		resp.Options.Update(*opt67)
-	}
-	log.Debugf("Added NBP %s / %s to request", opt66, opt67)
-	return resp, true
 }
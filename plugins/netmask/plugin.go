@@ -8,6 +8,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"net"
+	"time"
 
 	"github.com/coredhcp/coredhcp/handler"
 	"github.com/coredhcp/coredhcp/logger"
@@ -17,41 +18,71 @@ import (
 
 var log = logger.GetLogger("plugins/netmask")
 
+// limited logs the errors that can repeat for every packet
+var limited = logger.NewLimiter(log, 10, time.Minute)
+
+// pluginName is the name the plugin is registered, and registers its netmask
+// in the chain, under
+const pluginName = "netmask"
+
 // Plugin wraps plugin registration information
 var Plugin = plugins.Plugin{
-	Name:   "netmask",
-	Setup4: setup4,
+	Name:           pluginName,
+	ChainSetup4:    setup4,
+	SideEffectFree: true,
 }
 
-var (
-	netmask net.IPMask
-)
+// Mask returns the netmask given to clients by the plugin in chain, that of
+// its last instance if there are several, or nil if the plugin is not in
+// chain. The instances of the plugin are only all known once chain is set up,
+// so other plugins call it from chain.OnReady
+func Mask(chain *plugins.Chain) net.IPMask {
+	masks := chain.Instances(pluginName)
+	if len(masks) == 0 {
+		return nil
+	}
+	return masks[len(masks)-1].(net.IPMask)
+}
 
-func setup4(args ...string) (handler.Handler4, error) {
+// Handler4 was the handler of the plugin when it kept a single netmask. It
+// drops every packet, with an error.
+//
+// Deprecated: each instance of the plugin has its own netmask, use the handler
+// returned by its setup function.
+func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	limited.Limited("deprecated").Errorf("BUG: netmask.Handler4 has no netmask, dropping packet")
+	return nil, true
+}
+
+// setup4 sets up an instance of the plugin, and registers its netmask in chain
+func setup4(chain *plugins.Chain, args ...string) (handler.Handler4, error) {
 	log.Printf("loaded plugin for DHCPv4.")
 	if len(args) != 1 {
 		return nil, errors.New("need at least one netmask IP address")
 	}
 	netmaskIP := net.ParseIP(args[0])
 	if netmaskIP.IsUnspecified() {
-		return nil, errors.New("netmask is not valid, got: " + args[1])
+		return nil, plugins.ArgErrorf("netmask", "not a valid netmask: %s", args[0])
 	}
 	netmaskIP = netmaskIP.To4()
 	if netmaskIP == nil {
-		return nil, errors.New("expected an netmask address, got: " + args[1])
+		return nil, plugins.ArgErrorf("netmask", "expected an IPv4 netmask, got: %s", args[0])
 	}
-	netmask = net.IPv4Mask(netmaskIP[0], netmaskIP[1], netmaskIP[2], netmaskIP[3])
+	netmask := net.IPv4Mask(netmaskIP[0], netmaskIP[1], netmaskIP[2], netmaskIP[3])
 	if !checkValidNetmask(netmask) {
-		return nil, errors.New("netmask is not valid, got: " + args[1])
+		return nil, plugins.ArgErrorf("netmask", "not a valid netmask: %s", args[0])
 	}
 	log.Printf("loaded client netmask")
-	return Handler4, nil
+	chain.Register(pluginName, netmask)
+	return makeHandler4(netmask), nil
 }
 
-//Handler4 handles DHCPv4 packets for the netmask plugin
-func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	resp.Options.Update(dhcpv4.OptSubnetMask(netmask))
-	return resp, false
+// makeHandler4 returns a handler for DHCPv4 packets advertising netmask
+func makeHandler4(netmask net.IPMask) handler.Handler4 {
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		resp.Options.Update(dhcpv4.OptSubnetMask(netmask))
+		return resp, false
+	}
 }
 
 func checkValidNetmask(netmask net.IPMask) bool {
@@ -0,0 +1,116 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugins
+
+import (
+	"strings"
+
+	"github.com/coredhcp/coredhcp/config"
+)
+
+// checkOrder validates the order of a plugin chain against the Requires,
+// RunsAfter and RunsBefore declarations of its plugins. Plugins that are not
+// found in registry are ignored, they are reported when loading the chain
+func checkOrder(registry map[string]*Plugin, confs []config.PluginConfig) error {
+	// A plugin can be configured several times, all its instances must
+	// satisfy the constraints
+	first := make(map[string]int)
+	last := make(map[string]int)
+	var names []string
+	for i, c := range confs {
+		if _, ok := first[c.Name]; !ok {
+			first[c.Name] = i
+			names = append(names, c.Name)
+		}
+		last[c.Name] = i
+	}
+
+	// edges[a] lists the configured plugins that must run after a
+	edges := make(map[string][]string)
+	addEdge := func(before, after string) {
+		if _, ok := first[before]; !ok {
+			return
+		}
+		if _, ok := first[after]; !ok {
+			return
+		}
+		edges[before] = append(edges[before], after)
+	}
+	for _, name := range names {
+		p, ok := registry[name]
+		if !ok {
+			continue
+		}
+		for _, dep := range p.Requires {
+			if _, ok := first[dep]; !ok {
+				return config.ConfigErrorFromString("plugin `%s` requires plugin `%s`, which is not configured", name, dep)
+			}
+			addEdge(dep, name)
+		}
+		for _, other := range p.RunsAfter {
+			addEdge(other, name)
+		}
+		for _, other := range p.RunsBefore {
+			addEdge(name, other)
+		}
+	}
+
+	if cycle := findCycle(names, edges); cycle != nil {
+		return config.ConfigErrorFromString("plugins have circular ordering constraints: %s", strings.Join(cycle, " -> "))
+	}
+
+	for _, before := range names {
+		for _, after := range edges[before] {
+			if last[before] > first[after] {
+				return config.ConfigErrorFromString("plugin `%s` must come after plugin `%s`", after, before)
+			}
+		}
+	}
+	return nil
+}
+
+// findCycle returns a cycle in the graph of names and edges, starting and
+// ending with the same node, or nil if there is none
+func findCycle(names []string, edges map[string][]string) []string {
+	const (
+		unvisited = iota
+		inProgress
+		done
+	)
+	state := make(map[string]int)
+	var path []string
+
+	var visit func(n string) []string
+	visit = func(n string) []string {
+		state[n] = inProgress
+		path = append(path, n)
+		for _, next := range edges[n] {
+			switch state[next] {
+			case inProgress:
+				for i, p := range path {
+					if p == next {
+						return append(append([]string(nil), path[i:]...), next)
+					}
+				}
+			case unvisited:
+				if cycle := visit(next); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[n] = done
+		return nil
+	}
+
+	for _, n := range names {
+		if state[n] == unvisited {
+			if cycle := visit(n); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
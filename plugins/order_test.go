@@ -0,0 +1,74 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugins
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coredhcp/coredhcp/config"
+)
+
+func chain(names ...string) []config.PluginConfig {
+	confs := make([]config.PluginConfig, len(names))
+	for i, n := range names {
+		confs[i] = config.PluginConfig{Name: n}
+	}
+	return confs
+}
+
+func TestCheckOrder(t *testing.T) {
+	registry := map[string]*Plugin{
+		"server_id": {Name: "server_id"},
+		"classify":  {Name: "classify", RunsAfter: []string{"server_id"}},
+		"policy":    {Name: "policy", Requires: []string{"classify"}},
+		"alloc":     {Name: "alloc", RunsBefore: []string{"timers"}},
+		"timers":    {Name: "timers", RunsAfter: []string{"policy"}},
+		"sleep":     {Name: "sleep"},
+	}
+
+	for _, tt := range []struct {
+		name  string
+		chain []config.PluginConfig
+		ok    bool
+	}{
+		{"empty", chain(), true},
+		{"satisfied", chain("server_id", "classify", "policy", "alloc", "timers"), true},
+		{"optional dependencies missing", chain("classify", "timers"), true},
+		{"unconstrained plugins anywhere", chain("sleep", "classify", "sleep", "policy", "sleep"), true},
+		{"unknown plugins ignored", chain("unknown", "classify", "policy"), true},
+		{"RunsAfter violated", chain("classify", "server_id"), false},
+		{"RunsBefore violated", chain("timers", "alloc"), false},
+		{"required plugin missing", chain("server_id", "policy"), false},
+		{"required plugin after", chain("policy", "classify"), false},
+		{"repeated plugin violates", chain("server_id", "classify", "server_id"), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkOrder(registry, tt.chain)
+			if tt.ok {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestCheckOrderCycle(t *testing.T) {
+	registry := map[string]*Plugin{
+		"a": {Name: "a", RunsAfter: []string{"c"}},
+		"b": {Name: "b", RunsAfter: []string{"a"}},
+		"c": {Name: "c", RunsBefore: []string{"d"}, RunsAfter: []string{"b"}},
+		"d": {Name: "d"},
+	}
+	err := checkOrder(registry, chain("a", "b", "c", "d"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "circular")
+	}
+
+	// The cycle only exists when all its members are configured
+	assert.NoError(t, checkOrder(registry, chain("a", "b", "d")))
+}
@@ -17,10 +17,35 @@ var log = logger.GetLogger("plugins")
 // Plugin represents a plugin object.
 // Setup6 and Setup4 are the setup functions for DHCPv6 and DHCPv4 handlers
 // respectively. Both setup functions can be nil.
+// Requires, RunsAfter and RunsBefore declare constraints on the position of
+// the plugin in a chain, by plugin name, which are checked when loading it:
+// the plugins in Requires must be configured and come earlier in the chain,
+// while the plugins in RunsAfter and RunsBefore only need to respectively come
+// earlier or later if they are configured.
+// Validate6 and Validate4 optionally check the arguments of the plugin without
+// side effects, for configuration checks. Plugins without them are only
+// checked by calling their setup function if they set SideEffectFree, meaning
+// that it does not write files, connect to other services or start
+// goroutines; the others are reported as not validated.
+// ChainSetup6 and ChainSetup4 are used instead of Setup6 and Setup4 when set,
+// for plugins sharing state with the server or with the other plugins of
+// their chain.
 type Plugin struct {
 	Name   string
 	Setup6 SetupFunc6
 	Setup4 SetupFunc4
+
+	ChainSetup6 ChainSetupFunc6
+	ChainSetup4 ChainSetupFunc4
+
+	Validate6 ValidateFunc
+	Validate4 ValidateFunc
+
+	SideEffectFree bool
+
+	Requires   []string
+	RunsAfter  []string
+	RunsBefore []string
 }
 
 // RegisteredPlugins maps a plugin name to a Plugin instance.
@@ -32,6 +57,18 @@ type SetupFunc6 func(args ...string) (handler.Handler6, error)
 // SetupFunc4 defines a plugin setup function for DHCPv6
 type SetupFunc4 func(args ...string) (handler.Handler4, error)
 
+// ChainSetupFunc6 defines a plugin setup function for DHCPv6 with access to
+// the chain the plugin is set up in
+type ChainSetupFunc6 func(chain *Chain, args ...string) (handler.Handler6, error)
+
+// ChainSetupFunc4 defines a plugin setup function for DHCPv4 with access to
+// the chain the plugin is set up in
+type ChainSetupFunc4 func(chain *Chain, args ...string) (handler.Handler4, error)
+
+// ValidateFunc defines a plugin argument validation function, for either
+// protocol
+type ValidateFunc func(args ...string) error
+
 // RegisterPlugin registers a plugin.
 func RegisterPlugin(plugin *Plugin) error {
 	if plugin == nil {
@@ -51,16 +88,52 @@ func RegisterPlugin(plugin *Plugin) error {
 // `plugins` section, in order. For a plugin to be available, it must have been
 // previously registered with plugins.RegisterPlugin. This is normally done at
 // plugin import time.
-// This function returns the list of loaded v6 plugins, the list of loaded v4
-// plugins, and an error if any.
+// This function returns the list of loaded v4 plugins, the list of loaded v6
+// plugins, and an error if any, like LoadChains. The chains are not returned,
+// so the plugins holding resources are never closed: servers use LoadChains.
 func LoadPlugins(conf *config.Config) ([]handler.Handler4, []handler.Handler6, error) {
-	log.Print("Loading plugins...")
+	chain4, chain6, err := LoadChains(conf)
+	if err != nil {
+		return nil, nil, err
+	}
 	handlers4 := make([]handler.Handler4, 0)
 	handlers6 := make([]handler.Handler6, 0)
+	if chain4 != nil {
+		handlers4 = chain4.Handlers4
+	}
+	if chain6 != nil {
+		handlers6 = chain6.Handlers6
+	}
+	return handlers4, handlers6, nil
+}
 
+// LoadChains loads the plugins of a Config object like LoadPlugins, and
+// returns the chains they are set up in.
+// Panics in the handlers are recovered from according to the panic policy of
+// each server.
+// This function returns the DHCPv4 and DHCPv6 plugin chains, nil for servers
+// that are not configured, and an error if any. Plugins with a validation
+// function are checked with it before being set up, and the setup of every
+// other plugin is attempted, so that the error, a SetupErrors, reports every
+// faulty plugin at once. The plugins set up are closed if there is any.
+func LoadChains(conf *config.Config) (chain4, chain6 *Chain, err error) {
+	log := logger.WithInstance(log, conf.Name)
+	log.Print("Loading plugins...")
 	if conf.Server6 == nil && conf.Server4 == nil {
 		return nil, nil, errors.New("no configuration found for either DHCPv6 or DHCPv4")
 	}
+	var (
+		errs SetupErrors
+		// The plugins set up before a failure are closed
+		loaded []*Chain
+	)
+	defer func() {
+		if err != nil {
+			for _, c := range loaded {
+				c.Close()
+			}
+		}
+	}()
 
 	// now load the plugins. We need to call its setup function with
 	// the arguments extracted above. The setup function is mapped in
@@ -68,47 +141,197 @@ func LoadPlugins(conf *config.Config) ([]handler.Handler4, []handler.Handler6, e
 
 	// Load DHCPv6 plugins.
 	if conf.Server6 != nil {
+		chain6 = &Chain{Instance: conf.Name, Handlers6: make([]handler.Handler6, 0)}
+		loaded = append(loaded, chain6)
+		if err := checkOrder(RegisteredPlugins, conf.Server6.Plugins); err != nil {
+			errs = append(errs, &SetupError{Server: "DHCPv6", Err: err})
+		}
 		for _, pluginConf := range conf.Server6.Plugins {
-			if plugin, ok := RegisteredPlugins[pluginConf.Name]; ok {
-				log.Printf("DHCPv6: loading plugin `%s`", pluginConf.Name)
-				if plugin.Setup6 == nil {
-					log.Warningf("DHCPv6: plugin `%s` has no setup function for DHCPv6", pluginConf.Name)
+			fail := func(err error) {
+				errs = append(errs, &SetupError{Server: "DHCPv6", Plugin: pluginConf.Name, Position: pluginConf.Position, Err: err})
+			}
+			plugin, ok := RegisteredPlugins[pluginConf.Name]
+			if !ok {
+				fail(errors.New("unknown plugin"))
+				continue
+			}
+			if plugin.Validate6 != nil {
+				if err := plugin.Validate6(pluginConf.Args...); err != nil {
+					fail(err)
 					continue
 				}
-				h6, err := plugin.Setup6(pluginConf.Args...)
-				if err != nil {
-					return nil, nil, err
-				} else if h6 == nil {
-					return nil, nil, config.ConfigErrorFromString("no DHCPv6 handler for plugin %s", pluginConf.Name)
-				}
-				handlers6 = append(handlers6, h6)
-			} else {
-				return nil, nil, config.ConfigErrorFromString("DHCPv6: unknown plugin `%s`", pluginConf.Name)
 			}
+			log.Printf("DHCPv6: loading plugin `%s`", pluginConf.Name)
+			var (
+				h6  handler.Handler6
+				err error
+			)
+			switch {
+			case plugin.ChainSetup6 != nil:
+				h6, err = plugin.ChainSetup6(chain6, pluginConf.Args...)
+			case plugin.Setup6 != nil:
+				h6, err = plugin.Setup6(pluginConf.Args...)
+			default:
+				log.Warningf("DHCPv6: plugin `%s` has no setup function for DHCPv6", pluginConf.Name)
+				continue
+			}
+			if err != nil {
+				fail(err)
+				continue
+			} else if h6 == nil {
+				fail(errors.New("no DHCPv6 handler"))
+				continue
+			}
+			g := newGuard("DHCPv6: "+pluginConf.Name, conf.Server6.PluginPanics, log)
+			chain6.guards = append(chain6.guards, g)
+			chain6.Handlers6 = append(chain6.Handlers6, g.wrap6(h6))
 		}
 	}
 	// Load DHCPv4 plugins. Yes, duplicated code, there's not really much that
 	// can be deduplicated here.
 	if conf.Server4 != nil {
+		chain4 = &Chain{Instance: conf.Name, Handlers4: make([]handler.Handler4, 0)}
+		loaded = append(loaded, chain4)
+		if err := checkOrder(RegisteredPlugins, conf.Server4.Plugins); err != nil {
+			errs = append(errs, &SetupError{Server: "DHCPv4", Err: err})
+		}
 		for _, pluginConf := range conf.Server4.Plugins {
-			if plugin, ok := RegisteredPlugins[pluginConf.Name]; ok {
-				log.Printf("DHCPv4: loading plugin `%s`", pluginConf.Name)
-				if plugin.Setup4 == nil {
-					log.Warningf("DHCPv4: plugin `%s` has no setup function for DHCPv4", pluginConf.Name)
+			fail := func(err error) {
+				errs = append(errs, &SetupError{Server: "DHCPv4", Plugin: pluginConf.Name, Position: pluginConf.Position, Err: err})
+			}
+			plugin, ok := RegisteredPlugins[pluginConf.Name]
+			if !ok {
+				fail(errors.New("unknown plugin"))
+				continue
+			}
+			if plugin.Validate4 != nil {
+				if err := plugin.Validate4(pluginConf.Args...); err != nil {
+					fail(err)
 					continue
 				}
-				h4, err := plugin.Setup4(pluginConf.Args...)
-				if err != nil {
-					return nil, nil, err
-				} else if h4 == nil {
-					return nil, nil, config.ConfigErrorFromString("no DHCPv4 handler for plugin %s", pluginConf.Name)
-				}
-				handlers4 = append(handlers4, h4)
-			} else {
-				return nil, nil, config.ConfigErrorFromString("DHCPv4: unknown plugin `%s`", pluginConf.Name)
 			}
+			log.Printf("DHCPv4: loading plugin `%s`", pluginConf.Name)
+			var (
+				h4  handler.Handler4
+				err error
+			)
+			switch {
+			case plugin.ChainSetup4 != nil:
+				h4, err = plugin.ChainSetup4(chain4, pluginConf.Args...)
+			case plugin.Setup4 != nil:
+				h4, err = plugin.Setup4(pluginConf.Args...)
+			default:
+				log.Warningf("DHCPv4: plugin `%s` has no setup function for DHCPv4", pluginConf.Name)
+				continue
+			}
+			if err != nil {
+				fail(err)
+				continue
+			} else if h4 == nil {
+				fail(errors.New("no DHCPv4 handler"))
+				continue
+			}
+			g := newGuard("DHCPv4: "+pluginConf.Name, conf.Server4.PluginPanics, log)
+			chain4.guards = append(chain4.guards, g)
+			chain4.Handlers4 = append(chain4.Handlers4, g.wrap4(h4))
 		}
 	}
+	if len(errs) > 0 {
+		return nil, nil, errs
+	}
+	// The plugins of a chain only look each other up once they are all set
+	// up, which they may not be on failure
+	for _, c := range loaded {
+		c.setupDone()
+	}
 
-	return handlers4, handlers6, nil
+	return chain4, chain6, nil
+}
+
+// ValidatePlugins checks the plugins of a Config object like LoadChains, for
+// --validate: the arguments of plugins with a validation function are only
+// checked by it, so configurations can be checked while a server uses the same
+// files. The other plugins are set up in a scratch chain that is never
+// started, which is all they can be checked with, if they are side effect
+// free; the rest are logged as not validated. LoadChains does not use it, so
+// that they are set up once. The error, a SetupErrors, reports every faulty
+// plugin at once.
+func ValidatePlugins(conf *config.Config) error {
+	if conf.Server6 == nil && conf.Server4 == nil {
+		return errors.New("no configuration found for either DHCPv6 or DHCPv4")
+	}
+	var errs SetupErrors
+	if conf.Server6 != nil {
+		errs = append(errs, validateChain("DHCPv6", conf.Server6.Plugins, func(p *Plugin, args []string) (bool, error) {
+			switch {
+			case p.Validate6 != nil:
+				return true, p.Validate6(args...)
+			case p.ChainSetup6 == nil && p.Setup6 == nil:
+				return false, nil
+			case !p.SideEffectFree:
+				return true, errNotValidated
+			case p.ChainSetup6 != nil:
+				_, err := p.ChainSetup6(&Chain{}, args...)
+				return true, err
+			default:
+				_, err := p.Setup6(args...)
+				return true, err
+			}
+		})...)
+	}
+	if conf.Server4 != nil {
+		errs = append(errs, validateChain("DHCPv4", conf.Server4.Plugins, func(p *Plugin, args []string) (bool, error) {
+			switch {
+			case p.Validate4 != nil:
+				return true, p.Validate4(args...)
+			case p.ChainSetup4 == nil && p.Setup4 == nil:
+				return false, nil
+			case !p.SideEffectFree:
+				return true, errNotValidated
+			case p.ChainSetup4 != nil:
+				_, err := p.ChainSetup4(&Chain{}, args...)
+				return true, err
+			default:
+				_, err := p.Setup4(args...)
+				return true, err
+			}
+		})...)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// errNotValidated is returned by the validation functions of ValidatePlugins
+// for plugins that cannot be checked without side effects
+var errNotValidated = errors.New("not validated, its setup may have side effects")
+
+// validateChain checks the plugin chain of a server with validate, which
+// returns false for plugins without support for the protocol
+func validateChain(server string, confs []config.PluginConfig, validate func(*Plugin, []string) (bool, error)) SetupErrors {
+	var errs SetupErrors
+	if err := checkOrder(RegisteredPlugins, confs); err != nil {
+		errs = append(errs, &SetupError{Server: server, Err: err})
+	}
+	for _, pluginConf := range confs {
+		fail := func(err error) {
+			errs = append(errs, &SetupError{Server: server, Plugin: pluginConf.Name, Position: pluginConf.Position, Err: err})
+		}
+		plugin, ok := RegisteredPlugins[pluginConf.Name]
+		if !ok {
+			fail(errors.New("unknown plugin"))
+			continue
+		}
+		supported, err := validate(plugin, pluginConf.Args)
+		switch {
+		case !supported:
+			log.Warningf("%s: plugin `%s` has no setup function for %s", server, pluginConf.Name, server)
+		case err == errNotValidated:
+			log.Warning(&SetupError{Server: server, Plugin: pluginConf.Name, Position: pluginConf.Position, Err: err})
+		case err != nil:
+			fail(err)
+		}
+	}
+	return errs
 }
@@ -17,7 +17,6 @@ package prefix
 import (
 	"bytes"
 	"errors"
-	"fmt"
 	"net"
 	"strconv"
 	"sync"
@@ -38,8 +37,9 @@ var log = logger.GetLogger("plugins/prefix")
 
 // Plugin registers the prefix. Prefix delegation only exists for DHCPv6
 var Plugin = plugins.Plugin{
-	Name:   "prefix",
-	Setup6: setupPrefix,
+	Name:           "prefix",
+	Setup6:         setupPrefix,
+	SideEffectFree: true,
 }
 
 const leaseDuration = 3600 * time.Second
@@ -52,18 +52,18 @@ func setupPrefix(args ...string) (handler.Handler6, error) {
 
 	_, prefix, err := net.ParseCIDR(args[0])
 	if err != nil {
-		return nil, fmt.Errorf("Invalid pool subnet: %v", err)
+		return nil, plugins.ArgErrorf("subnet", "Invalid pool subnet: %v", err)
 	}
 
 	allocSize, err := strconv.Atoi(args[1])
 	if err != nil || allocSize > 128 || allocSize < 0 {
-		return nil, fmt.Errorf("Invalid prefix length: %v", err)
+		return nil, plugins.ArgErrorf("allocation size", "Invalid prefix length: %v", args[1])
 	}
 
 	// TODO: select allocators based on heuristics or user configuration
 	alloc, err := bitmap.NewBitmapAllocator(*prefix, allocSize)
 	if err != nil {
-		return nil, fmt.Errorf("Could not initialize prefix allocator: %v", err)
+		return nil, plugins.ArgErrorf("allocation size", "Could not initialize prefix allocator: %v", err)
 	}
 
 	return (&Handler{
@@ -110,6 +110,12 @@ func (h *Handler) Handle(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 		return nil, true
 	}
 
+	// RFC8415 §18.2.6: Information-Request is for stateless configuration,
+	// it carries no IA options and the client ID is optional
+	if msg.MessageType == dhcpv6.MessageTypeInformationRequest {
+		return resp, false
+	}
+
 	client := msg.Options.ClientID()
 	if client == nil {
 		log.Error("Invalid packet received, no clientID")
@@ -260,12 +266,14 @@ func addPrefix(resp *dhcpv6.OptIAPD, l lease) {
 	})
 }
 
+// dup returns a deep copy of src. The IP and mask keep their length, and a nil
+// mask stays nil while an empty one stays empty, so that the copy is
+// samePrefix to the original
 func dup(src *net.IPNet) (dst *net.IPNet) {
-	dst = &net.IPNet{
-		IP:   make(net.IP, net.IPv6len),
-		Mask: make(net.IPMask, net.IPv6len),
+	dst = &net.IPNet{IP: append(net.IP(nil), src.IP...)}
+	if src.Mask != nil {
+		dst.Mask = make(net.IPMask, len(src.Mask))
+		copy(dst.Mask, src.Mask)
 	}
-	copy(dst.IP, src.IP)
-	copy(dst.Mask, src.Mask)
 	return dst
 }
@@ -5,9 +5,11 @@
 package prefix
 
 import (
+	"bytes"
 	"net"
 	"testing"
 
+	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
 	"github.com/insomniacslk/dhcp/dhcpv6"
 	dhcpIana "github.com/insomniacslk/dhcp/iana"
 )
@@ -81,6 +83,55 @@ func TestRoundTrip(t *testing.T) {
 	}
 }
 
+func TestInformationRequest(t *testing.T) {
+	_, prefix, err := net.ParseCIDR("2001:db8::/48")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alloc, err := bitmap.NewBitmapAllocator(*prefix, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{
+		Records:   make(map[string][]lease),
+		allocator: alloc,
+	}
+
+	for _, withClientID := range []bool{false, true} {
+		req, err := dhcpv6.NewMessage(dhcpv6.WithRequestedOptions(dhcpv6.OptionDNSRecursiveNameServer))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.MessageType = dhcpv6.MessageTypeInformationRequest
+		if withClientID {
+			req.AddOption(dhcpv6.OptClientID(dhcpv6.Duid{
+				Type:          dhcpv6.DUID_LL,
+				HwType:        dhcpIana.HWTypeEthernet,
+				LinkLayerAddr: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
+			}))
+		}
+		// The client identifier is optional, as the server builds the reply
+		resp := &dhcpv6.Message{MessageType: dhcpv6.MessageTypeReply, TransactionID: req.TransactionID}
+		if withClientID {
+			resp, err = dhcpv6.NewReplyFromMessage(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		result, final := h.Handle(req, resp)
+		if result == nil || final {
+			t.Fatalf("Information-Request (client ID: %v) was dropped", withClientID)
+		}
+		if iapds := result.(*dhcpv6.Message).Options.IAPD(); len(iapds) != 0 {
+			t.Fatalf("Reply to Information-Request contains IA_PD options: %v", iapds)
+		}
+		if len(h.Records) != 0 {
+			t.Fatalf("Information-Request (client ID: %v) created records: %v", withClientID, h.Records)
+		}
+	}
+}
+
 func TestDup(t *testing.T) {
 	_, prefix, err := net.ParseCIDR("2001:db8::/48")
 	if err != nil {
@@ -90,4 +141,40 @@ func TestDup(t *testing.T) {
 	if !samePrefix(dupPrefix, prefix) {
 		t.Fatalf("dup doesn't work: got %v expected %v", dupPrefix, prefix)
 	}
+	dupPrefix.IP[0] = 0xfe
+	dupPrefix.Mask[0] = 0
+	if !prefix.IP.Equal(net.ParseIP("2001:db8::")) || prefix.Mask[0] != 0xff {
+		t.Fatalf("dup shares memory with the original: %v", prefix)
+	}
+}
+
+func TestDupMasks(t *testing.T) {
+	ip := net.ParseIP("2001:db8::1")
+	testcases := []struct {
+		name   string
+		prefix net.IPNet
+	}{
+		{"nil mask", net.IPNet{IP: ip}},
+		{"/128", net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}},
+		{"/0", net.IPNet{IP: ip, Mask: net.CIDRMask(0, 128)}},
+		{"empty mask", net.IPNet{IP: ip, Mask: net.IPMask{}}},
+		{"IPv4 /32", net.IPNet{IP: net.IPv4(192, 0, 2, 1).To4(), Mask: net.CIDRMask(32, 32)}},
+	}
+	for _, tc := range testcases {
+		d := dup(&tc.prefix)
+		if (d.Mask == nil) != (tc.prefix.Mask == nil) {
+			t.Errorf("%s: nil-ness of the mask not preserved: got %#v, expected %#v", tc.name, d.Mask, tc.prefix.Mask)
+		}
+		if !bytes.Equal(d.Mask, tc.prefix.Mask) || !bytes.Equal(d.IP, tc.prefix.IP) {
+			t.Errorf("%s: got %#v, expected %#v", tc.name, d, tc.prefix)
+		}
+		if !samePrefix(d, &tc.prefix) {
+			t.Errorf("%s: copy is not the same prefix as the original", tc.name)
+		}
+		ones, bits := d.Mask.Size()
+		wantOnes, wantBits := tc.prefix.Mask.Size()
+		if ones != wantOnes || bits != wantBits {
+			t.Errorf("%s: prefix length changed from /%d of %d bits to /%d of %d bits", tc.name, wantOnes, wantBits, ones, bits)
+		}
+	}
 }
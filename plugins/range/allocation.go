@@ -0,0 +1,74 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+)
+
+// newAllocator returns the allocator for the pool from start to end, following
+// an allocation setting of the form allocation=sequential|spread. Sequential
+// allocation, the default, gives out the lowest free address; spread
+// allocation gives out addresses across the whole pool
+func newAllocator(arg string, start, end net.IP) (allocators.Allocator, error) {
+	switch arg {
+	case "", "allocation=sequential":
+		return bitmap.NewIPv4Allocator(start, end)
+	case "allocation=spread":
+		return bitmap.NewIPv4SpreadAllocator(start, end)
+	default:
+		return nil, fmt.Errorf("invalid allocation in %q, expected sequential or spread", arg)
+	}
+}
+
+// distributionBuckets is the number of equal slices of the pool granted
+// addresses are counted in
+const distributionBuckets = 16
+
+// distribution counts the addresses granted in each slice of a pool, to show
+// how an allocation strategy spreads clients over it
+type distribution struct {
+	start, size uint32
+	granted     [distributionBuckets]uint64
+}
+
+func newDistribution(start net.IP, size int) distribution {
+	return distribution{start: binary.BigEndian.Uint32(start.To4()), size: uint32(size)}
+}
+
+// add counts a grant of ip, if it is part of the pool
+func (d *distribution) add(ip net.IP) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return
+	}
+	offset := binary.BigEndian.Uint32(ip4) - d.start
+	if offset >= d.size {
+		return
+	}
+	d.granted[uint64(offset)*distributionBuckets/uint64(d.size)]++
+}
+
+// PoolDistribution is the number of addresses granted in each sixteenth of the
+// pool of an instance of the range plugin, from the lowest addresses to the
+// highest
+type PoolDistribution struct {
+	Start, End net.IP
+	Granted    [distributionBuckets]uint64
+}
+
+// AllocationDistribution returns the distribution of the addresses granted by
+// the instance since the server started, whatever its allocation strategy.
+// Renewals are not counted
+func (p *PluginState) AllocationDistribution() PoolDistribution {
+	p.Lock()
+	defer p.Unlock()
+	return PoolDistribution{Start: p.start, End: p.end, Granted: p.granted.granted}
+}
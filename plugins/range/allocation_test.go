@@ -0,0 +1,90 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coredhcp/coredhcp/internal/testpackets"
+)
+
+func TestNewAllocator(t *testing.T) {
+	start, end := net.IPv4(192, 0, 2, 10), net.IPv4(192, 0, 2, 19)
+	for _, good := range []string{"", "allocation=sequential", "allocation=spread"} {
+		_, err := newAllocator(good, start, end)
+		assert.NoError(t, err, "%q should be accepted", good)
+	}
+	for _, bad := range []string{"allocation=", "allocation=random", "allocation=Spread"} {
+		_, err := newAllocator(bad, start, end)
+		assert.Error(t, err, "%q should be refused", bad)
+	}
+}
+
+func TestDistribution(t *testing.T) {
+	// 2 addresses per bucket
+	d := newDistribution(net.IPv4(192, 0, 2, 10), 32)
+	for _, ip := range []string{"192.0.2.10", "192.0.2.11", "192.0.2.12", "192.0.2.41", "192.0.2.9", "192.0.2.42", "2001:db8::1"} {
+		d.add(net.ParseIP(ip))
+	}
+	var expected [distributionBuckets]uint64
+	expected[0], expected[1], expected[15] = 2, 1, 1
+	assert.Equal(t, expected, d.granted)
+
+	// Pools smaller than the number of buckets
+	d = newDistribution(net.IPv4(192, 0, 2, 10), 4)
+	d.add(net.IPv4(192, 0, 2, 13))
+	assert.Equal(t, uint64(1), d.granted[12])
+
+	// The zero value counts nothing
+	var zero distribution
+	zero.add(net.IPv4(192, 0, 2, 10))
+	assert.Equal(t, [distributionBuckets]uint64{}, zero.granted)
+}
+
+// grantPool grants addresses of the pool of p to n new clients, and returns
+// the distribution of the grants
+func grantPool(t *testing.T, p *PluginState, n int) PoolDistribution {
+	for i := 0; i < n; i++ {
+		req, _ := testpackets.V4Discover(t, net.HardwareAddr{0x02, 0, 0, 0, 2, byte(i)})
+		resp, err := dhcpv4.NewReplyFromRequest(req)
+		require.NoError(t, err)
+		resp, _ = p.Handler4(req, resp)
+		require.NotNil(t, resp)
+	}
+	return p.AllocationDistribution()
+}
+
+func TestAllocationDistribution(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "coredhcp-allocation")
+	require.NoError(t, err)
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	// A quarter of a pool of 256 addresses
+	p, err := setupInstance(tmpfile.Name(), "192.0.2.0", "192.0.2.255", "1h")
+	require.NoError(t, err)
+	d := grantPool(t, p, 64)
+	assert.True(t, d.Start.Equal(net.IPv4(192, 0, 2, 0)) && d.End.Equal(net.IPv4(192, 0, 2, 255)))
+	assert.Equal(t, [distributionBuckets]uint64{16, 16, 16, 16}, d.Granted,
+		"sequential allocation should fill the bottom of the pool")
+
+	require.NoError(t, os.Truncate(tmpfile.Name(), 0))
+	p, err = setupInstance(tmpfile.Name(), "192.0.2.0", "192.0.2.255", "1h", "allocation=spread")
+	require.NoError(t, err)
+	d = grantPool(t, p, 64)
+	for i, granted := range d.Granted {
+		assert.True(t, granted >= 3 && granted <= 5, "spread allocation granted %d addresses in sixteenth %d: %v", granted, i, d.Granted)
+	}
+
+	_, err = setupInstance(tmpfile.Name(), "192.0.2.0", "192.0.2.255", "1h", "allocation=spread", "allocation=sequential")
+	assert.Error(t, err, "several allocation strategies should be refused")
+}
@@ -0,0 +1,101 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// circuitID returns the circuit req came from: the address of the relay agent
+// and the Agent Circuit ID it added (RFC3046 §2.0), as circuit IDs are only
+// unique per relay. It is empty if there is no circuit ID
+func circuitID(req *dhcpv4.DHCPv4) string {
+	rai := req.RelayAgentInfo()
+	if rai == nil {
+		return ""
+	}
+	id := rai.Get(dhcpv4.AgentCircuitIDSubOption)
+	if len(id) == 0 {
+		return ""
+	}
+	return req.GatewayIPAddr.String() + " " + string(id)
+}
+
+// circuitLimit caps the number of clients with an active lease behind each
+// relay circuit, such as a DSLAM port, against MAC flooding. Clients behind a
+// circuit that reached the limit get no new lease, while those that have one
+// can still renew it
+type circuitLimit struct {
+	max int
+	nak bool
+	// members indexes, for each circuit, the clients that got a lease from
+	// behind it. Clients whose lease expired are removed lazily
+	members map[string]map[string]struct{}
+}
+
+// parseCircuitLimit parses a circuit_limit setting, of the form
+// circuit_limit=<max clients>[:<drop|nak>]
+func parseCircuitLimit(arg string) (circuitLimit, error) {
+	spec := strings.TrimPrefix(arg, "circuit_limit=")
+	parts := strings.SplitN(spec, ":", 2)
+	l := circuitLimit{members: make(map[string]map[string]struct{})}
+	var err error
+	l.max, err = strconv.Atoi(parts[0])
+	if err != nil || l.max < 1 {
+		return circuitLimit{}, fmt.Errorf("invalid number of clients per circuit in %q", arg)
+	}
+	if len(parts) == 2 {
+		switch parts[1] {
+		case "drop":
+		case "nak":
+			l.nak = true
+		default:
+			return circuitLimit{}, fmt.Errorf("invalid action in %q, expected drop or nak", arg)
+		}
+	}
+	return l, nil
+}
+
+// circuitFull returns whether the circuit has as many clients with an active lease
+// as allowed, not counting the client mac
+func (p *PluginState) circuitFull(circuit, mac string, now time.Time) bool {
+	if p.circuits.max == 0 || circuit == "" {
+		return false
+	}
+	active := 0
+	for member := range p.circuits.members[circuit] {
+		if member == mac {
+			continue
+		}
+		record, ok := p.Recordsv4[member]
+		if !ok || record.circuit != circuit || record.expired(now) {
+			delete(p.circuits.members[circuit], member)
+			continue
+		}
+		active++
+	}
+	if len(p.circuits.members[circuit]) == 0 {
+		delete(p.circuits.members, circuit)
+	}
+	return active >= p.circuits.max
+}
+
+// joinCircuit records that mac got its lease from behind circuit
+func (p *PluginState) joinCircuit(circuit, mac string) {
+	if p.circuits.max == 0 || circuit == "" {
+		return
+	}
+	members, ok := p.circuits.members[circuit]
+	if !ok {
+		members = make(map[string]struct{})
+		p.circuits.members[circuit] = members
+	}
+	members[mac] = struct{}{}
+}
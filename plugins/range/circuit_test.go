@@ -0,0 +1,122 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coredhcp/coredhcp/internal/testpackets"
+)
+
+func TestCircuitID(t *testing.T) {
+	req, _ := testpackets.V4Discover(t, nil)
+	assert.Empty(t, circuitID(req))
+	relayed, _ := testpackets.V4Relayed(t, req, net.IPv4(192, 0, 2, 1), []byte("dslam1/port7"))
+	assert.Equal(t, "192.0.2.1 dslam1/port7", circuitID(relayed))
+	other, _ := testpackets.V4Relayed(t, req, net.IPv4(192, 0, 2, 2), []byte("dslam1/port7"))
+	assert.NotEqual(t, circuitID(relayed), circuitID(other), "circuit IDs are only unique per relay")
+	relayed, _ = testpackets.V4Relayed(t, req, net.IPv4(192, 0, 2, 1), nil)
+	assert.Empty(t, circuitID(relayed))
+}
+
+func TestParseCircuitLimit(t *testing.T) {
+	l, err := parseCircuitLimit("circuit_limit=4")
+	require.NoError(t, err)
+	assert.Equal(t, 4, l.max)
+	assert.False(t, l.nak)
+	l, err = parseCircuitLimit("circuit_limit=1:nak")
+	require.NoError(t, err)
+	assert.Equal(t, 1, l.max)
+	assert.True(t, l.nak)
+
+	for _, bad := range []string{"circuit_limit=", "circuit_limit=0", "circuit_limit=two", "circuit_limit=2:reject"} {
+		_, err := parseCircuitLimit(bad)
+		assert.Error(t, err, "%s should be refused", bad)
+	}
+}
+
+func TestCircuitRecordRoundTrip(t *testing.T) {
+	rec := &Record{IP: net.IPv4(10, 0, 0, 1).To4(), expires: time.Now().Round(time.Second), circuit: "port 1\x00\xff"}
+	mac, parsed, err := parseRecord(strings.TrimSuffix(formatRecord("02:00:00:00:00:01", rec), "\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "02:00:00:00:00:01", mac)
+	assert.Equal(t, rec.circuit, parsed.circuit)
+	assert.True(t, rec.expires.Equal(parsed.expires))
+
+	_, _, err = parseRecord("02:00:00:00:00:01 10.0.0.1 2021-01-01T00:00:00Z port1")
+	assert.Error(t, err)
+	_, _, err = parseRecord("02:00:00:00:00:01 10.0.0.1 2021-01-01T00:00:00Z circuit=zz")
+	assert.Error(t, err)
+}
+
+func TestCircuitLimit(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "coredhcp-circuit")
+	require.NoError(t, err)
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	p, err := setupInstance(tmpfile.Name(), "192.0.2.10", "192.0.2.19", "1h", "circuit_limit=2:nak")
+	require.NoError(t, err)
+
+	relay := net.IPv4(192, 0, 2, 1)
+	port1, port2 := []byte("dslam1/port1"), []byte("dslam1/port2")
+	circuit1 := "192.0.2.1 dslam1/port1"
+	handle := func(req *dhcpv4.DHCPv4, mt dhcpv4.MessageType) *dhcpv4.DHCPv4 {
+		resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(mt))
+		require.NoError(t, err)
+		resp, _ = p.Handler4(req, resp)
+		return resp
+	}
+	discover := func(mac net.HardwareAddr, circuit []byte) *dhcpv4.DHCPv4 {
+		req, _ := testpackets.V4Discover(t, mac)
+		req, _ = testpackets.V4Relayed(t, req, relay, circuit)
+		return handle(req, dhcpv4.MessageTypeOffer)
+	}
+
+	macs := []net.HardwareAddr{
+		{0x02, 0, 0, 0, 0, 1},
+		{0x02, 0, 0, 0, 0, 2},
+		{0x02, 0, 0, 0, 0, 3},
+	}
+	require.NotNil(t, discover(macs[0], port1))
+	require.NotNil(t, discover(macs[1], port1))
+	assert.Nil(t, discover(macs[2], port1), "third client behind the circuit got an offer")
+	assert.NotNil(t, discover(macs[2], port2), "clients behind other circuits are not limited")
+
+	// Refused DHCPREQUESTs get a DHCPNAK
+	req, _ := testpackets.V4RequestSelecting(t, macs[2], net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 12))
+	req, _ = testpackets.V4Relayed(t, req, relay, port1)
+	delete(p.Recordsv4, macs[2].String())
+	resp := handle(req, dhcpv4.MessageTypeAck)
+	require.NotNil(t, resp)
+	assert.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType())
+
+	// Clients with a lease can renew it, even without going through the relay
+	renewal, _ := testpackets.V4RequestRenewing(t, macs[0], p.Recordsv4[macs[0].String()].IP)
+	resp = handle(renewal, dhcpv4.MessageTypeAck)
+	require.NotNil(t, resp)
+	assert.Equal(t, dhcpv4.MessageTypeAck, resp.MessageType())
+	assert.Equal(t, circuit1, p.Recordsv4[macs[0].String()].circuit)
+
+	// An expired lease frees a slot
+	p.Recordsv4[macs[1].String()].expires = time.Now().Add(-time.Minute)
+	assert.NotNil(t, discover(macs[2], port1))
+	assert.Nil(t, discover(macs[1], port1), "the client whose lease expired took the slot back")
+
+	// The circuits are restored from the lease file
+	records, err := loadRecordsFromFile(tmpfile.Name())
+	require.NoError(t, err)
+	assert.Equal(t, circuit1, records[macs[0].String()].circuit)
+	assert.Equal(t, circuit1, records[macs[2].String()].circuit)
+}
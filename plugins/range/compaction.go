@@ -0,0 +1,124 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// compactionWindow is when the lease file is compacted while the server runs:
+// every day, or on a given day of the week, at a wall-clock time
+type compactionWindow struct {
+	hour, minute int
+	// weekday is only used if weekly is true
+	weekday time.Weekday
+	weekly  bool
+	loc     *time.Location
+}
+
+// parseCompactionWindow parses the compact setting: [<weekday>@]<HH:MM>, in
+// local time
+func parseCompactionWindow(arg string) (*compactionWindow, error) {
+	spec := strings.TrimPrefix(arg, "compact=")
+	w := compactionWindow{loc: time.Local}
+	if at := strings.Index(spec, "@"); at >= 0 {
+		wd, ok := weekdays[strings.ToLower(spec[:at])]
+		if !ok {
+			return nil, fmt.Errorf("invalid day of the week %q", spec[:at])
+		}
+		w.weekday, w.weekly = wd, true
+		spec = spec[at+1:]
+	}
+	t, err := time.Parse("15:04", spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time of day %q, expected [<weekday>@]HH:MM", spec)
+	}
+	w.hour, w.minute = t.Hour(), t.Minute()
+	return &w, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// next returns the first start of the window strictly after now
+func (w *compactionWindow) next(now time.Time) time.Time {
+	now = now.In(w.loc)
+	// Build the start from the calendar date rather than adding durations, so
+	// that it stays at the same wall-clock time across DST changes
+	for days := 0; ; days++ {
+		start := time.Date(now.Year(), now.Month(), now.Day()+days, w.hour, w.minute, 0, 0, w.loc)
+		if start.After(now) && (!w.weekly || start.Weekday() == w.weekday) {
+			return start
+		}
+	}
+}
+
+// scheduleCompaction arms the timer compacting the lease file at the next
+// window after now, if there is one. It must be called with the plugin lock
+// held
+func (p *PluginState) scheduleCompaction(now time.Time) {
+	if p.compaction == nil || p.closed {
+		return
+	}
+	p.compactTimer = time.AfterFunc(p.compaction.next(now).Sub(now), p.compactOnTimer)
+}
+
+func (p *PluginState) compactOnTimer() {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed {
+		return
+	}
+	start := time.Now()
+	reclaimed, err := p.compact()
+	if err != nil {
+		log.Errorf("Could not compact lease file %s: %v", p.filename, err)
+	} else {
+		log.Printf("Compacted lease file %s in %s, reclaimed %d bytes", p.filename, time.Since(start), reclaimed)
+	}
+	p.scheduleCompaction(time.Now())
+}
+
+// compact rewrites the lease file so that it only holds the current records,
+// and returns the number of bytes reclaimed. It must be called with the plugin
+// lock held, so requests wait for it: nothing is written to the file meanwhile
+func (p *PluginState) compact() (int64, error) {
+	if err := p.flushPending(); err != nil {
+		return 0, err
+	}
+	before, err := os.Stat(p.filename)
+	if err != nil {
+		return 0, err
+	}
+	if err := compactLeaseFile(p.filename, p.Recordsv4); err != nil {
+		// The lease file is left untouched
+		return 0, err
+	}
+	// The open file was replaced, leases go to the new one from now on
+	newLeasefile, err := os.OpenFile(p.filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		// Leases still go to the replaced file, and are lost on restart
+		return 0, fmt.Errorf("could not reopen compacted lease file: %w", err)
+	}
+	if err := p.leasefile.Close(); err != nil {
+		log.Warningf("Could not close replaced lease file %s: %v", p.filename, err)
+	}
+	p.leasefile = newLeasefile
+	after, err := newLeasefile.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return before.Size() - after.Size(), nil
+}
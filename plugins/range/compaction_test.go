@@ -0,0 +1,138 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCompactionWindow(t *testing.T) {
+	w, err := parseCompactionWindow("compact=03:30")
+	require.NoError(t, err)
+	assert.Equal(t, 3, w.hour)
+	assert.Equal(t, 30, w.minute)
+	assert.False(t, w.weekly)
+	assert.Equal(t, time.Local, w.loc)
+
+	w, err = parseCompactionWindow("compact=Sunday@23:00")
+	require.NoError(t, err)
+	assert.True(t, w.weekly)
+	assert.Equal(t, time.Sunday, w.weekday)
+	assert.Equal(t, 23, w.hour)
+
+	for _, arg := range []string{"compact=", "compact=3h", "compact=25:00", "compact=someday@03:00", "compact=sunday@"} {
+		_, err := parseCompactionWindow(arg)
+		assert.Error(t, err, arg)
+	}
+}
+
+func TestCompactionWindowNext(t *testing.T) {
+	// Clocks go forward from 02:00 to 03:00 on 2021-03-28 in Paris, and back
+	// from 03:00 to 02:00 on 2021-10-31
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skipf("no timezone data: %v", err)
+	}
+	daily := &compactionWindow{hour: 3, minute: 0, loc: paris}
+	weekly := &compactionWindow{hour: 3, minute: 0, weekday: time.Wednesday, weekly: true, loc: paris}
+	for _, tt := range []struct {
+		name string
+		w    *compactionWindow
+		now  time.Time
+		want time.Time
+	}{
+		{"before the window", daily, time.Date(2021, 6, 1, 2, 59, 0, 0, paris), time.Date(2021, 6, 1, 3, 0, 0, 0, paris)},
+		{"at the window", daily, time.Date(2021, 6, 1, 3, 0, 0, 0, paris), time.Date(2021, 6, 2, 3, 0, 0, 0, paris)},
+		{"after the window", daily, time.Date(2021, 6, 1, 12, 0, 0, 0, paris), time.Date(2021, 6, 2, 3, 0, 0, 0, paris)},
+		{"end of month", daily, time.Date(2021, 6, 30, 4, 0, 0, 0, paris), time.Date(2021, 7, 1, 3, 0, 0, 0, paris)},
+		{"other timezone", daily, time.Date(2021, 6, 1, 0, 30, 0, 0, time.UTC), time.Date(2021, 6, 1, 3, 0, 0, 0, paris)},
+		{"DST starts", daily, time.Date(2021, 3, 27, 12, 0, 0, 0, paris), time.Date(2021, 3, 28, 3, 0, 0, 0, paris)},
+		{"DST ends", daily, time.Date(2021, 10, 30, 12, 0, 0, 0, paris), time.Date(2021, 10, 31, 3, 0, 0, 0, paris)},
+		{"later this week", weekly, time.Date(2021, 6, 1, 12, 0, 0, 0, paris), time.Date(2021, 6, 2, 3, 0, 0, 0, paris)},
+		{"next week", weekly, time.Date(2021, 6, 2, 3, 0, 0, 0, paris), time.Date(2021, 6, 9, 3, 0, 0, 0, paris)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			next := tt.w.next(tt.now)
+			assert.True(t, tt.want.Equal(next), "want %s, got %s", tt.want, next)
+		})
+	}
+
+	// 25 hours pass over the end of DST, and 23 over its start
+	assert.Equal(t, 25*time.Hour, daily.next(time.Date(2021, 10, 30, 3, 0, 0, 0, paris)).Sub(time.Date(2021, 10, 30, 3, 0, 0, 0, paris)))
+	assert.Equal(t, 23*time.Hour, daily.next(time.Date(2021, 3, 27, 3, 0, 0, 0, paris)).Sub(time.Date(2021, 3, 27, 3, 0, 0, 0, paris)))
+}
+
+// TestCompactRunning checks that the lease file is compacted while it is open,
+// and that the following leases are written to the compacted file
+func TestCompactRunning(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "coredhcptest")
+	require.NoError(t, err)
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	lines := strings.SplitAfter(leasefile, "\n")
+	pl := PluginState{Recordsv4: make(map[string]*Record), flushInterval: time.Hour, flushSize: 10}
+	require.NoError(t, pl.registerBackingFile(tmpfile.Name()))
+	defer pl.close()
+	save := func(i int, renewal bool) {
+		hwaddr, err := net.ParseMAC(records[i].mac)
+		require.NoError(t, err)
+		pl.Recordsv4[hwaddr.String()] = records[i].ip
+		if renewal {
+			require.NoError(t, pl.saveRenewal(hwaddr, records[i].ip))
+		} else {
+			require.NoError(t, pl.saveIPAddress(hwaddr, records[i].ip))
+		}
+	}
+	for i := 0; i < 3; i++ {
+		save(0, false)
+		save(1, false)
+	}
+	// A renewal still buffered is written out before compacting
+	save(2, true)
+
+	reclaimed, err := pl.compact()
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(lines[0])+len(lines[1]))*2, reclaimed)
+	written, err := ioutil.ReadFile(tmpfile.Name())
+	require.NoError(t, err)
+	assert.Equal(t, strings.Join(lines[:3], ""), string(written))
+
+	save(3, false)
+	written, err = ioutil.ReadFile(tmpfile.Name())
+	require.NoError(t, err)
+	assert.Equal(t, strings.Join(lines[:4], ""), string(written), "lease written to the replaced file")
+}
+
+// TestScheduleCompaction checks that the timer is only armed with a window,
+// and is stopped when the plugin is closed
+func TestScheduleCompaction(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "coredhcptest")
+	require.NoError(t, err)
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	pl := PluginState{}
+	require.NoError(t, pl.registerBackingFile(tmpfile.Name()))
+	pl.scheduleCompaction(time.Now())
+	assert.Nil(t, pl.compactTimer)
+
+	pl.compaction = &compactionWindow{hour: 3, loc: time.Local}
+	pl.scheduleCompaction(time.Now())
+	require.NotNil(t, pl.compactTimer)
+	require.NoError(t, pl.close())
+	assert.False(t, pl.compactTimer.Stop(), "the timer was not stopped")
+
+	// A timer that fired while the plugin was closing does nothing
+	pl.compactOnTimer()
+}
@@ -0,0 +1,204 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/coredhcp/coredhcp/plugins/rfc2131"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// degenerateAction is what to do with requests from clients whose identity
+// cannot tell them apart from others, see isDegenerate
+type degenerateAction int
+
+const (
+	// degenerateDrop drops their requests
+	degenerateDrop degenerateAction = iota
+	// degenerateFallback keys their leases on another identity, see
+	// fallbackHWAddr, and drops their requests if they have none
+	degenerateFallback
+	// degenerateNoStore gives them addresses that are not stored, see
+	// serveUnstored
+	degenerateNoStore
+)
+
+// degeneratePolicy decides how to serve clients with a degenerate identity
+type degeneratePolicy struct {
+	action degenerateAction
+	// unstored holds the addresses given with degenerateNoStore, by
+	// address. They are only kept in memory
+	unstored map[string]unstoredLease
+
+	// Number of requests from clients with a degenerate identity, by
+	// outcome. They are protected by the plugin lock
+	dropped, fallback, notStored uint64
+}
+
+// unstoredLease is an address given to a client with a degenerate identity
+type unstoredLease struct {
+	expires time.Time
+	// xid is the transaction the address was last given in
+	xid dhcpv4.TransactionID
+}
+
+// offerTimeout is how long an address offered to a client with a degenerate
+// identity is held for, until the client requests it. As such clients cannot
+// be recognized, each DHCPDISCOVER gets an address: holding them for the lease
+// time would let clients that never request them exhaust the pool
+const offerTimeout = time.Minute
+
+// parseDegeneratePolicy parses a degenerate= setting: drop, fallback or nostore
+func parseDegeneratePolicy(arg string, leaseTime time.Duration) (degeneratePolicy, error) {
+	p := degeneratePolicy{unstored: make(map[string]unstoredLease)}
+	switch spec := strings.TrimPrefix(arg, "degenerate="); spec {
+	case "drop":
+	case "fallback":
+		p.action = degenerateFallback
+	case "nostore":
+		if leaseTime == infinite {
+			return p, fmt.Errorf("invalid degenerate client policy %q, addresses that are not stored need a finite lease time", arg)
+		}
+		p.action = degenerateNoStore
+	default:
+		return p, fmt.Errorf("invalid degenerate client policy %q, expected drop, fallback or nostore", arg)
+	}
+	return p, nil
+}
+
+// DegenerateClients returns the number of requests the instance got from
+// clients with a degenerate identity since the server started, by outcome:
+// dropped, served under a fallback identity, or served without storing the
+// lease
+func (p *PluginState) DegenerateClients() (dropped, fallback, notStored uint64) {
+	p.Lock()
+	defer p.Unlock()
+	return p.degenerate.dropped, p.degenerate.fallback, p.degenerate.notStored
+}
+
+// isDegenerateHWAddr returns true for hardware addresses that cannot identify a
+// single client: empty, all-zero or broadcast addresses, which some devices
+// send. Keying leases on them would make unrelated clients share a lease
+func isDegenerateHWAddr(hwaddr net.HardwareAddr) bool {
+	if len(hwaddr) == 0 {
+		return true
+	}
+	allZero, allOnes := true, true
+	for _, b := range hwaddr {
+		allZero = allZero && b == 0
+		allOnes = allOnes && b == 0xff
+	}
+	return allZero || allOnes
+}
+
+// usableClientID returns the Client Identifier option of req, or nil if it has
+// none or it is shorter than the 2 bytes RFC2132 §9.14 requires
+func usableClientID(req *dhcpv4.DHCPv4) []byte {
+	if id := req.Options.Get(dhcpv4.OptionClientIdentifier); len(id) >= 2 {
+		return id
+	}
+	return nil
+}
+
+// isDegenerate returns true if the identity of the client of req is
+// degenerate: a degenerate hardware address, or an empty Client Identifier
+func isDegenerate(req *dhcpv4.DHCPv4) bool {
+	return isDegenerateHWAddr(req.ClientHWAddr) ||
+		req.Options.Has(dhcpv4.OptionClientIdentifier) && usableClientID(req) == nil
+}
+
+// derivedHWAddr returns a locally administered unicast hardware address derived
+// from an identity of a client, so that leases keyed on it are stored like
+// those of other clients
+func derivedHWAddr(kind string, id []byte) net.HardwareAddr {
+	sum := sha256.Sum256(append([]byte(kind+"\x00"), id...))
+	hwaddr := net.HardwareAddr(sum[:6])
+	hwaddr[0] = hwaddr[0]&^0x01 | 0x02
+	return hwaddr
+}
+
+// fallbackHWAddr returns the hardware address to key the lease of a client
+// with a degenerate identity on: derived from its Client Identifier, then from
+// the relay circuit it is behind, and then its own if only its Client
+// Identifier is degenerate. It returns false if the client has none of them
+func fallbackHWAddr(req *dhcpv4.DHCPv4) (net.HardwareAddr, bool) {
+	if id := usableClientID(req); id != nil {
+		return derivedHWAddr("client-id", id), true
+	}
+	if circuit := circuitID(req); circuit != "" {
+		return derivedHWAddr("circuit-id", []byte(circuit)), true
+	}
+	if !isDegenerateHWAddr(req.ClientHWAddr) {
+		return req.ClientHWAddr, true
+	}
+	return nil, false
+}
+
+// serveUnstored answers a client with a degenerate identity with an address
+// that is only held in memory, and never stored. As the client cannot be
+// recognized, the address it asks for is confirmed if it was given that way and
+// did not expire, and a new one is given otherwise. Retransmissions of a
+// DHCPDISCOVER, in the same transaction, are offered the same address. Offered
+// addresses are held for offerTimeout, and for the lease time once requested.
+// It must be called with the plugin lock held
+func (p *PluginState) serveUnstored(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	now := time.Now()
+	for addr, lease := range p.degenerate.unstored {
+		if !now.Before(lease.expires) {
+			delete(p.degenerate.unstored, addr)
+			if err := p.allocator.Free(net.IPNet{IP: net.ParseIP(addr).To4()}); err != nil {
+				log.Warningf("Could not free unstored address %s: %v", addr, err)
+			}
+		}
+	}
+
+	ip := req.ClientIPAddr.To4()
+	if ip == nil || ip.IsUnspecified() {
+		ip = req.RequestedIPAddress().To4()
+	}
+	lease, ok := p.degenerate.unstored[ip.String()]
+	if ip == nil || !ok {
+		switch {
+		case rfc2131.RequestState(req) == rfc2131.StateInitReboot:
+			// Like other unknown clients in initReboot
+			return p.unknownInitReboot(resp)
+		case req.MessageType() == dhcpv4.MessageTypeRequest:
+			return nak(resp)
+		}
+		ip = nil
+		for addr, l := range p.degenerate.unstored {
+			if l.xid == req.TransactionID {
+				ip, lease = net.ParseIP(addr).To4(), l
+				break
+			}
+		}
+		if ip == nil {
+			n, err := p.allocator.Allocate(net.IPNet{})
+			if err != nil {
+				limited.Limited("allocate").Errorf("Could not allocate IP for a client with a degenerate identity: %v", err)
+				return nil, true
+			}
+			ip = n.IP.To4()
+		}
+	}
+	hold := offerTimeout
+	if req.MessageType() == dhcpv4.MessageTypeRequest {
+		hold = p.LeaseTime
+	}
+	if expires := now.Add(hold); expires.After(lease.expires) {
+		lease.expires = expires
+	}
+	lease.xid = req.TransactionID
+	p.degenerate.unstored[ip.String()] = lease
+	resp.YourIPAddr = ip
+	resp.Options.Update(dhcpv4.OptIPAddressLeaseTime(p.LeaseTime.Round(time.Second)))
+	log.Debugf("gave unstored IP address %s to a client with a degenerate identity", ip)
+	return resp, false
+}
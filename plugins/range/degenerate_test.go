@@ -0,0 +1,226 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coredhcp/coredhcp/internal/testpackets"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsDegenerateHWAddr(t *testing.T) {
+	testcases := []struct {
+		hwaddr     net.HardwareAddr
+		degenerate bool
+	}{
+		{nil, true},
+		{net.HardwareAddr{}, true},
+		{net.HardwareAddr{0, 0, 0, 0, 0, 0}, true},
+		{net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, true},
+		{net.HardwareAddr{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, true},
+		{net.HardwareAddr{0x02, 0, 0, 0, 0, 0}, false},
+		{net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xfe}, false},
+		{net.HardwareAddr{0, 0, 0, 0, 0, 1}, false},
+	}
+
+	for _, tc := range testcases {
+		if got := isDegenerateHWAddr(tc.hwaddr); got != tc.degenerate {
+			t.Errorf("isDegenerateHWAddr(%v) = %v, expected %v", tc.hwaddr, got, tc.degenerate)
+		}
+	}
+}
+
+var (
+	zeroMAC    = net.HardwareAddr{0, 0, 0, 0, 0, 0}
+	relay      = net.IPv4(192, 0, 2, 1)
+	clientID   = dhcpv4.OptClientIdentifier([]byte{0xff, 0, 0, 0, 1})
+	emptyID    = dhcpv4.OptGeneric(dhcpv4.OptionClientIdentifier, nil)
+	typeOnlyID = dhcpv4.OptGeneric(dhcpv4.OptionClientIdentifier, []byte{0xff})
+)
+
+func TestIsDegenerate(t *testing.T) {
+	good := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	for _, tc := range []struct {
+		name       string
+		mac        net.HardwareAddr
+		mods       []dhcpv4.Modifier
+		degenerate bool
+	}{
+		{"usable", good, nil, false},
+		{"usable with client identifier", good, []dhcpv4.Modifier{dhcpv4.WithOption(clientID)}, false},
+		{"all-zero", zeroMAC, nil, true},
+		{"broadcast", net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, nil, true},
+		{"empty client identifier", good, []dhcpv4.Modifier{dhcpv4.WithOption(emptyID)}, true},
+		{"client identifier without identifier", good, []dhcpv4.Modifier{dhcpv4.WithOption(typeOnlyID)}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := testpackets.V4Discover(t, tc.mac, tc.mods...)
+			assert.Equal(t, tc.degenerate, isDegenerate(req))
+		})
+	}
+
+	// hlen 0
+	req, _ := testpackets.V4Discover(t, good)
+	req.ClientHWAddr = nil
+	assert.True(t, isDegenerate(req))
+}
+
+func TestFallbackHWAddr(t *testing.T) {
+	good := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	discover := func(mac net.HardwareAddr, circuit []byte, mods ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+		req, _ := testpackets.V4Discover(t, mac, mods...)
+		if circuit != nil {
+			req, _ = testpackets.V4Relayed(t, req, relay, circuit)
+		}
+		return req
+	}
+	byClientID := derivedHWAddr("client-id", clientID.Value.ToBytes())
+	byCircuit := derivedHWAddr("circuit-id", []byte("192.0.2.1 port1"))
+	for _, tc := range []struct {
+		name     string
+		req      *dhcpv4.DHCPv4
+		expected net.HardwareAddr
+	}{
+		{"client identifier first", discover(zeroMAC, []byte("port1"), dhcpv4.WithOption(clientID)), byClientID},
+		{"then circuit", discover(zeroMAC, []byte("port1")), byCircuit},
+		{"empty client identifier, then circuit", discover(zeroMAC, []byte("port1"), dhcpv4.WithOption(emptyID)), byCircuit},
+		{"then the hardware address", discover(good, nil, dhcpv4.WithOption(emptyID)), good},
+		{"none", discover(zeroMAC, nil, dhcpv4.WithOption(emptyID)), nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hwaddr, ok := fallbackHWAddr(tc.req)
+			assert.Equal(t, tc.expected != nil, ok)
+			assert.Equal(t, tc.expected, hwaddr)
+		})
+	}
+	assert.NotEqual(t, byClientID, derivedHWAddr("circuit-id", clientID.Value.ToBytes()), "identities of different kinds should not collide")
+	assert.Equal(t, byte(0x02), byClientID[0]&0x03, "derived addresses should be locally administered unicast")
+}
+
+func TestParseDegeneratePolicy(t *testing.T) {
+	for arg, action := range map[string]degenerateAction{
+		"degenerate=drop":     degenerateDrop,
+		"degenerate=fallback": degenerateFallback,
+		"degenerate=nostore":  degenerateNoStore,
+	} {
+		p, err := parseDegeneratePolicy(arg, 3600e9)
+		require.NoError(t, err)
+		assert.Equal(t, action, p.action)
+	}
+	_, err := parseDegeneratePolicy("degenerate=serve", 3600e9)
+	assert.Error(t, err)
+	_, err = parseDegeneratePolicy("degenerate=nostore", infinite)
+	assert.Error(t, err, "addresses that are not stored cannot be leased forever")
+}
+
+func TestDegenerate(t *testing.T) {
+	// setup returns an instance with a lease file of its own
+	setup := func(t *testing.T, settings ...string) (*PluginState, string) {
+		tmpfile, err := ioutil.TempFile("", "coredhcp-degenerate")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.Remove(tmpfile.Name()) })
+		tmpfile.Close()
+		p, err := setupInstance(append([]string{tmpfile.Name(), "192.0.2.10", "192.0.2.19", "1h"}, settings...)...)
+		require.NoError(t, err)
+		return p, tmpfile.Name()
+	}
+	handle := func(p *PluginState, req *dhcpv4.DHCPv4, mt dhcpv4.MessageType) *dhcpv4.DHCPv4 {
+		resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(mt))
+		require.NoError(t, err)
+		resp, _ = p.Handler4(req, resp)
+		return resp
+	}
+	withCircuit, _ := testpackets.V4Discover(t, zeroMAC)
+	withCircuit, _ = testpackets.V4Relayed(t, withCircuit, relay, []byte("port1"))
+	anonymous, _ := testpackets.V4Discover(t, zeroMAC)
+
+	t.Run("drop", func(t *testing.T) {
+		p, _ := setup(t)
+		assert.Nil(t, handle(p, withCircuit, dhcpv4.MessageTypeOffer))
+		assert.Empty(t, p.Recordsv4)
+		dropped, fallback, notStored := p.DegenerateClients()
+		assert.Equal(t, [3]uint64{1, 0, 0}, [3]uint64{dropped, fallback, notStored})
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		p, _ := setup(t, "degenerate=fallback")
+		offer := handle(p, withCircuit, dhcpv4.MessageTypeOffer)
+		require.NotNil(t, offer)
+		record, ok := p.Recordsv4[derivedHWAddr("circuit-id", []byte("192.0.2.1 port1")).String()]
+		require.True(t, ok, "the lease was not keyed on the circuit")
+		assert.Equal(t, record.IP, offer.YourIPAddr.To4())
+		assert.Nil(t, handle(p, anonymous, dhcpv4.MessageTypeOffer), "clients without a fallback identity are dropped")
+		dropped, fallback, notStored := p.DegenerateClients()
+		assert.Equal(t, [3]uint64{1, 1, 0}, [3]uint64{dropped, fallback, notStored})
+	})
+
+	t.Run("nostore", func(t *testing.T) {
+		p, filename := setup(t, "degenerate=nostore")
+		first := handle(p, anonymous, dhcpv4.MessageTypeOffer)
+		require.NotNil(t, first)
+		other, _ := testpackets.V4Discover(t, zeroMAC)
+		second := handle(p, other, dhcpv4.MessageTypeOffer)
+		require.NotNil(t, second)
+		assert.False(t, first.YourIPAddr.Equal(second.YourIPAddr), "unrelated clients got the same address")
+		assert.Empty(t, p.Recordsv4)
+		used, _ := p.Usage()
+		assert.Equal(t, 2, used)
+
+		// The offered address is confirmed, others are refused
+		req, _ := testpackets.V4RequestSelecting(t, zeroMAC, relay, first.YourIPAddr)
+		ack := handle(p, req, dhcpv4.MessageTypeAck)
+		require.NotNil(t, ack)
+		assert.Equal(t, dhcpv4.MessageTypeAck, ack.MessageType())
+		assert.True(t, first.YourIPAddr.Equal(ack.YourIPAddr))
+		req, _ = testpackets.V4RequestSelecting(t, zeroMAC, relay, net.IPv4(192, 0, 2, 19))
+		nak := handle(p, req, dhcpv4.MessageTypeAck)
+		require.NotNil(t, nak)
+		assert.Equal(t, dhcpv4.MessageTypeNak, nak.MessageType())
+
+		dropped, fallback, notStored := p.DegenerateClients()
+		assert.Equal(t, [3]uint64{0, 0, 4}, [3]uint64{dropped, fallback, notStored})
+		records, err := loadRecordsFromFile(filename)
+		require.NoError(t, err)
+		assert.Empty(t, records, "leases of degenerate clients were stored")
+
+		// Offers are held until the client requests them, leases for
+		// the lease time
+		now := time.Now()
+		assert.WithinDuration(t, now.Add(offerTimeout), p.degenerate.unstored[second.YourIPAddr.String()].expires, time.Second)
+		assert.WithinDuration(t, now.Add(time.Hour), p.degenerate.unstored[first.YourIPAddr.String()].expires, time.Second)
+	})
+
+	t.Run("repeated discovers", func(t *testing.T) {
+		p, _ := setup(t, "degenerate=nostore")
+		// Retransmissions in a transaction get the same offer
+		offer := handle(p, anonymous, dhcpv4.MessageTypeOffer)
+		require.NotNil(t, offer)
+		for i := 0; i < 20; i++ {
+			again := handle(p, anonymous, dhcpv4.MessageTypeOffer)
+			require.NotNil(t, again)
+			assert.True(t, offer.YourIPAddr.Equal(again.YourIPAddr), "retransmission got another address")
+		}
+		used, _ := p.Usage()
+		assert.Equal(t, 1, used)
+
+		// New transactions that never request their offer do not drain
+		// the pool of 10 addresses once the offers time out
+		for i := 0; i < 30; i++ {
+			req, _ := testpackets.V4Discover(t, zeroMAC)
+			require.NotNil(t, handle(p, req, dhcpv4.MessageTypeOffer), "pool drained after %d transactions", i)
+			for addr, lease := range p.degenerate.unstored {
+				lease.expires = lease.expires.Add(-offerTimeout)
+				p.degenerate.unstored[addr] = lease
+			}
+		}
+	})
+}
@@ -0,0 +1,57 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// infiniteLeaseTime is the encoding of an infinite lease time in the IP
+// Address Lease Time option (RFC2132 §9.2)
+const infiniteLeaseTime = math.MaxUint32
+
+// infinite is the lease time of leases that never expire. It is encoded as
+// infiniteLeaseTime on the wire; records hold it as a flag rather than as a
+// far-future expiry
+const infinite = time.Duration(infiniteLeaseTime) * time.Second
+
+// parseLeaseTime parses a lease time: a duration, shorter than can be encoded
+// in a DHCP option, or "infinite"
+func parseLeaseTime(s string) (time.Duration, error) {
+	if s == "infinite" {
+		return infinite, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d >= infinite {
+		return 0, errors.New("lease time too long, use infinite for leases that never expire")
+	}
+	return d, nil
+}
+
+func formatLeaseTime(d time.Duration) string {
+	if d == infinite {
+		return "infinite"
+	}
+	return d.String()
+}
+
+// expired returns whether the lease of r has expired at now
+func (r *Record) expired(now time.Time) bool {
+	return !r.infinite && r.expires.Before(now)
+}
+
+// setExpiry makes the lease of r last leaseTime from now
+func (r *Record) setExpiry(now time.Time, leaseTime time.Duration) {
+	if leaseTime == infinite {
+		r.infinite, r.expires = true, time.Time{}
+		return
+	}
+	r.infinite, r.expires = false, now.Add(leaseTime).Round(time.Second)
+}
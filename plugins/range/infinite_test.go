@@ -0,0 +1,84 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coredhcp/coredhcp/internal/testpackets"
+)
+
+func TestParseLeaseTime(t *testing.T) {
+	d, err := parseLeaseTime("infinite")
+	require.NoError(t, err)
+	assert.Equal(t, infinite, d)
+
+	d, err = parseLeaseTime("1h")
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, d)
+
+	for _, bad := range []string{"", "forever", "2000000h"} {
+		_, err := parseLeaseTime(bad)
+		assert.Error(t, err, "%s should be refused", bad)
+	}
+}
+
+func TestInfiniteRecordRoundTrip(t *testing.T) {
+	rec := &Record{IP: net.IPv4(192, 0, 2, 10)}
+	rec.setExpiry(time.Now(), infinite)
+	line := formatRecord("02:00:00:00:00:01", rec)
+	assert.Equal(t, "02:00:00:00:00:01 192.0.2.10 infinite\n", line)
+
+	_, parsed, err := parseRecord(line[:len(line)-1])
+	require.NoError(t, err)
+	assert.Equal(t, rec, parsed)
+	assert.False(t, parsed.expired(time.Now().AddDate(1000, 0, 0)))
+
+	// Far-future expiries written by other servers are infinite leases
+	_, parsed, err = parseRecord("02:00:00:00:00:01 192.0.2.10 2200-01-01T00:00:00Z")
+	require.NoError(t, err)
+	assert.True(t, parsed.infinite)
+	_, parsed, err = parseRecord("02:00:00:00:00:01 192.0.2.10 2100-01-01T00:00:00Z")
+	require.NoError(t, err)
+	assert.False(t, parsed.infinite)
+}
+
+func TestInfiniteLeases(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "coredhcp-infinite")
+	require.NoError(t, err)
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	p, err := setupInstance(tmpfile.Name(), "192.0.2.10", "192.0.2.19", "infinite")
+	require.NoError(t, err)
+	h := p.Handler4
+
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	req, _ := testpackets.V4Discover(t, mac)
+	resp, err := dhcpv4.NewReplyFromRequest(req)
+	require.NoError(t, err)
+	resp, _ = h(req, resp)
+	require.NotNil(t, resp)
+	assert.Equal(t, []byte{0xff, 0xff, 0xff, 0xff}, resp.Options.Get(dhcpv4.OptionIPAddressLeaseTime))
+	rec := p.Recordsv4[mac.String()]
+	assert.True(t, rec.infinite)
+
+	// The lease survives a restart, and is never reclaimed
+	p, err = setupInstance(tmpfile.Name(), "192.0.2.10", "192.0.2.19", "1h")
+	require.NoError(t, err)
+	loaded := p.Recordsv4[mac.String()]
+	require.NotNil(t, loaded)
+	assert.True(t, rec.IP.Equal(loaded.IP))
+	assert.True(t, loaded.infinite)
+	assert.False(t, loaded.expired(time.Now().AddDate(100, 0, 0)))
+}
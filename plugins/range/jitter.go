@@ -0,0 +1,57 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// leaseJitter spreads the lease times of clients around the lease duration, so
+// that clients that got their lease at the same time, such as after a power
+// cut, do not all renew at the same time. The offset of each client is derived
+// from its hardware address, so it is stable across renewals. The zero value
+// applies no jitter
+type leaseJitter struct {
+	percent int
+}
+
+// maxJitter is the largest jitter, as a percentage of the lease duration
+const maxJitter = 50
+
+// parseJitter parses a jitter setting, of the form jitter=<percentage>%
+func parseJitter(arg string) (leaseJitter, error) {
+	spec := strings.TrimPrefix(arg, "jitter=")
+	percent, err := strconv.Atoi(strings.TrimSuffix(spec, "%"))
+	if err != nil || !strings.HasSuffix(spec, "%") || percent < 1 || percent > maxJitter {
+		return leaseJitter{}, fmt.Errorf("invalid jitter in %q, expected a percentage between 1%% and %d%%", arg, maxJitter)
+	}
+	return leaseJitter{percent: percent}, nil
+}
+
+// apply returns the lease time d for the client hwaddr, shifted by up to the
+// jitter percentage either way, to the second
+func (j leaseJitter) apply(d time.Duration, hwaddr net.HardwareAddr) time.Duration {
+	if j.percent == 0 || d == infinite {
+		return d
+	}
+	span := int64(d/time.Second) * int64(j.percent) / 100
+	if span == 0 {
+		return d
+	}
+	h := fnv.New64a()
+	h.Write(hwaddr)
+	offset := int64(h.Sum64()%uint64(2*span+1)) - span
+	d += time.Duration(offset) * time.Second
+	if d >= infinite {
+		// Stay finite, and encodable
+		d = infinite - time.Second
+	}
+	return d
+}
@@ -0,0 +1,77 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coredhcp/coredhcp/internal/testpackets"
+)
+
+func TestParseJitter(t *testing.T) {
+	j, err := parseJitter("jitter=10%")
+	require.NoError(t, err)
+	assert.Equal(t, 10, j.percent)
+
+	for _, bad := range []string{"jitter=", "jitter=10", "jitter=0%", "jitter=51%", "jitter=-5%", "jitter=ten%"} {
+		_, err := parseJitter(bad)
+		assert.Error(t, err, "%s should be refused", bad)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	j := leaseJitter{percent: 10}
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 256; i++ {
+		mac := net.HardwareAddr{0x02, 0, 0, 0, 1, byte(i)}
+		d := j.apply(time.Hour, mac)
+		assert.True(t, d >= 54*time.Minute && d <= 66*time.Minute, "%s out of bounds for %s", d, mac)
+		assert.Equal(t, d, j.apply(time.Hour, mac), "jitter is not stable for %s", mac)
+		assert.Equal(t, time.Duration(0), d%time.Second)
+		seen[d] = true
+	}
+	assert.True(t, len(seen) > 100, "only %d distinct lease times for 256 clients", len(seen))
+
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	assert.Equal(t, time.Hour, leaseJitter{}.apply(time.Hour, mac))
+	assert.Equal(t, infinite, j.apply(infinite, mac))
+	assert.True(t, leaseJitter{percent: maxJitter}.apply(infinite-time.Second, mac) < infinite)
+}
+
+func TestJitterHandler(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "coredhcp-jitter")
+	require.NoError(t, err)
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	p, err := setupInstance(tmpfile.Name(), "192.0.2.10", "192.0.2.19", "1h", "jitter=20%")
+	require.NoError(t, err)
+	h := p.Handler4
+
+	// The jittered lease time is the one on the wire and in the record, and
+	// renewals keep it
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	expected := p.jitter.apply(time.Hour, mac)
+	for i := 0; i < 2; i++ {
+		req, _ := testpackets.V4Discover(t, mac)
+		resp, err := dhcpv4.NewReplyFromRequest(req)
+		require.NoError(t, err)
+		resp, _ = h(req, resp)
+		require.NotNil(t, resp)
+		assert.Equal(t, expected, resp.IPAddressLeaseTime(0))
+		assert.WithinDuration(t, time.Now().Add(expected), p.Recordsv4[mac.String()].expires, 2*time.Second)
+	}
+
+	_, err = setupInstance(tmpfile.Name(), "192.0.2.10", "192.0.2.19", "1h", "jitter=10%", "jitter=20%")
+	assert.Error(t, err, "several jitters should be refused")
+}
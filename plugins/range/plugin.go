@@ -5,11 +5,11 @@
 package rangeplugin
 
 import (
+	"bytes"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"net"
-	"os"
+	"strconv"
 	"sync"
 	"time"
 
@@ -17,22 +17,40 @@ import (
 	"github.com/coredhcp/coredhcp/logger"
 	"github.com/coredhcp/coredhcp/plugins"
 	"github.com/coredhcp/coredhcp/plugins/allocators"
-	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+	"github.com/coredhcp/coredhcp/plugins/netmask"
+	"github.com/coredhcp/coredhcp/plugins/rfc2131"
 	"github.com/insomniacslk/dhcp/dhcpv4"
 )
 
 var log = logger.GetLogger("plugins/range")
 
+// limited logs the errors that can repeat for every request, such as lease file
+// write failures
+var limited = logger.NewLimiter(log, 10, time.Minute)
+
+// pluginName is the name the plugin is registered, and registers its state in
+// the chain, under
+const pluginName = "range"
+
 // Plugin wraps plugin registration information
 var Plugin = plugins.Plugin{
-	Name:   "range",
-	Setup4: setupRange,
+	Name:        pluginName,
+	ChainSetup4: setupRange,
+	Validate4:   validateRange,
 }
 
 //Record holds an IP lease record
 type Record struct {
 	IP      net.IP
 	expires time.Time
+	// infinite leases never expire, and have no expiry time
+	infinite bool
+	// tier is the lease tier the client was given a shorter lease under, nil
+	// for the normal lease time
+	tier *leaseTier
+	// circuit is the relay address and Agent Circuit ID of the relay
+	// circuit the client is behind, see circuitID
+	circuit string
 }
 
 // PluginState is the data held by an instance of the range plugin
@@ -42,82 +60,436 @@ type PluginState struct {
 	// Recordsv4 holds a MAC -> IP address and lease time mapping
 	Recordsv4 map[string]*Record
 	LeaseTime time.Duration
-	leasefile *os.File
+	leasefile leaseFile
 	allocator allocators.Allocator
+	// start and end are the first and last addresses of the pool
+	start, end net.IP
+	poolSize   int
+	// tiers shorten the leases of new clients when the pool runs out of
+	// free addresses
+	tiers leaseTiers
+	// requested decides the lease time of clients requesting a longer one
+	requested requestPolicy
+	// migration moves leases out of renumbered prefixes
+	migration renumberPlan
+	// circuits limits the number of clients behind each relay circuit
+	circuits circuitLimit
+	// jitter spreads the lease times of clients around LeaseTime
+	jitter leaseJitter
+	// degenerate serves the clients whose identity cannot tell them apart
+	degenerate degeneratePolicy
+	// granted counts the addresses given to new clients across the pool
+	granted distribution
+	// limits end the leases early, see LimitExpiry
+	limits []func(now time.Time) time.Time
+	// mask is the subnet mask of the netmask plugin of the chain, if any
+	mask net.IPMask
+	// last is set for the last instance of the chain, which remains silent
+	// for the INIT-REBOOT clients no instance knows, see unknownInitReboot
+	last bool
+
+	// Renewals are buffered in pending and written out in batches when
+	// flushInterval is non-zero, see saveRenewal
+	flushInterval time.Duration
+	flushSize     int
+	pending       bytes.Buffer
+	pendingCount  int
+	flushTimer    *time.Timer
+	// closed is set by close, after which nothing is written to leasefile
+	closed bool
+
+	// filename is the name of leasefile, which is compacted in the
+	// compaction window, if any, see compact
+	filename     string
+	compaction   *compactionWindow
+	compactTimer *time.Timer
+}
+
+// Instances returns the state of the instances of the range plugin in chain,
+// for the other plugins of the chain
+func Instances(chain *plugins.Chain) []*PluginState {
+	var states []*PluginState
+	for _, state := range chain.Instances(pluginName) {
+		states = append(states, state.(*PluginState))
+	}
+	return states
+}
+
+// Usage returns the number of leased addresses and the number of addresses in
+// the pool. Other plugins can use it to react to pool pressure
+func (p *PluginState) Usage() (used, size int) {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.Recordsv4) + len(p.degenerate.unstored), p.poolSize
+}
+
+// DumpFunc receives the leases of an instance from Dump, one at a time. A zero
+// expires is an infinite lease. Returning an error stops the dump
+type DumpFunc func(hwaddr net.HardwareAddr, ip net.IP, expires time.Time) error
+
+// Dump streams the leases that have not expired at now to f, in no particular
+// order, and returns the first error f returns. The instance is locked during
+// the dump, so f must not call back into it
+func (p *PluginState) Dump(now time.Time, f DumpFunc) error {
+	p.Lock()
+	defer p.Unlock()
+	for mac, record := range p.Recordsv4 {
+		if record.expired(now) {
+			continue
+		}
+		hwaddr, err := net.ParseMAC(mac)
+		if err != nil {
+			return fmt.Errorf("BUG: invalid MAC %q in the records: %w", mac, err)
+		}
+		if err := f(hwaddr, record.IP, record.expires); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LimitExpiry makes the leases the instance grants or extends expire at
+// limit(now) at the latest, both in the record it stores and in the lease time
+// sent to the client. Other plugins of the chain call it from their setup, for
+// instance to end all leases at a time of day
+func (p *PluginState) LimitExpiry(limit func(now time.Time) time.Time) {
+	p.Lock()
+	defer p.Unlock()
+	p.limits = append(p.limits, limit)
+}
+
+// limit returns the earliest expiry of the limits set with LimitExpiry, if it
+// comes before leaseTime elapses from now, along with the lease time left
+// until then. It returns false if no limit ends the lease early
+func (p *PluginState) limit(leaseTime time.Duration, now time.Time) (expiry time.Time, left time.Duration, ok bool) {
+	for _, limit := range p.limits {
+		e := limit(now)
+		if (leaseTime == infinite || e.Before(now.Add(leaseTime))) && (!ok || e.Before(expiry)) {
+			expiry, ok = e, true
+		}
+	}
+	// Whole seconds, as in option 51, without going past the limit
+	return expiry, expiry.Sub(now).Truncate(time.Second), ok
+}
+
+// leaseTime returns the lease time of the record, normal unless it was given
+// under a lease tier
+func (r *Record) leaseTime(normal time.Duration) time.Duration {
+	if r.tier != nil {
+		return r.tier.leaseTime
+	}
+	return normal
+}
+
+// free returns the number of addresses of the pool without a lease
+func (p *PluginState) free() int {
+	return p.poolSize - len(p.Recordsv4) - len(p.degenerate.unstored)
+}
+
+// inPool returns whether ip is one of the addresses of the pool
+func (p *PluginState) inPool(ip net.IP) bool {
+	ip = ip.To4()
+	return ip != nil && bytes.Compare(ip, p.start) >= 0 && bytes.Compare(ip, p.end) <= 0
+}
+
+// extend makes the lease of record last at least its lease time from now,
+// normal unless it is under a lease tier, or until the limit set with
+// LimitExpiry that ends it early. It returns the lease time granted
+func (p *PluginState) extend(hwaddr net.HardwareAddr, record *Record, normal time.Duration) time.Duration {
+	if record.tier != nil {
+		// Clients only keep short leases while the pool is short of
+		// addresses; they are known clients once it is not
+		_, record.tier = p.tiers.leaseTime(p.free(), p.poolSize, normal)
+	}
+	leaseTime, now := record.leaseTime(normal), time.Now()
+	var extended bool
+	if expiry, left, ok := p.limit(leaseTime, now); ok {
+		// The lease ends at the limit, in the record as on the wire
+		extended = record.infinite || !record.expires.Equal(expiry)
+		record.infinite, record.expires = false, expiry
+		leaseTime = left
+	} else if leaseTime == infinite && !record.infinite ||
+		leaseTime != infinite && (record.infinite || record.expires.Before(now.Add(leaseTime))) {
+		// Ensure we extend the existing lease at least past when the one we're giving expires
+		extended = true
+		record.setExpiry(now, leaseTime)
+	}
+	if extended {
+		err := p.saveRenewal(hwaddr, record)
+		if err != nil {
+			limited.Limited("persist").Errorf("Could not persist lease for MAC %s: %v", hwaddr.String(), err)
+		}
+	}
+	return leaseTime
+}
+
+// initReboot answers a DHCPREQUEST from a client in the INIT-REBOOT state,
+// verifying the address it was previously given (RFC2131 §4.3.2). The address
+// is confirmed from the client record, without allocating one: a DHCPACK if
+// it is the address of a lease that has not expired, a DHCPNAK if it is
+// another address, or if it is on another network than the client. Requests
+// from clients without a record, or from networks this pool does not serve,
+// are left unchanged to the next plugins, as another instance or another
+// server may know them
+func (p *PluginState) initReboot(req, resp *dhcpv4.DHCPv4, normal time.Duration) (*dhcpv4.DHCPv4, bool) {
+	requested := req.RequestedIPAddress()
+	mask := p.mask
+	if mask == nil {
+		mask = resp.SubnetMask()
+	}
+	serves, wrongNetwork := p.checkNetwork(req, mask)
+	if !serves {
+		log.Debugf("MAC %s requested %s from a network this pool does not serve", req.ClientHWAddr.String(), requested)
+		return p.unknownInitReboot(resp)
+	}
+	record, ok := p.Recordsv4[req.ClientHWAddr.String()]
+	switch {
+	case wrongNetwork:
+		log.Printf("MAC %s requested %s on another network", req.ClientHWAddr.String(), requested)
+	case !ok:
+		log.Printf("MAC %s requested %s without a lease, ignoring", req.ClientHWAddr.String(), requested)
+		return p.unknownInitReboot(resp)
+	case !record.IP.Equal(requested):
+		log.Printf("MAC %s requested %s but its lease is for %s", req.ClientHWAddr.String(), requested, record.IP)
+	case record.expired(time.Now()):
+		log.Printf("MAC %s requested %s but its lease expired", req.ClientHWAddr.String(), requested)
+	default:
+		leaseTime := p.extend(req.ClientHWAddr, record, normal)
+		resp.YourIPAddr = record.IP
+		resp.Options.Update(dhcpv4.OptIPAddressLeaseTime(leaseTime.Round(time.Second)))
+		log.Printf("confirmed IP address %s for MAC %s", record.IP, req.ClientHWAddr.String())
+		return resp, false
+	}
+	return nak(resp)
+}
+
+// unknownInitReboot answers an INIT-REBOOT request the instance has no record
+// of. It is left to the next plugins, as another instance or another plugin
+// may know the client, unless this is the last instance and no plugin before
+// gave the client an address: the request is then dropped, as RFC2131 §4.3.2
+// asks of servers without a record of the client
+func (p *PluginState) unknownInitReboot(resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if p.last && (resp.YourIPAddr == nil || resp.YourIPAddr.IsUnspecified()) {
+		return nil, true
+	}
+	return resp, false
+}
+
+// checkNetwork finds the network of the client of an INIT-REBOOT request, from
+// the relay address if there is one and the pool otherwise, with the subnet
+// mask given to clients. It returns whether the pool is on that network, and
+// whether the requested address is on another network. Without a subnet mask
+// the network is unknown, and assumed to be the one of the pool
+func (p *PluginState) checkNetwork(req *dhcpv4.DHCPv4, mask net.IPMask) (serves, wrongNetwork bool) {
+	if len(mask) != net.IPv4len {
+		return true, false
+	}
+	network := p.start.Mask(mask)
+	if giaddr := req.GatewayIPAddr.To4(); giaddr != nil && !giaddr.IsUnspecified() {
+		network = giaddr.Mask(mask)
+	}
+	requested := req.RequestedIPAddress().To4()
+	return network.Equal(p.start.Mask(mask)), requested == nil || !requested.Mask(mask).Equal(network)
+}
+
+// nak turns resp into a DHCPNAK and stops the chain
+func nak(resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	rfc2131.Nak(resp)
+	return resp, true
 }
 
 // Handler4 handles DHCPv4 packets for the range plugin
 func (p *PluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
 	p.Lock()
 	defer p.Unlock()
+	// Waiting for the lease file writes of other requests may take the
+	// request past its deadline. Allocating or writing out a lease for a
+	// client that stopped waiting is wasted, and may hold up the next ones
+	if err := handler.Context4(req).Err(); err != nil {
+		limited.Limited("deadline").Warningf("Dropping request from MAC %s past its deadline, nothing leased", req.ClientHWAddr.String())
+		return nil, true
+	}
+	if isDegenerate(req) {
+		switch p.degenerate.action {
+		case degenerateNoStore:
+			p.degenerate.notStored++
+			return p.serveUnstored(req, resp)
+		case degenerateFallback:
+			if hwaddr, ok := fallbackHWAddr(req); ok {
+				p.degenerate.fallback++
+				log.Debugf("Client with degenerate identity '%s' served as %s", req.ClientHWAddr, hwaddr)
+				// The rest of the plugin keys the lease on the
+				// hardware address of the request
+				keyed := *req
+				keyed.ClientHWAddr = hwaddr
+				req = &keyed
+				break
+			}
+			fallthrough
+		default:
+			p.degenerate.dropped++
+			limited.Limited("degenerate").Warningf("Dropping request with degenerate client identity '%s'", req.ClientHWAddr)
+			return nil, true
+		}
+	}
+	normal, ok := p.requested.leaseTime(req, p.jitter.apply(p.LeaseTime, req.ClientHWAddr))
+	if !ok {
+		if req.MessageType() != dhcpv4.MessageTypeRequest {
+			return nil, true
+		}
+		return nak(resp)
+	}
+	state := rfc2131.RequestState(req)
 	record, ok := p.Recordsv4[req.ClientHWAddr.String()]
+	var r *renumbering
+	if ok {
+		r = p.migration.lookup(record.IP)
+	}
+	if r != nil {
+		switch {
+		case state != rfc2131.StateRenewing:
+			// The client takes whatever address it is given
+			if err := p.renumber(req.ClientHWAddr, record, r); err != nil {
+				log.Errorf("Could not renumber %s for MAC %s: %v", record.IP, req.ClientHWAddr.String(), err)
+				return nil, true
+			}
+		case time.Now().Before(p.migration.deadline):
+			log.Warningf("MAC %s renews %s, which is renumbered from %s", req.ClientHWAddr.String(), record.IP, r)
+			if untilDeadline := time.Until(p.migration.deadline); untilDeadline < normal {
+				normal = untilDeadline
+			}
+		default:
+			log.Printf("MAC %s renews %s past the renumbering deadline", req.ClientHWAddr.String(), record.IP)
+			return nak(resp)
+		}
+	}
+	if state == rfc2131.StateInitReboot {
+		return p.initReboot(req, resp, normal)
+	}
+	circuit, now := circuitID(req), time.Now()
+	if (!ok || record.expired(now)) && p.circuitFull(circuit, req.ClientHWAddr.String(), now) {
+		log.Warningf("MAC %s refused, circuit %q has %d clients already", req.ClientHWAddr.String(), circuit, p.circuits.max)
+		if p.circuits.nak && req.MessageType() == dhcpv4.MessageTypeRequest {
+			return nak(resp)
+		}
+		return nil, true
+	}
+	var granted time.Duration
 	if !ok {
 		// Allocating new address since there isn't one allocated
 		log.Printf("MAC address %s is new, leasing new IPv4 address", req.ClientHWAddr.String())
 		ip, err := p.allocator.Allocate(net.IPNet{})
 		if err != nil {
-			log.Errorf("Could not allocate IP for MAC %s: %v", req.ClientHWAddr.String(), err)
+			limited.Limited("allocate").Errorf("Could not allocate IP for MAC %s: %v", req.ClientHWAddr.String(), err)
 			return nil, true
 		}
+		p.granted.add(ip.IP)
+		leaseTime, tier := p.tiers.leaseTime(p.free(), p.poolSize, normal)
 		rec := Record{
 			IP:      ip.IP.To4(),
-			expires: time.Now().Add(p.LeaseTime),
+			tier:    tier,
+			circuit: circuit,
+		}
+		if expiry, left, ok := p.limit(leaseTime, now); ok {
+			rec.expires, leaseTime = expiry, left
+		} else {
+			rec.setExpiry(now, leaseTime)
 		}
+		granted = leaseTime
 		err = p.saveIPAddress(req.ClientHWAddr, &rec)
 		if err != nil {
-			log.Errorf("SaveIPAddress for MAC %s failed: %v", req.ClientHWAddr.String(), err)
+			limited.Limited("persist").Errorf("SaveIPAddress for MAC %s failed: %v", req.ClientHWAddr.String(), err)
 		}
 		p.Recordsv4[req.ClientHWAddr.String()] = &rec
 		record = &rec
 	} else {
-		// Ensure we extend the existing lease at least past when the one we're giving expires
-		if record.expires.Before(time.Now().Add(p.LeaseTime)) {
-			record.expires = time.Now().Add(p.LeaseTime).Round(time.Second)
-			err := p.saveIPAddress(req.ClientHWAddr, record)
-			if err != nil {
-				log.Errorf("Could not persist lease for MAC %s: %v", req.ClientHWAddr.String(), err)
-			}
+		if circuit != "" {
+			// Renewals unicast to the server do not go through the relay
+			record.circuit = circuit
 		}
+		granted = p.extend(req.ClientHWAddr, record, normal)
 	}
+	p.joinCircuit(record.circuit, req.ClientHWAddr.String())
 	resp.YourIPAddr = record.IP
-	resp.Options.Update(dhcpv4.OptIPAddressLeaseTime(p.LeaseTime.Round(time.Second)))
+	resp.Options.Update(dhcpv4.OptIPAddressLeaseTime(granted.Round(time.Second)))
+	if record.tier != nil {
+		log.Printf("MAC %s gets a short lease, lease tier %s", req.ClientHWAddr.String(), record.tier)
+	}
 	log.Printf("found IP address %s for MAC %s", record.IP, req.ClientHWAddr.String())
 	return resp, false
 }
 
-func setupRange(args ...string) (handler.Handler4, error) {
-	var (
-		err error
-		p   PluginState
-	)
-
-	if len(args) < 4 {
-		return nil, fmt.Errorf("invalid number of arguments, want: 4 (file name, start IP, end IP, lease time), got: %d", len(args))
+// parseArgs returns the state of an instance of the plugin configured with
+// args, without its leases, the name of its lease file, and the seed file to
+// import if any. It has no side effects
+func parseArgs(args ...string) (p *PluginState, filename, seedFile string, err error) {
+	p = &PluginState{degenerate: degeneratePolicy{unstored: make(map[string]unstoredLease)}}
+	args, settingArgs := splitSettings(args)
+	if len(args) < 4 || len(args) > 6 {
+		return nil, "", "", fmt.Errorf("invalid number of arguments, want: 4 to 6 (file name, start IP, end IP, lease time, [renewal flush interval, [max batched renewals]]) followed by settings, got: %d", len(args))
 	}
-	filename := args[0]
+	filename = args[0]
 	if filename == "" {
-		return nil, errors.New("file name cannot be empty")
+		return nil, "", "", plugins.ArgErrorf("file", "cannot be empty")
 	}
 	ipRangeStart := net.ParseIP(args[1])
 	if ipRangeStart.To4() == nil {
-		return nil, fmt.Errorf("invalid IPv4 address: %v", args[1])
+		return nil, "", "", plugins.ArgErrorf("start", "invalid IPv4 address: %v", args[1])
 	}
 	ipRangeEnd := net.ParseIP(args[2])
 	if ipRangeEnd.To4() == nil {
-		return nil, fmt.Errorf("invalid IPv4 address: %v", args[2])
+		return nil, "", "", plugins.ArgErrorf("end", "invalid IPv4 address: %v", args[2])
 	}
 	if binary.BigEndian.Uint32(ipRangeStart.To4()) >= binary.BigEndian.Uint32(ipRangeEnd.To4()) {
-		return nil, errors.New("start of IP range has to be lower than the end of an IP range")
+		return nil, "", "", plugins.ArgErrorf("end", "start of IP range has to be lower than the end of an IP range")
+	}
+
+	p.start, p.end = ipRangeStart.To4(), ipRangeEnd.To4()
+	p.poolSize = int(binary.BigEndian.Uint32(ipRangeEnd.To4())-binary.BigEndian.Uint32(ipRangeStart.To4())) + 1
+	p.granted = newDistribution(p.start, p.poolSize)
+
+	p.LeaseTime, err = parseLeaseTime(args[3])
+	if err != nil {
+		return nil, "", "", plugins.ArgErrorf("lease time", "invalid lease duration: %v", args[3])
+	}
+
+	if len(args) > 4 {
+		p.flushInterval, err = time.ParseDuration(args[4])
+		if err != nil || p.flushInterval < 0 {
+			return nil, "", "", plugins.ArgErrorf("flush interval", "invalid renewal flush interval: %v", args[4])
+		}
+	}
+	if len(args) > 5 {
+		p.flushSize, err = strconv.Atoi(args[5])
+		if err != nil || p.flushSize < 1 {
+			return nil, "", "", plugins.ArgErrorf("flush size", "invalid number of batched renewals: %v", args[5])
+		}
 	}
 
-	p.allocator, err = bitmap.NewIPv4Allocator(ipRangeStart, ipRangeEnd)
+	s := settings{p: p}
+	if err := parseSettings(&s, settingArgs); err != nil {
+		return nil, "", "", err
+	}
+	p.allocator, err = newAllocator(s.allocation, p.start, p.end)
 	if err != nil {
-		return nil, fmt.Errorf("could not create an allocator: %w", err)
+		return nil, "", "", plugins.ArgErrorf("allocation", "could not create an allocator: %v", err)
 	}
+	return p, filename, s.seedFile, nil
+}
+
+// validateRange checks the arguments of the plugin. The lease file is left
+// alone, as a running server may be using it
+func validateRange(args ...string) error {
+	_, _, _, err := parseArgs(args...)
+	return err
+}
 
-	p.LeaseTime, err = time.ParseDuration(args[3])
+// setupRange sets up an instance of the plugin, and registers its state in
+// chain
+func setupRange(chain *plugins.Chain, args ...string) (handler.Handler4, error) {
+	p, filename, seedFile, err := parseArgs(args...)
 	if err != nil {
-		return nil, fmt.Errorf("invalid lease duration: %v", args[3])
+		return nil, err
 	}
 
 	p.Recordsv4, err = loadRecordsFromFile(filename)
@@ -126,10 +498,56 @@ func setupRange(args ...string) (handler.Handler4, error) {
 	}
 
 	log.Printf("Loaded %d DHCPv4 leases from %s", len(p.Recordsv4), filename)
+	for mac, record := range p.Recordsv4 {
+		p.joinCircuit(record.circuit, mac)
+		if !p.inPool(record.IP) {
+			continue
+		}
+		if err := p.reserve(record.IP); err != nil {
+			log.Warningf("Lease of MAC %s: %v", mac, err)
+		}
+	}
+	if len(p.migration.renumberings) > 0 {
+		remaining := 0
+		for _, record := range p.Recordsv4 {
+			if p.migration.lookup(record.IP) != nil {
+				remaining++
+			}
+		}
+		log.Printf("%d leases to renumber by %s", remaining, p.migration.deadline)
+	}
+
+	if err := compactLeaseFile(filename, p.Recordsv4); err != nil {
+		// Not fatal, the file is just larger than it needs to be
+		log.Warningf("Could not compact lease file %s: %v", filename, err)
+	}
 
 	if err := p.registerBackingFile(filename); err != nil {
 		return nil, fmt.Errorf("could not setup lease storage: %w", err)
 	}
+	chain.OnClose(p.close)
+	p.scheduleCompaction(time.Now())
+
+	if seedFile != "" {
+		imported, problems, err := p.seed(seedFile)
+		for _, problem := range problems {
+			log.Warning(problem)
+		}
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Seeded %d DHCPv4 leases from %s, %d entries not imported", imported, seedFile, len(problems))
+	}
 
+	// The subnet mask tells INIT-REBOOT clients on the wrong network apart,
+	// wherever the netmask plugin is in the chain
+	chain.OnReady(func() {
+		instances := Instances(chain)
+		p.Lock()
+		defer p.Unlock()
+		p.mask = netmask.Mask(chain)
+		p.last = instances[len(instances)-1] == p
+	})
+	chain.Register(pluginName, p)
 	return p.Handler4, nil
 }
@@ -0,0 +1,353 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/internal/testpackets"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/coredhcp/coredhcp/plugins/netmask"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupInstance sets up an instance of the plugin in a chain of its own, and
+// returns its state
+func setupInstance(args ...string) (*PluginState, error) {
+	var chain plugins.Chain
+	if _, err := setupRange(&chain, args...); err != nil {
+		return nil, err
+	}
+	return Instances(&chain)[0], nil
+}
+
+func TestUsage(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "coredhcp-pool-usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	p, err := setupInstance(tmpfile.Name(), "192.0.2.10", "192.0.2.19", "1h")
+	if err != nil {
+		t.Fatalf("could not set up plugin: %v", err)
+	}
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0x02, 0, 0, 0, 0, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := dhcpv4.NewReplyFromRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := p.Handler4(req, resp); resp == nil {
+		t.Fatal("no lease given")
+	}
+
+	used, size := p.Usage()
+	if used != 1 || size != 10 {
+		t.Errorf("got %d used out of %d, expected 1 out of 10", used, size)
+	}
+}
+
+func TestDump(t *testing.T) {
+	now := time.Now()
+	p := PluginState{Recordsv4: map[string]*Record{
+		"02:00:00:00:00:01": {IP: net.IPv4(192, 0, 2, 10), expires: now.Add(time.Hour)},
+		"02:00:00:00:00:02": {IP: net.IPv4(192, 0, 2, 11), expires: now.Add(-time.Hour)},
+		"02:00:00:00:00:03": {IP: net.IPv4(192, 0, 2, 12), infinite: true},
+	}}
+	dumped := make(map[string]time.Time)
+	require.NoError(t, p.Dump(now, func(hwaddr net.HardwareAddr, ip net.IP, expires time.Time) error {
+		dumped[hwaddr.String()+" "+ip.String()] = expires
+		return nil
+	}))
+	assert.Equal(t, map[string]time.Time{
+		"02:00:00:00:00:01 192.0.2.10": now.Add(time.Hour),
+		"02:00:00:00:00:03 192.0.2.12": {},
+	}, dumped, "expired leases should be skipped")
+
+	stop := fmt.Errorf("stop")
+	var calls int
+	assert.Equal(t, stop, p.Dump(now, func(net.HardwareAddr, net.IP, time.Time) error {
+		calls++
+		return stop
+	}))
+	assert.Equal(t, 1, calls)
+}
+
+// TestCaptures replays the requests of a captured exchange, and checks that the
+// answers give the addresses the captured server gave
+func TestCaptures(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "coredhcp-captures")
+	require.NoError(t, err)
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+	p, err := setupInstance(tmpfile.Name(), "192.168.0.10", "192.168.0.20", "1h")
+	require.NoError(t, err)
+
+	for _, exchange := range [][2]string{
+		{"grandstream-discover", "grandstream-offer"},
+		{"grandstream-request", "grandstream-ack"},
+	} {
+		req, _ := testpackets.Capture4(t, exchange[0])
+		want, _ := testpackets.Capture4(t, exchange[1])
+		resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(want.MessageType()))
+		require.NoError(t, err)
+		resp, stop := p.Handler4(req, resp)
+		require.NotNil(t, resp, exchange[0])
+		assert.False(t, stop)
+		assert.True(t, want.YourIPAddr.Equal(resp.YourIPAddr), "%s: got %s, want %s", exchange[0], resp.YourIPAddr, want.YourIPAddr)
+		assert.Equal(t, want.MessageType(), resp.MessageType())
+	}
+
+	req, _ := testpackets.Capture4(t, "macosx-discover")
+	resp, err := dhcpv4.NewReplyFromRequest(req)
+	require.NoError(t, err)
+	resp, _ = p.Handler4(req, resp)
+	require.NotNil(t, resp)
+	assert.True(t, p.inPool(resp.YourIPAddr), "got %s", resp.YourIPAddr)
+	assert.Len(t, p.Recordsv4, 2)
+}
+
+func TestInitReboot(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "coredhcp-init-reboot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	p, err := setupInstance(tmpfile.Name(), "192.0.2.10", "192.0.2.19", "1h")
+	if err != nil {
+		t.Fatalf("could not set up plugin: %v", err)
+	}
+
+	valid := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	expired := net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+	unknown := net.HardwareAddr{0x02, 0, 0, 0, 0, 3}
+	p.Recordsv4[valid.String()] = &Record{IP: net.IPv4(192, 0, 2, 10).To4(), expires: time.Now().Add(10 * time.Minute)}
+	p.Recordsv4[expired.String()] = &Record{IP: net.IPv4(192, 0, 2, 11).To4(), expires: time.Now().Add(-time.Minute)}
+
+	mask := net.CIDRMask(24, 32)
+	testcases := []struct {
+		name      string
+		mac       net.HardwareAddr
+		requested net.IP
+		mask      net.IPMask
+		giaddr    net.IP
+		// expected is 0 when the request is left to the next plugins
+		expected dhcpv4.MessageType
+	}{
+		{"valid", valid, net.IPv4(192, 0, 2, 10), mask, nil, dhcpv4.MessageTypeAck},
+		{"other address", valid, net.IPv4(192, 0, 2, 12), mask, nil, dhcpv4.MessageTypeNak},
+		{"other address outside of the pool", valid, net.IPv4(192, 0, 2, 200), mask, nil, dhcpv4.MessageTypeNak},
+		{"expired", expired, net.IPv4(192, 0, 2, 11), mask, nil, dhcpv4.MessageTypeNak},
+		{"wrong network", valid, net.IPv4(198, 51, 100, 10), mask, nil, dhcpv4.MessageTypeNak},
+		{"unknown client, wrong network", unknown, net.IPv4(198, 51, 100, 10), mask, nil, dhcpv4.MessageTypeNak},
+		{"unknown client", unknown, net.IPv4(192, 0, 2, 13), mask, nil, 0},
+		{"unknown client outside of the pool", unknown, net.IPv4(192, 0, 2, 200), mask, nil, 0},
+		{"relayed from the network of the pool", valid, net.IPv4(192, 0, 2, 10), mask, net.IPv4(192, 0, 2, 1), dhcpv4.MessageTypeAck},
+		{"relayed from another network", valid, net.IPv4(198, 51, 100, 10), mask, net.IPv4(198, 51, 100, 1), 0},
+		{"relayed from another network, wrong network", valid, net.IPv4(192, 0, 2, 10), mask, net.IPv4(198, 51, 100, 1), 0},
+		{"no netmask, other address", valid, net.IPv4(198, 51, 100, 10), nil, nil, dhcpv4.MessageTypeNak},
+		{"no netmask, unknown client", unknown, net.IPv4(198, 51, 100, 10), nil, nil, 0},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := testpackets.V4RequestInitReboot(t, tc.mac, tc.requested)
+			if tc.giaddr != nil {
+				req, _ = testpackets.V4Relayed(t, req, tc.giaddr, nil)
+			}
+			resp, err := dhcpv4.NewReplyFromRequest(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+			if tc.mask != nil {
+				resp.UpdateOption(dhcpv4.OptSubnetMask(tc.mask))
+			}
+			leases := len(p.Recordsv4)
+			resp, stop := p.Handler4(req, resp)
+			if len(p.Recordsv4) != leases {
+				t.Errorf("an address was allocated")
+			}
+			if resp == nil {
+				t.Fatalf("expected a response, got none")
+			}
+			if tc.expected == 0 {
+				if stop || !resp.YourIPAddr.IsUnspecified() || resp.MessageType() != dhcpv4.MessageTypeAck {
+					t.Errorf("expected the request to be left to the next plugins, got a %s for %s (stop: %v)", resp.MessageType(), resp.YourIPAddr, stop)
+				}
+				return
+			}
+			if resp.MessageType() != tc.expected {
+				t.Errorf("expected a %s, got a %s", tc.expected, resp.MessageType())
+			}
+			if tc.expected == dhcpv4.MessageTypeAck && !resp.YourIPAddr.Equal(tc.requested) {
+				t.Errorf("expected %s to be confirmed, got %s", tc.requested, resp.YourIPAddr)
+			}
+			if tc.expected == dhcpv4.MessageTypeNak && !resp.YourIPAddr.Equal(net.IPv4zero) {
+				t.Errorf("expected no address in the DHCPNAK, got %s", resp.YourIPAddr)
+			}
+		})
+	}
+	if !p.Recordsv4[valid.String()].expires.After(time.Now().Add(50 * time.Minute)) {
+		t.Errorf("confirmed lease was not extended")
+	}
+}
+
+// TestInitRebootNetmaskOrder checks that INIT-REBOOT clients on the wrong
+// network are told apart with the subnet mask of the netmask plugin, wherever
+// it is in the chain
+func TestInitRebootNetmaskOrder(t *testing.T) {
+	require.NoError(t, plugins.RegisterPlugin(&Plugin))
+	require.NoError(t, plugins.RegisterPlugin(&netmask.Plugin))
+
+	for _, netmaskFirst := range []bool{true, false} {
+		t.Run(fmt.Sprintf("netmask first: %v", netmaskFirst), func(t *testing.T) {
+			tmpfile, err := ioutil.TempFile("", "coredhcp-init-reboot-order")
+			require.NoError(t, err)
+			defer os.Remove(tmpfile.Name())
+			tmpfile.Close()
+
+			confs := []config.PluginConfig{
+				{Name: "range", Args: []string{tmpfile.Name(), "192.0.2.10", "192.0.2.19", "1h"}},
+				{Name: "netmask", Args: []string{"255.255.255.0"}},
+			}
+			if netmaskFirst {
+				confs[0], confs[1] = confs[1], confs[0]
+			}
+			chain4, _, err := plugins.LoadChains(&config.Config{Server4: &config.ServerConfig{Plugins: confs}})
+			require.NoError(t, err)
+			defer chain4.Close()
+
+			req, _ := testpackets.V4RequestInitReboot(t, net.HardwareAddr{0x02, 0, 0, 0, 0, 1}, net.IPv4(198, 51, 100, 10))
+			resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(dhcpv4.MessageTypeAck))
+			require.NoError(t, err)
+			for _, h := range chain4.Handlers4 {
+				var stop bool
+				if resp, stop = h(req, resp); stop {
+					break
+				}
+			}
+			require.NotNil(t, resp)
+			require.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType())
+		})
+	}
+}
+
+// TestInitRebootChain checks that INIT-REBOOT clients are confirmed by the
+// instance of the chain that knows them, and that the server remains silent for
+// the clients no instance knows
+func TestInitRebootChain(t *testing.T) {
+	if _, ok := plugins.RegisteredPlugins[pluginName]; !ok {
+		require.NoError(t, plugins.RegisterPlugin(&Plugin))
+	}
+	var confs []config.PluginConfig
+	for _, pool := range [][2]string{{"192.0.2.10", "192.0.2.19"}, {"192.0.2.20", "192.0.2.29"}} {
+		tmpfile, err := ioutil.TempFile("", "coredhcp-init-reboot-chain")
+		require.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+		tmpfile.Close()
+		confs = append(confs, config.PluginConfig{Name: "range", Args: []string{tmpfile.Name(), pool[0], pool[1], "1h"}})
+	}
+	chain4, _, err := plugins.LoadChains(&config.Config{Server4: &config.ServerConfig{Plugins: confs}})
+	require.NoError(t, err)
+	defer chain4.Close()
+	known := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	second := Instances(chain4)[1]
+	second.Recordsv4[known.String()] = &Record{IP: net.IPv4(192, 0, 2, 20).To4(), expires: time.Now().Add(time.Hour)}
+
+	run := func(mac net.HardwareAddr, requested net.IP) *dhcpv4.DHCPv4 {
+		req, _ := testpackets.V4RequestInitReboot(t, mac, requested)
+		resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(dhcpv4.MessageTypeAck))
+		require.NoError(t, err)
+		for _, h := range chain4.Handlers4 {
+			var stop bool
+			if resp, stop = h(req, resp); stop {
+				break
+			}
+		}
+		return resp
+	}
+	resp := run(known, net.IPv4(192, 0, 2, 20))
+	require.NotNil(t, resp, "the client known by the second instance was dropped")
+	assert.Equal(t, dhcpv4.MessageTypeAck, resp.MessageType())
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(192, 0, 2, 20)))
+
+	assert.Nil(t, run(net.HardwareAddr{0x02, 0, 0, 0, 0, 2}, net.IPv4(192, 0, 2, 21)), "an unknown client was answered")
+}
+
+// slowFile is a lease file whose writes take delay, and which closes writing
+// when the first one starts
+type slowFile struct {
+	*os.File
+	delay   time.Duration
+	writing chan struct{}
+	once    sync.Once
+}
+
+func (s *slowFile) Write(b []byte) (int, error) {
+	s.once.Do(func() { close(s.writing) })
+	time.Sleep(s.delay)
+	return s.File.Write(b)
+}
+
+// TestDeadlineSlowStore checks that a request that waited past its deadline for
+// a slow lease file write of another request is dropped, without leasing an
+// address nor writing to the lease file
+func TestDeadlineSlowStore(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "coredhcp-deadline")
+	require.NoError(t, err)
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	p, err := setupInstance(tmpfile.Name(), "192.0.2.10", "192.0.2.19", "1h")
+	require.NoError(t, err)
+	slow := &slowFile{File: p.leasefile.(*os.File), delay: 300 * time.Millisecond, writing: make(chan struct{})}
+	p.leasefile = slow
+	defer p.close()
+
+	first, _ := testpackets.V4Discover(t, net.HardwareAddr{0x02, 0, 0, 0, 0, 1})
+	firstResp, err := dhcpv4.NewReplyFromRequest(first)
+	require.NoError(t, err)
+	done := make(chan *dhcpv4.DHCPv4)
+	go func() {
+		resp, _ := p.Handler4(first, firstResp)
+		done <- resp
+	}()
+	<-slow.writing
+
+	late, _ := testpackets.V4Discover(t, net.HardwareAddr{0x02, 0, 0, 0, 0, 2})
+	lateResp, err := dhcpv4.NewReplyFromRequest(late)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	defer handler.Bind(late, ctx)()
+	resp, stop := p.Handler4(late, lateResp)
+	assert.Nil(t, resp, "request past its deadline answered")
+	assert.True(t, stop)
+	require.NotNil(t, <-done, "request within its deadline not answered")
+
+	used, _ := p.Usage()
+	assert.Equal(t, 1, used, "address leased past the deadline")
+	loaded, err := loadRecordsFromFile(tmpfile.Name())
+	require.NoError(t, err)
+	assert.Contains(t, loaded, first.ClientHWAddr.String())
+	assert.NotContains(t, loaded, late.ClientHWAddr.String(), "lease written past the deadline")
+}
@@ -0,0 +1,121 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// renumbering maps the addresses of an old prefix to a new one, keeping
+// their host bits
+type renumbering struct {
+	from, to *net.IPNet
+}
+
+func (r renumbering) String() string {
+	return fmt.Sprintf("%s to %s", r.from, r.to)
+}
+
+// translate returns the address of the new prefix with the host bits of ip
+func (r renumbering) translate(ip net.IP) net.IP {
+	ip = ip.To4()
+	out := make(net.IP, net.IPv4len)
+	for i := range out {
+		host := ip[i] &^ r.from.Mask[i]
+		out[i] = r.to.IP[i] | host&^r.to.Mask[i]
+	}
+	return out
+}
+
+// parseRenumbering parses a renumber setting, of the form
+// renumber=<old prefix>:<new prefix>
+func parseRenumbering(arg string) (renumbering, error) {
+	spec := strings.TrimPrefix(arg, "renumber=")
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return renumbering{}, fmt.Errorf("invalid renumbering %q, expected renumber=<old prefix>:<new prefix>", arg)
+	}
+	var r renumbering
+	for i, prefix := range []**net.IPNet{&r.from, &r.to} {
+		_, n, err := net.ParseCIDR(parts[i])
+		if err != nil || n.IP.To4() == nil {
+			return renumbering{}, fmt.Errorf("invalid IPv4 prefix %q in renumbering %q", parts[i], arg)
+		}
+		n.IP, n.Mask = n.IP.To4(), n.Mask[len(n.Mask)-net.IPv4len:]
+		*prefix = n
+	}
+	return r, nil
+}
+
+// renumberPlan moves the leases of old prefixes to new ones. Clients that are
+// ready to take a new address, as they are not renewing a lease, get the
+// address of the new prefix with the same host bits, or any free one if it is
+// not available. Until the deadline, renewals of addresses of the old prefixes
+// are extended, but not past the deadline; after it they get a DHCPNAK, so the
+// clients start over and get a new address
+type renumberPlan struct {
+	renumberings []renumbering
+	deadline     time.Time
+	// migrated is the number of leases moved to a new prefix
+	migrated int
+}
+
+// parseDeadline parses the renumber_deadline setting, an RFC3339 time
+func parseDeadline(arg string) (time.Time, error) {
+	deadline, err := time.Parse(time.RFC3339, strings.TrimPrefix(arg, "renumber_deadline="))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid renumbering deadline %q, expected an RFC3339 time: %v", arg, err)
+	}
+	return deadline, nil
+}
+
+// lookup returns the renumbering for ip, nil if it is not being renumbered
+func (r *renumberPlan) lookup(ip net.IP) *renumbering {
+	for i := range r.renumberings {
+		if r.renumberings[i].from.Contains(ip) {
+			return &r.renumberings[i]
+		}
+	}
+	return nil
+}
+
+// renumber moves the lease of record to the new prefix of r, freeing its
+// old address if it is part of the pool
+func (p *PluginState) renumber(hwaddr net.HardwareAddr, record *Record, r *renumbering) error {
+	ip, err := p.allocator.Allocate(net.IPNet{IP: r.translate(record.IP)})
+	if err != nil {
+		return err
+	}
+	old := record.IP
+	if p.inPool(old) {
+		if err := p.allocator.Free(net.IPNet{IP: old}); err != nil {
+			log.Warningf("Could not free renumbered address %s: %v", old, err)
+		}
+	}
+	record.IP = ip.IP.To4()
+	p.granted.add(record.IP)
+	if err := p.saveIPAddress(hwaddr, record); err != nil {
+		limited.Limited("persist").Errorf("Could not persist renumbered lease for MAC %s: %v", hwaddr.String(), err)
+	}
+	p.migration.migrated++
+	log.Printf("MAC %s renumbered from %s to %s", hwaddr.String(), old, record.IP)
+	return nil
+}
+
+// RenumberProgress returns the number of leases of the instance moved to a new
+// prefix, and the number of its leases still in old prefixes
+func (p *PluginState) RenumberProgress() (migrated, remaining int) {
+	p.Lock()
+	defer p.Unlock()
+	for _, record := range p.Recordsv4 {
+		if p.migration.lookup(record.IP) != nil {
+			remaining++
+		}
+	}
+	return p.migration.migrated, remaining
+}
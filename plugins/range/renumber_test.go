@@ -0,0 +1,127 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coredhcp/coredhcp/internal/testpackets"
+)
+
+func TestParseRenumbering(t *testing.T) {
+	r, err := parseRenumbering("renumber=10.1.0.0/16:10.2.0.0/16")
+	require.NoError(t, err)
+	assert.Equal(t, "10.1.0.0/16 to 10.2.0.0/16", r.String())
+	assert.Equal(t, net.IPv4(10, 2, 3, 4).To4(), r.translate(net.IPv4(10, 1, 3, 4)))
+
+	// Host bits that do not fit in the new prefix are dropped
+	r, err = parseRenumbering("renumber=10.1.0.0/16:192.168.7.0/24")
+	require.NoError(t, err)
+	assert.Equal(t, net.IPv4(192, 168, 7, 4).To4(), r.translate(net.IPv4(10, 1, 3, 4)))
+
+	for _, bad := range []string{
+		"renumber=10.1.0.0/16", "renumber=10.1.0.0/16:", "renumber=10.1.0.0:10.2.0.0/16",
+		"renumber=10.1.0.0/16:2001:db8::/32", "renumber=2001:db8::/32:10.1.0.0/16",
+	} {
+		_, err := parseRenumbering(bad)
+		assert.Error(t, err, "%s should be refused", bad)
+	}
+
+	_, err = parseDeadline("renumber_deadline=2026-11-01T00:00:00Z")
+	assert.NoError(t, err)
+	_, err = parseDeadline("renumber_deadline=tomorrow")
+	assert.Error(t, err)
+}
+
+func TestRenumberSetup(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "coredhcp-renumber")
+	require.NoError(t, err)
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	for _, args := range [][]string{
+		{"renumber=10.1.0.0/24:10.2.0.0/24"},
+		{"renumber_deadline=2026-11-01T00:00:00Z"},
+		{"renumber=10.1.0.0/24:10.3.0.0/24", "renumber_deadline=2026-11-01T00:00:00Z"},
+		{"renumber=10.1.0.0/24:10.2.0.0/24", "renumber_deadline=2026-11-01T00:00:00Z", "renumber_deadline=2026-12-01T00:00:00Z"},
+	} {
+		_, err := setupInstance(append([]string{tmpfile.Name(), "10.2.0.1", "10.2.0.254", "24h"}, args...)...)
+		assert.Error(t, err, args)
+	}
+}
+
+func TestRenumber(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "coredhcp-renumber")
+	require.NoError(t, err)
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	p, err := setupInstance(tmpfile.Name(), "10.2.0.1", "10.2.0.254", "24h",
+		"renumber=10.1.0.0/24:10.2.0.0/24", "renumber_deadline="+time.Now().Add(time.Hour).Format(time.RFC3339))
+	require.NoError(t, err)
+
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	old := net.IPv4(10, 1, 0, 42).To4()
+	p.Recordsv4[mac.String()] = &Record{IP: old, expires: time.Now().Add(time.Hour)}
+	other := net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+	p.Recordsv4[other.String()] = &Record{IP: net.IPv4(10, 1, 0, 43).To4(), expires: time.Now().Add(time.Hour)}
+	migrated, remaining := p.RenumberProgress()
+	assert.Equal(t, 0, migrated)
+	assert.Equal(t, 2, remaining)
+
+	handle := func(req *dhcpv4.DHCPv4, mt dhcpv4.MessageType) *dhcpv4.DHCPv4 {
+		resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(mt))
+		require.NoError(t, err)
+		resp, _ = p.Handler4(req, resp)
+		require.NotNil(t, resp)
+		return resp
+	}
+
+	// Before the deadline, renewals keep the old address until the deadline
+	req, _ := testpackets.V4RequestRenewing(t, mac, old)
+	resp := handle(req, dhcpv4.MessageTypeAck)
+	assert.Equal(t, dhcpv4.MessageTypeAck, resp.MessageType())
+	assert.Equal(t, old, resp.YourIPAddr.To4())
+	assert.True(t, resp.IPAddressLeaseTime(0) <= time.Hour, "lease extended past the deadline: %s", resp.IPAddressLeaseTime(0))
+	assert.Equal(t, old, p.Recordsv4[mac.String()].IP)
+
+	// A restarting client gets the equivalent address of the new prefix
+	req, _ = testpackets.V4Discover(t, mac)
+	resp = handle(req, dhcpv4.MessageTypeOffer)
+	assert.Equal(t, net.IPv4(10, 2, 0, 42).To4(), resp.YourIPAddr.To4())
+	assert.Equal(t, net.IPv4(10, 2, 0, 42).To4(), p.Recordsv4[mac.String()].IP)
+	assert.Equal(t, 24*time.Hour, resp.IPAddressLeaseTime(0))
+	stored, err := loadRecordsFromFile(tmpfile.Name())
+	require.NoError(t, err)
+	assert.Equal(t, net.IPv4(10, 2, 0, 42).To4(), stored[mac.String()].IP.To4(), "renumbered lease not persisted")
+	migrated, remaining = p.RenumberProgress()
+	assert.Equal(t, 1, migrated)
+	assert.Equal(t, 1, remaining)
+
+	// After the deadline, renewals are refused, then the client gets any
+	// free address if the equivalent one is taken
+	p.migration.deadline = time.Now().Add(-time.Minute)
+	_, err = p.allocator.Allocate(net.IPNet{IP: net.IPv4(10, 2, 0, 43)})
+	require.NoError(t, err)
+	req, _ = testpackets.V4RequestRenewing(t, other, net.IPv4(10, 1, 0, 43))
+	resp = handle(req, dhcpv4.MessageTypeAck)
+	assert.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType())
+
+	req, _ = testpackets.V4Discover(t, other)
+	resp = handle(req, dhcpv4.MessageTypeOffer)
+	assert.True(t, p.inPool(resp.YourIPAddr), "%s not in the pool", resp.YourIPAddr)
+	assert.NotEqual(t, net.IPv4(10, 2, 0, 43).To4(), resp.YourIPAddr.To4())
+	migrated, remaining = p.RenumberProgress()
+	assert.Equal(t, 2, migrated)
+	assert.Equal(t, 0, remaining)
+}
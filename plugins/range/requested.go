@@ -0,0 +1,115 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// requestAction is what to do with clients requesting a lease time longer
+// than the normal one
+type requestAction int
+
+const (
+	// requestClamp gives them the normal lease time
+	requestClamp requestAction = iota
+	// requestHonor gives them the lease time they requested, up to a maximum
+	requestHonor
+	// requestReject is like requestHonor, but refuses clients requesting more
+	// than the maximum
+	requestReject
+)
+
+// requestPolicy decides the lease time given to clients requesting one with
+// the IP Address Lease Time option
+type requestPolicy struct {
+	action requestAction
+	max    time.Duration
+
+	// Number of requests above the normal lease time, by outcome. They are
+	// protected by the plugin lock
+	clamped, honored, rejected uint64
+}
+
+// parseRequestPolicy parses a requested= setting: clamp, honor:<max lease
+// time> or nak:<max lease time>
+func parseRequestPolicy(arg string, normal time.Duration) (requestPolicy, error) {
+	spec := strings.TrimPrefix(arg, "requested=")
+	parts := strings.SplitN(spec, ":", 2)
+	var p requestPolicy
+	switch parts[0] {
+	case "clamp":
+		if len(parts) != 1 {
+			return p, fmt.Errorf("invalid requested lease time policy %q, clamp takes no maximum", arg)
+		}
+		return p, nil
+	case "honor":
+		p.action = requestHonor
+	case "nak":
+		p.action = requestReject
+	default:
+		return p, fmt.Errorf("invalid requested lease time policy %q, expected clamp, honor:<max> or nak:<max>", arg)
+	}
+	if len(parts) != 2 {
+		return p, fmt.Errorf("invalid requested lease time policy %q, %s needs a maximum lease time", arg, parts[0])
+	}
+	var err error
+	p.max, err = parseLeaseTime(parts[1])
+	if err != nil || p.max < normal {
+		return p, fmt.Errorf("invalid maximum lease time in %q, must be at least the lease time %s", arg, formatLeaseTime(normal))
+	}
+	return p, nil
+}
+
+// LongLeaseRequests returns the number of requests the instance got for a
+// lease time longer than the normal one since the server started, by outcome:
+// given the normal or the maximum lease time instead, given the lease time
+// requested, or refused
+func (p *PluginState) LongLeaseRequests() (clamped, honored, rejected uint64) {
+	p.Lock()
+	defer p.Unlock()
+	return p.requested.clamped, p.requested.honored, p.requested.rejected
+}
+
+// requestedLeaseTime returns the lease time req asks for, and false if it
+// does not ask for one
+func requestedLeaseTime(req *dhcpv4.DHCPv4) (time.Duration, bool) {
+	v := req.Options.Get(dhcpv4.OptionIPAddressLeaseTime)
+	if len(v) != 4 {
+		return 0, false
+	}
+	return time.Duration(binary.BigEndian.Uint32(v)) * time.Second, true
+}
+
+// leaseTime returns the lease time to give to the client of req, normal unless
+// it requested a longer one, and false if the request must be refused
+func (p *requestPolicy) leaseTime(req *dhcpv4.DHCPv4, normal time.Duration) (time.Duration, bool) {
+	requested, ok := requestedLeaseTime(req)
+	if !ok || requested <= normal {
+		return normal, true
+	}
+	granted := normal
+	switch {
+	case p.action == requestClamp:
+		p.clamped++
+	case requested <= p.max:
+		p.honored++
+		granted = requested
+	case p.action == requestHonor:
+		p.clamped++
+		granted = p.max
+	default:
+		p.rejected++
+		log.Debugf("MAC %s requested a lease time of %s, refused", req.ClientHWAddr.String(), formatLeaseTime(requested))
+		return 0, false
+	}
+	log.Debugf("MAC %s requested a lease time of %s, granted %s", req.ClientHWAddr.String(), formatLeaseTime(requested), formatLeaseTime(granted))
+	return granted, true
+}
@@ -0,0 +1,150 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coredhcp/coredhcp/internal/testpackets"
+)
+
+func TestParseRequestPolicy(t *testing.T) {
+	p, err := parseRequestPolicy("requested=clamp", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, requestClamp, p.action)
+
+	p, err = parseRequestPolicy("requested=honor:4h", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, requestHonor, p.action)
+	assert.Equal(t, 4*time.Hour, p.max)
+
+	p, err = parseRequestPolicy("requested=nak:1h", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, requestReject, p.action)
+	assert.Equal(t, time.Hour, p.max)
+
+	for _, bad := range []string{
+		"requested=", "requested=ignore", "requested=clamp:4h", "requested=honor",
+		"requested=nak:", "requested=honor:59m", "requested=honor:soon", "requested=honor:2000000h",
+	} {
+		_, err := parseRequestPolicy(bad, time.Hour)
+		assert.Error(t, err, "%s should be refused", bad)
+	}
+}
+
+// withLeaseTime sets the lease time requested by a client, in seconds
+func withLeaseTime(secs uint32) dhcpv4.Modifier {
+	return dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionIPAddressLeaseTime,
+		[]byte{byte(secs >> 24), byte(secs >> 16), byte(secs >> 8), byte(secs)}))
+}
+
+func TestRequestPolicy(t *testing.T) {
+	const (
+		normal = time.Hour
+		max    = 4 * time.Hour
+	)
+	none := uint32(0)
+	testcases := []struct {
+		name string
+		// requested is in seconds, none for no option
+		requested uint32
+		// expected lease time for each action, 0 for a refusal
+		clamp, honor, reject time.Duration
+	}{
+		{"no request", none, normal, normal, normal},
+		{"shorter", 1800, normal, normal, normal},
+		{"normal", 3600, normal, normal, normal},
+		{"above normal", 3601, normal, normal + time.Second, normal + time.Second},
+		{"maximum", 4 * 3600, normal, max, max},
+		{"above maximum", 4*3600 + 1, normal, max, 0},
+		{"weeks", 3 * 7 * 24 * 3600, normal, max, 0},
+		{"largest finite", infiniteLeaseTime - 1, normal, max, 0},
+		{"infinite", infiniteLeaseTime, normal, max, 0},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var mods []dhcpv4.Modifier
+			if tc.requested != none {
+				mods = append(mods, withLeaseTime(tc.requested))
+			}
+			req, _ := testpackets.V4Discover(t, nil, mods...)
+			for _, c := range []struct {
+				action   requestAction
+				expected time.Duration
+			}{
+				{requestClamp, tc.clamp},
+				{requestHonor, tc.honor},
+				{requestReject, tc.reject},
+			} {
+				p := requestPolicy{action: c.action, max: max}
+				granted, ok := p.leaseTime(req, normal)
+				if c.expected == 0 {
+					assert.False(t, ok, "action %d: expected a refusal", c.action)
+					assert.Equal(t, uint64(1), p.rejected)
+					continue
+				}
+				assert.True(t, ok, "action %d: unexpected refusal", c.action)
+				assert.Equal(t, c.expected, granted, "action %d", c.action)
+				if tc.requested != none && time.Duration(tc.requested)*time.Second > normal {
+					assert.Equal(t, uint64(1), p.clamped+p.honored, "action %d: request not counted", c.action)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestPolicyHandler(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "coredhcp-requested")
+	require.NoError(t, err)
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	p, err := setupInstance(tmpfile.Name(), "192.0.2.10", "192.0.2.19", "1h", "tier=1:10m", "requested=nak:4h")
+	require.NoError(t, err)
+	h := p.Handler4
+
+	// The granted lease time is the one on the wire and in the record
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	req, _ := testpackets.V4Discover(t, mac, withLeaseTime(2*3600))
+	resp, err := dhcpv4.NewReplyFromRequest(req)
+	require.NoError(t, err)
+	resp, _ = h(req, resp)
+	require.NotNil(t, resp)
+	assert.Equal(t, 2*time.Hour, resp.IPAddressLeaseTime(0))
+	expires := p.Recordsv4[mac.String()].expires
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), expires, time.Minute)
+
+	// Egregious requests get a DHCPNAK, and DHCPDISCOVERs no answer
+	req, _ = testpackets.V4RequestSelecting(t, mac, net.IPv4(192, 0, 2, 1), resp.YourIPAddr, withLeaseTime(infiniteLeaseTime))
+	resp, err = dhcpv4.NewReplyFromRequest(req)
+	require.NoError(t, err)
+	resp, _ = h(req, resp)
+	require.NotNil(t, resp)
+	assert.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType())
+	assert.False(t, resp.Options.Has(dhcpv4.OptionIPAddressLeaseTime))
+	assert.Equal(t, expires, p.Recordsv4[mac.String()].expires, "a refused request extended the lease")
+
+	req, _ = testpackets.V4Discover(t, net.HardwareAddr{0x02, 0, 0, 0, 0, 2}, withLeaseTime(5*3600))
+	resp, err = dhcpv4.NewReplyFromRequest(req)
+	require.NoError(t, err)
+	resp, _ = h(req, resp)
+	assert.Nil(t, resp)
+
+	clamped, honored, rejected := p.LongLeaseRequests()
+	assert.Equal(t, uint64(0), clamped)
+	assert.Equal(t, uint64(1), honored)
+	assert.Equal(t, uint64(2), rejected)
+
+	_, err = setupInstance(tmpfile.Name(), "192.0.2.10", "192.0.2.19", "1h", "requested=clamp", "requested=nak:4h")
+	assert.Error(t, err)
+}
@@ -0,0 +1,124 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reserve marks ip as allocated, so that it is not given to another client
+func (p *PluginState) reserve(ip net.IP) error {
+	got, err := p.allocator.Allocate(net.IPNet{IP: ip})
+	if err != nil {
+		return err
+	}
+	if !got.IP.Equal(ip) {
+		if err := p.allocator.Free(got); err != nil {
+			return err
+		}
+		return fmt.Errorf("address %s is already allocated", ip)
+	}
+	return nil
+}
+
+// seed imports the leases listed in a seed file, such as a DHCP snooping
+// binding table or an ARP cache exported from the network the server is
+// deployed into, so that clients keep their address when they first renew.
+// The file holds comma-separated lines of MAC address, IPv4 address and
+// remaining lease time in seconds. Lines starting with # are comments.
+// Leases that are already known are skipped, and lines that cannot be
+// imported are returned as problems: malformed lines, expired leases,
+// addresses out of the pool, and conflicts with known leases, which are never
+// overwritten
+func (p *PluginState) seed(filename string) (imported int, problems []error, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, nil, fmt.Errorf("cannot open seed file %s: %w", filename, err)
+	}
+	defer f.Close()
+
+	holders := make(map[string]string, len(p.Recordsv4))
+	for mac, record := range p.Recordsv4 {
+		holders[record.IP.String()] = mac
+	}
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	now := time.Now()
+	for line := 1; ; line++ {
+		fields, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		problem := func(format string, args ...interface{}) {
+			problems = append(problems, fmt.Errorf("%s: entry %d: %s", filename, line, fmt.Sprintf(format, args...)))
+		}
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); !ok {
+				return imported, problems, err
+			}
+			problem("%v", err)
+			continue
+		}
+		if len(fields) != 3 {
+			problem("want 3 fields (MAC address, IP address, remaining seconds), got %d", len(fields))
+			continue
+		}
+		mac, err := net.ParseMAC(strings.TrimSpace(fields[0]))
+		if err != nil {
+			problem("malformed hardware address %q", fields[0])
+			continue
+		}
+		ip := net.ParseIP(strings.TrimSpace(fields[1])).To4()
+		if ip == nil {
+			problem("malformed IPv4 address %q", fields[1])
+			continue
+		}
+		secs, err := strconv.ParseUint(strings.TrimSpace(fields[2]), 10, 32)
+		if err != nil {
+			problem("malformed remaining lease time %q", fields[2])
+			continue
+		}
+		if secs == 0 {
+			problem("lease of %s for %s expired", ip, mac)
+			continue
+		}
+		if !p.inPool(ip) {
+			problem("%s for %s is out of the pool", ip, mac)
+			continue
+		}
+		if record, ok := p.Recordsv4[mac.String()]; ok {
+			if !record.IP.Equal(ip) {
+				problem("conflict: %s has a lease for %s, not %s", mac, record.IP, ip)
+			}
+			continue
+		}
+		if holder, ok := holders[ip.String()]; ok {
+			problem("conflict: %s is leased to %s, not %s", ip, holder, mac)
+			continue
+		}
+		if err := p.reserve(ip); err != nil {
+			problem("cannot reserve %s for %s: %v", ip, mac, err)
+			continue
+		}
+		record := &Record{IP: ip}
+		record.setExpiry(now, time.Duration(secs)*time.Second)
+		if err := p.saveIPAddress(mac, record); err != nil {
+			return imported, problems, fmt.Errorf("could not persist seeded lease for %s: %w", mac, err)
+		}
+		p.Recordsv4[mac.String()] = record
+		holders[ip.String()] = mac.String()
+		imported++
+	}
+	return imported, problems, nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coredhcp/coredhcp/internal/testpackets"
+)
+
+const seedFile = `# Exported from the DHCP snooping table
+02:00:00:00:00:01,192.0.2.10,3600
+02:00:00:00:00:02,192.0.2.10,3600
+02:00:00:00:00:01,192.0.2.11,3600
+02:00:00:00:00:03,198.51.100.1,3600
+02:00:00:00:00:04,192.0.2.12
+not-a-mac,192.0.2.13,3600
+02:00:00:00:00:05,192.0.2.14,0
+02:00:00:00:00:06, 192.0.2.15, 7200
+`
+
+func TestSeed(t *testing.T) {
+	leases, err := ioutil.TempFile("", "coredhcp-seed-leases")
+	require.NoError(t, err)
+	defer os.Remove(leases.Name())
+	_, err = leases.WriteString("02:00:00:00:00:01 192.0.2.10 " + time.Now().Add(time.Hour).UTC().Format(time.RFC3339) + "\n")
+	require.NoError(t, err)
+	leases.Close()
+
+	seed, err := ioutil.TempFile("", "coredhcp-seed")
+	require.NoError(t, err)
+	defer os.Remove(seed.Name())
+	_, err = seed.WriteString(seedFile)
+	require.NoError(t, err)
+	seed.Close()
+
+	p, err := setupInstance(leases.Name(), "192.0.2.10", "192.0.2.19", "1h")
+	require.NoError(t, err)
+	h := p.Handler4
+
+	imported, problems, err := p.seed(seed.Name())
+	require.NoError(t, err)
+	assert.Equal(t, 1, imported)
+	assert.Len(t, problems, 6, "problems: %v", problems)
+	record := p.Recordsv4["02:00:00:00:00:06"]
+	require.NotNil(t, record)
+	assert.True(t, record.IP.Equal(net.IPv4(192, 0, 2, 15)))
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), record.expires, 2*time.Second)
+	assert.True(t, p.Recordsv4["02:00:00:00:00:01"].IP.Equal(net.IPv4(192, 0, 2, 10)), "a known lease was overwritten")
+
+	// Seeding again imports nothing more
+	imported, problems, err = p.seed(seed.Name())
+	require.NoError(t, err)
+	assert.Equal(t, 0, imported)
+	assert.Len(t, problems, 6)
+
+	// Loaded and seeded addresses are not given to new clients
+	for _, mac := range []net.HardwareAddr{{0x02, 0, 0, 0, 1, 1}, {0x02, 0, 0, 0, 1, 2}} {
+		req, _ := testpackets.V4Discover(t, mac)
+		resp, err := dhcpv4.NewReplyFromRequest(req)
+		require.NoError(t, err)
+		resp, _ = h(req, resp)
+		require.NotNil(t, resp)
+		assert.False(t, resp.YourIPAddr.Equal(net.IPv4(192, 0, 2, 10)))
+		assert.False(t, resp.YourIPAddr.Equal(net.IPv4(192, 0, 2, 15)))
+	}
+
+	// Seeded leases are persisted
+	p, err = setupInstance(leases.Name(), "192.0.2.10", "192.0.2.19", "1h", "seed="+seed.Name())
+	require.NoError(t, err)
+	require.NotNil(t, p.Recordsv4["02:00:00:00:00:06"])
+
+	_, err = setupInstance(leases.Name(), "192.0.2.10", "192.0.2.19", "1h", "seed=/nonexistent")
+	assert.Error(t, err)
+}
@@ -0,0 +1,143 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/plugins"
+)
+
+// settings are the key=value arguments of an instance of the plugin, which
+// come after its positional arguments, in any order
+type settings struct {
+	p *PluginState
+	// allocation is the allocation strategy, applied once the pool is known
+	allocation string
+	// seedFile is imported after the lease file is loaded
+	seedFile string
+	// given counts the settings given, by key
+	given map[string]int
+}
+
+// A setting is a key=value argument of the plugin
+type setting struct {
+	// repeatable settings can be given several times, in which case they are
+	// parsed in the order they are given
+	repeatable bool
+	// parse applies the setting to s. It is given the whole argument, key
+	// included, and is called after the positional arguments are parsed
+	parse func(s *settings, arg string) error
+}
+
+// knownSettings are the settings of the plugin, by key
+var knownSettings = map[string]setting{
+	"tier": {repeatable: true, parse: func(s *settings, arg string) error {
+		tier, err := parseLeaseTier(arg)
+		if err != nil {
+			return err
+		}
+		s.p.tiers = append(s.p.tiers, tier)
+		return nil
+	}},
+	"requested": {parse: func(s *settings, arg string) (err error) {
+		s.p.requested, err = parseRequestPolicy(arg, s.p.LeaseTime)
+		return err
+	}},
+	"renumber": {repeatable: true, parse: func(s *settings, arg string) error {
+		r, err := parseRenumbering(arg)
+		if err != nil {
+			return err
+		}
+		if !r.to.Contains(s.p.start) || !r.to.Contains(s.p.end) {
+			return fmt.Errorf("the new prefix of renumbering %q must contain the range", arg)
+		}
+		s.p.migration.renumberings = append(s.p.migration.renumberings, r)
+		return nil
+	}},
+	"renumber_deadline": {parse: func(s *settings, arg string) (err error) {
+		s.p.migration.deadline, err = parseDeadline(arg)
+		return err
+	}},
+	"circuit_limit": {parse: func(s *settings, arg string) (err error) {
+		s.p.circuits, err = parseCircuitLimit(arg)
+		return err
+	}},
+	"jitter": {parse: func(s *settings, arg string) (err error) {
+		s.p.jitter, err = parseJitter(arg)
+		return err
+	}},
+	"degenerate": {parse: func(s *settings, arg string) (err error) {
+		s.p.degenerate, err = parseDegeneratePolicy(arg, s.p.LeaseTime)
+		return err
+	}},
+	"seed": {parse: func(s *settings, arg string) error {
+		s.seedFile = strings.TrimPrefix(arg, "seed=")
+		return nil
+	}},
+	"compact": {parse: func(s *settings, arg string) (err error) {
+		s.p.compaction, err = parseCompactionWindow(arg)
+		return err
+	}},
+	"allocation": {parse: func(s *settings, arg string) error {
+		s.allocation = arg
+		return nil
+	}},
+}
+
+// settingKeys returns the keys of the known settings, for error messages
+func settingKeys() string {
+	keys := make([]string, 0, len(knownSettings))
+	for key := range knownSettings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ", ")
+}
+
+// splitSettings splits args into the positional arguments, and the settings
+// after them. Only the first argument, the file name, can contain a '='
+// without being a setting
+func splitSettings(args []string) (positional, settings []string) {
+	for i := 1; i < len(args); i++ {
+		if strings.Contains(args[i], "=") {
+			return args[:i], args[i:]
+		}
+	}
+	return args, nil
+}
+
+// parseSettings applies the settings in args to s
+func parseSettings(s *settings, args []string) error {
+	s.given = make(map[string]int)
+	for _, arg := range args {
+		key := strings.SplitN(arg, "=", 2)[0]
+		def, ok := knownSettings[key]
+		if !ok {
+			return plugins.ArgErrorf(key, "unknown setting, expected one of %s", settingKeys())
+		}
+		if s.given[key] > 0 && !def.repeatable {
+			return plugins.ArgErrorf(key, "can only be given once")
+		}
+		s.given[key]++
+		if err := def.parse(s, arg); err != nil {
+			return plugins.ArgErrorf(key, "%v", err)
+		}
+	}
+
+	// Settings depending on each other
+	switch renumber, deadline := s.given["renumber"] > 0, s.given["renumber_deadline"] > 0; {
+	case deadline && !renumber:
+		return plugins.ArgErrorf("renumber_deadline", "needs renumberings")
+	case renumber && !deadline:
+		return plugins.ArgErrorf("renumber", "renumberings need a deadline")
+	}
+	if err := sortTiers(s.p.tiers, s.p.poolSize, s.p.LeaseTime); err != nil {
+		return plugins.ArgErrorf("tier", "%v", err)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitSettings(t *testing.T) {
+	positional, settings := splitSettings([]string{"a=b.txt", "192.0.2.10", "192.0.2.19", "1h", "5s", "tier=1:10m", "jitter=10%"})
+	assert.Equal(t, []string{"a=b.txt", "192.0.2.10", "192.0.2.19", "1h", "5s"}, positional)
+	assert.Equal(t, []string{"tier=1:10m", "jitter=10%"}, settings)
+
+	positional, settings = splitSettings([]string{"leases.txt", "192.0.2.10", "192.0.2.19", "1h"})
+	assert.Len(t, positional, 4)
+	assert.Empty(t, settings)
+}
+
+func TestParseArgs(t *testing.T) {
+	p, filename, seedFile, err := parseArgs("leases.txt", "192.0.2.10", "192.0.2.19", "1h", "5s", "100",
+		"tier=2:10m", "seed=seed.csv", "tier=5:30m", "jitter=10%", "allocation=spread", "compact=03:00")
+	require.NoError(t, err)
+	assert.Equal(t, "leases.txt", filename)
+	assert.Equal(t, "seed.csv", seedFile)
+	assert.Equal(t, 5*time.Second, p.flushInterval)
+	assert.Equal(t, 100, p.flushSize)
+	assert.Equal(t, 10, p.jitter.percent)
+	require.NotNil(t, p.compaction)
+	assert.Equal(t, 3, p.compaction.hour)
+	require.Len(t, p.tiers, 2)
+	assert.Equal(t, 30*time.Minute, p.tiers[0].leaseTime, "tiers should be sorted")
+
+	for _, bad := range [][]string{
+		{"1h", "tier=2:10m", "5s"},
+		{"1h", "unknown=1"},
+		{"1h", "jitter=10%", "jitter=20%"},
+		{"1h", "seed=a.csv", "seed=b.csv"},
+		{"1h", "allocation=random"},
+		{"1h", "circuit_limit=0"},
+		{"1h", "compact=daily"},
+	} {
+		_, _, _, err := parseArgs(append([]string{"leases.txt", "192.0.2.10", "192.0.2.19"}, bad...)...)
+		assert.Error(t, err, "%v should be refused", bad)
+	}
+}
+
+func TestValidateRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredhcp-validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Compaction would rewrite a lease file with repeated records
+	leases := filepath.Join(dir, "leases.txt")
+	content := []byte("02:00:00:00:00:01 192.0.2.10 2030-01-01T00:00:00Z\n02:00:00:00:00:01 192.0.2.10 2030-01-02T00:00:00Z\n")
+	require.NoError(t, ioutil.WriteFile(leases, content, 0644))
+	require.NoError(t, validateRange(leases, "192.0.2.10", "192.0.2.19", "1h", "seed="+filepath.Join(dir, "seed.csv")))
+	after, err := ioutil.ReadFile(leases)
+	require.NoError(t, err)
+	assert.Equal(t, content, after, "validation should not touch the lease file")
+
+	missing := filepath.Join(dir, "missing.txt")
+	require.NoError(t, validateRange(missing, "192.0.2.10", "192.0.2.19", "1h"))
+	_, err = os.Stat(missing)
+	assert.True(t, os.IsNotExist(err), "validation should not create the lease file")
+
+	assert.Error(t, validateRange(leases, "192.0.2.19", "192.0.2.10", "1h"))
+}
@@ -6,71 +6,284 @@ package rangeplugin
 
 import (
 	"bufio"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"sort"
 	"strings"
 	"time"
+
+	"github.com/coredhcp/coredhcp/internal/atomicfile"
 )
 
+// leaseFile is what lease records are appended to. It is implemented by
+// *os.File, and tests use it to inject write failures
+type leaseFile interface {
+	io.WriteCloser
+	Sync() error
+}
+
 // loadRecords loads the DHCPv6/v4 Records global map with records stored on
 // the specified file. The records have to be one per line, a mac address and an
 // IP address.
 func loadRecords(r io.Reader) (map[string]*Record, error) {
-	sc := bufio.NewScanner(r)
+	records, _, err := loadRecordsPrefix(r)
+	return records, err
+}
+
+// loadRecordsPrefix is like loadRecords, and also returns the length of the
+// data holding the records. A malformed last line without a terminating
+// newline is the remainder of a write interrupted by a crash, and is skipped
+// rather than rejected: it is not included in the returned length
+func loadRecordsPrefix(r io.Reader) (map[string]*Record, int64, error) {
+	br := bufio.NewReader(r)
 	records := make(map[string]*Record)
-	for sc.Scan() {
-		line := sc.Text()
+	var length int64
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+		torn := err == io.EOF
 		if len(line) == 0 {
-			continue
+			break
 		}
-		tokens := strings.Fields(line)
-		if len(tokens) != 3 {
-			return nil, fmt.Errorf("malformed line, want 3 fields, got %d: %s", len(tokens), line)
+		mac, record, perr := parseRecord(strings.TrimSuffix(line, "\n"))
+		if perr != nil {
+			if torn {
+				log.Warningf("Ignoring incomplete last line in lease file: %q", line)
+				break
+			}
+			return nil, 0, perr
 		}
-		hwaddr, err := net.ParseMAC(tokens[0])
-		if err != nil {
-			return nil, fmt.Errorf("malformed hardware address: %s", tokens[0])
+		if record != nil {
+			records[mac] = record
 		}
-		ipaddr := net.ParseIP(tokens[1])
-		if ipaddr.To4() == nil {
-			return nil, fmt.Errorf("expected an IPv4 address, got: %v", ipaddr)
+		length += int64(len(line))
+		if torn {
+			break
 		}
-		expires, err := time.Parse(time.RFC3339, tokens[2])
+	}
+	return records, length, nil
+}
+
+// parseRecord parses one line of a lease file. Empty lines yield a nil record
+func parseRecord(line string) (string, *Record, error) {
+	if len(line) == 0 {
+		return "", nil, nil
+	}
+	tokens := strings.Fields(line)
+	if len(tokens) != 3 && len(tokens) != 4 {
+		return "", nil, fmt.Errorf("malformed line, want 3 or 4 fields, got %d: %s", len(tokens), line)
+	}
+	hwaddr, err := net.ParseMAC(tokens[0])
+	if err != nil {
+		return "", nil, fmt.Errorf("malformed hardware address: %s", tokens[0])
+	}
+	ipaddr := net.ParseIP(tokens[1])
+	if ipaddr.To4() == nil {
+		return "", nil, fmt.Errorf("expected an IPv4 address, got: %v", ipaddr)
+	}
+	record := &Record{IP: ipaddr}
+	if tokens[2] == "infinite" {
+		record.infinite = true
+	} else {
+		record.expires, err = time.Parse(time.RFC3339, tokens[2])
 		if err != nil {
-			return nil, fmt.Errorf("expected time of exipry in RFC3339 format, got: %v", tokens[2])
+			return "", nil, fmt.Errorf("expected time of exipry in RFC3339 format or infinite, got: %v", tokens[2])
+		}
+		// Files written by other servers may encode infinite leases as
+		// expiring in the far future
+		if time.Until(record.expires) >= infinite {
+			record.setExpiry(time.Now(), infinite)
 		}
-		records[hwaddr.String()] = &Record{IP: ipaddr, expires: expires}
 	}
-	return records, nil
+	if len(tokens) == 4 {
+		circuit, err := hex.DecodeString(strings.TrimPrefix(tokens[3], "circuit="))
+		if err != nil || !strings.HasPrefix(tokens[3], "circuit=") {
+			return "", nil, fmt.Errorf("expected circuit=<hex circuit ID>, got: %v", tokens[3])
+		}
+		record.circuit = string(circuit)
+	}
+	return hwaddr.String(), record, nil
 }
 
+// loadRecordsFromFile loads the records from a lease file. An incomplete last
+// line left by a crash is truncated away, so that records appended later don't
+// get merged into it
 func loadRecordsFromFile(filename string) (map[string]*Record, error) {
 	reader, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open lease file %s: %w", filename, err)
+	}
 	defer func() {
 		if err := reader.Close(); err != nil {
 			log.Warningf("Failed to close file %s: %v", filename, err)
 		}
 	}()
+	records, length, err := loadRecordsPrefix(reader)
 	if err != nil {
-		return nil, fmt.Errorf("cannot open lease file %s: %w", filename, err)
+		return nil, err
+	}
+	info, err := reader.Stat()
+	if err != nil {
+		return nil, err
 	}
-	return loadRecords(reader)
+	if info.Size() > length {
+		log.Warningf("Truncating incomplete record at the end of lease file %s", filename)
+		if err := reader.Truncate(length); err != nil {
+			return nil, fmt.Errorf("cannot truncate lease file %s: %w", filename, err)
+		}
+		if err := reader.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	// A valid last record can still lack its newline, if the file was edited
+	// by hand. Terminate it so the next record appended goes on its own line
+	if length > 0 {
+		last := make([]byte, 1)
+		if _, err := reader.ReadAt(last, length-1); err != nil {
+			return nil, err
+		}
+		if last[0] != '\n' {
+			if _, err := reader.WriteAt([]byte("\n"), length); err != nil {
+				return nil, fmt.Errorf("cannot terminate last line of lease file %s: %w", filename, err)
+			}
+		}
+	}
+	return records, nil
 }
 
-// saveIPAddress writes out a lease to storage
-func (p *PluginState) saveIPAddress(mac net.HardwareAddr, record *Record) error {
-	_, err := p.leasefile.WriteString(mac.String() + " " + record.IP.String() + " " + record.expires.Format(time.RFC3339) + "\n")
+func formatRecord(mac string, record *Record) string {
+	expires := "infinite"
+	if !record.infinite {
+		expires = record.expires.Format(time.RFC3339)
+	}
+	line := mac + " " + record.IP.String() + " " + expires
+	if record.circuit != "" {
+		line += " circuit=" + hex.EncodeToString([]byte(record.circuit))
+	}
+	return line + "\n"
+}
+
+// compactLeaseFile rewrites the lease file so that it only holds the given
+// records, dropping the entries superseded by later renewals. The new contents
+// are written to a temporary file which is then renamed over the lease file, so
+// that a crash leaves either the old or the new file in place
+func compactLeaseFile(filename string, records map[string]*Record) error {
+	info, err := os.Stat(filename)
 	if err != nil {
 		return err
 	}
-	err = p.leasefile.Sync()
+	macs := make([]string, 0, len(records))
+	for mac := range records {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+	return atomicfile.Write(filename, info.Mode().Perm(), func(w io.Writer) error {
+		for _, mac := range macs {
+			if _, err := io.WriteString(w, formatRecord(mac, records[mac])); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// saveIPAddress writes out a lease to storage. Renewals still waiting in the
+// write buffer are written out first, so the file stays in chronological order
+func (p *PluginState) saveIPAddress(mac net.HardwareAddr, record *Record) error {
+	if p.closed {
+		return errClosed
+	}
+	p.pending.WriteString(formatRecord(mac.String(), record))
+	return p.flushPending()
+}
+
+// saveRenewal writes out a lease whose expiration was pushed back.
+// If renewal coalescing is enabled, the record is only buffered in memory, and
+// written out once flushInterval has elapsed or flushSize renewals are pending,
+// whichever comes first. Losing buffered renewals in a crash is acceptable: the
+// previous record for the same address is still in the file and the client will
+// renew again.
+func (p *PluginState) saveRenewal(mac net.HardwareAddr, record *Record) error {
+	if p.closed {
+		return errClosed
+	}
+	if p.flushInterval == 0 {
+		return p.saveIPAddress(mac, record)
+	}
+	p.pending.WriteString(formatRecord(mac.String(), record))
+	p.pendingCount++
+	if p.flushSize > 0 && p.pendingCount >= p.flushSize {
+		return p.flushPending()
+	}
+	if p.flushTimer == nil {
+		p.flushTimer = time.AfterFunc(p.flushInterval, p.flushOnTimer)
+	}
+	return nil
+}
+
+// flushPending writes out all buffered records and syncs the file.
+// It must be called with the plugin lock held
+func (p *PluginState) flushPending() error {
+	if p.flushTimer != nil {
+		p.flushTimer.Stop()
+		p.flushTimer = nil
+	}
+	if p.pending.Len() == 0 {
+		return nil
+	}
+	n, err := p.leasefile.Write(p.pending.Bytes())
 	if err != nil {
+		// Keep what was not written for the next flush, which completes
+		// a torn record
+		p.pending.Next(n)
 		return err
 	}
-	return nil
+	p.pending.Reset()
+	p.pendingCount = 0
+	return p.leasefile.Sync()
+}
+
+// errClosed is returned for the leases saved after close
+var errClosed = errors.New("lease file closed")
+
+// close writes out the buffered renewals and closes the lease file, when the
+// server shuts down. Leases saved afterwards are refused with errClosed
+func (p *PluginState) close() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	if p.compactTimer != nil {
+		p.compactTimer.Stop()
+	}
+	err := p.flushPending()
+	if cerr := p.leasefile.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (p *PluginState) flushOnTimer() {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed {
+		// close flushed the renewals of a timer that fired meanwhile
+		return
+	}
+	if err := p.flushPending(); err != nil {
+		log.Errorf("Could not persist batched lease renewals, retrying in %s: %v", p.flushInterval, err)
+		// The renewals not written out are still pending, and may be the
+		// last ones for a while
+		p.flushTimer = time.AfterFunc(p.flushInterval, p.flushOnTimer)
+	}
 }
 
 // registerBackingFile installs a file as the backing store for leases
@@ -80,11 +293,12 @@ func (p *PluginState) registerBackingFile(filename string) error {
 		// but maintaining consistency with the in-memory state isn't
 		return errors.New("cannot swap out a lease storage file while running")
 	}
-	// We never close this, but that's ok because plugins are never stopped/unregistered
+	// This is closed along with the plugin chain, see close
 	newLeasefile, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to open lease file %s: %w", filename, err)
 	}
 	p.leasefile = newLeasefile
+	p.filename = filename
 	return nil
 }
@@ -5,14 +5,19 @@
 package rangeplugin
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var leasefile string = `02:00:00:00:00:00 10.0.0.0 2000-01-01T00:00:00Z
@@ -28,12 +33,12 @@ var records = []struct {
 	mac string
 	ip  *Record
 }{
-	{"02:00:00:00:00:00", &Record{net.IPv4(10, 0, 0, 0), expire}},
-	{"02:00:00:00:00:01", &Record{net.IPv4(10, 0, 0, 1), expire}},
-	{"02:00:00:00:00:02", &Record{net.IPv4(10, 0, 0, 2), expire}},
-	{"02:00:00:00:00:03", &Record{net.IPv4(10, 0, 0, 3), expire}},
-	{"02:00:00:00:00:04", &Record{net.IPv4(10, 0, 0, 4), expire}},
-	{"02:00:00:00:00:05", &Record{net.IPv4(10, 0, 0, 5), expire}},
+	{"02:00:00:00:00:00", &Record{IP: net.IPv4(10, 0, 0, 0), expires: expire}},
+	{"02:00:00:00:00:01", &Record{IP: net.IPv4(10, 0, 0, 1), expires: expire}},
+	{"02:00:00:00:00:02", &Record{IP: net.IPv4(10, 0, 0, 2), expires: expire}},
+	{"02:00:00:00:00:03", &Record{IP: net.IPv4(10, 0, 0, 3), expires: expire}},
+	{"02:00:00:00:00:04", &Record{IP: net.IPv4(10, 0, 0, 4), expires: expire}},
+	{"02:00:00:00:00:05", &Record{IP: net.IPv4(10, 0, 0, 5), expires: expire}},
 }
 
 func TestLoadRecords(t *testing.T) {
@@ -85,3 +90,451 @@ func TestWriteRecords(t *testing.T) {
 	}
 	assert.Equal(t, leasefile, string(written), "Data written to the file doesn't match records")
 }
+
+func TestCoalesceRenewals(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "coredhcptest")
+	if err != nil {
+		t.Skipf("Could not setup file-based test: %v", err)
+	}
+	defer os.Remove(tmpfile.Name())
+	defer tmpfile.Close()
+
+	pl := PluginState{flushInterval: time.Hour, flushSize: 3}
+	if err := pl.registerBackingFile(tmpfile.Name()); err != nil {
+		t.Fatalf("Could not setup file")
+	}
+	defer pl.leasefile.Close()
+
+	readBack := func() string {
+		written, err := ioutil.ReadFile(tmpfile.Name())
+		if err != nil {
+			t.Fatalf("Could not read back temp file")
+		}
+		return string(written)
+	}
+	hwaddrs := make([]net.HardwareAddr, len(records))
+	for i, rec := range records {
+		if hwaddrs[i], err = net.ParseMAC(rec.mac); err != nil {
+			// bug in testdata
+			panic(err)
+		}
+	}
+	lines := strings.SplitAfter(leasefile, "\n")
+
+	// Renewals are only buffered
+	for i := 0; i < 2; i++ {
+		if err := pl.saveRenewal(hwaddrs[i], records[i].ip); err != nil {
+			t.Errorf("Failed to save renewal for %s: %v", hwaddrs[i], err)
+		}
+	}
+	assert.Empty(t, readBack(), "Renewals were written out before the batch was complete")
+
+	// A new lease is written synchronously, along with pending renewals
+	if err := pl.saveIPAddress(hwaddrs[2], records[2].ip); err != nil {
+		t.Errorf("Failed to save ip for %s: %v", hwaddrs[2], err)
+	}
+	assert.Equal(t, strings.Join(lines[:3], ""), readBack(), "New lease was not written out immediately")
+
+	// A full batch is written out without waiting for the interval
+	for i := 3; i < 6; i++ {
+		if err := pl.saveRenewal(hwaddrs[i], records[i].ip); err != nil {
+			t.Errorf("Failed to save renewal for %s: %v", hwaddrs[i], err)
+		}
+	}
+	assert.Equal(t, leasefile, readBack(), "Full batch of renewals was not written out")
+	assert.Nil(t, pl.flushTimer, "Flush timer still armed with no pending renewals")
+}
+
+func TestCoalesceRenewalsInterval(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "coredhcptest")
+	if err != nil {
+		t.Skipf("Could not setup file-based test: %v", err)
+	}
+	defer os.Remove(tmpfile.Name())
+	defer tmpfile.Close()
+
+	pl := PluginState{flushInterval: 10 * time.Millisecond}
+	if err := pl.registerBackingFile(tmpfile.Name()); err != nil {
+		t.Fatalf("Could not setup file")
+	}
+	defer pl.leasefile.Close()
+
+	hwaddr, err := net.ParseMAC(records[0].mac)
+	if err != nil {
+		// bug in testdata
+		panic(err)
+	}
+	pl.Lock()
+	if err := pl.saveRenewal(hwaddr, records[0].ip); err != nil {
+		t.Errorf("Failed to save renewal for %s: %v", hwaddr, err)
+	}
+	pl.Unlock()
+
+	assert.Eventually(t, func() bool {
+		written, err := ioutil.ReadFile(tmpfile.Name())
+		return err == nil && string(written) == strings.SplitAfter(leasefile, "\n")[0]
+	}, time.Second, 5*time.Millisecond, "Renewal was not written out after the flush interval")
+}
+
+// TestFlushRetry checks that renewals that could not be written out are kept
+// for the next flush, which completes the records torn by the failed one
+func TestFlushRetry(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "coredhcptest")
+	require.NoError(t, err)
+	defer os.Remove(tmpfile.Name())
+	defer tmpfile.Close()
+
+	pl := PluginState{flushInterval: time.Hour, flushSize: 3}
+	pl.leasefile = &crashingFile{f: tmpfile, budget: 10}
+	lines := strings.SplitAfter(leasefile, "\n")
+	for i := 0; i < 2; i++ {
+		hwaddr, err := net.ParseMAC(records[i].mac)
+		require.NoError(t, err)
+		require.NoError(t, pl.saveRenewal(hwaddr, records[i].ip))
+	}
+	require.Error(t, pl.flushPending())
+	assert.Equal(t, 2, pl.pendingCount)
+	assert.Equal(t, strings.Join(lines[:2], "")[10:], pl.pending.String(), "the renewals not written out were dropped")
+
+	pl.leasefile = tmpfile
+	require.NoError(t, pl.flushPending())
+	assert.Zero(t, pl.pending.Len())
+	written, err := ioutil.ReadFile(tmpfile.Name())
+	require.NoError(t, err)
+	assert.Equal(t, strings.Join(lines[:2], ""), string(written))
+}
+
+// flakyFile is a lease file whose first writes fail without writing anything
+type flakyFile struct {
+	*os.File
+	sync.Mutex
+	failures int
+}
+
+func (f *flakyFile) Write(b []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return 0, errors.New("transient write failure")
+	}
+	return f.File.Write(b)
+}
+
+// TestFlushTimerRetry checks that the timer retries a flush that failed, when
+// no other renewal comes to arm it again
+func TestFlushTimerRetry(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "coredhcptest")
+	require.NoError(t, err)
+	defer os.Remove(tmpfile.Name())
+	defer tmpfile.Close()
+
+	pl := PluginState{flushInterval: 10 * time.Millisecond, leasefile: &flakyFile{File: tmpfile, failures: 2}}
+	hwaddr, err := net.ParseMAC(records[0].mac)
+	require.NoError(t, err)
+	pl.Lock()
+	require.NoError(t, pl.saveRenewal(hwaddr, records[0].ip))
+	pl.Unlock()
+
+	assert.Eventually(t, func() bool {
+		written, err := ioutil.ReadFile(tmpfile.Name())
+		return err == nil && string(written) == strings.SplitAfter(leasefile, "\n")[0]
+	}, time.Second, 5*time.Millisecond, "Renewal was not written out once the write failures cleared")
+	require.NoError(t, pl.close())
+}
+
+// TestBatchTorn checks that a crash in the middle of writing out a batch of
+// renewals leaves a file that reloads with the complete records only, and that
+// the next record appended after recovery gets its own line
+func TestBatchTorn(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "coredhcptest")
+	require.NoError(t, err)
+	defer os.Remove(tmpfile.Name())
+	defer tmpfile.Close()
+
+	lines := strings.SplitAfter(leasefile, "\n")
+	pl := PluginState{flushInterval: time.Hour, flushSize: 3}
+	// The crash tears the second record of the batch
+	pl.leasefile = &crashingFile{f: tmpfile, budget: len(lines[0]) + 10}
+	for i := 0; i < 3; i++ {
+		hwaddr, err := net.ParseMAC(records[i].mac)
+		require.NoError(t, err)
+		err = pl.saveRenewal(hwaddr, records[i].ip)
+		if i < 2 {
+			require.NoError(t, err)
+		} else {
+			require.Equal(t, errCrash, err)
+		}
+	}
+
+	loaded, err := loadRecordsFromFile(tmpfile.Name())
+	require.NoError(t, err, "Lease file torn in a batch could not be reloaded")
+	assert.Equal(t, map[string]*Record{records[0].mac: records[0].ip}, loaded)
+
+	pl = PluginState{}
+	require.NoError(t, pl.registerBackingFile(tmpfile.Name()))
+	hwaddr, err := net.ParseMAC(records[3].mac)
+	require.NoError(t, err)
+	require.NoError(t, pl.saveIPAddress(hwaddr, records[3].ip))
+	require.NoError(t, pl.close())
+	written, err := ioutil.ReadFile(tmpfile.Name())
+	require.NoError(t, err)
+	assert.Equal(t, lines[0]+lines[3], string(written), "record appended after recovery merged into the torn one")
+}
+
+// syncCounter counts the syncs of a lease file
+type syncCounter struct {
+	*os.File
+	syncs int
+}
+
+func (s *syncCounter) Sync() error {
+	s.syncs++
+	return s.File.Sync()
+}
+
+// TestNewLeaseNotBatched checks that new leases are written out and synced
+// immediately when renewals are batched, so that a crash can only lose
+// renewals
+func TestNewLeaseNotBatched(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "coredhcptest")
+	require.NoError(t, err)
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	f, err := os.OpenFile(tmpfile.Name(), os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	file := &syncCounter{File: f}
+	pl := PluginState{flushInterval: time.Hour, flushSize: 10, leasefile: file}
+	defer pl.close()
+	lines := strings.SplitAfter(leasefile, "\n")
+	for i := 0; i < 3; i++ {
+		hwaddr, err := net.ParseMAC(records[i].mac)
+		require.NoError(t, err)
+		require.NoError(t, pl.saveIPAddress(hwaddr, records[i].ip))
+		assert.Equal(t, i+1, file.syncs, "new lease %d was not synced", i)
+		assert.Nil(t, pl.flushTimer, "new lease %d was batched", i)
+	}
+
+	// A crash now only loses the renewal
+	hwaddr, err := net.ParseMAC(records[3].mac)
+	require.NoError(t, err)
+	require.NoError(t, pl.saveRenewal(hwaddr, records[3].ip))
+	assert.Equal(t, 3, file.syncs)
+	loaded, err := loadRecordsFromFile(tmpfile.Name())
+	require.NoError(t, err)
+	assert.Len(t, loaded, 3)
+	written, err := ioutil.ReadFile(tmpfile.Name())
+	require.NoError(t, err)
+	assert.Equal(t, strings.Join(lines[:3], ""), string(written))
+}
+
+// TestCloseFlushes checks that the renewals still buffered are written out
+// when the plugin is closed at shutdown, and that nothing is written after
+func TestCloseFlushes(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "coredhcptest")
+	require.NoError(t, err)
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	pl := PluginState{flushInterval: time.Hour, flushSize: 10}
+	require.NoError(t, pl.registerBackingFile(tmpfile.Name()))
+	hwaddr, err := net.ParseMAC(records[0].mac)
+	require.NoError(t, err)
+	require.NoError(t, pl.saveRenewal(hwaddr, records[0].ip))
+
+	require.NoError(t, pl.close())
+	assert.Nil(t, pl.flushTimer)
+	written, err := ioutil.ReadFile(tmpfile.Name())
+	require.NoError(t, err)
+	assert.Equal(t, strings.SplitAfter(leasefile, "\n")[0], string(written), "buffered renewal lost at shutdown")
+
+	// Requests still being handled cannot write to the closed file
+	assert.Equal(t, errClosed, pl.saveRenewal(hwaddr, records[0].ip))
+	assert.Equal(t, errClosed, pl.saveIPAddress(hwaddr, records[0].ip))
+	pl.flushOnTimer()
+	assert.Zero(t, pl.pending.Len())
+	require.NoError(t, pl.close())
+}
+
+func TestCompactLeaseFile(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "coredhcptest")
+	if err != nil {
+		t.Skipf("Could not setup file-based test: %v", err)
+	}
+	defer os.Remove(tmpfile.Name())
+	defer tmpfile.Close()
+
+	// Older entries for the same MAC, superseded by the ones in leasefile
+	stale := `02:00:00:00:00:03 10.0.0.3 1999-01-01T00:00:00Z
+02:00:00:00:00:00 10.0.0.0 1999-01-01T00:00:00Z
+`
+	if _, err := tmpfile.WriteString(stale + leasefile); err != nil {
+		t.Fatal(err)
+	}
+	parsedRec, err := loadRecordsFromFile(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Failed to load records from file: %v", err)
+	}
+
+	if err := compactLeaseFile(tmpfile.Name(), parsedRec); err != nil {
+		t.Fatalf("Failed to compact lease file: %v", err)
+	}
+	written, err := ioutil.ReadFile(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Could not read back compacted file")
+	}
+	assert.Equal(t, leasefile, string(written), "Compacted file should only hold the latest records")
+
+	reloaded, err := loadRecordsFromFile(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Failed to load records from compacted file: %v", err)
+	}
+	assert.Equal(t, parsedRec, reloaded, "Compaction changed the records")
+}
+
+func TestLoadRecordsTornTail(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "coredhcptest")
+	if err != nil {
+		t.Skipf("Could not setup file-based test: %v", err)
+	}
+	defer os.Remove(tmpfile.Name())
+	defer tmpfile.Close()
+
+	torn := "02:00:00:00:00:06 10.0.0.6 2000-01-0"
+	if _, err := tmpfile.WriteString(leasefile + torn); err != nil {
+		t.Fatal(err)
+	}
+	parsedRec, err := loadRecordsFromFile(tmpfile.Name())
+	require.NoError(t, err, "Incomplete last line should be skipped")
+	assert.Len(t, parsedRec, len(records))
+	written, err := ioutil.ReadFile(tmpfile.Name())
+	require.NoError(t, err)
+	assert.Equal(t, leasefile, string(written), "Incomplete last line was not truncated")
+
+	// Malformed lines are still errors anywhere else
+	_, err = loadRecords(strings.NewReader(torn + "\n" + leasefile))
+	assert.Error(t, err)
+
+	// A complete last record without a newline is kept and terminated
+	if err := ioutil.WriteFile(tmpfile.Name(), []byte(strings.TrimSuffix(leasefile, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	parsedRec, err = loadRecordsFromFile(tmpfile.Name())
+	require.NoError(t, err)
+	assert.Len(t, parsedRec, len(records))
+	written, err = ioutil.ReadFile(tmpfile.Name())
+	require.NoError(t, err)
+	assert.Equal(t, leasefile, string(written), "Last line was not terminated")
+}
+
+var errCrash = errors.New("simulated crash")
+
+// crashingFile simulates a crash after budget bytes were written: the write
+// that exceeds the budget is torn, and all subsequent operations fail
+type crashingFile struct {
+	f      *os.File
+	budget int
+}
+
+func (c *crashingFile) Write(b []byte) (int, error) {
+	if len(b) <= c.budget {
+		c.budget -= len(b)
+		return c.f.Write(b)
+	}
+	n, _ := c.f.Write(b[:c.budget])
+	c.budget = -1
+	return n, errCrash
+}
+
+func (c *crashingFile) Sync() error {
+	if c.budget < 0 {
+		return errCrash
+	}
+	return c.f.Sync()
+}
+
+func (c *crashingFile) Close() error {
+	return c.f.Close()
+}
+
+// TestCrashRecovery runs a random workload of new leases and renewals against
+// a lease file that crashes at a random point, and checks that the file can be
+// reloaded, holds no record attributed to the wrong client, and only lost
+// renewals that were still being batched
+func TestCrashRecovery(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	const clients = 8
+	base := time.Date(2000, 01, 01, 00, 00, 00, 00, time.UTC)
+
+	for iter := 0; iter < 200; iter++ {
+		t.Run(fmt.Sprint(iter), func(t *testing.T) {
+			tmpfile, err := ioutil.TempFile("", "coredhcptest")
+			if err != nil {
+				t.Skipf("Could not setup file-based test: %v", err)
+			}
+			defer os.Remove(tmpfile.Name())
+			tmpfile.Close()
+
+			pl := PluginState{}
+			if rnd.Intn(2) == 0 {
+				pl.flushInterval = time.Hour
+				pl.flushSize = 1 + rnd.Intn(4)
+			}
+			f, err := os.OpenFile(tmpfile.Name(), os.O_APPEND|os.O_WRONLY, 0644)
+			require.NoError(t, err)
+			pl.leasefile = &crashingFile{f: f, budget: rnd.Intn(3000)}
+
+			// durable holds the latest expiry of each client known to be on disk
+			durable := make(map[string]time.Time)
+			// unflushed holds the records that may still be in the write buffer
+			var unflushed []Record
+			for op := 0; op < 60; op++ {
+				i := rnd.Intn(clients)
+				mac := net.HardwareAddr{0x02, 0, 0, 0, 0, byte(i)}
+				rec := &Record{IP: net.IPv4(10, 0, 0, byte(i)), expires: base.Add(time.Duration(op) * time.Second)}
+				if rnd.Intn(3) == 0 {
+					err = pl.saveIPAddress(mac, rec)
+				} else {
+					err = pl.saveRenewal(mac, rec)
+				}
+				if err != nil {
+					break
+				}
+				unflushed = append(unflushed, *rec)
+				if pl.pending.Len() == 0 {
+					for _, r := range unflushed {
+						durable[fmt.Sprintf("02:00:00:00:00:%02x", r.IP.To4()[3])] = r.expires
+					}
+					unflushed = nil
+				}
+			}
+			if pl.flushTimer != nil {
+				pl.flushTimer.Stop()
+			}
+			pl.leasefile.Close()
+
+			loaded, err := loadRecordsFromFile(tmpfile.Name())
+			require.NoError(t, err, "Lease file could not be reloaded after a crash")
+			for mac, rec := range loaded {
+				hwaddr, err := net.ParseMAC(mac)
+				require.NoError(t, err)
+				assert.True(t, rec.IP.Equal(net.IPv4(10, 0, 0, hwaddr[5])), "%s was attributed %s", mac, rec.IP)
+			}
+			for mac, expires := range durable {
+				require.Contains(t, loaded, mac, "Lease written out before the crash was lost")
+				assert.False(t, loaded[mac].expires.Before(expires), "Renewal of %s written out before the crash was lost", mac)
+			}
+
+			// The server can keep appending to the recovered file
+			pl = PluginState{}
+			require.NoError(t, pl.registerBackingFile(tmpfile.Name()))
+			mac := net.HardwareAddr{0x02, 0, 0, 0, 0, clients}
+			require.NoError(t, pl.saveIPAddress(mac, &Record{IP: net.IPv4(10, 0, 0, clients), expires: base}))
+			pl.leasefile.Close()
+			loaded, err = loadRecordsFromFile(tmpfile.Name())
+			require.NoError(t, err, "Lease file corrupted by appending after recovery")
+			assert.Contains(t, loaded, mac.String())
+		})
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// leaseTier gives new clients shorter leases once the number of free addresses
+// in the pool drops below a threshold, so that oversubscribed pools churn
+// faster. The threshold is either an absolute number of addresses or a
+// percentage of the pool size
+type leaseTier struct {
+	below     int
+	percent   bool
+	leaseTime time.Duration
+}
+
+func (t leaseTier) String() string {
+	if t.percent {
+		return fmt.Sprintf("below %d%% free: %s", t.below, t.leaseTime)
+	}
+	return fmt.Sprintf("below %d free: %s", t.below, t.leaseTime)
+}
+
+// threshold returns the number of free addresses below which t applies, in a
+// pool of size addresses
+func (t leaseTier) threshold(size int) int {
+	if t.percent {
+		return size * t.below / 100
+	}
+	return t.below
+}
+
+// parseLeaseTier parses a tier setting, of the form tier=<free>:<lease time>
+// where free is a number of addresses or a percentage of the pool
+func parseLeaseTier(arg string) (leaseTier, error) {
+	spec := strings.TrimPrefix(arg, "tier=")
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return leaseTier{}, fmt.Errorf("invalid lease tier %q, expected tier=<free addresses or %%>:<lease time>", arg)
+	}
+	var t leaseTier
+	free := parts[0]
+	if strings.HasSuffix(free, "%") {
+		t.percent = true
+		free = strings.TrimSuffix(free, "%")
+	}
+	var err error
+	t.below, err = strconv.Atoi(free)
+	if err != nil || t.below <= 0 || (t.percent && t.below > 100) {
+		return leaseTier{}, fmt.Errorf("invalid free address threshold in lease tier %q", arg)
+	}
+	t.leaseTime, err = time.ParseDuration(parts[1])
+	if err != nil || t.leaseTime <= 0 {
+		return leaseTier{}, fmt.Errorf("invalid lease time in lease tier %q", arg)
+	}
+	return t, nil
+}
+
+// leaseTiers are the tiers of a pool, sorted by decreasing threshold
+type leaseTiers []leaseTier
+
+// sortTiers sorts tiers by decreasing threshold in a pool of size addresses,
+// and checks that the lease time decreases with the threshold and stays below
+// the normal lease time, so a fuller pool never gives longer leases
+func sortTiers(tiers leaseTiers, size int, normal time.Duration) error {
+	sort.SliceStable(tiers, func(i, j int) bool {
+		return tiers[i].threshold(size) > tiers[j].threshold(size)
+	})
+	prev := normal
+	for _, t := range tiers {
+		if t.leaseTime >= prev {
+			return fmt.Errorf("lease tier %s: lease time must be shorter than for fewer used addresses (%s)", t, prev)
+		}
+		prev = t.leaseTime
+	}
+	return nil
+}
+
+// leaseTime returns the lease time for a new client when free addresses are
+// left in a pool of size addresses, and the tier that was applied. It is the
+// normal lease time if no tier applies
+func (tiers leaseTiers) leaseTime(free, size int, normal time.Duration) (time.Duration, *leaseTier) {
+	var applied *leaseTier
+	for i := range tiers {
+		if free < tiers[i].threshold(size) {
+			applied = &tiers[i]
+		}
+	}
+	if applied == nil {
+		return normal, nil
+	}
+	return applied.leaseTime, applied
+}
@@ -0,0 +1,115 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rangeplugin
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+)
+
+func TestParseLeaseTier(t *testing.T) {
+	tier, err := parseLeaseTier("tier=20%:10m")
+	require.NoError(t, err)
+	assert.Equal(t, leaseTier{below: 20, percent: true, leaseTime: 10 * time.Minute}, tier)
+	assert.Equal(t, 2, tier.threshold(10))
+
+	tier, err = parseLeaseTier("tier=5:1m")
+	require.NoError(t, err)
+	assert.Equal(t, leaseTier{below: 5, leaseTime: time.Minute}, tier)
+	assert.Equal(t, 5, tier.threshold(1000))
+
+	for _, bad := range []string{"tier=20%", "tier=:1m", "tier=0:1m", "tier=101%:1m", "tier=5:0s", "tier=5:soon", "tier=-1:1m"} {
+		_, err := parseLeaseTier(bad)
+		assert.Error(t, err, "%s should be refused", bad)
+	}
+}
+
+func TestSortTiers(t *testing.T) {
+	tiers := leaseTiers{
+		{below: 2, leaseTime: time.Minute},
+		{below: 50, percent: true, leaseTime: 10 * time.Minute},
+	}
+	require.NoError(t, sortTiers(tiers, 10, time.Hour))
+	assert.Equal(t, 50, tiers[0].below, "tiers not sorted by decreasing threshold")
+
+	longer := leaseTiers{
+		{below: 2, leaseTime: 20 * time.Minute},
+		{below: 5, leaseTime: 10 * time.Minute},
+	}
+	assert.Error(t, sortTiers(longer, 10, time.Hour), "a fuller pool should not give longer leases")
+	assert.Error(t, sortTiers(leaseTiers{{below: 2, leaseTime: 2 * time.Hour}}, 10, time.Hour),
+		"tiers should be shorter than the normal lease time")
+}
+
+// TestLeaseTiers fills a pool of 10 addresses, and checks new clients get
+// shorter leases as it fills up, while known clients keep normal ones
+func TestLeaseTiers(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "coredhcp-tiers")
+	require.NoError(t, err)
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	start, end := net.IPv4(192, 0, 2, 10), net.IPv4(192, 0, 2, 19)
+	p := PluginState{
+		Recordsv4: make(map[string]*Record),
+		LeaseTime: time.Hour,
+		poolSize:  10,
+		tiers: leaseTiers{
+			{below: 50, percent: true, leaseTime: 10 * time.Minute},
+			{below: 2, leaseTime: time.Minute},
+		},
+	}
+	p.allocator, err = bitmap.NewIPv4Allocator(start, end)
+	require.NoError(t, err)
+	require.NoError(t, p.registerBackingFile(tmpfile.Name()))
+	defer p.leasefile.Close()
+
+	lease := func(i int) time.Duration {
+		mac := net.HardwareAddr{0x02, 0, 0, 0, 0, byte(i)}
+		req, err := dhcpv4.NewDiscovery(mac)
+		require.NoError(t, err)
+		resp, err := dhcpv4.NewReplyFromRequest(req)
+		require.NoError(t, err)
+		resp, stop := p.Handler4(req, resp)
+		require.NotNil(t, resp, "client %d got no lease", i)
+		require.False(t, stop)
+		return resp.IPAddressLeaseTime(0)
+	}
+
+	// Client i finds 10-i free addresses: 10 to 5 are at least 50% of the
+	// pool, 4 to 2 are below it, 1 is below 2
+	for i := 0; i < 10; i++ {
+		want := time.Hour
+		switch {
+		case i >= 9:
+			want = time.Minute
+		case i >= 6:
+			want = 10 * time.Minute
+		}
+		assert.Equal(t, want, lease(i), "client %d", i)
+	}
+	assert.Equal(t, time.Hour, lease(0), "known clients should keep normal leases")
+	assert.Equal(t, time.Minute, lease(9), "short leases should be kept while the pool is full")
+
+	// Free up space, as lease expiry would
+	for i := 1; i < 7; i++ {
+		mac := net.HardwareAddr{0x02, 0, 0, 0, 0, byte(i)}.String()
+		ip := p.Recordsv4[mac].IP
+		require.NoError(t, p.allocator.Free(net.IPNet{IP: ip}))
+		delete(p.Recordsv4, mac)
+	}
+	assert.Equal(t, time.Hour, lease(9), "tiers should be left once space is freed")
+	assert.Nil(t, p.Recordsv4[net.HardwareAddr{0x02, 0, 0, 0, 0, 9}.String()].tier)
+	assert.Equal(t, time.Hour, lease(1), "new clients should get normal leases once space is freed")
+}
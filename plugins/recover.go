@@ -0,0 +1,120 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugins
+
+import (
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/sirupsen/logrus"
+)
+
+// guard recovers from the panics of the handler of one plugin, and applies the
+// panic policy of the server it runs in
+type guard struct {
+	// panics is updated atomically, and kept first for alignment on 32-bit
+	// platforms
+	panics   uint64
+	disabled int32
+	// name identifies the plugin and the protocol, e.g. "DHCPv4: range"
+	name   string
+	policy config.PanicPolicy
+	// log is the logger of the server instance, and limited logs its panics,
+	// which can happen for every request
+	log     *logrus.Entry
+	limited *logger.Limiter
+
+	mu sync.Mutex
+	// recent holds the times of the panics within the policy window
+	recent []time.Time
+}
+
+func newGuard(name string, policy config.PanicPolicy, log *logrus.Entry) *guard {
+	if policy.MaxPanics <= 0 {
+		policy.MaxPanics = config.DefaultPanicPolicy.MaxPanics
+	}
+	if policy.Window <= 0 {
+		policy.Window = config.DefaultPanicPolicy.Window
+	}
+	return &guard{name: name, policy: policy, log: log, limited: logger.NewLimiter(log, 10, time.Minute)}
+}
+
+func (g *guard) isDisabled() bool {
+	return atomic.LoadInt32(&g.disabled) != 0
+}
+
+// recovered accounts for a panic with value r while handling the request
+// summarized by summary. It returns true if the request is to be dropped, and
+// false if the rest of the chain is to run, skipping the plugin
+func (g *guard) recovered(summary string, r interface{}) bool {
+	n := atomic.AddUint64(&g.panics, 1)
+	g.limited.Limited(g.name).Errorf("%s: plugin panicked (%d panics so far): %v\nRequest: %s\n%s", g.name, n, r, summary, debug.Stack())
+	switch g.policy.Action {
+	case config.PanicSkip:
+		return false
+	case config.PanicDisable:
+		now := time.Now()
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		recent := g.recent[:0]
+		for _, t := range g.recent {
+			if now.Sub(t) < g.policy.Window {
+				recent = append(recent, t)
+			}
+		}
+		g.recent = append(recent, now)
+		if len(g.recent) >= g.policy.MaxPanics && !g.isDisabled() {
+			atomic.StoreInt32(&g.disabled, 1)
+			g.log.Errorf("%s: plugin disabled after %d panics within %s, restart the server to enable it again",
+				g.name, len(g.recent), g.policy.Window)
+		}
+	}
+	return true
+}
+
+func (g *guard) wrap4(h handler.Handler4) handler.Handler4 {
+	return func(req, resp *dhcpv4.DHCPv4) (out *dhcpv4.DHCPv4, stop bool) {
+		if g.isDisabled() {
+			return resp, false
+		}
+		defer func() {
+			if r := recover(); r != nil {
+				if g.recovered(req.Summary(), r) {
+					out, stop = nil, true
+				} else {
+					// The response may have been partially modified
+					out, stop = resp, false
+				}
+			}
+		}()
+		return h(req, resp)
+	}
+}
+
+func (g *guard) wrap6(h handler.Handler6) handler.Handler6 {
+	return func(req, resp dhcpv6.DHCPv6) (out dhcpv6.DHCPv6, stop bool) {
+		if g.isDisabled() {
+			return resp, false
+		}
+		defer func() {
+			if r := recover(); r != nil {
+				if g.recovered(req.Summary(), r) {
+					out, stop = nil, true
+				} else {
+					out, stop = resp, false
+				}
+			}
+		}()
+		return h(req, resp)
+	}
+}
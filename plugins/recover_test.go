@@ -0,0 +1,105 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugins
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coredhcp/coredhcp/config"
+)
+
+// panicky4 panics on requests from client, and sets the file name of other
+// responses
+func panicky4(client net.HardwareAddr) func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		if req.ClientHWAddr.String() == client.String() {
+			panic("malformed request")
+		}
+		resp.BootFileName = "handled"
+		return resp, false
+	}
+}
+
+func TestGuard4(t *testing.T) {
+	bad := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	good := net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+	run := func(g *guard, mac net.HardwareAddr) (*dhcpv4.DHCPv4, bool) {
+		req, err := dhcpv4.NewDiscovery(mac)
+		require.NoError(t, err)
+		resp, err := dhcpv4.NewReplyFromRequest(req)
+		require.NoError(t, err)
+		return g.wrap4(panicky4(bad))(req, resp)
+	}
+
+	t.Run("drop", func(t *testing.T) {
+		g := newGuard("DHCPv4: test", config.PanicPolicy{Action: config.PanicDrop}, log)
+		resp, stop := run(g, bad)
+		assert.Nil(t, resp)
+		assert.True(t, stop)
+		resp, stop = run(g, good)
+		require.NotNil(t, resp)
+		assert.Equal(t, "handled", resp.BootFileName)
+		assert.False(t, stop)
+		assert.Equal(t, uint64(1), g.panics)
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		g := newGuard("DHCPv4: test", config.PanicPolicy{Action: config.PanicSkip}, log)
+		resp, stop := run(g, bad)
+		assert.NotNil(t, resp)
+		assert.False(t, stop)
+	})
+
+	t.Run("disable", func(t *testing.T) {
+		g := newGuard("DHCPv4: disabled", config.PanicPolicy{Action: config.PanicDisable, MaxPanics: 2, Window: time.Minute}, log)
+		chain := &Chain{guards: []*guard{newGuard("DHCPv4: other", config.DefaultPanicPolicy, log), g}}
+		resp, _ := run(g, bad)
+		assert.Nil(t, resp)
+		assert.False(t, g.isDisabled())
+		assert.Empty(t, chain.Disabled())
+
+		resp, _ = run(g, bad)
+		assert.Nil(t, resp)
+		assert.True(t, g.isDisabled())
+		assert.Equal(t, []string{"DHCPv4: disabled"}, chain.Disabled())
+
+		// A disabled plugin is skipped
+		resp, stop := run(g, good)
+		require.NotNil(t, resp)
+		assert.Empty(t, resp.BootFileName)
+		assert.False(t, stop)
+	})
+
+	t.Run("disable window", func(t *testing.T) {
+		g := newGuard("DHCPv4: test", config.PanicPolicy{Action: config.PanicDisable, MaxPanics: 2, Window: time.Minute}, log)
+		run(g, bad)
+		g.recent[0] = g.recent[0].Add(-2 * time.Minute)
+		run(g, bad)
+		assert.False(t, g.isDisabled(), "panics outside the window disabled the plugin")
+	})
+}
+
+func TestGuard6(t *testing.T) {
+	g := newGuard("DHCPv6: test", config.PanicPolicy{Action: config.PanicDrop}, log)
+	chain := &Chain{guards: []*guard{g}}
+	h := g.wrap6(func(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+		var m map[string]int
+		m["nil map"]++
+		return resp, false
+	})
+	req, err := dhcpv6.NewSolicit(net.HardwareAddr{0x02, 0, 0, 0, 0, 1})
+	require.NoError(t, err)
+	resp, stop := h(req, req)
+	assert.Nil(t, resp)
+	assert.True(t, stop)
+	assert.Equal(t, uint64(1), chain.Panics())
+}
@@ -0,0 +1,76 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package refreshtime
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger("plugins/refresh_time")
+
+// Plugin wraps plugin registration information
+var Plugin = plugins.Plugin{
+	Name:           "refresh_time",
+	Setup6:         setup6,
+	SideEffectFree: true,
+}
+
+// minRefreshTime is IRT_MINIMUM, RFC8415 §7.6. Clients use it in place of
+// any shorter value, so refuse to configure one
+const minRefreshTime = 600 * time.Second
+
+// makeHandler6 returns a handler for DHCPv6 packets advertising refreshTime in
+// replies to Information-Request messages
+func makeHandler6(refreshTime time.Duration) handler.Handler6 {
+	data := make([]byte, 4)
+	if secs := refreshTime / time.Second; secs >= math.MaxUint32 {
+		binary.BigEndian.PutUint32(data, math.MaxUint32) // infinity
+	} else {
+		binary.BigEndian.PutUint32(data, uint32(secs))
+	}
+	opt := &dhcpv6.OptionGeneric{
+		OptionCode: dhcpv6.OptionInformationRefreshTime,
+		OptionData: data,
+	}
+
+	return func(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+		msg, err := req.GetInnerMessage()
+		if err != nil {
+			log.Error(err)
+			return nil, true
+		}
+		// RFC8415 §21.23: only sent in replies to Information-Request
+		if msg.MessageType != dhcpv6.MessageTypeInformationRequest {
+			return resp, false
+		}
+		if resp.GetOneOption(dhcpv6.OptionInformationRefreshTime) == nil {
+			resp.AddOption(opt)
+		}
+		return resp, false
+	}
+}
+
+func setup6(args ...string) (handler.Handler6, error) {
+	log.Print("loading `refresh_time` plugin for DHCPv6")
+	if len(args) != 1 {
+		return nil, errors.New("need exactly one refresh time")
+	}
+	refreshTime, err := time.ParseDuration(args[0])
+	if err != nil {
+		return nil, plugins.ArgErrorf("refresh time", "invalid duration: %s", args[0])
+	}
+	if refreshTime < minRefreshTime {
+		return nil, plugins.ArgErrorf("refresh time", "must be at least %s", minRefreshTime)
+	}
+	return makeHandler6(refreshTime), nil
+}
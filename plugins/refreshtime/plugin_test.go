@@ -0,0 +1,58 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package refreshtime
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddRefreshTime(t *testing.T) {
+	handler, err := setup6("24h")
+	require.NoError(t, err)
+
+	req, err := dhcpv6.NewMessage()
+	require.NoError(t, err)
+	req.MessageType = dhcpv6.MessageTypeInformationRequest
+	// Without a client identifier, as the server builds it
+	resp := &dhcpv6.Message{MessageType: dhcpv6.MessageTypeReply, TransactionID: req.TransactionID}
+
+	result, stop := handler(req, resp)
+	require.NotNil(t, result)
+	assert.False(t, stop)
+	opt := result.GetOneOption(dhcpv6.OptionInformationRefreshTime)
+	require.NotNil(t, opt, "refresh time missing from reply to Information-Request")
+	assert.Equal(t, []byte{0x00, 0x01, 0x51, 0x80}, opt.ToBytes())
+}
+
+func TestNoRefreshTimeForStatefulMessages(t *testing.T) {
+	handler, err := setup6("1h")
+	require.NoError(t, err)
+
+	req, err := dhcpv6.NewMessage()
+	require.NoError(t, err)
+	req.MessageType = dhcpv6.MessageTypeRequest
+	req.AddOption(dhcpv6.OptClientID(dhcpv6.Duid{Type: dhcpv6.DUID_LL, HwType: iana.HWTypeEthernet, LinkLayerAddr: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}}))
+	resp, err := dhcpv6.NewReplyFromMessage(req)
+	require.NoError(t, err)
+
+	result, _ := handler(req, resp)
+	require.NotNil(t, result)
+	assert.Nil(t, result.GetOneOption(dhcpv6.OptionInformationRefreshTime))
+}
+
+func TestSetup(t *testing.T) {
+	_, err := setup6()
+	assert.Error(t, err)
+	_, err = setup6("not a duration")
+	assert.Error(t, err)
+	_, err = setup6("60s")
+	assert.Error(t, err, "refresh time below IRT_MINIMUM should be refused")
+}
@@ -0,0 +1,88 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rfc2131
+
+// This plugin rejects DHCPREQUEST messages that do not match any of the client
+// states of RFC2131 §4.3.2, such as a RENEWING request carrying a server
+// identifier or a SELECTING request without a requested IP address. Lenient
+// servers hide these client bugs.
+//
+// Example configuration:
+//
+// server4:
+//   plugins:
+//     - server_id: 10.10.10.1
+//     - rfc2131: nak
+//     - range: leases.txt 10.10.10.100 10.10.10.200 60s
+//
+// The only, optional, argument is what to do with invalid requests: drop them
+// (the default), or answer with a DHCPNAK. The plugin must come after
+// server_id, so the DHCPNAK carries a server identifier.
+//
+// Other plugins can classify requests with RequestState without loading this
+// plugin.
+
+import (
+	"fmt"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+var log = logger.GetLogger("plugins/rfc2131")
+
+// Plugin wraps plugin registration information
+var Plugin = plugins.Plugin{
+	Name:           "rfc2131",
+	Setup4:         setup4,
+	SideEffectFree: true,
+	// Reject invalid requests before they get a lease, and after the server
+	// identifier is set for DHCPNAKs
+	RunsAfter:  []string{"server_id"},
+	RunsBefore: []string{"file", "range"},
+}
+
+func setup4(args ...string) (handler.Handler4, error) {
+	nak := false
+	if len(args) > 1 {
+		return nil, fmt.Errorf("want at most one argument, got %d", len(args))
+	}
+	if len(args) == 1 {
+		switch args[0] {
+		case "drop":
+		case "nak":
+			nak = true
+		default:
+			return nil, plugins.ArgErrorf("action", "unknown action %q, expected drop or nak", args[0])
+		}
+	}
+	log.Printf("loaded plugin for DHCPv4.")
+	return makeHandler4(nak), nil
+}
+
+// makeHandler4 returns a handler for DHCPv4 packets rejecting DHCPREQUESTs in
+// no valid client state, with a DHCPNAK if nak is true
+func makeHandler4(nak bool) handler.Handler4 {
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		if req.MessageType() != dhcpv4.MessageTypeRequest {
+			return resp, false
+		}
+		state := RequestState(req)
+		if state != StateInvalid {
+			log.Debugf("%s: request in %s state", req.ClientHWAddr, state)
+			return resp, false
+		}
+
+		log.Warningf("%s: request in no valid client state (server identifier: %v, requested IP: %v, ciaddr: %s)",
+			req.ClientHWAddr, req.ServerIdentifier(), req.RequestedIPAddress(), req.ClientIPAddr)
+		if !nak {
+			return nil, true
+		}
+		Nak(resp)
+		return resp, true
+	}
+}
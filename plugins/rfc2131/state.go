@@ -0,0 +1,79 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rfc2131
+
+import (
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// State is the client state a DHCPREQUEST is sent from, as defined in
+// RFC2131 §4.3.2
+type State int
+
+// Client states
+const (
+	// StateInvalid is for requests that do not match any state
+	StateInvalid State = iota
+	// StateSelecting is for requests answering a DHCPOFFER
+	StateSelecting
+	// StateInitReboot is for requests verifying a previously allocated address
+	StateInitReboot
+	// StateRenewing is for requests extending a lease, in the RENEWING or
+	// REBINDING state. These two only differ by the destination address
+	// (unicast to the server or broadcast), which plugins do not see
+	StateRenewing
+)
+
+func (s State) String() string {
+	switch s {
+	case StateSelecting:
+		return "SELECTING"
+	case StateInitReboot:
+		return "INIT-REBOOT"
+	case StateRenewing:
+		return "RENEWING/REBINDING"
+	default:
+		return "invalid"
+	}
+}
+
+// RequestState classifies a DHCPREQUEST according to the options and
+// addresses it carries (RFC2131 §4.3.2):
+//
+//	state        server identifier  requested IP  ciaddr
+//	SELECTING    MUST               MUST          MUST be zero
+//	INIT-REBOOT  MUST NOT           MUST          MUST be zero
+//	RENEWING     MUST NOT           MUST NOT      MUST
+//
+// It returns StateInvalid for other combinations, and for other message types
+func RequestState(req *dhcpv4.DHCPv4) State {
+	if req.MessageType() != dhcpv4.MessageTypeRequest {
+		return StateInvalid
+	}
+	hasServerID := req.Options.Has(dhcpv4.OptionServerIdentifier)
+	hasRequestedIP := req.Options.Has(dhcpv4.OptionRequestedIPAddress)
+	hasCiaddr := req.ClientIPAddr != nil && !req.ClientIPAddr.Equal(net.IPv4zero)
+
+	switch {
+	case hasServerID && hasRequestedIP && !hasCiaddr:
+		return StateSelecting
+	case !hasServerID && hasRequestedIP && !hasCiaddr:
+		return StateInitReboot
+	case !hasServerID && !hasRequestedIP && hasCiaddr:
+		return StateRenewing
+	default:
+		return StateInvalid
+	}
+}
+
+// Nak turns resp into a DHCPNAK, which carries no address or lease time
+// (RFC2131 §4.3.1, table 3)
+func Nak(resp *dhcpv4.DHCPv4) {
+	resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeNak))
+	resp.YourIPAddr = net.IPv4zero
+	delete(resp.Options, dhcpv4.OptionIPAddressLeaseTime.Code())
+}
@@ -0,0 +1,96 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rfc2131
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeRequest(t *testing.T, serverID, requestedIP bool, ciaddr net.IP) *dhcpv4.DHCPv4 {
+	mods := []dhcpv4.Modifier{dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest)}
+	if serverID {
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(192, 0, 2, 1))))
+	}
+	if requestedIP {
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(192, 0, 2, 100))))
+	}
+	if ciaddr != nil {
+		mods = append(mods, dhcpv4.WithClientIP(ciaddr))
+	}
+	req, err := dhcpv4.New(mods...)
+	require.NoError(t, err)
+	return req
+}
+
+func TestRequestState(t *testing.T) {
+	leased := net.IPv4(192, 0, 2, 100)
+	for _, tt := range []struct {
+		name                  string
+		serverID, requestedIP bool
+		ciaddr                net.IP
+		want                  State
+	}{
+		{"selecting", true, true, nil, StateSelecting},
+		{"selecting with zero ciaddr", true, true, net.IPv4zero, StateSelecting},
+		{"selecting without requested IP", true, false, nil, StateInvalid},
+		{"selecting with ciaddr", true, true, leased, StateInvalid},
+		{"init-reboot", false, true, nil, StateInitReboot},
+		{"init-reboot with ciaddr", false, true, leased, StateInvalid},
+		{"renewing", false, false, leased, StateRenewing},
+		{"renewing with server identifier", true, false, leased, StateInvalid},
+		{"no identifying fields", false, false, nil, StateInvalid},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := makeRequest(t, tt.serverID, tt.requestedIP, tt.ciaddr)
+			assert.Equal(t, tt.want, RequestState(req), "got %s, want %s", RequestState(req), tt.want)
+		})
+	}
+
+	discover, err := dhcpv4.New(dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover))
+	require.NoError(t, err)
+	assert.Equal(t, StateInvalid, RequestState(discover))
+}
+
+func TestStrictHandler(t *testing.T) {
+	valid := makeRequest(t, false, true, nil)
+	invalid := makeRequest(t, true, false, net.IPv4(192, 0, 2, 100))
+
+	for _, nak := range []bool{false, true} {
+		h := makeHandler4(nak)
+
+		resp, err := dhcpv4.NewReplyFromRequest(valid)
+		require.NoError(t, err)
+		result, stop := h(valid, resp)
+		assert.NotNil(t, result, "valid request dropped")
+		assert.False(t, stop)
+
+		resp, err = dhcpv4.NewReplyFromRequest(invalid,
+			dhcpv4.WithMessageType(dhcpv4.MessageTypeAck), dhcpv4.WithYourIP(net.IPv4(192, 0, 2, 100)))
+		require.NoError(t, err)
+		result, stop = h(invalid, resp)
+		assert.True(t, stop)
+		if !nak {
+			assert.Nil(t, result, "invalid request not dropped")
+			continue
+		}
+		require.NotNil(t, result)
+		assert.Equal(t, dhcpv4.MessageTypeNak, result.MessageType())
+		assert.True(t, result.YourIPAddr.Equal(net.IPv4zero))
+	}
+}
+
+func TestSetup(t *testing.T) {
+	_, err := setup4()
+	assert.NoError(t, err)
+	_, err = setup4("nak")
+	assert.NoError(t, err)
+	_, err = setup4("ignore")
+	assert.Error(t, err)
+}
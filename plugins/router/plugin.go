@@ -7,6 +7,7 @@ package router
 import (
 	"errors"
 	"net"
+	"time"
 
 	"github.com/coredhcp/coredhcp/handler"
 	"github.com/coredhcp/coredhcp/logger"
@@ -16,34 +17,47 @@ import (
 
 var log = logger.GetLogger("plugins/router")
 
+// limited logs the errors that can repeat for every packet
+var limited = logger.NewLimiter(log, 10, time.Minute)
+
 // Plugin wraps plugin registration information
 var Plugin = plugins.Plugin{
-	Name:   "router",
-	Setup4: setup4,
+	Name:           "router",
+	Setup4:         setup4,
+	SideEffectFree: true,
 }
 
-var (
-	routers []net.IP
-)
+// Handler4 was the handler of the plugin when it kept a single list of routers.
+// It drops every packet, with an error.
+//
+// Deprecated: each instance of the plugin has its own routers, use the handler
+// returned by its setup function.
+func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	limited.Limited("deprecated").Errorf("BUG: router.Handler4 has no routers, dropping packet")
+	return nil, true
+}
 
 func setup4(args ...string) (handler.Handler4, error) {
 	log.Printf("Loaded plugin for DHCPv4.")
 	if len(args) < 1 {
 		return nil, errors.New("need at least one router IP address")
 	}
+	var routers []net.IP
 	for _, arg := range args {
 		router := net.ParseIP(arg)
 		if router.To4() == nil {
-			return Handler4, errors.New("expected an router IP address, got: " + arg)
+			return nil, plugins.ArgErrorf(arg, "expected a router IPv4 address")
 		}
 		routers = append(routers, router)
 	}
 	log.Infof("loaded %d router IP addresses.", len(routers))
-	return Handler4, nil
+	return makeHandler4(routers), nil
 }
 
-//Handler4 handles DHCPv4 packets for the router plugin
-func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	resp.Options.Update(dhcpv4.OptRouter(routers...))
-	return resp, false
+// makeHandler4 returns a handler for DHCPv4 packets advertising routers
+func makeHandler4(routers []net.IP) handler.Handler4 {
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		resp.Options.Update(dhcpv4.OptRouter(routers...))
+		return resp, false
+	}
 }
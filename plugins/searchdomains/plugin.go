@@ -29,18 +29,12 @@ var log = logger.GetLogger("plugins/searchdomains")
 //   - file: "leases.txt"
 //
 var Plugin = plugins.Plugin{
-	Name:   "searchdomains",
-	Setup6: setup6,
-	Setup4: setup4,
+	Name:           "searchdomains",
+	Setup6:         setup6,
+	Setup4:         setup4,
+	SideEffectFree: true,
 }
 
-// These are the DNS search domains that are set by the plugin.
-// Note that DHCPv4 and DHCPv6 options are totally independent.
-// If you need the same settings for both, you'll need to configure
-// this plugin once for the v4 and once for the v6 server.
-var v4SearchList []string
-var v6SearchList []string
-
 // copySlice creates a new copy of a string slice in memory.
 // This helps to ensure that downstream plugins can't corrupt
 // this plugin's configuration
@@ -51,27 +45,35 @@ func copySlice(original []string) []string {
 }
 
 func setup6(args ...string) (handler.Handler6, error) {
-	v6SearchList = args
+	// These are the DNS search domains that are set by the plugin.
+	// Note that DHCPv4 and DHCPv6 options are totally independent.
+	// If you need the same settings for both, you'll need to configure
+	// this plugin once for the v4 and once for the v6 server.
+	v6SearchList := copySlice(args)
 	log.Printf("Registered domain search list (DHCPv6) %s", v6SearchList)
-	return domainSearchListHandler6, nil
+	return makeDomainSearchListHandler6(v6SearchList), nil
 }
 
 func setup4(args ...string) (handler.Handler4, error) {
-	v4SearchList = args
+	v4SearchList := copySlice(args)
 	log.Printf("Registered domain search list (DHCPv4) %s", v4SearchList)
-	return domainSearchListHandler4, nil
+	return makeDomainSearchListHandler4(v4SearchList), nil
 }
 
-func domainSearchListHandler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
-	resp.UpdateOption(dhcpv6.OptDomainSearchList(&rfc1035label.Labels{
-		Labels: copySlice(v6SearchList),
-	}))
-	return resp, false
+func makeDomainSearchListHandler6(v6SearchList []string) handler.Handler6 {
+	return func(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+		resp.UpdateOption(dhcpv6.OptDomainSearchList(&rfc1035label.Labels{
+			Labels: copySlice(v6SearchList),
+		}))
+		return resp, false
+	}
 }
 
-func domainSearchListHandler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	resp.UpdateOption(dhcpv4.OptDomainSearch(&rfc1035label.Labels{
-		Labels: copySlice(v4SearchList),
-	}))
-	return resp, false
+func makeDomainSearchListHandler4(v4SearchList []string) handler.Handler4 {
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		resp.UpdateOption(dhcpv4.OptDomainSearch(&rfc1035label.Labels{
+			Labels: copySlice(v4SearchList),
+		}))
+		return resp, false
+	}
 }
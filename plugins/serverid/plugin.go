@@ -8,6 +8,7 @@ import (
 	"errors"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/coredhcp/coredhcp/handler"
 	"github.com/coredhcp/coredhcp/logger"
@@ -19,80 +20,104 @@ import (
 
 var log = logger.GetLogger("plugins/server_id")
 
+// limited logs the errors that can repeat for every packet
+var limited = logger.NewLimiter(log, 10, time.Minute)
+
 // Plugin wraps plugin registration information
 var Plugin = plugins.Plugin{
-	Name:   "server_id",
-	Setup6: setup6,
-	Setup4: setup4,
+	Name:        "server_id",
+	ChainSetup6: setup6,
+	Setup4:      setup4,
+	Validate6:   validate6,
 }
 
-// v6ServerID is the DUID of the v6 server
-var (
-	v6ServerID *dhcpv6.Duid
-	v4ServerID net.IP
-)
+// makeHandler6 returns a handler for DHCPv6 packets, using v6ServerID as the
+// DUID of the server
+func makeHandler6(v6ServerID *dhcpv6.Duid) handler.Handler6 {
+	return func(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+		if v6ServerID == nil {
+			log.Fatal("BUG: Plugin is running uninitialized!")
+			return nil, true
+		}
 
-// Handler6 handles DHCPv6 packets for the server_id plugin.
-func Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
-	if v6ServerID == nil {
-		log.Fatal("BUG: Plugin is running uninitialized!")
-		return nil, true
-	}
+		msg, err := req.GetInnerMessage()
+		if err != nil {
+			// BUG: this should already have failed in the main handler. Abort
+			log.Error(err)
+			return nil, true
+		}
 
-	msg, err := req.GetInnerMessage()
-	if err != nil {
-		// BUG: this should already have failed in the main handler. Abort
-		log.Error(err)
-		return nil, true
-	}
+		if sid := msg.Options.ServerID(); sid != nil {
+			// RFC8415 §16.{2,5,7}
+			// These message types MUST be discarded if they contain *any* ServerID option
+			if msg.MessageType == dhcpv6.MessageTypeSolicit ||
+				msg.MessageType == dhcpv6.MessageTypeConfirm ||
+				msg.MessageType == dhcpv6.MessageTypeRebind {
+				return nil, true
+			}
 
-	if sid := msg.Options.ServerID(); sid != nil {
-		// RFC8415 §16.{2,5,7}
-		// These message types MUST be discarded if they contain *any* ServerID option
-		if msg.MessageType == dhcpv6.MessageTypeSolicit ||
-			msg.MessageType == dhcpv6.MessageTypeConfirm ||
-			msg.MessageType == dhcpv6.MessageTypeRebind {
+			// Approximately all others MUST be discarded if the ServerID doesn't match
+			if !sid.Equal(*v6ServerID) {
+				log.Infof("requested server ID does not match this server's ID. Got %v, want %v", sid, *v6ServerID)
+				return nil, true
+			}
+		} else if msg.MessageType == dhcpv6.MessageTypeRequest ||
+			msg.MessageType == dhcpv6.MessageTypeRenew ||
+			msg.MessageType == dhcpv6.MessageTypeDecline ||
+			msg.MessageType == dhcpv6.MessageTypeRelease {
+			// RFC8415 §16.{6,8,10,11}
+			// These message types MUST be discarded if they *don't* contain a ServerID option
 			return nil, true
 		}
+		dhcpv6.WithServerID(*v6ServerID)(resp)
+		return resp, false
+	}
+}
 
-		// Approximately all others MUST be discarded if the ServerID doesn't match
-		if !sid.Equal(*v6ServerID) {
-			log.Infof("requested server ID does not match this server's ID. Got %v, want %v", sid, *v6ServerID)
+// makeHandler4 returns a handler for DHCPv4 packets, using v4ServerID as the
+// server identifier
+func makeHandler4(v4ServerID net.IP) handler.Handler4 {
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		if v4ServerID == nil {
+			log.Fatal("BUG: Plugin is running uninitialized!")
+			return nil, true
+		}
+		if req.OpCode != dhcpv4.OpcodeBootRequest {
+			log.Warningf("not a BootRequest, ignoring")
+			return resp, false
+		}
+		if req.ServerIPAddr != nil &&
+			!req.ServerIPAddr.Equal(net.IPv4zero) &&
+			!req.ServerIPAddr.Equal(v4ServerID) {
+			// This request is not for us, drop it.
+			log.Infof("requested server ID does not match this server's ID. Got %v, want %v", req.ServerIPAddr, v4ServerID)
 			return nil, true
 		}
-	} else if msg.MessageType == dhcpv6.MessageTypeRequest ||
-		msg.MessageType == dhcpv6.MessageTypeRenew ||
-		msg.MessageType == dhcpv6.MessageTypeDecline ||
-		msg.MessageType == dhcpv6.MessageTypeRelease {
-		// RFC8415 §16.{6,8,10,11}
-		// These message types MUST be discarded if they *don't* contain a ServerID option
-		return nil, true
-	}
-	dhcpv6.WithServerID(*v6ServerID)(resp)
-	return resp, false
+		resp.ServerIPAddr = make(net.IP, net.IPv4len)
+		copy(resp.ServerIPAddr[:], v4ServerID)
+		resp.UpdateOption(dhcpv4.OptServerIdentifier(v4ServerID))
+		return resp, false
+	}
 }
 
-// Handler4 handles DHCPv4 packets for the server_id plugin.
+// Handler6 was the handler of the plugin when it kept a single server
+// identifier. It drops every packet, with an error.
+//
+// Deprecated: each instance of the plugin has its own server identifier, use
+// the handler returned by its setup function.
+func Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	limited.Limited("deprecated").Errorf("BUG: serverid.Handler6 has no server identifier, dropping packet")
+	return nil, true
+}
+
+// Handler4 was the handler of the plugin when it kept a single server
+// identifier. It drops every packet, with an error.
+//
+// Deprecated: each instance of the plugin has its own server identifier, use
+// the handler returned by its setup function.
 func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	if v4ServerID == nil {
-		log.Fatal("BUG: Plugin is running uninitialized!")
-		return nil, true
-	}
-	if req.OpCode != dhcpv4.OpcodeBootRequest {
-		log.Warningf("not a BootRequest, ignoring")
-		return resp, false
-	}
-	if req.ServerIPAddr != nil &&
-		!req.ServerIPAddr.Equal(net.IPv4zero) &&
-		!req.ServerIPAddr.Equal(v4ServerID) {
-		// This request is not for us, drop it.
-		log.Infof("requested server ID does not match this server's ID. Got %v, want %v", req.ServerIPAddr, v4ServerID)
-		return nil, true
-	}
-	resp.ServerIPAddr = make(net.IP, net.IPv4len)
-	copy(resp.ServerIPAddr[:], v4ServerID)
-	resp.UpdateOption(dhcpv4.OptServerIdentifier(v4ServerID))
-	return resp, false
+	limited.Limited("deprecated").Errorf("BUG: serverid.Handler4 has no server identifier, dropping packet")
+	return nil, true
 }
 
 func setup4(args ...string) (handler.Handler4, error) {
@@ -102,56 +127,104 @@ func setup4(args ...string) (handler.Handler4, error) {
 	}
 	serverID := net.ParseIP(args[0])
 	if serverID == nil {
-		return nil, errors.New("invalid or empty IP address")
+		return nil, plugins.ArgErrorf("server ID", "invalid or empty IP address")
 	}
 	if serverID.To4() == nil {
-		return nil, errors.New("not a valid IPv4 address")
+		return nil, plugins.ArgErrorf("server ID", "not a valid IPv4 address")
 	}
-	v4ServerID = serverID.To4()
-	return Handler4, nil
+	return makeHandler4(serverID.To4()), nil
 }
 
-func setup6(args ...string) (handler.Handler6, error) {
-	log.Printf("loading `server_id` plugin for DHCPv6 with args: %v", args)
+// parseArgs6 returns the DUID configured by args, nil for a generated one,
+// and the state file to keep it in, if any
+func parseArgs6(args ...string) (duid *dhcpv6.Duid, stateFile string, err error) {
 	if len(args) < 2 {
-		return nil, errors.New("need a DUID type and value")
+		return nil, "", errors.New("need a DUID type and value, or auto and a state file")
+	}
+	if strings.ToLower(args[0]) == "auto" {
+		if len(args) != 2 {
+			return nil, "", errors.New("auto takes exactly one argument, the state file")
+		}
+		return nil, args[1], nil
+	}
+	if len(args) > 3 {
+		return nil, "", errors.New("want a DUID type, a DUID value and an optional state file")
+	}
+	if duid, err = parseDUID(args[0], args[1]); err != nil {
+		return nil, "", err
+	}
+	if len(args) == 3 {
+		stateFile = args[2]
+	}
+	return duid, stateFile, nil
+}
+
+// validate6 checks the arguments of the plugin, and the DUID stored in the
+// state file if there is one, without writing it
+func validate6(args ...string) error {
+	_, stateFile, err := parseArgs6(args...)
+	if err != nil || stateFile == "" {
+		return err
+	}
+	_, err = loadDUID(stateFile)
+	return err
+}
+
+// setup6 sets up the plugin, and publishes the DUID of the server in chain for
+// the messages it answers without running the plugins
+func setup6(chain *plugins.Chain, args ...string) (handler.Handler6, error) {
+	log.Printf("loading `server_id` plugin for DHCPv6 with args: %v", args)
+	v6ServerID, stateFile, err := parseArgs6(args...)
+	if err != nil {
+		return nil, err
 	}
-	duidType := args[0]
+	if stateFile != "" {
+		v6ServerID, err = persistentDUID(stateFile, v6ServerID, func() (*dhcpv6.Duid, error) {
+			return generateDUID(net.Interfaces, time.Now())
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("using %s", v6ServerID)
+
+	chain.ServerID = v6ServerID
+	return makeHandler6(v6ServerID), nil
+}
+
+// parseDUID returns the DUID of the given type with the given value
+func parseDUID(duidType, duidValue string) (*dhcpv6.Duid, error) {
 	if duidType == "" {
-		return nil, errors.New("got empty DUID type")
+		return nil, plugins.ArgErrorf("DUID type", "cannot be empty")
 	}
-	duidValue := args[1]
 	if duidValue == "" {
-		return nil, errors.New("got empty DUID value")
+		return nil, plugins.ArgErrorf("DUID value", "cannot be empty")
 	}
 	duidType = strings.ToLower(duidType)
 	hwaddr, err := net.ParseMAC(duidValue)
 	if err != nil {
-		return nil, err
+		return nil, plugins.ArgErrorf("DUID value", "%v", err)
 	}
 	switch duidType {
 	case "ll", "duid-ll", "duid_ll":
-		v6ServerID = &dhcpv6.Duid{
+		return &dhcpv6.Duid{
 			Type: dhcpv6.DUID_LL,
 			// sorry, only ethernet for now
 			HwType:        iana.HWTypeEthernet,
 			LinkLayerAddr: hwaddr,
-		}
+		}, nil
 	case "llt", "duid-llt", "duid_llt":
-		v6ServerID = &dhcpv6.Duid{
+		return &dhcpv6.Duid{
 			Type: dhcpv6.DUID_LLT,
 			// sorry, zero-time for now
 			Time: 0,
 			// sorry, only ethernet for now
 			HwType:        iana.HWTypeEthernet,
 			LinkLayerAddr: hwaddr,
-		}
+		}, nil
 	case "en", "uuid":
-		return nil, errors.New("EN/UUID DUID type not supported yet")
+		return nil, plugins.ArgErrorf("DUID type", "EN/UUID DUID type not supported yet")
 	default:
-		return nil, errors.New("Opaque DUID type not supported yet")
+		return nil, plugins.ArgErrorf("DUID type", "Opaque DUID type not supported yet")
 	}
-	log.Printf("using %s %s", duidType, duidValue)
-
-	return Handler6, nil
 }
@@ -8,6 +8,7 @@ import (
 	"net"
 	"testing"
 
+	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv6"
 )
 
@@ -23,7 +24,7 @@ func TestRejectBadServerIDV6(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	v6ServerID = makeTestDUID("0000000000000000")
+	v6ServerID := makeTestDUID("0000000000000000")
 
 	req.MessageType = dhcpv6.MessageTypeRenew
 	dhcpv6.WithClientID(*makeTestDUID("1000000000000000"))(req)
@@ -34,7 +35,7 @@ func TestRejectBadServerIDV6(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	resp, stop := Handler6(req, stub)
+	resp, stop := makeHandler6(v6ServerID)(req, stub)
 	if resp != nil {
 		t.Error("server_id is sending a response message to a request with mismatched ServerID")
 	}
@@ -48,7 +49,7 @@ func TestRejectUnexpectedServerIDV6(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	v6ServerID = makeTestDUID("0000000000000000")
+	v6ServerID := makeTestDUID("0000000000000000")
 
 	req.MessageType = dhcpv6.MessageTypeSolicit
 	dhcpv6.WithClientID(*makeTestDUID("1000000000000000"))(req)
@@ -59,7 +60,7 @@ func TestRejectUnexpectedServerIDV6(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	resp, stop := Handler6(req, stub)
+	resp, stop := makeHandler6(v6ServerID)(req, stub)
 	if resp != nil {
 		t.Error("server_id is sending a response message to a solicit with a ServerID")
 	}
@@ -73,7 +74,7 @@ func TestAddServerIDV6(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	v6ServerID = makeTestDUID("0000000000000000")
+	v6ServerID := makeTestDUID("0000000000000000")
 
 	req.MessageType = dhcpv6.MessageTypeRebind
 	dhcpv6.WithClientID(*makeTestDUID("1000000000000000"))(req)
@@ -83,7 +84,7 @@ func TestAddServerIDV6(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	resp, _ := Handler6(req, stub)
+	resp, _ := makeHandler6(v6ServerID)(req, stub)
 	if resp == nil {
 		t.Fatal("plugin did not return an answer")
 	}
@@ -100,7 +101,7 @@ func TestRejectInnerMessageServerID(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	v6ServerID = makeTestDUID("0000000000000000")
+	v6ServerID := makeTestDUID("0000000000000000")
 
 	req.MessageType = dhcpv6.MessageTypeSolicit
 	dhcpv6.WithClientID(*makeTestDUID("1000000000000000"))(req)
@@ -116,7 +117,7 @@ func TestRejectInnerMessageServerID(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	resp, stop := Handler6(relayedRequest, stub)
+	resp, stop := makeHandler6(v6ServerID)(relayedRequest, stub)
 	if resp != nil {
 		t.Error("server_id is sending a response message to a relayed solicit with a ServerID")
 	}
@@ -124,3 +125,34 @@ func TestRejectInnerMessageServerID(t *testing.T) {
 		t.Error("server_id did not interrupt processing on a relayed solicit with a ServerID")
 	}
 }
+
+// TestDeprecatedHandlers checks that the package handlers do not answer with
+// the identifier of an instance set up for another server
+func TestDeprecatedHandlers(t *testing.T) {
+	if _, err := setup4("192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0x02, 0, 0, 0, 0, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub, err := dhcpv4.NewReplyFromRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, stop := Handler4(req, stub); resp != nil || !stop {
+		t.Error("the deprecated DHCPv4 handler should drop packets")
+	}
+
+	req6, err := dhcpv6.NewSolicit(net.HardwareAddr{0x02, 0, 0, 0, 0, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub6, err := dhcpv6.NewAdvertiseFromSolicit(req6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, stop := Handler6(req6, stub6); resp != nil || !stop {
+		t.Error("the deprecated DHCPv6 handler should drop packets")
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package serverid
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+
+	"github.com/coredhcp/coredhcp/internal/atomicfile"
+)
+
+// duidEpoch is the origin of the time field of DUID-LLTs (RFC8415 §11.2)
+var duidEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// generateDUID returns a new DUID-LLT based on the hardware address of one of
+// the interfaces, or a DUID-UUID (RFC6355) if none has an Ethernet address
+func generateDUID(interfaces func() ([]net.Interface, error), now time.Time) (*dhcpv6.Duid, error) {
+	ifaces, err := interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) != 6 {
+			continue
+		}
+		return &dhcpv6.Duid{
+			Type:          dhcpv6.DUID_LLT,
+			HwType:        iana.HWTypeEthernet,
+			Time:          uint32(now.Sub(duidEpoch) / time.Second),
+			LinkLayerAddr: iface.HardwareAddr,
+		}, nil
+	}
+	uuid := make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		return nil, err
+	}
+	// Random (version 4) UUID, RFC4122 §4.4
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return &dhcpv6.Duid{Type: dhcpv6.DUID_UUID, Uuid: uuid}, nil
+}
+
+// loadDUID reads the DUID stored in a state file, as hexadecimal. It returns
+// nil and no error if the file does not exist
+func loadDUID(filename string) (*dhcpv6.Duid, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	raw, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DUID in %s: %v", filename, err)
+	}
+	duid, err := dhcpv6.DuidFromBytes(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DUID in %s: %v", filename, err)
+	}
+	return duid, nil
+}
+
+// saveDUID writes a DUID to a state file. The file is replaced atomically, so
+// a crash never leaves it empty
+func saveDUID(filename string, duid *dhcpv6.Duid) error {
+	return atomicfile.Write(filename, 0600, func(w io.Writer) error {
+		_, err := io.WriteString(w, hex.EncodeToString(duid.ToBytes())+"\n")
+		return err
+	})
+}
+
+// persistentDUID returns the server DUID kept in a state file. If override is
+// not nil, it is used whatever the file holds, and stored if the file does not
+// exist yet, so switching to a generated DUID later keeps the same identity.
+// Otherwise, a DUID is generated and stored on first use
+func persistentDUID(filename string, override *dhcpv6.Duid, generate func() (*dhcpv6.Duid, error)) (*dhcpv6.Duid, error) {
+	stored, err := loadDUID(filename)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case stored != nil && override == nil:
+		return stored, nil
+	case stored != nil:
+		if !stored.Equal(*override) {
+			log.Warningf("configured server DUID %s differs from the one stored in %s (%s), clients will see a new server",
+				override, filename, stored)
+		}
+		return override, nil
+	case override != nil:
+		return override, saveDUID(filename, override)
+	}
+	duid, err := generate()
+	if err != nil {
+		return nil, fmt.Errorf("could not generate a DUID: %v", err)
+	}
+	log.Printf("generated server DUID %s, stored in %s", duid, filename)
+	return duid, saveDUID(filename, duid)
+}
@@ -0,0 +1,159 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package serverid
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateDUID(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	ifaces := func() ([]net.Interface, error) {
+		return []net.Interface{
+			{Name: "lo", Flags: net.FlagLoopback | net.FlagUp},
+			{Name: "tun0", Flags: net.FlagUp},
+			{Name: "eth0", Flags: net.FlagUp, HardwareAddr: mac},
+		}, nil
+	}
+	duid, err := generateDUID(ifaces, now)
+	require.NoError(t, err)
+	assert.Equal(t, dhcpv6.DUID_LLT, duid.Type)
+	assert.Equal(t, mac, duid.LinkLayerAddr)
+	assert.Equal(t, uint32(now.Sub(duidEpoch)/time.Second), duid.Time)
+
+	duid, err = generateDUID(func() ([]net.Interface, error) { return nil, nil }, now)
+	require.NoError(t, err)
+	assert.Equal(t, dhcpv6.DUID_UUID, duid.Type)
+	assert.Len(t, duid.Uuid, 16)
+
+	_, err = generateDUID(func() ([]net.Interface, error) { return nil, errors.New("no interfaces") }, now)
+	assert.Error(t, err)
+}
+
+func tempStateFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "coredhcp-serverid")
+	require.NoError(t, err)
+	return filepath.Join(dir, "duid"), func() { os.RemoveAll(dir) }
+}
+
+// TestPersistentDUIDRestarts checks a generated DUID is kept across restarts
+func TestPersistentDUIDRestarts(t *testing.T) {
+	filename, cleanup := tempStateFile(t)
+	defer cleanup()
+
+	generated := 0
+	generate := func() (*dhcpv6.Duid, error) {
+		generated++
+		return makeTestDUID("0123456789abcdef"), nil
+	}
+	first, err := persistentDUID(filename, nil, generate)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		again, err := persistentDUID(filename, nil, generate)
+		require.NoError(t, err)
+		assert.True(t, again.Equal(*first), "DUID changed across restarts: %s, then %s", first, again)
+	}
+	assert.Equal(t, 1, generated, "DUID generated more than once")
+}
+
+// TestPersistentDUIDMigration checks that a configured DUID is stored, so the
+// server keeps it once switched to auto, and that overrides still win
+func TestPersistentDUIDMigration(t *testing.T) {
+	filename, cleanup := tempStateFile(t)
+	defer cleanup()
+	noGenerate := func() (*dhcpv6.Duid, error) {
+		t.Fatal("DUID generated despite a stored one")
+		return nil, nil
+	}
+
+	configured, err := parseDUID("LL", "11:22:33:44:55:66")
+	require.NoError(t, err)
+	duid, err := persistentDUID(filename, configured, nil)
+	require.NoError(t, err)
+	assert.True(t, duid.Equal(*configured))
+
+	duid, err = persistentDUID(filename, nil, noGenerate)
+	require.NoError(t, err)
+	assert.True(t, duid.Equal(*configured), "auto mode did not keep the configured DUID")
+
+	other, err := parseDUID("LL", "66:55:44:33:22:11")
+	require.NoError(t, err)
+	duid, err = persistentDUID(filename, other, nil)
+	require.NoError(t, err)
+	assert.True(t, duid.Equal(*other), "the configured DUID should override the stored one")
+	duid, err = persistentDUID(filename, nil, noGenerate)
+	require.NoError(t, err)
+	assert.True(t, duid.Equal(*configured), "an override should not replace the stored DUID")
+}
+
+func TestLoadDUIDInvalid(t *testing.T) {
+	filename, cleanup := tempStateFile(t)
+	defer cleanup()
+	require.NoError(t, ioutil.WriteFile(filename, []byte("not hex\n"), 0644))
+	_, err := loadDUID(filename)
+	assert.Error(t, err)
+	_, err = persistentDUID(filename, nil, nil)
+	assert.Error(t, err, "a corrupt state file should not be silently replaced")
+}
+
+func TestSetup6Auto(t *testing.T) {
+	filename, cleanup := tempStateFile(t)
+	defer cleanup()
+	_, err := setup6(&plugins.Chain{}, "auto", filename)
+	require.NoError(t, err)
+	stored, err := loadDUID(filename)
+	require.NoError(t, err)
+	assert.NotNil(t, stored, "auto mode did not store its DUID")
+
+	_, err = setup6(&plugins.Chain{}, "auto")
+	assert.Error(t, err)
+	_, err = setup6(&plugins.Chain{}, "auto", filename, "extra")
+	assert.Error(t, err)
+	_, err = setup6(&plugins.Chain{}, "LL", "11:22:33:44:55:66", filename, "extra")
+	assert.Error(t, err)
+}
+
+func TestValidate6(t *testing.T) {
+	filename, cleanup := tempStateFile(t)
+	defer cleanup()
+	require.NoError(t, validate6("auto", filename))
+	require.NoError(t, validate6("LL", "11:22:33:44:55:66", filename))
+	_, err := os.Stat(filename)
+	assert.True(t, os.IsNotExist(err), "validation should not write the state file")
+
+	require.NoError(t, ioutil.WriteFile(filename, []byte("not hex\n"), 0644))
+	assert.Error(t, validate6("auto", filename), "a corrupt state file should be reported")
+	assert.Error(t, validate6("auto"))
+}
+
+func TestSetup6ServerID(t *testing.T) {
+	filename, cleanup := tempStateFile(t)
+	defer cleanup()
+	var chain plugins.Chain
+	_, err := setup6(&chain, "LL", "11:22:33:44:55:66")
+	require.NoError(t, err)
+	require.NotNil(t, chain.ServerID)
+	assert.Equal(t, net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}, chain.ServerID.LinkLayerAddr)
+
+	chain = plugins.Chain{}
+	_, err = setup6(&chain, "auto", filename)
+	require.NoError(t, err)
+	stored, err := loadDUID(filename)
+	require.NoError(t, err)
+	require.NotNil(t, chain.ServerID)
+	assert.True(t, stored.Equal(*chain.ServerID), "the generated DUID should be published")
+}
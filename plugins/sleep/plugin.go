@@ -39,9 +39,10 @@ var (
 
 // Plugin contains the `sleep` plugin data.
 var Plugin = plugins.Plugin{
-	Name:   pluginName,
-	Setup6: setup6,
-	Setup4: setup4,
+	Name:           pluginName,
+	Setup6:         setup6,
+	Setup4:         setup4,
+	SideEffectFree: true,
 }
 
 func setup6(args ...string) (handler.Handler6, error) {
@@ -50,7 +51,7 @@ func setup6(args ...string) (handler.Handler6, error) {
 	}
 	delay, err := time.ParseDuration(args[0])
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse duration: %w", err)
+		return nil, plugins.ArgErrorf("delay", "failed to parse duration: %v", err)
 	}
 	log.Printf("loaded plugin for DHCPv6.")
 	return makeSleepHandler6(delay), nil
@@ -62,7 +63,7 @@ func setup4(args ...string) (handler.Handler4, error) {
 	}
 	delay, err := time.ParseDuration(args[0])
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse duration: %w", err)
+		return nil, plugins.ArgErrorf("delay", "failed to parse duration: %v", err)
 	}
 	log.Printf("loaded plugin for DHCPv4.")
 	return makeSleepHandler4(delay), nil
@@ -0,0 +1,138 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package v6only
+
+// This plugin tells dual-stack clients that prefer IPv6-only operation, by
+// requesting the IPv6-Only Preferred option (108, RFC8925), to go without an
+// IPv4 address. Their DHCPOFFER and DHCPACK carry the option and no address,
+// and the plugins after this one, which would allocate that address, are not
+// run. Clients that do not request the option are served normally.
+//
+// Example configuration:
+//
+// server4:
+//   plugins:
+//     - server_id: 10.10.10.1
+//     - v6only: 30m 80%
+//     - range: leases.txt 10.10.10.100 10.10.10.200 60s
+//
+// The first argument is the V6ONLY_WAIT time clients disable IPv4 for, at
+// least 300s. With only this argument, every client requesting the option
+// gets it. The second, optional, argument only gives it once the range pools
+// are used above the given percentage, to relieve pool pressure.
+//
+// Clients that already hold a lease and request the option get it too; their
+// lease is not renewed and expires normally.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	rangeplugin "github.com/coredhcp/coredhcp/plugins/range"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+var log = logger.GetLogger("plugins/v6only")
+
+// Plugin wraps plugin registration information
+var Plugin = plugins.Plugin{
+	Name:           "v6only",
+	ChainSetup4:    setup4,
+	SideEffectFree: true,
+	// Answer before an address is allocated, and with a server identifier
+	RunsAfter:  []string{"server_id"},
+	RunsBefore: []string{"file", "range"},
+}
+
+// optionIPv6OnlyPreferred is the IPv6-Only Preferred option (RFC8925 §3.1)
+type optionIPv6OnlyPreferred struct{}
+
+func (optionIPv6OnlyPreferred) Code() uint8    { return 108 }
+func (optionIPv6OnlyPreferred) String() string { return "IPv6-Only Preferred" }
+
+// minV6OnlyWait is MIN_V6ONLY_WAIT (RFC8925 §4.2)
+const minV6OnlyWait = 300 * time.Second
+
+// setup4 sets up an instance of the plugin. With a pool usage threshold, it
+// watches the instances of the range plugin of chain, which come later
+func setup4(chain *plugins.Chain, args ...string) (handler.Handler4, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, fmt.Errorf("want 1 or 2 arguments (V6ONLY_WAIT, [pool usage percentage]), got %d", len(args))
+	}
+	wait, err := time.ParseDuration(args[0])
+	if err != nil {
+		return nil, plugins.ArgErrorf("V6ONLY_WAIT", "invalid duration %q: %v", args[0], err)
+	}
+	if wait < minV6OnlyWait {
+		return nil, plugins.ArgErrorf("V6ONLY_WAIT", "must be at least %s, got %s", minV6OnlyWait, wait)
+	}
+	threshold := 0
+	if len(args) == 2 {
+		threshold, err = strconv.Atoi(strings.TrimSuffix(args[1], "%"))
+		if err != nil || !strings.HasSuffix(args[1], "%") || threshold <= 0 || threshold > 100 {
+			return nil, plugins.ArgErrorf("pool usage", "invalid threshold %q, expected a percentage such as 80%%", args[1])
+		}
+	}
+	var pools []*rangeplugin.PluginState
+	if threshold > 0 {
+		chain.OnReady(func() {
+			pools = rangeplugin.Instances(chain)
+			if len(pools) == 0 {
+				log.Warning("no range plugin to watch the pools of, the IPv6-Only Preferred option will not be given")
+			}
+		})
+	}
+	log.Printf("loaded plugin for DHCPv4.")
+	return makeHandler4(wait, threshold, func() (used, size int) {
+		for _, p := range pools {
+			u, s := p.Usage()
+			used += u
+			size += s
+		}
+		return used, size
+	}), nil
+}
+
+// requestsOption returns whether req has the IPv6-Only Preferred option in
+// its parameter request list
+func requestsOption(req *dhcpv4.DHCPv4) bool {
+	prl := req.Options.Get(dhcpv4.OptionParameterRequestList)
+	return bytes.IndexByte(prl, optionIPv6OnlyPreferred{}.Code()) >= 0
+}
+
+// makeHandler4 returns a handler for DHCPv4 packets answering clients that
+// request the IPv6-Only Preferred option with it. If threshold is not zero, it
+// only does so once usage reports at least threshold percent of the pools used
+func makeHandler4(wait time.Duration, threshold int, usage func() (used, size int)) handler.Handler4 {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, uint32(wait/time.Second))
+	// answered counts the responses of the instance carrying the option
+	var answered uint64
+	return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		if !requestsOption(req) {
+			return resp, false
+		}
+		if threshold > 0 {
+			used, size := usage()
+			if size == 0 || used*100 < threshold*size {
+				return resp, false
+			}
+		}
+		resp.UpdateOption(dhcpv4.OptGeneric(optionIPv6OnlyPreferred{}, value))
+		resp.YourIPAddr = net.IPv4zero
+		n := atomic.AddUint64(&answered, 1)
+		log.Debugf("%s: IPv6-only preferred, not leasing an address (%d such responses so far)", req.ClientHWAddr, n)
+		return resp, true
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package v6only
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/internal/testpackets"
+	"github.com/coredhcp/coredhcp/plugins"
+	rangeplugin "github.com/coredhcp/coredhcp/plugins/range"
+)
+
+var (
+	leased = net.IPv4(192, 0, 2, 100)
+	prl108 = dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionParameterRequestList, []byte{1, 3, 108}))
+)
+
+// offer runs h on req, with a response that a previous plugin offered leased in
+func offer(t *testing.T, h func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool), req *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	resp, err := dhcpv4.NewReplyFromRequest(req,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer), dhcpv4.WithYourIP(leased))
+	require.NoError(t, err)
+	return h(req, resp)
+}
+
+func assertV6Only(t *testing.T, resp *dhcpv4.DHCPv4, stop bool) {
+	t.Helper()
+	require.NotNil(t, resp)
+	assert.True(t, stop, "the chain should stop so no address is allocated")
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4zero), "an address was offered: %s", resp.YourIPAddr)
+	assert.Equal(t, []byte{0, 0, 0x07, 0x08}, resp.Options.Get(optionIPv6OnlyPreferred{}))
+}
+
+func assertServed(t *testing.T, resp *dhcpv4.DHCPv4, stop bool) {
+	t.Helper()
+	require.NotNil(t, resp)
+	assert.False(t, stop)
+	assert.True(t, resp.YourIPAddr.Equal(leased))
+	assert.Nil(t, resp.Options.Get(optionIPv6OnlyPreferred{}))
+}
+
+func TestStatic(t *testing.T) {
+	h := makeHandler4(30*time.Minute, 0, nil)
+
+	req, _ := testpackets.V4Discover(t, nil, prl108)
+	resp, stop := offer(t, h, req)
+	assertV6Only(t, resp, stop)
+
+	req, _ = testpackets.V4Discover(t, nil)
+	resp, stop = offer(t, h, req)
+	assertServed(t, resp, stop)
+
+	// A client holding a lease is told too; its lease is left to expire
+	req, _ = testpackets.V4RequestRenewing(t, nil, leased, prl108)
+	resp, stop = offer(t, h, req)
+	assertV6Only(t, resp, stop)
+}
+
+func TestPoolPressure(t *testing.T) {
+	var used int
+	h := makeHandler4(30*time.Minute, 80, func() (int, int) { return used, 100 })
+	req, _ := testpackets.V4Discover(t, nil, prl108)
+
+	for _, tc := range []struct {
+		used     int
+		v6Only   bool
+		describe string
+	}{
+		{0, false, "empty pool"},
+		{79, false, "below threshold"},
+		{80, true, "at threshold"},
+		{100, true, "full pool"},
+		{50, false, "space freed"},
+	} {
+		used = tc.used
+		resp, stop := offer(t, h, req)
+		if tc.v6Only {
+			assertV6Only(t, resp, stop)
+		} else {
+			assertServed(t, resp, stop)
+		}
+	}
+
+	noPool := makeHandler4(30*time.Minute, 80, func() (int, int) { return 0, 0 })
+	resp, stop := offer(t, noPool, req)
+	assertServed(t, resp, stop)
+}
+
+func TestSetup(t *testing.T) {
+	for _, args := range [][]string{
+		{"30m"},
+		{"300s", "80%"},
+		{"1h", "100%"},
+	} {
+		_, err := setup4(&plugins.Chain{}, args...)
+		assert.NoError(t, err, "args %v", args)
+	}
+	for _, args := range [][]string{
+		{},
+		{"299s"},
+		{"soon"},
+		{"30m", "80"},
+		{"30m", "0%"},
+		{"30m", "101%"},
+		{"30m", "80%", "extra"},
+	} {
+		_, err := setup4(&plugins.Chain{}, args...)
+		assert.Error(t, err, "args %v should be refused", args)
+	}
+}
+
+func TestRangePools(t *testing.T) {
+	leases, err := ioutil.TempFile("", "coredhcp-v6only")
+	require.NoError(t, err)
+	defer os.Remove(leases.Name())
+	leases.Close()
+
+	require.NoError(t, plugins.RegisterPlugin(&Plugin))
+	require.NoError(t, plugins.RegisterPlugin(&rangeplugin.Plugin))
+	chain4, _, err := plugins.LoadChains(&config.Config{Server4: &config.ServerConfig{
+		Plugins: []config.PluginConfig{
+			{Name: "v6only", Args: []string{"30m", "50%"}},
+			{Name: "range", Args: []string{leases.Name(), "192.0.2.100", "192.0.2.101", "1h"}},
+		},
+	}})
+	require.NoError(t, err)
+	run := func(req *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		resp, err := dhcpv4.NewReplyFromRequest(req)
+		require.NoError(t, err)
+		var stop bool
+		for _, h := range chain4.Handlers4 {
+			if resp, stop = h(req, resp); stop {
+				break
+			}
+		}
+		return resp, stop
+	}
+
+	// The pool of the range plugin after it in the chain is watched
+	req, _ := testpackets.V4Discover(t, net.HardwareAddr{0x02, 0, 0, 0, 0, 1}, prl108)
+	resp, _ := run(req)
+	require.NotNil(t, resp)
+	assert.True(t, resp.YourIPAddr.Equal(leased), "got %s", resp.YourIPAddr)
+
+	req, _ = testpackets.V4Discover(t, net.HardwareAddr{0x02, 0, 0, 0, 0, 2}, prl108)
+	resp, stop := run(req)
+	assertV6Only(t, resp, stop)
+}
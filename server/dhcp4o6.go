@@ -0,0 +1,58 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// handle4o6 handles a DHCPV4-QUERY: the DHCPv4 request it carries is run
+// through the DHCPv4 plugins, and the DHCPv4 response returned in a
+// DHCPV4-RESPONSE. It returns nil if there is nothing to send back
+func (l *listener6) handle4o6(msg *dhcpv6.Message, deadline time.Time) *dhcpv6.Message {
+	if l.handlers4 == nil {
+		l.limited.Limited("4o6 no server").Printf("MainHandler6: dropping DHCPV4-QUERY, no DHCPv4 server is configured")
+		return nil
+	}
+	// The DHCPv4 message is parsed along with the DHCPv6 one, which is
+	// dropped if it cannot be
+	opt, ok := msg.GetOneOption(dhcpv6.OptionDHCPv4Msg).(*dhcpv6.OptDHCPv4Msg)
+	if !ok {
+		l.limited.Limited("4o6 malformed").Printf("MainHandler6: dropping DHCPV4-QUERY without DHCPv4 message")
+		return nil
+	}
+	req := opt.Msg
+	if err := checkSize(len(req.ToBytes()), &l.limits); err != nil {
+		l.overLimits.count(err)
+		l.limited.Limited("4o6 limits").Printf("MainHandler6: dropping DHCPV4-QUERY: %v", err)
+		return nil
+	}
+	if req.OpCode != dhcpv4.OpcodeBootRequest {
+		l.limited.Limited("4o6 malformed").Printf("MainHandler6: dropping DHCPV4-QUERY: unsupported opcode %d", req.OpCode)
+		return nil
+	}
+	if err := checkLimits4(req); err != nil {
+		l.overLimits.count(err)
+		l.limited.Limited("4o6 limits").Printf("MainHandler6: dropping DHCPV4-QUERY: %v", err)
+		return nil
+	}
+
+	resp4, ok := l.process4(l.handlers4, l.timers4, req, deadline)
+	if !ok {
+		return nil
+	}
+	if resp4 == nil {
+		l.limited.Limited("4o6 nil response").Printf("MainHandler6: dropping DHCPV4-QUERY because response is nil")
+		return nil
+	}
+	// The transaction ID field holds flags in DHCPv4-over-DHCPv6 messages,
+	// none of which are defined for DHCPV4-RESPONSE (RFC7341 §6.2)
+	resp := &dhcpv6.Message{MessageType: dhcpv6.MessageTypeDHCPv4Response}
+	resp.AddOption(&dhcpv6.OptDHCPv4Msg{Msg: resp4})
+	return resp
+}
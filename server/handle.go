@@ -5,32 +5,81 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
 
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv6"
+
+	"github.com/coredhcp/coredhcp/handler"
 )
 
 // HandleMsg6 runs for every received DHCPv6 packet. It will run every
 // registered handler in sequence, and reply with the resulting response.
 // It will not reply if the resulting response is `nil`.
-func (l *listener6) HandleMsg6(buf []byte, oob *ipv6.ControlMessage, peer *net.UDPAddr) {
+// inFlight is the number of requests being handled when this one was received,
+// for load shedding.
+func (l *listener6) HandleMsg6(buf []byte, oob *ipv6.ControlMessage, peer *net.UDPAddr, inFlight int32) {
+	var shed, resumed bool
+	defer func() { l.load.leave(resumed) }()
+	deadline := time.Now().Add(l.timeout)
+	if err := checkSize(len(buf), &l.limits); err != nil {
+		l.overLimits.count(err)
+		bufpool.Put(&buf)
+		l.limited.Limited("v6 limits").Printf("MainHandler6: dropping request: %v", err)
+		return
+	}
 	d, err := dhcpv6.FromBytes(buf)
 	bufpool.Put(&buf)
 	if err != nil {
-		log.Printf("Error parsing DHCPv6 request: %v", err)
+		l.limited.Limited("v6 malformed").Printf("Error parsing DHCPv6 request: %v", err)
+		return
+	}
+	if err := checkLimits6(d, &l.limits); err != nil {
+		l.overLimits.count(err)
+		l.limited.Limited("v6 limits").Printf("MainHandler6: dropping request: %v", err)
 		return
 	}
 
 	// decapsulate the relay message
 	msg, err := d.GetInnerMessage()
 	if err != nil {
-		log.Warningf("DHCPv6: cannot get inner message: %v", err)
+		l.limited.Limited("v6 malformed").Warningf("DHCPv6: cannot get inner message: %v", err)
+		return
+	}
+
+	if shed, resumed = l.load.shed6(msg, inFlight, deadline); shed {
+		return
+	}
+
+	if !d.IsRelay() && receivedUnicast(oob) && refuseUnicast(msg.Type(), l.unicast) {
+		resp := newUseMulticastReply(msg, l.serverID)
+		if resp == nil {
+			l.limited.Limited("v6 unicast").Printf("MainHandler6: dropping unicast %s not addressed to this server", msg.Type())
+			return
+		}
+		l.log.Debugf("MainHandler6: %s received by unicast, replying UseMulticast", msg.Type())
+		l.send(resp, oob, peer, deadline)
+		return
+	}
+
+	defer l.clients.lock(clientID6(msg))()
+
+	if msg.Type() == dhcpv6.MessageTypeDHCPv4Query {
+		resp := l.handle4o6(msg, deadline)
+		if resp == nil {
+			return
+		}
+		if resp, ok := l.encapsulate(d, resp); ok {
+			l.send(resp, oob, peer, deadline)
+		}
 		return
 	}
 
@@ -44,42 +93,90 @@ func (l *listener6) HandleMsg6(buf []byte, oob *ipv6.ControlMessage, peer *net.U
 			resp, err = dhcpv6.NewAdvertiseFromSolicit(msg)
 		}
 	case dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeConfirm, dhcpv6.MessageTypeRenew,
-		dhcpv6.MessageTypeRebind, dhcpv6.MessageTypeRelease, dhcpv6.MessageTypeInformationRequest:
+		dhcpv6.MessageTypeRebind, dhcpv6.MessageTypeRelease:
 		resp, err = dhcpv6.NewReplyFromMessage(msg)
+	case dhcpv6.MessageTypeInformationRequest:
+		resp, err = newInformationReply(msg)
 	default:
 		err = fmt.Errorf("MainHandler6: message type %d not supported", msg.Type())
 	}
 	if err != nil {
-		log.Printf("MainHandler6: NewReplyFromDHCPv6Message failed: %v", err)
+		l.log.Printf("MainHandler6: NewReplyFromDHCPv6Message failed: %v", err)
 		return
 	}
 
+	if l.pastDeadline(deadline, "MainHandler6", stageDecode, 0) {
+		return
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	defer handler.Bind(d, ctx)()
 	var stop bool
-	for _, handler := range l.handlers {
+	for i, handler := range l.handlers {
 		resp, stop = handler(d, resp)
+		if l.pastDeadline(deadline, "MainHandler6", stagePlugins, i+1) {
+			return
+		}
 		if stop {
 			break
 		}
 	}
 	if resp == nil {
-		log.Print("MainHandler6: dropping request because response is nil")
+		l.limited.Limited("v6 nil response").Printf("MainHandler6: dropping request because response is nil")
 		return
 	}
+	if m, ok := resp.(*dhcpv6.Message); ok {
+		l.timers.check6(m)
+	}
 
-	// if the request was relayed, re-encapsulate the response
-	if d.IsRelay() {
-		if rmsg, ok := resp.(*dhcpv6.Message); !ok {
-			log.Warningf("DHCPv6: response is a relayed message, not reencapsulating")
-		} else {
-			tmp, err := dhcpv6.NewRelayReplFromRelayForw(d.(*dhcpv6.RelayMessage), rmsg)
-			if err != nil {
-				log.Warningf("DHCPv6: cannot create relay-repl from relay-forw: %v", err)
-				return
-			}
-			resp = tmp
-		}
+	if l.unicast != nil {
+		addUnicastOption(resp, l.unicast)
+	}
+
+	resp, ok := l.encapsulate(d, resp)
+	if !ok {
+		return
+	}
+	l.send(resp, oob, peer, deadline)
+}
+
+// newInformationReply builds the reply to an Information-Request. Its client
+// identifier is optional (RFC8415 §18.2.6), unlike in the other messages
+// dhcpv6.NewReplyFromMessage handles
+func newInformationReply(msg *dhcpv6.Message) (*dhcpv6.Message, error) {
+	if msg.GetOneOption(dhcpv6.OptionClientID) != nil {
+		return dhcpv6.NewReplyFromMessage(msg)
+	}
+	return &dhcpv6.Message{
+		MessageType:   dhcpv6.MessageTypeReply,
+		TransactionID: msg.TransactionID,
+	}, nil
+}
+
+// encapsulate returns resp, re-encapsulated in relay messages if the request
+// d was relayed. It returns false if that fails
+func (l *listener6) encapsulate(d, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	if !d.IsRelay() {
+		return resp, true
+	}
+	rmsg, ok := resp.(*dhcpv6.Message)
+	if !ok {
+		l.log.Warningf("DHCPv6: response is a relayed message, not reencapsulating")
+		return resp, true
 	}
+	tmp, err := dhcpv6.NewRelayReplFromRelayForw(d.(*dhcpv6.RelayMessage), rmsg)
+	if err != nil {
+		l.log.Warningf("DHCPv6: cannot create relay-repl from relay-forw: %v", err)
+		return nil, false
+	}
+	return tmp, true
+}
 
+// send writes resp to peer, on the interface the request was received on
+func (l *listener6) send(resp dhcpv6.DHCPv6, oob *ipv6.ControlMessage, peer *net.UDPAddr, deadline time.Time) {
+	if l.pastDeadline(deadline, "MainHandler6", stageSend, 0) {
+		return
+	}
 	var woob *ipv6.ControlMessage
 	if peer.IP.IsLinkLocalUnicast() {
 		// LL need to be directed to the correct interface. Globally reachable
@@ -90,56 +187,56 @@ func (l *listener6) HandleMsg6(buf []byte, oob *ipv6.ControlMessage, peer *net.U
 		case oob != nil && oob.IfIndex != 0:
 			woob = &ipv6.ControlMessage{IfIndex: oob.IfIndex}
 		default:
-			log.Errorf("HandleMsg6: Did not receive interface information")
+			l.log.Errorf("HandleMsg6: Did not receive interface information")
 		}
 	}
 	if _, err := l.WriteTo(resp.ToBytes(), woob, peer); err != nil {
-		log.Printf("MainHandler6: conn.Write to %v failed: %v", peer, err)
+		l.limited.Limited("v6 send").Printf("MainHandler6: conn.Write to %v failed: %v", peer, err)
 	}
 }
 
-func (l *listener4) HandleMsg4(buf []byte, oob *ipv4.ControlMessage, _peer net.Addr) {
-	var (
-		resp, tmp *dhcpv4.DHCPv4
-		err       error
-		stop      bool
-	)
-
+// HandleMsg4 is the DHCPv4 equivalent of HandleMsg6
+func (l *listener4) HandleMsg4(buf []byte, oob *ipv4.ControlMessage, _peer net.Addr, inFlight int32) {
+	var shed, resumed bool
+	defer func() { l.load.leave(resumed) }()
+	deadline := time.Now().Add(l.timeout)
+	if err := checkSize(len(buf), &l.limits); err != nil {
+		l.overLimits.count(err)
+		bufpool.Put(&buf)
+		l.limited.Limited("v4 limits").Printf("MainHandler4: dropping request: %v", err)
+		return
+	}
 	req, err := dhcpv4.FromBytes(buf)
 	bufpool.Put(&buf)
 	if err != nil {
-		log.Printf("Error parsing DHCPv4 request: %v", err)
+		l.limited.Limited("v4 malformed").Printf("Error parsing DHCPv4 request: %v", err)
 		return
 	}
 
 	if req.OpCode != dhcpv4.OpcodeBootRequest {
-		log.Printf("MainHandler4: unsupported opcode %d. Only BootRequest (%d) is supported", req.OpCode, dhcpv4.OpcodeBootRequest)
+		l.limited.Limited("v4 malformed").Printf("MainHandler4: unsupported opcode %d. Only BootRequest (%d) is supported", req.OpCode, dhcpv4.OpcodeBootRequest)
 		return
 	}
-	tmp, err = dhcpv4.NewReplyFromRequest(req)
-	if err != nil {
-		log.Printf("MainHandler4: failed to build reply: %v", err)
+
+	if err := checkLimits4(req); err != nil {
+		l.overLimits.count(err)
+		l.limited.Limited("v4 limits").Printf("MainHandler4: dropping request: %v", err)
 		return
 	}
-	switch mt := req.MessageType(); mt {
-	case dhcpv4.MessageTypeDiscover:
-		tmp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer))
-	case dhcpv4.MessageTypeRequest:
-		tmp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
-	default:
-		log.Printf("plugins/server: Unhandled message type: %v", mt)
+
+	if shed, resumed = l.load.shed4(req, inFlight, deadline); shed {
 		return
 	}
-
-	resp = tmp
-	for _, handler := range l.handlers {
-		resp, stop = handler(req, resp)
-		if stop {
-			break
-		}
+	defer l.clients.lock(clientID4(req))()
+	resp, ok := l.process4(l.handlers, l.timers, req, deadline)
+	if !ok {
+		return
 	}
 
 	if resp != nil {
+		if l.pastDeadline(deadline, "MainHandler4", stageSend, 0) {
+			return
+		}
 		useEthernet := false
 		var peer *net.UDPAddr
 		if !req.GatewayIPAddr.IsUnspecified() {
@@ -168,28 +265,120 @@ func (l *listener4) HandleMsg4(buf []byte, oob *ipv4.ControlMessage, _peer net.A
 			case oob != nil && oob.IfIndex != 0:
 				woob = &ipv4.ControlMessage{IfIndex: oob.IfIndex}
 			default:
-				log.Errorf("HandleMsg4: Did not receive interface information")
+				l.log.Errorf("HandleMsg4: Did not receive interface information")
 			}
 		}
 
+		if useEthernet && inMemory4(l.PacketConn4) {
+			// There is no interface to send a frame on, the connection
+			// gets the response like any other
+			useEthernet = false
+		}
+
 		if useEthernet {
+			if woob == nil {
+				return
+			}
 			intf, err := net.InterfaceByIndex(woob.IfIndex)
 			if err != nil {
-				log.Errorf("MainHandler4: Can not get Interface for index %d %v", woob.IfIndex, err)
+				l.log.Errorf("MainHandler4: Can not get Interface for index %d %v", woob.IfIndex, err)
 				return
 			}
 			err = sendEthernet(*intf, resp)
 			if err != nil {
-				log.Errorf("MainHandler4: Cannot send Ethernet packet: %v", err)
+				l.limited.Limited("v4 send").Errorf("MainHandler4: Cannot send Ethernet packet: %v", err)
+			} else if rec, ok := l.PacketConn4.(*recordingConn4); ok {
+				rec.recordSent(resp.ToBytes(), woob, peer)
 			}
 		} else {
 			if _, err := l.WriteTo(resp.ToBytes(), woob, peer); err != nil {
-				log.Errorf("MainHandler4: conn.Write to %v failed: %v", peer, err)
+				l.limited.Limited("v4 send").Errorf("MainHandler4: conn.Write to %v failed: %v", peer, err)
 			}
 		}
 	} else {
-		log.Print("MainHandler4: dropping request because response is nil")
+		l.limited.Limited("v4 nil response").Printf("MainHandler4: dropping request because response is nil")
+	}
+}
+
+// process4 builds the response to a DHCPv4 request by running it through
+// handlers. It returns false if the request cannot be handled or was not
+// handled before deadline. Otherwise the response is nil if the request is to
+// be dropped
+func (inst *instance) process4(handlers []handler.Handler4, timers *timerCheck, req *dhcpv4.DHCPv4, deadline time.Time) (*dhcpv4.DHCPv4, bool) {
+	resp, err := dhcpv4.NewReplyFromRequest(req)
+	if err != nil {
+		inst.log.Printf("MainHandler4: failed to build reply: %v", err)
+		return nil, false
+	}
+	switch mt := req.MessageType(); mt {
+	case dhcpv4.MessageTypeDiscover:
+		resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer))
+	case dhcpv4.MessageTypeRequest:
+		resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+	default:
+		inst.log.Printf("plugins/server: Unhandled message type: %v", mt)
+		return nil, false
+	}
+
+	if inst.pastDeadline(deadline, "MainHandler4", stageDecode, 0) {
+		return nil, false
+	}
+	// The handlers can check the deadline through handler.Context4
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	defer handler.Bind(req, ctx)()
+	var stop bool
+	for i, handler := range handlers {
+		resp, stop = handler(req, resp)
+		if inst.pastDeadline(deadline, "MainHandler4", stagePlugins, i+1) {
+			return nil, false
+		}
+		if stop {
+			break
+		}
+	}
+	if resp != nil {
+		// Also when a plugin stopped the chain before the ones setting
+		// the lease time ran
+		timers.check4(resp)
+	}
+	return resp, true
+}
+
+// stage is a stage of the handling of a request, at which it can be found past
+// its deadline
+type stage int
+
+// The stages of the handling of a request. stageDecode is everything before the
+// plugins run: parsing and checking the request, shedding, and waiting for the
+// other requests of the client
+const (
+	stageDecode stage = iota
+	stagePlugins
+	stageSend
+	numStages
+)
+
+// pastDeadline returns true, counts the request, and logs how far its handling
+// went, if the deadline for responding to it has passed. Clients have given up
+// on the response by then, so the remaining plugins don't need to run. plugins
+// is the number of plugins that ran, in stagePlugins
+func (inst *instance) pastDeadline(deadline time.Time, prefix string, st stage, plugins int) bool {
+	if time.Now().Before(deadline) {
+		return false
+	}
+	atomic.AddUint64(&inst.missed[st], 1)
+	var when string
+	switch st {
+	case stageDecode:
+		when = "before the plugins ran"
+	case stagePlugins:
+		when = fmt.Sprintf("after %d plugins", plugins)
+	case stageSend:
+		when = "before sending the response"
 	}
+	inst.limited.Limited(prefix+" deadline").Warningf("%s: dropping request not handled in time, %s", prefix, when)
+	return true
 }
 
 // XXX: performance-wise, Pool may or may not be good (see https://github.com/golang/go/issues/23199)
@@ -203,32 +392,44 @@ const MaxDatagram = 1 << 16
 
 // Serve6 handles datagrams received on conn and passes them to the pluginchain
 func (l *listener6) Serve() error {
-	log.Printf("Listen %s", l.LocalAddr())
+	l.log.Printf("Listen %s", l.LocalAddr())
 	for {
 		b := *bufpool.Get().(*[]byte)
 		b = b[:MaxDatagram] //Reslice to max capacity in case the buffer in pool was resliced smaller
 
 		n, oob, peer, err := l.ReadFrom(b)
 		if err != nil {
-			log.Printf("Error reading from connection: %v", err)
+			l.log.Printf("Error reading from connection: %v", err)
 			return err
 		}
-		go l.HandleMsg6(b[:n], oob, peer.(*net.UDPAddr))
+		inFlight := l.load.enter()
+		// The listener is counted in running until it returns, so the
+		// count cannot drop to zero while Servers.Close waits on it
+		l.running.Add(1)
+		go func() {
+			defer l.running.Done()
+			l.HandleMsg6(b[:n], oob, peer.(*net.UDPAddr), inFlight)
+		}()
 	}
 }
 
 // Serve6 handles datagrams received on conn and passes them to the pluginchain
 func (l *listener4) Serve() error {
-	log.Printf("Listen %s", l.LocalAddr())
+	l.log.Printf("Listen %s", l.LocalAddr())
 	for {
 		b := *bufpool.Get().(*[]byte)
 		b = b[:MaxDatagram] //Reslice to max capacity in case the buffer in pool was resliced smaller
 
 		n, oob, peer, err := l.ReadFrom(b)
 		if err != nil {
-			log.Printf("Error reading from connection: %v", err)
+			l.log.Printf("Error reading from connection: %v", err)
 			return err
 		}
-		go l.HandleMsg4(b[:n], oob, peer.(*net.UDPAddr))
+		inFlight := l.load.enter()
+		l.running.Add(1)
+		go func() {
+			defer l.running.Done()
+			l.HandleMsg4(b[:n], oob, peer.(*net.UDPAddr), inFlight)
+		}()
 	}
 }
@@ -0,0 +1,210 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+
+	"github.com/coredhcp/coredhcp/config"
+)
+
+// Default values for the fields of config.Limits
+const (
+	// DefaultMaxMessageSize leaves ample room for large vendor options while
+	// rejecting datagrams no DHCP client sends
+	DefaultMaxMessageSize = 8192
+	// DefaultMaxRelayDepth is HOP_COUNT_LIMIT, RFC8415 §7.6
+	DefaultMaxRelayDepth = 8
+	// DefaultMaxIAOptions is well above what multi-homed clients request
+	DefaultMaxIAOptions = 32
+)
+
+var defaultLimits = withDefaults(config.Limits{})
+
+// The limits requests are dropped for exceeding, by the name of their setting
+// in the limits section of the configuration. limitOptionLength is for the
+// options whose length is fixed or bounded, which have no setting
+const (
+	limitMessageSize  = "max_message_size"
+	limitRelayDepth   = "max_relay_depth"
+	limitIAOptions    = "max_ia_options"
+	limitOptionLength = "option_length"
+)
+
+var allLimits = []string{limitMessageSize, limitRelayDepth, limitIAOptions, limitOptionLength}
+
+// limitError is the error of a request exceeding the limit called limit
+type limitError struct {
+	limit string
+	err   error
+}
+
+func (e *limitError) Error() string {
+	return e.err.Error()
+}
+
+// exceeded returns a *limitError for limit, with a formatted message
+func exceeded(limit, format string, args ...interface{}) error {
+	return &limitError{limit: limit, err: fmt.Errorf(format, args...)}
+}
+
+// LimitCounts are the numbers of requests a server dropped for exceeding its
+// limits, keyed by limit: max_message_size, max_relay_depth, max_ia_options,
+// and option_length for the options of an invalid length
+type LimitCounts map[string]uint64
+
+// limitCounter counts the requests the listeners of a server drop for
+// exceeding each limit. The counters are updated atomically. A nil
+// limitCounter counts nothing
+type limitCounter map[string]*uint64
+
+func newLimitCounter() limitCounter {
+	c := make(limitCounter, len(allLimits))
+	for _, limit := range allLimits {
+		c[limit] = new(uint64)
+	}
+	return c
+}
+
+// count counts err if it is a *limitError
+func (c limitCounter) count(err error) {
+	if e, ok := err.(*limitError); ok && c != nil {
+		atomic.AddUint64(c[e.limit], 1)
+	}
+}
+
+// counts returns the numbers of requests dropped so far
+func (c limitCounter) counts() LimitCounts {
+	counts := make(LimitCounts, len(c))
+	for limit, n := range c {
+		counts[limit] = atomic.LoadUint64(n)
+	}
+	return counts
+}
+
+// withDefaults returns l with zero fields replaced by their default
+func withDefaults(l config.Limits) config.Limits {
+	if l.MaxMessageSize == 0 {
+		l.MaxMessageSize = DefaultMaxMessageSize
+	}
+	if l.MaxRelayDepth == 0 {
+		l.MaxRelayDepth = DefaultMaxRelayDepth
+	}
+	if l.MaxIAOptions == 0 {
+		l.MaxIAOptions = DefaultMaxIAOptions
+	}
+	return l
+}
+
+// fixedLengthOptions4 lists the DHCPv4 options plugins read as fixed-size
+// values, with their length (RFC2132 §9). The parser does not check them
+var fixedLengthOptions4 = []struct {
+	code dhcpv4.OptionCode
+	len  int
+}{
+	{dhcpv4.OptionRequestedIPAddress, 4},
+	{dhcpv4.OptionIPAddressLeaseTime, 4},
+	{dhcpv4.OptionDHCPMessageType, 1},
+	{dhcpv4.OptionServerIdentifier, 4},
+	{dhcpv4.OptionMaximumDHCPMessageSize, 2},
+	{dhcpv4.OptionRenewTimeValue, 4},
+	{dhcpv4.OptionRebindingTimeValue, 4},
+}
+
+// anyLength is the maximum length of the options of optionLengths6 that are
+// only bounded below
+const anyLength = -1
+
+// optionLengths6 lists the bounds of the lengths of the DHCPv6 options plugins
+// read, in the innermost message (RFC8415 §21). The parser leaves some of them
+// as raw options without checking their length
+var optionLengths6 = []struct {
+	code     dhcpv6.OptionCode
+	min, max int
+}{
+	// A type code and at most 128 octets, RFC8415 §11.1
+	{dhcpv6.OptionClientID, 2, 130},
+	{dhcpv6.OptionServerID, 2, 130},
+	// The IAID, T1 and T2 header, followed by options
+	{dhcpv6.OptionIANA, 12, anyLength},
+	{dhcpv6.OptionIAPD, 12, anyLength},
+	// The IAID only
+	{dhcpv6.OptionIATA, 4, anyLength},
+	{dhcpv6.OptionPreference, 1, 1},
+	{dhcpv6.OptionElapsedTime, 2, 2},
+	{dhcpv6.OptionUnicast, 16, 16},
+	{dhcpv6.OptionStatusCode, 2, anyLength},
+	{dhcpv6.OptionRapidCommit, 0, 0},
+	{dhcpv6.OptionReconfAccept, 0, 0},
+}
+
+// checkSize returns an error if a datagram of n bytes exceeds the limits
+func checkSize(n int, l *config.Limits) error {
+	if n > l.MaxMessageSize {
+		return exceeded(limitMessageSize, "message size %d exceeds the limit of %d", n, l.MaxMessageSize)
+	}
+	return nil
+}
+
+// checkLimits4 returns an error if req exceeds the limits
+func checkLimits4(req *dhcpv4.DHCPv4) error {
+	for _, o := range fixedLengthOptions4 {
+		// Empty options are present with a nil value
+		if v := req.Options.Get(o.code); req.Options.Has(o.code) && len(v) != o.len {
+			return exceeded(limitOptionLength, "option %s has length %d, expected %d", o.code, len(v), o.len)
+		}
+	}
+	return nil
+}
+
+// checkLimits6 returns an error if d exceeds the limits
+func checkLimits6(d dhcpv6.DHCPv6, l *config.Limits) error {
+	depth := 0
+	for d.IsRelay() {
+		depth++
+		if depth > l.MaxRelayDepth {
+			return exceeded(limitRelayDepth, "relay nesting exceeds the limit of %d", l.MaxRelayDepth)
+		}
+		var err error
+		if d, err = dhcpv6.DecapsulateRelay(d); err != nil {
+			return err
+		}
+	}
+
+	msg, ok := d.(*dhcpv6.Message)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", d)
+	}
+	n := len(msg.Options.Get(dhcpv6.OptionIANA)) +
+		len(msg.Options.Get(dhcpv6.OptionIATA)) +
+		len(msg.Options.Get(dhcpv6.OptionIAPD))
+	if n > l.MaxIAOptions {
+		return exceeded(limitIAOptions, "%d IA options exceed the limit of %d", n, l.MaxIAOptions)
+	}
+	for _, o := range optionLengths6 {
+		for _, opt := range msg.Options.Get(o.code) {
+			n := len(opt.ToBytes())
+			if n < o.min || (o.max != anyLength && n > o.max) {
+				return exceeded(limitOptionLength, "option %s has length %d, expected %s", o.code, n, lengthRange(o.min, o.max))
+			}
+		}
+	}
+	return nil
+}
+
+// lengthRange describes the lengths from min to max
+func lengthRange(min, max int) string {
+	switch max {
+	case min:
+		return fmt.Sprint(min)
+	case anyLength:
+		return fmt.Sprintf("at least %d", min)
+	}
+	return fmt.Sprintf("%d to %d", min, max)
+}
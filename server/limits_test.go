@@ -0,0 +1,263 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/internal/testpackets"
+)
+
+func TestCheckSize(t *testing.T) {
+	assert.NoError(t, checkSize(DefaultMaxMessageSize, &defaultLimits))
+	assert.Error(t, checkSize(DefaultMaxMessageSize+1, &defaultLimits))
+	assert.Error(t, checkSize(600, &config.Limits{MaxMessageSize: 576}))
+}
+
+func TestCheckLimits4(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opt  dhcpv4.Option
+		ok   bool
+	}{
+		{"valid requested IP", dhcpv4.OptRequestedIPAddress(net.IPv4(192, 0, 2, 1)), true},
+		{"short requested IP", dhcpv4.OptGeneric(dhcpv4.OptionRequestedIPAddress, []byte{192, 0, 2}), false},
+		{"long server identifier", dhcpv4.OptGeneric(dhcpv4.OptionServerIdentifier, []byte{192, 0, 2, 1, 0}), false},
+		{"empty lease time", dhcpv4.OptGeneric(dhcpv4.OptionIPAddressLeaseTime, []byte{}), false},
+		{"long max message size", dhcpv4.OptGeneric(dhcpv4.OptionMaximumDHCPMessageSize, []byte{0, 0, 2, 64}), false},
+		{"variable length option", dhcpv4.OptGeneric(dhcpv4.OptionHostName, []byte("a")), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := testpackets.V4Discover(t, nil, dhcpv4.WithOption(tc.opt))
+			if tc.ok {
+				assert.NoError(t, checkLimits4(req))
+			} else {
+				assert.Error(t, checkLimits4(req))
+			}
+		})
+	}
+}
+
+func TestCheckLimits6RelayDepth(t *testing.T) {
+	solicit, _ := testpackets.V6Solicit(t, nil)
+	for depth := 1; depth <= DefaultMaxRelayDepth+1; depth++ {
+		parsed, _ := testpackets.RelayWrap(t, solicit, depth, net.ParseIP("2001:db8::1"), net.ParseIP("fe80::1"))
+		if depth <= DefaultMaxRelayDepth {
+			assert.NoError(t, checkLimits6(parsed, &defaultLimits), "%d relays should be accepted", depth)
+		} else {
+			assert.Error(t, checkLimits6(parsed, &defaultLimits), "%d relays should be refused", depth)
+		}
+	}
+}
+
+func TestCheckLimits6IAOptions(t *testing.T) {
+	msg, err := dhcpv6.NewMessage()
+	require.NoError(t, err)
+	for i := 0; i < DefaultMaxIAOptions; i++ {
+		if i%2 == 0 {
+			msg.AddOption(&dhcpv6.OptIANA{IaId: [4]byte{0, 0, 0, byte(i)}})
+		} else {
+			msg.AddOption(&dhcpv6.OptIAPD{IaId: [4]byte{0, 0, 0, byte(i)}})
+		}
+	}
+	parsed, err := dhcpv6.FromBytes(msg.ToBytes())
+	require.NoError(t, err)
+	assert.NoError(t, checkLimits6(parsed, &defaultLimits))
+
+	msg.AddOption(&dhcpv6.OptIANA{IaId: [4]byte{0, 0, 1, 0}})
+	parsed, err = dhcpv6.FromBytes(msg.ToBytes())
+	require.NoError(t, err)
+	assert.Error(t, checkLimits6(parsed, &defaultLimits))
+}
+
+func TestCheckLimits6OptionLengths(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opt  dhcpv6.Option
+		ok   bool
+	}{
+		{"valid elapsed time", dhcpv6.OptElapsedTime(time.Second), true},
+		{"valid preference", &dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionPreference, OptionData: []byte{255}}, true},
+		{"long preference", &dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionPreference, OptionData: []byte{0, 255}}, false},
+		{"empty preference", &dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionPreference}, false},
+		{"short unicast", &dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionUnicast, OptionData: []byte{0x20, 0x01, 0x0d, 0xb8}}, false},
+		{"rapid commit with data", &dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionRapidCommit, OptionData: []byte{1}}, false},
+		{"reconfigure accept with data", &dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionReconfAccept, OptionData: []byte{1}}, false},
+		{"empty rapid commit", &dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionRapidCommit}, true},
+		{"IA_NA header", &dhcpv6.OptIANA{IaId: [4]byte{0, 0, 0, 1}}, true},
+		{"IA_PD header", &dhcpv6.OptIAPD{IaId: [4]byte{0, 0, 0, 1}}, true},
+		{"short IA_NA", &dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionIANA, OptionData: []byte{0, 0, 0, 1}}, false},
+		{"short IA_PD", &dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionIAPD, OptionData: make([]byte, 11)}, false},
+		{"long client ID", &dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionClientID, OptionData: make([]byte, 131)}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			msg, err := dhcpv6.NewMessage()
+			require.NoError(t, err)
+			msg.AddOption(tc.opt)
+			err = checkLimits6(msg, &defaultLimits)
+			if tc.ok {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Equal(t, limitOptionLength, err.(*limitError).limit)
+		})
+	}
+}
+
+func TestLimitCounter(t *testing.T) {
+	c := newLimitCounter()
+	c.count(checkSize(DefaultMaxMessageSize+1, &defaultLimits))
+	c.count(checkSize(DefaultMaxMessageSize+1, &defaultLimits))
+	c.count(exceeded(limitRelayDepth, "too deep"))
+	c.count(errors.New("malformed"))
+	c.count(nil)
+	assert.Equal(t, LimitCounts{
+		limitMessageSize:  2,
+		limitRelayDepth:   1,
+		limitIAOptions:    0,
+		limitOptionLength: 0,
+	}, c.counts())
+
+	var none limitCounter
+	none.count(exceeded(limitRelayDepth, "too deep"))
+	assert.Empty(t, none.counts())
+}
+
+// mutate returns a copy of b with a few random changes: bits flipped, bytes
+// set to 0 or 0xff, bytes inserted, or the end cut off
+func mutate(rng *rand.Rand, b []byte) []byte {
+	b = append([]byte(nil), b...)
+	for n := 1 + rng.Intn(4); n > 0 && len(b) > 0; n-- {
+		i := rng.Intn(len(b))
+		switch rng.Intn(5) {
+		case 0:
+			b[i] ^= 1 << uint(rng.Intn(8))
+		case 1:
+			b[i] = 0
+		case 2:
+			b[i] = 0xff
+		case 3:
+			b = append(b[:i], append([]byte{byte(rng.Intn(256))}, b[i:]...)...)
+		case 4:
+			b = b[:i]
+		}
+	}
+	return b
+}
+
+// pooled returns a copy of b in a buffer of the pool, as the handlers put the
+// buffers of the requests back in it
+func pooled(b []byte) []byte {
+	buf := *bufpool.Get().(*[]byte)
+	return append(buf[:0], b...)
+}
+
+// TestLimitsMutations feeds the server randomly mutated copies of a corpus of
+// valid requests. The requests accepted must be within the limits, which
+// plugins rely on, the others must be counted under the limit they exceeded,
+// and none may crash the server. The seed is fixed, for the failures to be
+// reproducible
+func TestLimitsMutations(t *testing.T) {
+	registerTestPlugins(t)
+
+	const rounds = 2000
+	rng := rand.New(rand.NewSource(1))
+	_, discover := testpackets.V4Discover(t, nil, dhcpv4.WithOption(dhcpv4.OptMaxMessageSize(1500)))
+	_, selecting := testpackets.V4RequestSelecting(t, nil, net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 100))
+	solicit, rawSolicit := testpackets.V6Solicit(t, nil, dhcpv6.WithOption(dhcpv6.OptElapsedTime(time.Second)))
+	_, both := testpackets.V6SolicitWithIANAandIAPD(t, nil, dhcpv6.WithRapidCommit)
+	_, relayed := testpackets.RelayWrap(t, solicit, 3, net.ParseIP("2001:db8::1"), net.ParseIP("fe80::1"))
+	_, deep := testpackets.RelayWrap(t, solicit, DefaultMaxRelayDepth+1, net.ParseIP("2001:db8::1"), net.ParseIP("fe80::1"))
+	many, err := dhcpv6.NewMessage()
+	require.NoError(t, err)
+	for i := 0; i <= DefaultMaxIAOptions; i++ {
+		many.AddOption(&dhcpv6.OptIANA{IaId: [4]byte{0, 0, 0, byte(i)}})
+	}
+	huge, err := dhcpv4.NewDiscovery(net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionVendorSpecificInformation, make([]byte, 255))))
+	require.NoError(t, err)
+	padded := append(huge.ToBytes(), make([]byte, DefaultMaxMessageSize)...)
+	corpus4 := [][]byte{discover, selecting, padded}
+	corpus6 := [][]byte{rawSolicit, both, relayed, deep, many.ToBytes()}
+
+	srv, new4, new6, err := newServers(&memServerConfig)
+	require.NoError(t, err)
+	defer srv.Close()
+	conn4 := NewMemConn4(&net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ServerPort})
+	conn6 := NewMemConn6(&net.UDPAddr{IP: dhcpv6.AllDHCPRelayAgentsAndServers, Port: dhcpv6.DefaultServerPort})
+	defer conn4.Close()
+	defer conn6.Close()
+	l4, l6 := new4(conn4, net.Interface{}), new6(conn6, net.Interface{})
+	for _, conn := range []interface {
+		Sent(time.Duration) ([]byte, *net.UDPAddr, int, error)
+	}{conn4, conn6} {
+		go func(sent func(time.Duration) ([]byte, *net.UDPAddr, int, error)) {
+			for {
+				if _, _, _, err := sent(time.Minute); err == ErrMemConnClosed {
+					return
+				}
+			}
+		}(conn.Sent)
+	}
+
+	expected4, expected6 := make(LimitCounts), make(LimitCounts)
+	count := func(counts LimitCounts, err error) {
+		if e, ok := err.(*limitError); ok {
+			counts[e.limit]++
+		}
+	}
+	for i := 0; i < rounds; i++ {
+		b := mutate(rng, corpus4[rng.Intn(len(corpus4))])
+		if err := checkSize(len(b), &defaultLimits); err != nil {
+			count(expected4, err)
+		} else if req, err := dhcpv4.FromBytes(b); err == nil && req.OpCode == dhcpv4.OpcodeBootRequest {
+			err := checkLimits4(req)
+			count(expected4, err)
+			if err == nil {
+				for _, o := range fixedLengthOptions4 {
+					if req.Options.Has(o.code) {
+						require.Len(t, req.Options.Get(o.code), o.len, "accepted %x", b)
+					}
+				}
+			}
+		}
+		l4.HandleMsg4(pooled(b), nil, &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ClientPort}, 0)
+
+		b = mutate(rng, corpus6[rng.Intn(len(corpus6))])
+		if err := checkSize(len(b), &defaultLimits); err != nil {
+			count(expected6, err)
+		} else if d, err := dhcpv6.FromBytes(b); err == nil {
+			err := checkLimits6(d, &defaultLimits)
+			count(expected6, err)
+			if msg, merr := d.GetInnerMessage(); err == nil && merr == nil {
+				for _, o := range optionLengths6 {
+					for _, opt := range msg.Options.Get(o.code) {
+						n := len(opt.ToBytes())
+						require.True(t, n >= o.min && (o.max == anyLength || n <= o.max), "accepted %s of length %d in %x", o.code, n, b)
+					}
+				}
+			}
+		}
+		l6.HandleMsg6(pooled(b), nil, &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: dhcpv6.DefaultClientPort}, 0)
+	}
+
+	v4, v6 := srv.Limited()
+	for _, limit := range allLimits {
+		assert.Equal(t, expected4[limit], v4[limit], "DHCPv4 requests over %s", limit)
+		assert.Equal(t, expected6[limit], v6[limit], "DHCPv6 requests over %s", limit)
+	}
+	t.Logf("dropped over the limits: DHCPv4 %v, DHCPv6 %v", v4, v6)
+}
@@ -0,0 +1,205 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// ErrMemConnClosed is returned by operations on a closed MemConn4 or MemConn6
+var ErrMemConnClosed = errors.New("use of closed in-memory connection")
+
+// ErrMemConnTimeout is returned by Sent when the server did not write a
+// datagram in time
+var ErrMemConnTimeout = errors.New("timed out waiting for a datagram")
+
+var (
+	_ PacketConn4 = (*MemConn4)(nil)
+	_ PacketConn6 = (*MemConn6)(nil)
+)
+
+// memConnQueueLen is the number of datagrams that can be queued in each
+// direction of an in-memory connection before the writer blocks
+const memConnQueueLen = 64
+
+type memDatagram struct {
+	b       []byte
+	peer    *net.UDPAddr
+	dst     net.IP
+	ifIndex int
+}
+
+// memConn holds the protocol-independent part of MemConn4 and MemConn6
+type memConn struct {
+	local  *net.UDPAddr
+	in     chan memDatagram
+	out    chan memDatagram
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newMemConn(local *net.UDPAddr) *memConn {
+	return &memConn{
+		local:  local,
+		in:     make(chan memDatagram, memConnQueueLen),
+		out:    make(chan memDatagram, memConnQueueLen),
+		closed: make(chan struct{}),
+	}
+}
+
+// Inject queues a datagram as if it was received from peer, on the interface
+// with index ifIndex (0 if unknown). The datagram is copied
+func (c *memConn) Inject(b []byte, peer *net.UDPAddr, ifIndex int) error {
+	return c.InjectTo(b, peer, nil, ifIndex)
+}
+
+// InjectTo is like Inject, with dst as the destination address of the
+// datagram, as reported to the server in the control message
+func (c *memConn) InjectTo(b []byte, peer *net.UDPAddr, dst net.IP, ifIndex int) error {
+	d := memDatagram{b: append([]byte(nil), b...), peer: peer, dst: dst, ifIndex: ifIndex}
+	select {
+	case <-c.closed:
+		return ErrMemConnClosed
+	default:
+	}
+	select {
+	case c.in <- d:
+		return nil
+	case <-c.closed:
+		return ErrMemConnClosed
+	}
+}
+
+// Sent waits up to timeout for a datagram written by the server, and returns
+// it along with its destination and outgoing interface index (0 if the server
+// did not pick an interface)
+func (c *memConn) Sent(timeout time.Duration) ([]byte, *net.UDPAddr, int, error) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case d := <-c.out:
+		return d.b, d.peer, d.ifIndex, nil
+	case <-c.closed:
+		return nil, nil, 0, ErrMemConnClosed
+	case <-t.C:
+		return nil, nil, 0, ErrMemConnTimeout
+	}
+}
+
+// LocalAddr returns the address the connection pretends to be bound to
+func (c *memConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// Close closes the connection. Pending and future reads and writes fail
+func (c *memConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *memConn) read(b []byte) (int, memDatagram, error) {
+	select {
+	case <-c.closed:
+		return 0, memDatagram{}, ErrMemConnClosed
+	case d := <-c.in:
+		return copy(b, d.b), d, nil
+	}
+}
+
+func (c *memConn) write(b []byte, ifIndex int, dst net.Addr) (int, error) {
+	peer, ok := dst.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("in-memory connection: unsupported address type %T", dst)
+	}
+	d := memDatagram{b: append([]byte(nil), b...), peer: peer, ifIndex: ifIndex}
+	select {
+	case <-c.closed:
+		return 0, ErrMemConnClosed
+	default:
+	}
+	select {
+	case c.out <- d:
+		return len(b), nil
+	case <-c.closed:
+		return 0, ErrMemConnClosed
+	}
+}
+
+// MemConn6 is an in-memory PacketConn6. Requests are fed to the server with
+// Inject and its responses retrieved with Sent
+type MemConn6 struct {
+	*memConn
+}
+
+// NewMemConn6 returns an in-memory connection pretending to be bound to local
+func NewMemConn6(local *net.UDPAddr) *MemConn6 {
+	return &MemConn6{newMemConn(local)}
+}
+
+// ReadFrom implements PacketConn6
+func (c *MemConn6) ReadFrom(b []byte) (int, *ipv6.ControlMessage, net.Addr, error) {
+	n, d, err := c.read(b)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return n, &ipv6.ControlMessage{IfIndex: d.ifIndex, Dst: d.dst}, d.peer, nil
+}
+
+// WriteTo implements PacketConn6
+func (c *MemConn6) WriteTo(b []byte, cm *ipv6.ControlMessage, dst net.Addr) (int, error) {
+	var ifIndex int
+	if cm != nil {
+		ifIndex = cm.IfIndex
+	}
+	return c.write(b, ifIndex, dst)
+}
+
+// MemConn4 is an in-memory PacketConn4. Requests are fed to the server with
+// Inject and its responses retrieved with Sent.
+// Responses a server on sockets sends as raw ethernet frames (unicast to a
+// client that has no address yet) are written to the connection, addressed to
+// the offered address
+type MemConn4 struct {
+	*memConn
+}
+
+// inMemory4 tells whether c is a MemConn4, possibly recorded
+func inMemory4(c PacketConn4) bool {
+	if rec, ok := c.(*recordingConn4); ok {
+		c = rec.PacketConn4
+	}
+	_, ok := c.(*MemConn4)
+	return ok
+}
+
+// NewMemConn4 returns an in-memory connection pretending to be bound to local
+func NewMemConn4(local *net.UDPAddr) *MemConn4 {
+	return &MemConn4{newMemConn(local)}
+}
+
+// ReadFrom implements PacketConn4
+func (c *MemConn4) ReadFrom(b []byte) (int, *ipv4.ControlMessage, net.Addr, error) {
+	n, d, err := c.read(b)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return n, &ipv4.ControlMessage{IfIndex: d.ifIndex, Dst: d.dst}, d.peer, nil
+}
+
+// WriteTo implements PacketConn4
+func (c *MemConn4) WriteTo(b []byte, cm *ipv4.ControlMessage, dst net.Addr) (int, error) {
+	var ifIndex int
+	if cm != nil {
+		ifIndex = cm.IfIndex
+	}
+	return c.write(b, ifIndex, dst)
+}
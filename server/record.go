@@ -0,0 +1,298 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/coredhcp/coredhcp/config"
+)
+
+// Event is a datagram received or sent by a server, as recorded for replay.
+// Recordings are files of JSON-encoded events, one per line
+type Event struct {
+	Time time.Time `json:"time"`
+	// Family is 4 for DHCPv4 and 6 for DHCPv6
+	Family int `json:"family"`
+	// Sent is true for responses, false for requests
+	Sent bool `json:"sent"`
+	// Peer is the source of requests, and the destination of responses
+	Peer *net.UDPAddr `json:"peer"`
+	// Dst is the destination address of requests, when known
+	Dst     net.IP `json:"dst,omitempty"`
+	IfIndex int    `json:"ifindex,omitempty"`
+	Data    []byte `json:"data"`
+}
+
+// DefaultRecordMaxSize is the size past which recordings are rotated, when
+// the configuration does not set one
+const DefaultRecordMaxSize = 64 << 20
+
+// recordQueueLength is the number of datagrams waiting to be written to a
+// recording, beyond which they are dropped
+const recordQueueLength = 1024
+
+// recorder appends the datagrams of a server to a recording. Datagrams are
+// queued by the listeners, and written out by a goroutine, so that a slow disk
+// does not hold up requests
+type recorder struct {
+	file          string
+	hostnameChars int
+	maxSize       int64
+
+	mu      sync.Mutex
+	closed  bool
+	events  chan Event
+	dropped int
+	done    chan struct{}
+
+	// Only used by the writing goroutine
+	f    *os.File
+	size int64
+}
+
+func newRecorder(conf *config.RecordConfig) (*recorder, error) {
+	r := &recorder{
+		file:          conf.File,
+		hostnameChars: conf.HostnameChars,
+		maxSize:       conf.MaxSize,
+		events:        make(chan Event, recordQueueLength),
+		done:          make(chan struct{}),
+	}
+	if r.maxSize == 0 {
+		r.maxSize = DefaultRecordMaxSize
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	log.Printf("Recording traffic to %s", conf.File)
+	go r.run()
+	return r, nil
+}
+
+// open opens the recording for appending
+func (r *recorder) open() error {
+	f, err := os.OpenFile(r.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open recording %s: %w", r.file, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("cannot open recording %s: %w", r.file, err)
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+// record queues e to be written out, or drops it if the queue is full or the
+// recorder closed
+func (r *recorder) record(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	select {
+	case r.events <- e:
+	default:
+		r.dropped++
+		limited.Limited("record drop").Warningf("Recording queue full, %d datagrams dropped so far", r.dropped)
+	}
+}
+
+// run writes out the queued datagrams until the recorder is closed
+func (r *recorder) run() {
+	defer close(r.done)
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for e := range r.events {
+		if r.hostnameChars >= 0 {
+			if e.Family == 4 {
+				e.Data = truncateHostname4(e.Data, r.hostnameChars)
+			} else {
+				e.Data = truncateHostname6(e.Data, r.hostnameChars)
+			}
+		}
+		b.Reset()
+		if err := enc.Encode(e); err != nil {
+			limited.Limited("record").Errorf("Cannot record datagram: %v", err)
+			continue
+		}
+		if err := r.write(b.Bytes()); err != nil {
+			limited.Limited("record").Errorf("Cannot record datagram: %v", err)
+		}
+	}
+	if r.f != nil {
+		if err := r.f.Close(); err != nil {
+			log.Errorf("Cannot close recording %s: %v", r.file, err)
+		}
+	}
+}
+
+// write appends line to the recording, rotating it first if it would grow
+// past its maximum size
+func (r *recorder) write(line []byte) error {
+	if r.f != nil && r.size > 0 && r.size+int64(len(line)) > r.maxSize {
+		r.f.Close()
+		r.f = nil
+		if err := os.Rename(r.file, r.file+".1"); err != nil {
+			return fmt.Errorf("cannot rotate recording %s: %w", r.file, err)
+		}
+	}
+	if r.f == nil {
+		// Also retries opening after a failed rotation
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+	n, err := r.f.Write(line)
+	r.size += int64(n)
+	return err
+}
+
+// Close stops recording, once the queued datagrams are written out. It can be
+// called several times
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.events)
+	}
+	r.mu.Unlock()
+	<-r.done
+	return nil
+}
+
+// truncateHostname4 returns the DHCPv4 message b with the Host Name option
+// truncated to n characters, or removed if n is 0
+func truncateHostname4(b []byte, n int) []byte {
+	m, err := dhcpv4.FromBytes(b)
+	if err != nil {
+		return b
+	}
+	name := m.HostName()
+	if len(name) <= n {
+		return b
+	}
+	if n == 0 {
+		delete(m.Options, dhcpv4.OptionHostName.Code())
+	} else {
+		m.UpdateOption(dhcpv4.OptHostName(name[:n]))
+	}
+	return m.ToBytes()
+}
+
+// truncateHostname6 returns the DHCPv6 message b with the first label of the
+// name in the Client FQDN option truncated to n characters, and the rest of
+// the name removed
+func truncateHostname6(b []byte, n int) []byte {
+	d, err := dhcpv6.FromBytes(b)
+	if err != nil {
+		return b
+	}
+	msg, err := d.GetInnerMessage()
+	if err != nil {
+		return b
+	}
+	opt := msg.GetOneOption(dhcpv6.OptionFQDN)
+	if opt == nil {
+		return b
+	}
+	// A flags byte, then the name in DNS wire format, RFC4704 §4
+	fqdn := opt.ToBytes()
+	if len(fqdn) < 2 {
+		return b
+	}
+	label := fqdn[2:]
+	if int(fqdn[1]) < len(label) {
+		label = label[:fqdn[1]]
+	}
+	if len(label) > n {
+		label = label[:n]
+	}
+	data := []byte{fqdn[0]}
+	if len(label) > 0 {
+		data = append(append(data, byte(len(label))), label...)
+	}
+	data = append(data, 0)
+	msg.UpdateOption(&dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionFQDN, OptionData: data})
+	return d.ToBytes()
+}
+
+// recordingConn4 records the datagrams going through a PacketConn4. Responses
+// sent as raw ethernet frames bypass it, and are recorded with recordSent
+type recordingConn4 struct {
+	PacketConn4
+	r *recorder
+}
+
+func (c *recordingConn4) ReadFrom(b []byte) (int, *ipv4.ControlMessage, net.Addr, error) {
+	n, cm, src, err := c.PacketConn4.ReadFrom(b)
+	if err == nil {
+		e := Event{Time: time.Now(), Family: 4, Data: append([]byte(nil), b[:n]...)}
+		e.Peer, _ = src.(*net.UDPAddr)
+		if cm != nil {
+			e.Dst, e.IfIndex = cm.Dst, cm.IfIndex
+		}
+		c.r.record(e)
+	}
+	return n, cm, src, err
+}
+
+func (c *recordingConn4) WriteTo(b []byte, cm *ipv4.ControlMessage, dst net.Addr) (int, error) {
+	c.recordSent(b, cm, dst)
+	return c.PacketConn4.WriteTo(b, cm, dst)
+}
+
+// recordSent records the response b sent to dst
+func (c *recordingConn4) recordSent(b []byte, cm *ipv4.ControlMessage, dst net.Addr) {
+	e := Event{Time: time.Now(), Family: 4, Sent: true, Data: append([]byte(nil), b...)}
+	e.Peer, _ = dst.(*net.UDPAddr)
+	if cm != nil {
+		e.IfIndex = cm.IfIndex
+	}
+	c.r.record(e)
+}
+
+// recordingConn6 records the datagrams going through a PacketConn6
+type recordingConn6 struct {
+	PacketConn6
+	r *recorder
+}
+
+func (c *recordingConn6) ReadFrom(b []byte) (int, *ipv6.ControlMessage, net.Addr, error) {
+	n, cm, src, err := c.PacketConn6.ReadFrom(b)
+	if err == nil {
+		e := Event{Time: time.Now(), Family: 6, Data: append([]byte(nil), b[:n]...)}
+		e.Peer, _ = src.(*net.UDPAddr)
+		if cm != nil {
+			e.Dst, e.IfIndex = cm.Dst, cm.IfIndex
+		}
+		c.r.record(e)
+	}
+	return n, cm, src, err
+}
+
+func (c *recordingConn6) WriteTo(b []byte, cm *ipv6.ControlMessage, dst net.Addr) (int, error) {
+	e := Event{Time: time.Now(), Family: 6, Sent: true, Data: append([]byte(nil), b...)}
+	e.Peer, _ = dst.(*net.UDPAddr)
+	if cm != nil {
+		e.IfIndex = cm.IfIndex
+	}
+	c.r.record(e)
+	return c.PacketConn6.WriteTo(b, cm, dst)
+}
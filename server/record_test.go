@@ -0,0 +1,180 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coredhcp/coredhcp/config"
+)
+
+func serverIDConfig(id string) *config.Config {
+	return &config.Config{
+		Server4: &config.ServerConfig{
+			Plugins: []config.PluginConfig{
+				{Name: "server_id", Args: []string{id}},
+			},
+		},
+	}
+}
+
+// TestRecordReplay records a DISCOVER and its OFFER, and replays them against
+// the same and a different configuration
+func TestRecordReplay(t *testing.T) {
+	registerTestPlugins(t)
+
+	dir, err := ioutil.TempDir("", "coredhcp-record")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	recording := filepath.Join(dir, "recording.json")
+
+	conf := serverIDConfig("192.0.2.1")
+	conf.Server4.Record = &config.RecordConfig{File: recording, HostnameChars: 3}
+	conn := NewMemConn4(&net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ServerPort})
+	srv, err := StartConns(conf, []PacketConn4{conn}, nil)
+	require.NoError(t, err)
+
+	mac := net.HardwareAddr{0xde, 0xad, 0xbe, 0xef, 0x00, 0x01}
+	discover, err := dhcpv4.NewDiscovery(mac, dhcpv4.WithBroadcast(true), dhcpv4.WithOption(dhcpv4.OptHostName("laptop")))
+	require.NoError(t, err)
+	require.NoError(t, conn.Inject(discover.ToBytes(), &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ClientPort}, 1))
+	_, _, _, err = conn.Sent(time.Second)
+	require.NoError(t, err)
+	srv.Close()
+
+	f, err := os.Open(recording)
+	require.NoError(t, err)
+	events, err := ReadRecording(f)
+	f.Close()
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.False(t, events[0].Sent)
+	require.True(t, events[1].Sent)
+	req, err := dhcpv4.FromBytes(events[0].Data)
+	require.NoError(t, err)
+	require.Equal(t, "lap", req.HostName(), "host name not truncated in the recording")
+
+	t.Run("same", func(t *testing.T) {
+		divergences, err := Replay(serverIDConfig("192.0.2.1"), events, 0)
+		require.NoError(t, err)
+		require.Empty(t, divergences)
+	})
+	t.Run("different", func(t *testing.T) {
+		divergences, err := Replay(serverIDConfig("192.0.2.2"), events, 0)
+		require.NoError(t, err)
+		require.Len(t, divergences, 1)
+		require.Len(t, divergences[0].Recorded, 1)
+		require.Len(t, divergences[0].Replayed, 1)
+	})
+	t.Run("no server", func(t *testing.T) {
+		_, err := Replay(&config.Config{}, events, 0)
+		require.Error(t, err)
+	})
+}
+
+// TestReplayUnicast records and replays the OFFER to a non-broadcast DISCOVER,
+// which a server on sockets sends as a raw ethernet frame, received on an
+// unknown interface
+func TestReplayUnicast(t *testing.T) {
+	registerTestPlugins(t)
+
+	dir, err := ioutil.TempDir("", "coredhcp-record")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	recording := filepath.Join(dir, "recording.json")
+
+	conf := serverIDConfig("192.0.2.1")
+	conf.Server4.Record = &config.RecordConfig{File: recording}
+	conn := NewMemConn4(&net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ServerPort})
+	srv, err := StartConns(conf, []PacketConn4{conn}, nil)
+	require.NoError(t, err)
+
+	mac := net.HardwareAddr{0xde, 0xad, 0xbe, 0xef, 0x00, 0x03}
+	discover, err := dhcpv4.NewDiscovery(mac)
+	require.NoError(t, err)
+	require.False(t, discover.IsBroadcast())
+	require.NoError(t, conn.Inject(discover.ToBytes(), &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ClientPort}, 0))
+	_, peer, _, err := conn.Sent(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, dhcpv4.ClientPort, peer.Port)
+	srv.Close()
+
+	f, err := os.Open(recording)
+	require.NoError(t, err)
+	events, err := ReadRecording(f)
+	f.Close()
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Zero(t, events[0].IfIndex)
+
+	divergences, err := Replay(serverIDConfig("192.0.2.1"), events, 0)
+	require.NoError(t, err)
+	require.Empty(t, divergences)
+}
+
+// TestRecordRotate checks that recordings are rotated past their maximum size,
+// and that datagrams recorded after Close are ignored
+func TestRecordRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredhcp-record")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	recording := filepath.Join(dir, "recording.json")
+
+	rec, err := newRecorder(&config.RecordConfig{File: recording, HostnameChars: -1, MaxSize: 400})
+	require.NoError(t, err)
+	// Each event takes about 170 bytes: the third one starts a new file
+	for i := 0; i < 3; i++ {
+		rec.record(Event{Family: 4, Data: make([]byte, 64)})
+	}
+	require.NoError(t, rec.Close())
+	require.NoError(t, rec.Close(), "closing twice should be harmless")
+	rec.record(Event{Family: 4, Data: make([]byte, 64)})
+
+	var events []Event
+	for _, name := range []string{recording + ".1", recording} {
+		f, err := os.Open(name)
+		require.NoError(t, err)
+		info, err := f.Stat()
+		require.NoError(t, err)
+		require.LessOrEqual(t, info.Size(), int64(400), "%s grew past its maximum size", name)
+		e, err := ReadRecording(f)
+		f.Close()
+		require.NoError(t, err)
+		events = append(events, e...)
+	}
+	require.Len(t, events, 3, "datagrams lost in the rotation, or recorded after Close")
+}
+
+func TestPairExchanges(t *testing.T) {
+	mac := net.HardwareAddr{0xde, 0xad, 0xbe, 0xef, 0x00, 0x02}
+	var events []Event
+	var xids []dhcpv4.TransactionID
+	for i := 0; i < 2; i++ {
+		m, err := dhcpv4.NewDiscovery(mac)
+		require.NoError(t, err)
+		xids = append(xids, m.TransactionID)
+		events = append(events, Event{Family: 4, Data: m.ToBytes()})
+	}
+	for _, xid := range []dhcpv4.TransactionID{xids[1], xids[0], xids[1]} {
+		m, err := dhcpv4.New(dhcpv4.WithTransactionID(xid), dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer))
+		require.NoError(t, err)
+		events = append(events, Event{Family: 4, Sent: true, Data: m.ToBytes()})
+	}
+	events = append(events, Event{Family: 4, Data: []byte("garbage")})
+
+	exchanges := pairExchanges(events)
+	require.Len(t, exchanges, 3)
+	require.Len(t, exchanges[0].responses, 1)
+	require.Len(t, exchanges[1].responses, 2)
+	require.Empty(t, exchanges[2].responses)
+}
@@ -0,0 +1,258 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+
+	"github.com/coredhcp/coredhcp/config"
+)
+
+// replayTimeout is how long Replay waits for each response recorded for a
+// request, and replayQuietTimeout how long it waits for unexpected responses to
+// a request that got none
+const (
+	replayTimeout      = time.Second
+	replayQuietTimeout = 100 * time.Millisecond
+)
+
+// ReadRecording reads the events of a recording, as written by a server with
+// a record section in its configuration
+func ReadRecording(r io.Reader) ([]Event, error) {
+	var events []Event
+	dec := json.NewDecoder(r)
+	for {
+		var e Event
+		if err := dec.Decode(&e); err == io.EOF {
+			return events, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid recording after %d events: %w", len(events), err)
+		}
+		if e.Family != 4 && e.Family != 6 {
+			return nil, fmt.Errorf("invalid recording: event %d has family %d", len(events)+1, e.Family)
+		}
+		events = append(events, e)
+	}
+}
+
+// Divergence is a request to which the replayed server did not respond as the
+// recorded one did. Responses are given as summaries of the messages, in the
+// order they were sent
+type Divergence struct {
+	Request  Event
+	Recorded []string
+	Replayed []string
+}
+
+// exchange is a recorded request and the responses sent for it
+type exchange struct {
+	request   Event
+	responses []Event
+}
+
+// exchangeKey identifies the request a message belongs to: by family and
+// transaction ID, of the relayed message for DHCPv6
+func exchangeKey(e Event) (string, error) {
+	if e.Family == 4 {
+		m, err := dhcpv4.FromBytes(e.Data)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("4/%s", m.TransactionID), nil
+	}
+	d, err := dhcpv6.FromBytes(e.Data)
+	if err != nil {
+		return "", err
+	}
+	msg, err := d.GetInnerMessage()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("6/%s", msg.TransactionID), nil
+}
+
+// pairExchanges groups the responses of a recording with the last request
+// before them that has the same transaction ID. Responses that match no
+// request are ignored, as are unparseable requests, which are never answered
+func pairExchanges(events []Event) []*exchange {
+	var exchanges []*exchange
+	last := make(map[string]*exchange)
+	for _, e := range events {
+		key, err := exchangeKey(e)
+		if err != nil {
+			if !e.Sent {
+				exchanges = append(exchanges, &exchange{request: e})
+			}
+			continue
+		}
+		if !e.Sent {
+			x := &exchange{request: e}
+			exchanges = append(exchanges, x)
+			last[key] = x
+		} else if x, ok := last[key]; ok {
+			x.responses = append(x.responses, e)
+		}
+	}
+	return exchanges
+}
+
+// Summary returns a description of the message of the event
+func (e Event) Summary() string {
+	if e.Family == 4 {
+		m, err := dhcpv4.FromBytes(e.Data)
+		if err != nil {
+			return fmt.Sprintf("invalid DHCPv4 message %x: %v", e.Data, err)
+		}
+		return m.Summary()
+	}
+	d, err := dhcpv6.FromBytes(e.Data)
+	if err != nil {
+		return fmt.Sprintf("invalid DHCPv6 message %x: %v", e.Data, err)
+	}
+	return d.Summary()
+}
+
+// summarize returns a description of a response for comparison. Lifetimes
+// are left out, as they depend on when the server runs
+func summarize(family int, b []byte) string {
+	if family == 4 {
+		m, err := dhcpv4.FromBytes(b)
+		if err != nil {
+			return fmt.Sprintf("invalid DHCPv4 message %x: %v", b, err)
+		}
+		delete(m.Options, dhcpv4.OptionIPAddressLeaseTime.Code())
+		delete(m.Options, dhcpv4.OptionRenewTimeValue.Code())
+		delete(m.Options, dhcpv4.OptionRebindingTimeValue.Code())
+		return m.Summary()
+	}
+	d, err := dhcpv6.FromBytes(b)
+	if err != nil {
+		return fmt.Sprintf("invalid DHCPv6 message %x: %v", b, err)
+	}
+	if msg, err := d.GetInnerMessage(); err == nil {
+		for _, iana := range msg.Options.IANA() {
+			iana.T1, iana.T2 = 0, 0
+			for _, addr := range iana.Options.Addresses() {
+				addr.PreferredLifetime, addr.ValidLifetime = 0, 0
+			}
+		}
+		for _, iapd := range msg.Options.IAPD() {
+			iapd.T1, iapd.T2 = 0, 0
+			for _, prefix := range iapd.Options.Prefixes() {
+				prefix.PreferredLifetime, prefix.ValidLifetime = 0, 0
+			}
+		}
+	}
+	return d.Summary()
+}
+
+// Replay runs a server with the configuration conf on in-memory connections,
+// sends it the requests of a recording in order, and returns the requests it
+// did not respond to as recorded. With a speed of 0, each request is sent as
+// soon as the previous one was answered; otherwise requests are paced as
+// recorded, speed times faster.
+// The plugins are set up as for a real server, so any file they use (lease
+// files in particular) should be a copy, made for the replay, of the file the
+// recorded server used when the recording started. Recording is disabled in
+// the replayed server
+func Replay(conf *config.Config, events []Event, speed float64) ([]Divergence, error) {
+	c := *conf
+	var conns4 []PacketConn4
+	var conns6 []PacketConn6
+	var conn4 *MemConn4
+	var conn6 *MemConn6
+	if c.Server4 != nil {
+		s := *c.Server4
+		s.Record = nil
+		c.Server4 = &s
+		conn4 = NewMemConn4(&net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ServerPort})
+		conns4 = append(conns4, conn4)
+	}
+	if c.Server6 != nil {
+		s := *c.Server6
+		s.Record = nil
+		c.Server6 = &s
+		conn6 = NewMemConn6(&net.UDPAddr{IP: dhcpv6.AllDHCPRelayAgentsAndServers, Port: dhcpv6.DefaultServerPort})
+		conns6 = append(conns6, conn6)
+	}
+	exchanges := pairExchanges(events)
+	for _, x := range exchanges {
+		if x.request.Family == 4 && conn4 == nil {
+			return nil, errors.New("the recording has DHCPv4 requests, but no DHCPv4 server is configured")
+		}
+		if x.request.Family == 6 && conn6 == nil {
+			return nil, errors.New("the recording has DHCPv6 requests, but no DHCPv6 server is configured")
+		}
+	}
+
+	srv, err := StartConns(&c, conns4, conns6)
+	if err != nil {
+		return nil, err
+	}
+	defer srv.Close()
+
+	var divergences []Divergence
+	var prev time.Time
+	for _, x := range exchanges {
+		req := x.request
+		if speed > 0 && !prev.IsZero() {
+			time.Sleep(time.Duration(float64(req.Time.Sub(prev)) / speed))
+		}
+		prev = req.Time
+
+		var conn *memConn
+		if req.Family == 4 {
+			conn = conn4.memConn
+		} else {
+			conn = conn6.memConn
+		}
+		if err := conn.InjectTo(req.Data, req.Peer, req.Dst, req.IfIndex); err != nil {
+			return nil, err
+		}
+		d := Divergence{Request: req}
+		for _, resp := range x.responses {
+			d.Recorded = append(d.Recorded, summarize(resp.Family, resp.Data))
+		}
+		// Wait for as many responses as were recorded, and make sure no more
+		// are coming
+		timeout := replayTimeout
+		for len(d.Replayed) <= len(d.Recorded) {
+			if len(d.Replayed) == len(d.Recorded) {
+				timeout = replayQuietTimeout
+			}
+			b, _, _, err := conn.Sent(timeout)
+			if err == ErrMemConnTimeout {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			d.Replayed = append(d.Replayed, summarize(req.Family, b))
+		}
+		if !equalSummaries(d.Recorded, d.Replayed) {
+			divergences = append(divergences, d)
+		}
+	}
+	return divergences, nil
+}
+
+func equalSummaries(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
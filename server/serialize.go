@@ -0,0 +1,102 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// clientLocks serializes the handling of requests from the same client, such
+// as retransmissions received on two listeners, so plugins never handle two
+// requests from one client at the same time. Clients are spread over a fixed
+// number of locks, so unrelated clients sharing a lock wait for each other.
+// A nil *clientLocks does not serialize anything
+type clientLocks struct {
+	// waits counts the requests that had to wait for another one, and
+	// waited the total time they spent waiting, in nanoseconds. They are
+	// updated atomically, and kept first for alignment on 32-bit platforms
+	waits   uint64
+	waited  uint64
+	stripes []clientLock
+}
+
+// clientLock is one of the locks of clientLocks. users counts the requests
+// holding or waiting for it, to tell when a request has to wait
+type clientLock struct {
+	sync.Mutex
+	users int32
+}
+
+func (l *clientLock) unlock() {
+	atomic.AddInt32(&l.users, -1)
+	l.Unlock()
+}
+
+func newClientLocks(stripes int) *clientLocks {
+	if stripes <= 0 {
+		return nil
+	}
+	return &clientLocks{stripes: make([]clientLock, stripes)}
+}
+
+// noUnlock is returned by lock when there is nothing to unlock
+func noUnlock() {}
+
+// lock waits until no other request from the client identified by id is being
+// handled, and returns the function ending the handling of this request.
+// Requests without a client identifier are not serialized
+func (c *clientLocks) lock(id []byte) func() {
+	if c == nil || len(id) == 0 {
+		return noUnlock
+	}
+	h := fnv.New32a()
+	_, _ = h.Write(id)
+	l := &c.stripes[h.Sum32()%uint32(len(c.stripes))]
+
+	if atomic.AddInt32(&l.users, 1) == 1 {
+		l.Lock()
+		return l.unlock
+	}
+	start := time.Now()
+	l.Lock()
+	waited := time.Since(start)
+	n := atomic.AddUint64(&c.waits, 1)
+	total := time.Duration(atomic.AddUint64(&c.waited, uint64(waited)))
+	log.Debugf("Request waited %s for another request from the same client (%d waits so far, %s in total)", waited, n, total)
+	return l.unlock
+}
+
+// counts returns the number of requests that had to wait for another one, and
+// the total time they spent waiting
+func (c *clientLocks) counts() (waits uint64, waited time.Duration) {
+	if c == nil {
+		return 0, 0
+	}
+	return atomic.LoadUint64(&c.waits), time.Duration(atomic.LoadUint64(&c.waited))
+}
+
+// clientID4 identifies the client of a DHCPv4 request: by its client
+// identifier option if it has one, else by its hardware address (RFC2131 §4.2)
+func clientID4(req *dhcpv4.DHCPv4) []byte {
+	if id := req.Options.Get(dhcpv4.OptionClientIdentifier); len(id) > 0 {
+		return append([]byte{'i'}, id...)
+	}
+	return append([]byte{'h', byte(req.HWType)}, req.ClientHWAddr...)
+}
+
+// clientID6 identifies the client of a DHCPv6 message by its DUID, or returns
+// nil if it has none
+func clientID6(msg *dhcpv6.Message) []byte {
+	if id := msg.GetOneOption(dhcpv6.OptionClientID); id != nil {
+		return id.ToBytes()
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/coredhcp/coredhcp/internal/testpackets"
+)
+
+func TestClientLocks(t *testing.T) {
+	var disabled *clientLocks
+	disabled.lock([]byte("client"))()
+	assert.Nil(t, newClientLocks(0))
+
+	c := newClientLocks(16)
+	// Requests without an identifier are never serialized
+	unlock := c.lock(nil)
+	c.lock(nil)()
+	unlock()
+
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer c.lock([]byte("client"))()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), maxRunning, "requests from one client ran concurrently")
+	assert.NotZero(t, c.waits, "waits were not counted")
+}
+
+func TestClientID4(t *testing.T) {
+	mac := net.HardwareAddr{0xde, 0xad, 0xbe, 0xef, 0x00, 0x01}
+	byMAC, _ := testpackets.V4Discover(t, mac)
+	otherMAC, _ := testpackets.V4Discover(t, net.HardwareAddr{0xde, 0xad, 0xbe, 0xef, 0x00, 0x02})
+	assert.NotEqual(t, clientID4(byMAC), clientID4(otherMAC))
+
+	withID := dhcpv4.WithOption(dhcpv4.OptClientIdentifier([]byte{0xff, 1, 2, 3, 4}))
+	a, _ := testpackets.V4Discover(t, mac, withID)
+	b, _ := testpackets.V4RequestInitReboot(t, net.HardwareAddr{0xde, 0xad, 0xbe, 0xef, 0x00, 0x02}, net.IPv4(192, 0, 2, 100), withID)
+	assert.Equal(t, clientID4(a), clientID4(b), "the client identifier should take precedence over the hardware address")
+	assert.NotEqual(t, clientID4(a), clientID4(byMAC))
+}
+
+func TestClientID6(t *testing.T) {
+	a, _ := testpackets.V6Solicit(t, nil)
+	b, _ := testpackets.V6SolicitWithIANAandIAPD(t, nil)
+	assert.NotEmpty(t, clientID6(a))
+	assert.Equal(t, clientID6(a), clientID6(b))
+
+	anonymous, _ := testpackets.V6InformationRequest(t, nil)
+	assert.Nil(t, clientID6(anonymous))
+}
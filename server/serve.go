@@ -5,9 +5,13 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
@@ -17,41 +21,153 @@ import (
 	"github.com/coredhcp/coredhcp/logger"
 	"github.com/coredhcp/coredhcp/plugins"
 	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
 	"github.com/insomniacslk/dhcp/dhcpv6/server6"
+	"github.com/sirupsen/logrus"
 )
 
 var log = logger.GetLogger("server")
 
+// limited logs the errors of sockets and recordings, which would flood the
+// logs when they fail for every datagram
+var limited = logger.NewLimiter(log, 10, time.Minute)
+
+// PacketConn6 is the transport a DHCPv6 server reads requests from and writes
+// responses to. It is implemented by *ipv6.PacketConn, and by MemConn6 to run a
+// server without sockets
+type PacketConn6 interface {
+	ReadFrom(b []byte) (n int, cm *ipv6.ControlMessage, src net.Addr, err error)
+	WriteTo(b []byte, cm *ipv6.ControlMessage, dst net.Addr) (n int, err error)
+	LocalAddr() net.Addr
+	io.Closer
+}
+
+// PacketConn4 is the DHCPv4 equivalent of PacketConn6. It is implemented by
+// *ipv4.PacketConn and MemConn4
+type PacketConn4 interface {
+	ReadFrom(b []byte) (n int, cm *ipv4.ControlMessage, src net.Addr, err error)
+	WriteTo(b []byte, cm *ipv4.ControlMessage, dst net.Addr) (n int, err error)
+	LocalAddr() net.Addr
+	io.Closer
+}
+
+// instance holds the state shared by the listeners of the servers of an
+// instance, see config.LoadInstances
+type instance struct {
+	// missed counts the requests dropped past their deadline, by stage. It
+	// is updated atomically, and kept first for alignment on 32-bit
+	// platforms
+	missed [numStages]uint64
+	log    *logrus.Entry
+	// limited logs the reasons requests are dropped, which would flood the
+	// logs when many requests fail the same way
+	limited *logger.Limiter
+	// running counts the listeners serving and the requests they are
+	// handling, so that the plugins are only closed once they are done
+	running sync.WaitGroup
+}
+
+func newInstance(name string) *instance {
+	log := logger.WithInstance(log, name)
+	return &instance{log: log, limited: logger.NewLimiter(log, 10, time.Minute)}
+}
+
 type listener6 struct {
-	*ipv6.PacketConn
+	PacketConn6
 	net.Interface
+	*instance
 	handlers []handler.Handler6
+	// handlers4 is the DHCPv4 plugin chain, for DHCPv4-over-DHCPv6. It is
+	// nil if no DHCPv4 server is configured
+	handlers4 []handler.Handler4
+	// timers4 checks the DHCPv4-over-DHCPv6 responses, like the DHCPv4
+	// server's
+	timers4 *timerCheck
+	// load is shared by all the listeners of a server
+	load   *loadShedder
+	limits config.Limits
+	// overLimits counts the requests dropped for exceeding limits, by the
+	// listeners of the server and for its DHCPv4-over-DHCPv6 queries
+	overLimits limitCounter
+	timeout    time.Duration
+	// unicast is the address advertised in the Server Unicast option, nil
+	// if clients must multicast their requests
+	unicast net.IP
+	// serverID is the DUID of the server, to answer the messages clients
+	// were not allowed to unicast. It is nil if it is unknown
+	serverID *dhcpv6.Duid
+	// clients is shared by all the listeners of a server, like load
+	clients *clientLocks
+	timers  *timerCheck
 }
 
 type listener4 struct {
-	*ipv4.PacketConn
+	PacketConn4
 	net.Interface
-	handlers []handler.Handler4
+	*instance
+	handlers   []handler.Handler4
+	load       *loadShedder
+	limits     config.Limits
+	overLimits limitCounter
+	timeout    time.Duration
+	clients    *clientLocks
+	timers     *timerCheck
 }
 
 type listener interface {
 	io.Closer
 }
 
+// DefaultRequestTimeout is the time the server has to respond to a request
+// when the configuration does not set one. DHCP clients retransmit after a
+// few seconds, so a response sent later than this would be wasted
+const DefaultRequestTimeout = 3 * time.Second
+
+func requestTimeout(configured time.Duration) time.Duration {
+	if configured == 0 {
+		return DefaultRequestTimeout
+	}
+	return configured
+}
+
 // Servers contains state for a running server (with possibly multiple interfaces/listeners)
 type Servers struct {
+	log       *logrus.Entry
 	listeners []listener
-	errors    chan error
+	// recorders are closed after the listeners, so that they get the last
+	// responses
+	recorders []*recorder
+	// chains are the plugin chains of the servers
+	chains []*plugins.Chain
+	// timers are the checks of the renewal timers of the servers
+	timers []*timerCheck
+	// clients are the client locks of the servers
+	clients []*clientLocks
+	// load4 and load6 are the load shedders of the servers, nil if they do
+	// not shed
+	load4, load6 *loadShedder
+	// overLimits4 and overLimits6 count the requests the servers dropped
+	// for exceeding their limits, nil for the servers not configured
+	overLimits4, overLimits6 limitCounter
+	// inst is the state shared by the listeners of the servers
+	inst   *instance
+	errors chan error
 }
 
-func listen4(a *net.UDPAddr) (*listener4, error) {
+func listen4(a *net.UDPAddr, o config.SocketOptions) (*listener4, error) {
 	var err error
 	l4 := listener4{}
 	udpConn, err := server4.NewIPv4UDPConn(a.Zone, a)
 	if err != nil {
 		return nil, err
 	}
-	l4.PacketConn = ipv4.NewPacketConn(udpConn)
+	pc := ipv4.NewPacketConn(udpConn)
+	l4.PacketConn4 = pc
+	if err = setSocketOptions4(udpConn, pc, o); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	watchDrops(udpConn)
 	var ifi *net.Interface
 	if a.Zone != "" {
 		ifi, err = net.InterfaceByName(a.Zone)
@@ -63,14 +179,14 @@ func listen4(a *net.UDPAddr) (*listener4, error) {
 
 		// When not bound to an interface, we need the information in each
 		// packet to know which interface it came on
-		err = l4.SetControlMessage(ipv4.FlagInterface, true)
+		err = pc.SetControlMessage(ipv4.FlagInterface, true)
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	if a.IP.IsMulticast() {
-		err = l4.JoinGroup(ifi, a)
+		err = pc.JoinGroup(ifi, a)
 		if err != nil {
 			return nil, err
 		}
@@ -78,13 +194,19 @@ func listen4(a *net.UDPAddr) (*listener4, error) {
 	return &l4, nil
 }
 
-func listen6(a *net.UDPAddr) (*listener6, error) {
+func listen6(a *net.UDPAddr, o config.SocketOptions) (*listener6, error) {
 	l6 := listener6{}
 	udpconn, err := server6.NewIPv6UDPConn(a.Zone, a)
 	if err != nil {
 		return nil, err
 	}
-	l6.PacketConn = ipv6.NewPacketConn(udpconn)
+	pc := ipv6.NewPacketConn(udpconn)
+	l6.PacketConn6 = pc
+	if err = setSocketOptions6(udpconn, pc, o); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	watchDrops(udpconn)
 	var ifi *net.Interface
 	if a.Zone != "" {
 		ifi, err = net.InterfaceByName(a.Zone)
@@ -95,14 +217,18 @@ func listen6(a *net.UDPAddr) (*listener6, error) {
 	} else {
 		// When not bound to an interface, we need the information in each
 		// packet to know which interface it came on
-		err = l6.SetControlMessage(ipv6.FlagInterface, true)
+		err = pc.SetControlMessage(ipv6.FlagInterface, true)
 		if err != nil {
 			return nil, err
 		}
 	}
+	// The destination address tells requests sent by unicast apart
+	if err = pc.SetControlMessage(ipv6.FlagDst, true); err != nil {
+		return nil, err
+	}
 
 	if a.IP.IsMulticast() {
-		err = l6.JoinGroup(ifi, a)
+		err = pc.JoinGroup(ifi, a)
 		if err != nil {
 			return nil, err
 		}
@@ -110,70 +236,285 @@ func listen6(a *net.UDPAddr) (*listener6, error) {
 	return &l6, nil
 }
 
+// newServers loads the plugins of config, and sets up the state shared by the
+// listeners of each of its servers. It returns the functions making a listener
+// of each server out of a connection, and, for listeners bound to one, its
+// interface. They are nil for the servers that are not configured
+func newServers(config *config.Config) (srv *Servers, new4 func(PacketConn4, net.Interface) *listener4, new6 func(PacketConn6, net.Interface) *listener6, err error) {
+	chain4, chain6, err := plugins.LoadChains(config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	inst := newInstance(config.Name)
+	srv = &Servers{
+		log:    inst.log,
+		inst:   inst,
+		errors: make(chan error),
+	}
+	for _, c := range []*plugins.Chain{chain4, chain6} {
+		if c != nil {
+			srv.chains = append(srv.chains, c)
+		}
+	}
+
+	var timers4, timers6 *timerCheck
+	if config.Server4 != nil {
+		timers4 = newTimerCheck(config.Server4.Timers)
+		srv.timers = append(srv.timers, timers4)
+	}
+	if config.Server6 != nil {
+		timers6 = newTimerCheck(config.Server6.Timers)
+		srv.timers = append(srv.timers, timers6)
+	}
+
+	if config.Server6 != nil {
+		srv.load6 = newLoadShedder(config.Server6.LoadShedding)
+		srv.overLimits6 = newLimitCounter()
+		clients6 := newClientLocks(config.Server6.ClientLockStripes)
+		srv.clients = append(srv.clients, clients6)
+		template := listener6{
+			instance:   inst,
+			handlers:   chain6.Handlers6,
+			load:       srv.load6,
+			limits:     withDefaults(config.Server6.Limits),
+			overLimits: srv.overLimits6,
+			timeout:    requestTimeout(config.Server6.RequestTimeout),
+			unicast:    config.Server6.Unicast,
+			serverID:   chain6.ServerID,
+			clients:    clients6,
+			timers:     timers6,
+		}
+		if chain4 != nil {
+			template.handlers4, template.timers4 = chain4.Handlers4, timers4
+		}
+		var rec *recorder
+		if config.Server6.Record != nil {
+			if rec, err = newRecorder(config.Server6.Record); err != nil {
+				srv.Close()
+				return nil, nil, nil, err
+			}
+			srv.recorders = append(srv.recorders, rec)
+		}
+		new6 = func(conn PacketConn6, ifi net.Interface) *listener6 {
+			l6 := template
+			if rec != nil {
+				conn = &recordingConn6{PacketConn6: conn, r: rec}
+			}
+			l6.PacketConn6, l6.Interface = conn, ifi
+			return &l6
+		}
+	}
+
+	if config.Server4 != nil {
+		srv.load4 = newLoadShedder(config.Server4.LoadShedding)
+		srv.overLimits4 = newLimitCounter()
+		clients4 := newClientLocks(config.Server4.ClientLockStripes)
+		srv.clients = append(srv.clients, clients4)
+		template := listener4{
+			instance:   inst,
+			handlers:   chain4.Handlers4,
+			load:       srv.load4,
+			limits:     withDefaults(config.Server4.Limits),
+			overLimits: srv.overLimits4,
+			timeout:    requestTimeout(config.Server4.RequestTimeout),
+			clients:    clients4,
+			timers:     timers4,
+		}
+		var rec *recorder
+		if config.Server4.Record != nil {
+			if rec, err = newRecorder(config.Server4.Record); err != nil {
+				srv.Close()
+				return nil, nil, nil, err
+			}
+			srv.recorders = append(srv.recorders, rec)
+		}
+		new4 = func(conn PacketConn4, ifi net.Interface) *listener4 {
+			l4 := template
+			if rec != nil {
+				conn = &recordingConn4{PacketConn4: conn, r: rec}
+			}
+			l4.PacketConn4, l4.Interface = conn, ifi
+			return &l4
+		}
+	}
+	return srv, new4, new6, nil
+}
+
 // Start will start the server asynchronously. See `Wait` to wait until
 // the execution ends.
 func Start(config *config.Config) (*Servers, error) {
-	handlers4, handlers6, err := plugins.LoadPlugins(config)
+	srv, new4, new6, err := newServers(config)
 	if err != nil {
 		return nil, err
 	}
-	srv := Servers{
-		errors: make(chan error),
-	}
 
 	// listen
-	if config.Server6 != nil {
-		log.Println("Starting DHCPv6 server")
+	if new6 != nil {
+		srv.log.Println("Starting DHCPv6 server")
 		for _, addr := range config.Server6.Addresses {
 			var l6 *listener6
-			l6, err = listen6(&addr)
+			l6, err = listen6(&addr, config.Server6.Socket)
 			if err != nil {
 				goto cleanup
 			}
-			l6.handlers = handlers6
-			srv.listeners = append(srv.listeners, l6)
-			go func() {
-				srv.errors <- l6.Serve()
-			}()
+			srv.serve6(new6(l6.PacketConn6, l6.Interface))
 		}
 	}
 
-	if config.Server4 != nil {
-		log.Println("Starting DHCPv4 server")
+	if new4 != nil {
+		srv.log.Println("Starting DHCPv4 server")
 		for _, addr := range config.Server4.Addresses {
 			var l4 *listener4
-			l4, err = listen4(&addr)
+			l4, err = listen4(&addr, config.Server4.Socket)
 			if err != nil {
 				goto cleanup
 			}
-			l4.handlers = handlers4
-			srv.listeners = append(srv.listeners, l4)
-			go func() {
-				srv.errors <- l4.Serve()
-			}()
+			srv.serve4(new4(l4.PacketConn4, l4.Interface))
 		}
 	}
 
-	return &srv, nil
+	return srv, nil
 
 cleanup:
 	srv.Close()
 	return nil, err
 }
 
+// StartConns is like Start, but serves requests from the given connections
+// instead of listening on the addresses from the configuration, which are
+// ignored. Together with MemConn4 and MemConn6, this allows running the full
+// server and plugin chain in-process, without privileges
+func StartConns(config *config.Config, conns4 []PacketConn4, conns6 []PacketConn6) (*Servers, error) {
+	if len(conns4) > 0 && config.Server4 == nil {
+		return nil, errors.New("DHCPv4 connections given without a DHCPv4 server configured")
+	}
+	if len(conns6) > 0 && config.Server6 == nil {
+		return nil, errors.New("DHCPv6 connections given without a DHCPv6 server configured")
+	}
+	srv, new4, new6, err := newServers(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range conns6 {
+		srv.serve6(new6(c, net.Interface{}))
+	}
+	for _, c := range conns4 {
+		srv.serve4(new4(c, net.Interface{}))
+	}
+	return srv, nil
+}
+
+func (s *Servers) serve6(l6 *listener6) {
+	s.listeners = append(s.listeners, l6)
+	s.inst.running.Add(1)
+	go func() {
+		err := l6.Serve()
+		s.inst.running.Done()
+		s.errors <- err
+	}()
+}
+
+func (s *Servers) serve4(l4 *listener4) {
+	s.listeners = append(s.listeners, l4)
+	s.inst.running.Add(1)
+	go func() {
+		err := l4.Serve()
+		s.inst.running.Done()
+		s.errors <- err
+	}()
+}
+
 // Wait waits until the end of the execution of the server.
 func (s *Servers) Wait() error {
-	log.Debug("Waiting")
+	s.log.Debug("Waiting")
 	err := <-s.errors
 	s.Close()
 	return err
 }
 
-// Close closes all listening connections
+// Panics returns the number of panics recovered from in the plugins
+func (s *Servers) Panics() uint64 {
+	var n uint64
+	for _, c := range s.chains {
+		n += c.Panics()
+	}
+	return n
+}
+
+// Disabled returns the plugins disabled for panicking too often, e.g.
+// "DHCPv4: range". The server is degraded when it is not empty
+func (s *Servers) Disabled() []string {
+	var names []string
+	for _, c := range s.chains {
+		names = append(names, c.Disabled()...)
+	}
+	return names
+}
+
+// Timers returns the number of responses whose renewal timers were
+// inconsistent with their lease times, and were fixed or dropped
+func (s *Servers) Timers() (fixed, dropped uint64) {
+	for _, t := range s.timers {
+		f, d := t.counts()
+		fixed, dropped = fixed+f, dropped+d
+	}
+	return fixed, dropped
+}
+
+// ClientWaits returns the number of requests that waited for another request
+// from the same client to be handled, and the total time they waited
+func (s *Servers) ClientWaits() (waits uint64, waited time.Duration) {
+	for _, c := range s.clients {
+		n, d := c.counts()
+		waits, waited = waits+n, waited+d
+	}
+	return waits, waited
+}
+
+// Limited returns the numbers of requests the DHCPv4 and DHCPv6 servers dropped
+// for exceeding their limits, by limit. They are nil for the servers not
+// configured
+func (s *Servers) Limited() (v4, v6 LimitCounts) {
+	if s.overLimits4 != nil {
+		v4 = s.overLimits4.counts()
+	}
+	if s.overLimits6 != nil {
+		v6 = s.overLimits6.counts()
+	}
+	return v4, v6
+}
+
+// Deadlines returns the number of requests the servers dropped for not being
+// handled in time, by the stage of their handling they were in: decoding them
+// before the plugins ran, running the plugins, or sending the response
+func (s *Servers) Deadlines() (decode, plugins, send uint64) {
+	return atomic.LoadUint64(&s.inst.missed[stageDecode]),
+		atomic.LoadUint64(&s.inst.missed[stagePlugins]),
+		atomic.LoadUint64(&s.inst.missed[stageSend])
+}
+
+// Shed returns the numbers of requests from new clients the DHCPv4 and DHCPv6
+// servers shed while they were overloaded
+func (s *Servers) Shed() (v4, v6 ShedCounts) {
+	return s.load4.counts(), s.load6.counts()
+}
+
+// Close closes all listening connections, waits for the requests being
+// handled, and closes the recordings, then the plugins, which write out the
+// state they buffer
 func (s *Servers) Close() {
 	for _, srv := range s.listeners {
 		if srv != nil {
 			srv.Close()
 		}
 	}
+	s.inst.running.Wait()
+	for _, rec := range s.recorders {
+		rec.Close()
+	}
+	for _, c := range s.chains {
+		if err := c.Close(); err != nil {
+			s.log.Errorf("Could not close the plugins: %v", err)
+		}
+	}
 }
@@ -0,0 +1,682 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/internal/testpackets"
+	"github.com/coredhcp/coredhcp/plugins"
+	rangeplugin "github.com/coredhcp/coredhcp/plugins/range"
+	"github.com/coredhcp/coredhcp/plugins/serverid"
+	"github.com/coredhcp/coredhcp/plugins/sleep"
+	"github.com/coredhcp/coredhcp/plugins/v6only"
+)
+
+var registerOnce sync.Once
+
+// panickyMAC is the client the "panicky" test plugin panics on
+var panickyMAC = net.HardwareAddr{0xde, 0xad, 0xbe, 0xef, 0x00, 0x66}
+
+var panickyPlugin = plugins.Plugin{
+	Name: "panicky",
+	Setup4: func(args ...string) (handler.Handler4, error) {
+		return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+			if req.ClientHWAddr.String() == panickyMAC.String() {
+				panic("malformed request")
+			}
+			return resp, false
+		}, nil
+	},
+}
+
+func registerTestPlugins(t *testing.T) {
+	registerOnce.Do(func() {
+		require.NoError(t, plugins.RegisterPlugin(&serverid.Plugin))
+		require.NoError(t, plugins.RegisterPlugin(&sleep.Plugin))
+		require.NoError(t, plugins.RegisterPlugin(&panickyPlugin))
+		require.NoError(t, plugins.RegisterPlugin(&rangeplugin.Plugin))
+	})
+}
+
+var memServerConfig = config.Config{
+	Server6: &config.ServerConfig{
+		Plugins: []config.PluginConfig{
+			{Name: "server_id", Args: []string{"LL", "11:22:33:44:55:66"}},
+		},
+	},
+	Server4: &config.ServerConfig{
+		Plugins: []config.PluginConfig{
+			{Name: "server_id", Args: []string{"192.0.2.1"}},
+		},
+	},
+}
+
+// TestMemDora runs the server on in-memory connections and checks that it
+// answers a SOLICIT and a DISCOVER
+func TestMemDora(t *testing.T) {
+	registerTestPlugins(t)
+
+	conn6 := NewMemConn6(&net.UDPAddr{IP: dhcpv6.AllDHCPRelayAgentsAndServers, Port: dhcpv6.DefaultServerPort})
+	conn4 := NewMemConn4(&net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ServerPort})
+	srv, err := StartConns(&memServerConfig, []PacketConn4{conn4}, []PacketConn6{conn6})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	mac, err := net.ParseMAC("de:ad:be:ef:00:00")
+	require.NoError(t, err)
+
+	t.Run("solicit", func(t *testing.T) {
+		solicit, err := dhcpv6.NewSolicit(mac)
+		require.NoError(t, err)
+		client := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: dhcpv6.DefaultClientPort}
+		require.NoError(t, conn6.Inject(solicit.ToBytes(), client, 1))
+
+		b, peer, ifIndex, err := conn6.Sent(time.Second)
+		require.NoError(t, err)
+		require.True(t, peer.IP.Equal(client.IP), "response sent to %s instead of %s", peer, client)
+		require.Equal(t, 1, ifIndex, "link-local response not sent on the receiving interface")
+
+		resp, err := dhcpv6.FromBytes(b)
+		require.NoError(t, err)
+		require.Equal(t, dhcpv6.MessageTypeAdvertise, resp.Type())
+		sid := resp.(*dhcpv6.Message).Options.ServerID()
+		require.NotNil(t, sid, "response has no server ID")
+		require.True(t, sid.Equal(dhcpv6.Duid{
+			Type:          dhcpv6.DUID_LL,
+			HwType:        iana.HWTypeEthernet,
+			LinkLayerAddr: net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66},
+		}), "unexpected server ID %s", sid)
+	})
+
+	t.Run("information-request", func(t *testing.T) {
+		// Without a client identifier, which is optional in this message
+		req, err := dhcpv6.NewMessage()
+		require.NoError(t, err)
+		req.MessageType = dhcpv6.MessageTypeInformationRequest
+		client := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: dhcpv6.DefaultClientPort}
+		require.NoError(t, conn6.Inject(req.ToBytes(), client, 1))
+
+		b, _, _, err := conn6.Sent(time.Second)
+		require.NoError(t, err)
+		resp, err := dhcpv6.FromBytes(b)
+		require.NoError(t, err)
+		require.Equal(t, dhcpv6.MessageTypeReply, resp.Type())
+		require.Nil(t, resp.GetOneOption(dhcpv6.OptionClientID))
+		require.NotNil(t, resp.(*dhcpv6.Message).Options.ServerID(), "response has no server ID")
+	})
+
+	t.Run("discover", func(t *testing.T) {
+		discover, err := dhcpv4.NewDiscovery(mac, dhcpv4.WithBroadcast(true))
+		require.NoError(t, err)
+		client := &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ClientPort}
+		require.NoError(t, conn4.Inject(discover.ToBytes(), client, 1))
+
+		b, peer, ifIndex, err := conn4.Sent(time.Second)
+		require.NoError(t, err)
+		require.True(t, peer.IP.Equal(net.IPv4bcast), "broadcast response sent to %s", peer)
+		require.Equal(t, dhcpv4.ClientPort, peer.Port)
+		require.Equal(t, 1, ifIndex, "broadcast response not sent on the receiving interface")
+
+		resp, err := dhcpv4.FromBytes(b)
+		require.NoError(t, err)
+		require.Equal(t, dhcpv4.MessageTypeOffer, resp.MessageType())
+		require.Equal(t, discover.TransactionID, resp.TransactionID)
+		require.True(t, resp.ServerIdentifier().Equal(net.IPv4(192, 0, 2, 1)),
+			"unexpected server identifier %s", resp.ServerIdentifier())
+	})
+}
+
+// TestMemIsolatedInstances runs the two named instances of a configuration
+// file in the same process, and checks that each answers with its own server
+// ID and logs with its own name
+func TestMemIsolatedInstances(t *testing.T) {
+	registerTestPlugins(t)
+
+	f, err := ioutil.TempFile("", "coredhcp-*.yml")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`instances:
+    customer-a:
+        server4:
+            plugins:
+                - server_id: 192.0.2.1
+    customer-b:
+        server4:
+            plugins:
+                - server_id: 198.51.100.1
+`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	confs, err := config.LoadInstances(f.Name())
+	require.NoError(t, err)
+	require.Len(t, confs, 2)
+
+	serverIDs := []net.IP{net.IPv4(192, 0, 2, 1).To4(), net.IPv4(198, 51, 100, 1).To4()}
+	conns := make([]*MemConn4, len(confs))
+	for i, conf := range confs {
+		conns[i] = NewMemConn4(&net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ServerPort})
+		srv, err := StartConns(conf, []PacketConn4{conns[i]}, nil)
+		require.NoError(t, err)
+		defer srv.Close()
+		require.Equal(t, conf.Name, srv.log.Data["instance"])
+	}
+
+	mac, err := net.ParseMAC("de:ad:be:ef:00:01")
+	require.NoError(t, err)
+	for i, sid := range serverIDs {
+		discover, err := dhcpv4.NewDiscovery(mac, dhcpv4.WithBroadcast(true))
+		require.NoError(t, err)
+		require.NoError(t, conns[i].Inject(discover.ToBytes(), &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ClientPort}, 1))
+
+		b, _, _, err := conns[i].Sent(time.Second)
+		require.NoError(t, err)
+		resp, err := dhcpv4.FromBytes(b)
+		require.NoError(t, err)
+		require.True(t, resp.ServerIdentifier().Equal(sid),
+			"instance %s answered with server identifier %s, expected %s", confs[i].Name, resp.ServerIdentifier(), sid)
+		// Nothing leaks to the other instance
+		_, _, _, err = conns[1-i].Sent(50 * time.Millisecond)
+		require.Error(t, err, "instance %s answered a request sent to the other one", confs[1-i].Name)
+	}
+}
+
+// TestMemLoadShedding keeps the server busy with a slow plugin chain, and
+// checks that new clients are shed while clients that have been retrying for a
+// while are still served
+func TestMemLoadShedding(t *testing.T) {
+	registerTestPlugins(t)
+
+	conf := config.Config{
+		Server4: &config.ServerConfig{
+			Plugins: []config.PluginConfig{
+				{Name: "server_id", Args: []string{"192.0.2.1"}},
+				{Name: "sleep", Args: []string{"300ms"}},
+			},
+			LoadShedding: &config.LoadSheddingConfig{MaxInFlight: 2, MinSecs: 5 * time.Second},
+		},
+	}
+	conn := NewMemConn4(&net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ServerPort})
+	srv, err := StartConns(&conf, []PacketConn4{conn}, nil)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	mac, err := net.ParseMAC("de:ad:be:ef:00:02")
+	require.NoError(t, err)
+	served := make(map[dhcpv4.TransactionID]bool)
+	// The first two fit under the watermark, the third is a new client over
+	// it, the last one has been retrying long enough
+	for i, secs := range []uint16{0, 0, 0, 10} {
+		discover, err := dhcpv4.NewDiscovery(mac, dhcpv4.WithBroadcast(true))
+		require.NoError(t, err)
+		discover.NumSeconds = secs
+		served[discover.TransactionID] = i != 2
+		require.NoError(t, conn.Inject(discover.ToBytes(), &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ClientPort}, 1))
+	}
+
+	for i := 0; i < 3; i++ {
+		b, _, _, err := conn.Sent(time.Second)
+		require.NoError(t, err)
+		resp, err := dhcpv4.FromBytes(b)
+		require.NoError(t, err)
+		require.True(t, served[resp.TransactionID], "request %s should have been shed", resp.TransactionID)
+		delete(served, resp.TransactionID)
+	}
+	_, _, _, err = conn.Sent(500 * time.Millisecond)
+	require.Equal(t, ErrMemConnTimeout, err, "new client served while over the watermark")
+}
+
+// TestMemPluginPanic checks that a plugin panicking on a request only drops
+// that request, or skips the plugin, and the server keeps serving
+func TestMemPluginPanic(t *testing.T) {
+	registerTestPlugins(t)
+
+	for _, tc := range []struct {
+		action config.PanicAction
+		// answered tells whether the request causing the panic is answered
+		answered bool
+	}{
+		{config.PanicDrop, false},
+		{config.PanicSkip, true},
+	} {
+		conf := config.Config{
+			Server4: &config.ServerConfig{
+				Plugins: []config.PluginConfig{
+					{Name: "panicky"},
+					{Name: "server_id", Args: []string{"192.0.2.1"}},
+				},
+				PluginPanics: config.PanicPolicy{Action: tc.action},
+			},
+		}
+		conn := NewMemConn4(&net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ServerPort})
+		srv, err := StartConns(&conf, []PacketConn4{conn}, nil)
+		require.NoError(t, err)
+		defer srv.Close()
+
+		client := &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ClientPort}
+		discover, err := dhcpv4.NewDiscovery(panickyMAC, dhcpv4.WithBroadcast(true))
+		require.NoError(t, err)
+		require.NoError(t, conn.Inject(discover.ToBytes(), client, 1))
+		_, _, _, err = conn.Sent(300 * time.Millisecond)
+		if tc.answered {
+			require.NoError(t, err)
+		} else {
+			require.Equal(t, ErrMemConnTimeout, err, "request answered after the plugin panicked")
+		}
+
+		mac, err := net.ParseMAC("de:ad:be:ef:00:07")
+		require.NoError(t, err)
+		discover, err = dhcpv4.NewDiscovery(mac, dhcpv4.WithBroadcast(true))
+		require.NoError(t, err)
+		require.NoError(t, conn.Inject(discover.ToBytes(), client, 1))
+		b, _, _, err := conn.Sent(time.Second)
+		require.NoError(t, err)
+		resp, err := dhcpv4.FromBytes(b)
+		require.NoError(t, err)
+		require.Equal(t, discover.TransactionID, resp.TransactionID)
+		// Only the panics of this server are counted
+		require.Equal(t, uint64(1), srv.Panics())
+	}
+}
+
+// TestMemRequestTimeout checks that the server stops handling a request, and
+// does not respond, once its deadline has passed
+func TestMemRequestTimeout(t *testing.T) {
+	registerTestPlugins(t)
+
+	conf := config.Config{
+		Server4: &config.ServerConfig{
+			Plugins: []config.PluginConfig{
+				{Name: "sleep", Args: []string{"200ms"}},
+				{Name: "server_id", Args: []string{"192.0.2.1"}},
+			},
+			RequestTimeout: 100 * time.Millisecond,
+		},
+	}
+	conn := NewMemConn4(&net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ServerPort})
+	srv, err := StartConns(&conf, []PacketConn4{conn}, nil)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	mac, err := net.ParseMAC("de:ad:be:ef:00:03")
+	require.NoError(t, err)
+	discover, err := dhcpv4.NewDiscovery(mac, dhcpv4.WithBroadcast(true))
+	require.NoError(t, err)
+	require.NoError(t, conn.Inject(discover.ToBytes(), &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ClientPort}, 1))
+
+	_, _, _, err = conn.Sent(500 * time.Millisecond)
+	require.Equal(t, ErrMemConnTimeout, err, "response sent after the request deadline")
+	decode, plugins, send := srv.Deadlines()
+	require.Equal(t, []uint64{0, 1, 0}, []uint64{decode, plugins, send}, "requests past their deadline by stage")
+}
+
+// TestMemRequestTimeoutWaiting checks that a request that waited past its
+// deadline for another request from the same client is dropped before the
+// plugins run, and counted so
+func TestMemRequestTimeoutWaiting(t *testing.T) {
+	registerTestPlugins(t)
+
+	conf := config.Config{
+		Server4: &config.ServerConfig{
+			Plugins: []config.PluginConfig{
+				{Name: "server_id", Args: []string{"192.0.2.1"}},
+				{Name: "sleep", Args: []string{"150ms"}},
+			},
+			RequestTimeout:    100 * time.Millisecond,
+			ClientLockStripes: 1,
+		},
+	}
+	conn := NewMemConn4(&net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ServerPort})
+	srv, err := StartConns(&conf, []PacketConn4{conn}, nil)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	_, raw := testpackets.V4Discover(t, nil, dhcpv4.WithBroadcast(true))
+	client := &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ClientPort}
+	require.NoError(t, conn.Inject(raw, client, 1))
+	require.NoError(t, conn.Inject(raw, client, 1))
+	_, _, _, err = conn.Sent(500 * time.Millisecond)
+	require.Equal(t, ErrMemConnTimeout, err, "response sent after the request deadline")
+	decode, plugins, send := srv.Deadlines()
+	require.Equal(t, []uint64{1, 1, 0}, []uint64{decode, plugins, send}, "requests past their deadline by stage")
+}
+
+func TestPastDeadline(t *testing.T) {
+	inst := newInstance("")
+	require.False(t, inst.pastDeadline(time.Now().Add(time.Minute), "test", stageSend, 0))
+	require.True(t, inst.pastDeadline(time.Now(), "test", stageSend, 0))
+	require.True(t, inst.pastDeadline(time.Now(), "test", stagePlugins, 2))
+	decode, plugins, send := (&Servers{inst: inst}).Deadlines()
+	require.Equal(t, []uint64{0, 1, 1}, []uint64{decode, plugins, send})
+}
+
+// TestHandlerContext checks that the handlers can see the deadline of the
+// request they handle, and only while they handle it
+func TestHandlerContext(t *testing.T) {
+	inst := newInstance("")
+	req, _ := testpackets.V4Discover(t, nil)
+	deadline := time.Now().Add(time.Minute)
+	var seen time.Time
+	handlers := []handler.Handler4{func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		seen, _ = handler.Context4(req).Deadline()
+		return resp, false
+	}}
+	_, ok := inst.process4(handlers, &timerCheck{}, req, deadline)
+	require.True(t, ok)
+	require.True(t, deadline.Equal(seen), "handler saw deadline %s", seen)
+	_, ok = handler.Context4(req).Deadline()
+	require.False(t, ok, "the context of the request outlived its handling")
+}
+
+// TestMemCloseFlushes checks that closing the server writes out the lease
+// renewals the range plugin buffers
+func TestMemCloseFlushes(t *testing.T) {
+	registerTestPlugins(t)
+
+	// A client whose lease renewals are buffered
+	mac := net.HardwareAddr{0xde, 0xad, 0xbe, 0xef, 0x00, 0x10}
+	ip := net.IPv4(192, 0, 2, 100)
+	leases, err := ioutil.TempFile("", "coredhcp-close")
+	require.NoError(t, err)
+	defer os.Remove(leases.Name())
+	_, err = fmt.Fprintf(leases, "%s %s %s\n", mac, ip, time.Now().Add(time.Minute).Format(time.RFC3339))
+	require.NoError(t, err)
+	leases.Close()
+	conf := config.Config{
+		Server4: &config.ServerConfig{
+			Plugins: []config.PluginConfig{
+				{Name: "server_id", Args: []string{"192.0.2.1"}},
+				{Name: "range", Args: []string{leases.Name(), "192.0.2.100", "192.0.2.110", "1h", "1h", "10"}},
+			},
+		},
+	}
+	conn := NewMemConn4(&net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ServerPort})
+	srv, err := StartConns(&conf, []PacketConn4{conn}, nil)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	written := func() []string {
+		b, err := ioutil.ReadFile(leases.Name())
+		require.NoError(t, err)
+		return strings.SplitAfter(strings.TrimSuffix(string(b), "\n"), "\n")
+	}
+	renew, _ := testpackets.V4RequestRenewing(t, mac, ip)
+	require.NoError(t, conn.Inject(renew.ToBytes(), &net.UDPAddr{IP: ip, Port: dhcpv4.ClientPort}, 1))
+	_, _, _, err = conn.Sent(time.Second)
+	require.NoError(t, err)
+	require.Len(t, written(), 1, "renewal not buffered")
+
+	srv.Close()
+	require.Len(t, written(), 2, "buffered renewal lost at shutdown")
+}
+
+// TestMemCloseWaits checks that closing the server waits for the requests being
+// handled before closing the plugins, so that their leases are still stored
+func TestMemCloseWaits(t *testing.T) {
+	registerTestPlugins(t)
+
+	mac := net.HardwareAddr{0xde, 0xad, 0xbe, 0xef, 0x00, 0x11}
+	ip := net.IPv4(192, 0, 2, 100)
+	leases, err := ioutil.TempFile("", "coredhcp-close-waits")
+	require.NoError(t, err)
+	defer os.Remove(leases.Name())
+	_, err = fmt.Fprintf(leases, "%s %s %s\n", mac, ip, time.Now().Add(time.Minute).Format(time.RFC3339))
+	require.NoError(t, err)
+	leases.Close()
+	conf := config.Config{
+		Server4: &config.ServerConfig{
+			Plugins: []config.PluginConfig{
+				{Name: "sleep", Args: []string{"100ms"}},
+				{Name: "server_id", Args: []string{"192.0.2.1"}},
+				{Name: "range", Args: []string{leases.Name(), "192.0.2.100", "192.0.2.110", "1h"}},
+			},
+		},
+	}
+	conn := NewMemConn4(&net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ServerPort})
+	srv, err := StartConns(&conf, []PacketConn4{conn}, nil)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	renew, _ := testpackets.V4RequestRenewing(t, mac, ip)
+	require.NoError(t, conn.Inject(renew.ToBytes(), &net.UDPAddr{IP: ip, Port: dhcpv4.ClientPort}, 1))
+	// Close while the request is held up in the sleep plugin
+	time.Sleep(20 * time.Millisecond)
+	srv.Close()
+
+	b, err := ioutil.ReadFile(leases.Name())
+	require.NoError(t, err)
+	require.Len(t, strings.SplitAfter(strings.TrimSuffix(string(b), "\n"), "\n"), 2, "renewal handled during shutdown not stored")
+}
+
+// TestMemUnicast checks that RENEWs unicast to the server are refused with
+// UseMulticast unless the server advertises a unicast address
+func TestMemUnicast(t *testing.T) {
+	registerTestPlugins(t)
+
+	serverAddr := net.ParseIP("2001:db8::1")
+	client := &net.UDPAddr{IP: net.ParseIP("2001:db8::100"), Port: dhcpv6.DefaultClientPort}
+	serverID := dhcpv6.Duid{
+		Type:          dhcpv6.DUID_LL,
+		HwType:        iana.HWTypeEthernet,
+		LinkLayerAddr: net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66},
+	}
+	renew, _ := testpackets.V6Solicit(t, nil)
+	renew.MessageType = dhcpv6.MessageTypeRenew
+	renew.AddOption(dhcpv6.OptServerID(serverID))
+
+	for _, tc := range []struct {
+		name    string
+		unicast net.IP
+		dst     net.IP
+		status  bool
+	}{
+		{"multicast", nil, dhcpv6.AllDHCPRelayAgentsAndServers, false},
+		{"unknown destination", nil, nil, false},
+		{"unicast not allowed", nil, serverAddr, true},
+		{"unicast allowed", serverAddr, serverAddr, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s6 := *memServerConfig.Server6
+			s6.Unicast = tc.unicast
+			conn := NewMemConn6(&net.UDPAddr{IP: net.IPv6unspecified, Port: dhcpv6.DefaultServerPort})
+			srv, err := StartConns(&config.Config{Server6: &s6}, nil, []PacketConn6{conn})
+			require.NoError(t, err)
+			defer srv.Close()
+
+			require.NoError(t, conn.InjectTo(renew.ToBytes(), client, tc.dst, 1))
+			b, _, _, err := conn.Sent(time.Second)
+			require.NoError(t, err)
+			resp, err := dhcpv6.FromBytes(b)
+			require.NoError(t, err)
+			require.Equal(t, dhcpv6.MessageTypeReply, resp.Type())
+
+			status := resp.GetOneOption(dhcpv6.OptionStatusCode)
+			if tc.status {
+				require.NotNil(t, status, "no status code in the reply")
+				require.Equal(t, []byte{0, byte(iana.StatusUseMulticast)}, status.ToBytes()[:2])
+				require.NotNil(t, resp.GetOneOption(dhcpv6.OptionServerID), "no server ID in the reply")
+			} else {
+				require.Nil(t, status, "unexpected status code %s", status)
+			}
+
+			unicast := resp.GetOneOption(dhcpv6.OptionUnicast)
+			if tc.unicast != nil {
+				require.NotNil(t, unicast, "server unicast option not sent")
+				require.Equal(t, []byte(tc.unicast.To16()), unicast.ToBytes())
+			} else {
+				require.Nil(t, unicast, "unexpected server unicast option")
+			}
+		})
+	}
+}
+
+// TestMemUnicastOtherServer checks that messages unicast to another server are
+// dropped rather than answered with UseMulticast
+func TestMemUnicastOtherServer(t *testing.T) {
+	registerTestPlugins(t)
+
+	serverAddr := net.ParseIP("2001:db8::1")
+	client := &net.UDPAddr{IP: net.ParseIP("2001:db8::100"), Port: dhcpv6.DefaultClientPort}
+	renew, _ := testpackets.V6Solicit(t, nil)
+	renew.MessageType = dhcpv6.MessageTypeRenew
+	renew.AddOption(dhcpv6.OptServerID(dhcpv6.Duid{
+		Type:          dhcpv6.DUID_LL,
+		HwType:        iana.HWTypeEthernet,
+		LinkLayerAddr: net.HardwareAddr{0x66, 0x55, 0x44, 0x33, 0x22, 0x11},
+	}))
+
+	conn := NewMemConn6(&net.UDPAddr{IP: net.IPv6unspecified, Port: dhcpv6.DefaultServerPort})
+	srv, err := StartConns(&config.Config{Server6: memServerConfig.Server6}, nil, []PacketConn6{conn})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	require.NoError(t, conn.InjectTo(renew.ToBytes(), client, serverAddr, 1))
+	_, _, _, err = conn.Sent(500 * time.Millisecond)
+	require.Equal(t, ErrMemConnTimeout, err, "message for another server answered")
+}
+
+// TestMemSerializeClients sends the same DISCOVER on two listeners, and checks
+// the second one is only handled once the first is done
+func TestMemSerializeClients(t *testing.T) {
+	registerTestPlugins(t)
+
+	conf := config.Config{
+		Server4: &config.ServerConfig{
+			Plugins: []config.PluginConfig{
+				{Name: "sleep", Args: []string{"100ms"}},
+				{Name: "server_id", Args: []string{"192.0.2.1"}},
+			},
+			ClientLockStripes: 16,
+		},
+	}
+	conns := []*MemConn4{
+		NewMemConn4(&net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ServerPort}),
+		NewMemConn4(&net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ServerPort}),
+	}
+	srv, err := StartConns(&conf, []PacketConn4{conns[0], conns[1]}, nil)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	discover, raw := testpackets.V4Discover(t, nil, dhcpv4.WithBroadcast(true))
+	client := &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ClientPort}
+	start := time.Now()
+	for _, conn := range conns {
+		require.NoError(t, conn.Inject(raw, client, 1))
+	}
+	var replies []*dhcpv4.DHCPv4
+	for _, conn := range conns {
+		b, _, _, err := conn.Sent(time.Second)
+		require.NoError(t, err)
+		resp, err := dhcpv4.FromBytes(b)
+		require.NoError(t, err)
+		require.Equal(t, discover.TransactionID, resp.TransactionID)
+		replies = append(replies, resp)
+	}
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(200*time.Millisecond),
+		"duplicate requests were handled concurrently")
+	require.Equal(t, replies[0].ToBytes(), replies[1].ToBytes(), "duplicate requests got different replies")
+	waits, waited := srv.ClientWaits()
+	require.Equal(t, uint64(1), waits)
+	require.GreaterOrEqual(t, int64(waited), int64(50*time.Millisecond), "the duplicate did not wait for the first request")
+}
+
+// TestMemDHCPv4o6 sends a DISCOVER in a DHCPV4-QUERY, directly and through a
+// relay, and checks the DHCPv4 plugins answer it in a DHCPV4-RESPONSE
+func TestMemDHCPv4o6(t *testing.T) {
+	registerTestPlugins(t)
+
+	conn6 := NewMemConn6(&net.UDPAddr{IP: dhcpv6.AllDHCPRelayAgentsAndServers, Port: dhcpv6.DefaultServerPort})
+	srv, err := StartConns(&memServerConfig, nil, []PacketConn6{conn6})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	discover, _ := testpackets.V4Discover(t, nil)
+	query, err := dhcpv6.NewMessage()
+	require.NoError(t, err)
+	query.MessageType = dhcpv6.MessageTypeDHCPv4Query
+	query.AddOption(&dhcpv6.OptDHCPv4Msg{Msg: discover})
+	relayed, _ := testpackets.RelayWrap(t, query, 1, net.ParseIP("2001:db8::1"), net.ParseIP("fe80::1"))
+
+	for _, tc := range []struct {
+		name string
+		req  dhcpv6.DHCPv6
+	}{
+		{"direct", query},
+		{"relayed", relayed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: dhcpv6.DefaultClientPort}
+			require.NoError(t, conn6.Inject(tc.req.ToBytes(), client, 1))
+			b, _, _, err := conn6.Sent(time.Second)
+			require.NoError(t, err)
+			d, err := dhcpv6.FromBytes(b)
+			require.NoError(t, err)
+			require.Equal(t, tc.req.IsRelay(), d.IsRelay(), "relayed queries should get relayed responses")
+
+			msg, err := d.GetInnerMessage()
+			require.NoError(t, err)
+			require.Equal(t, dhcpv6.MessageTypeDHCPv4Response, msg.Type())
+			opt, ok := msg.GetOneOption(dhcpv6.OptionDHCPv4Msg).(*dhcpv6.OptDHCPv4Msg)
+			require.True(t, ok, "no DHCPv4 message in the response")
+			offer := opt.Msg
+			require.Equal(t, dhcpv4.MessageTypeOffer, offer.MessageType())
+			require.Equal(t, discover.TransactionID, offer.TransactionID)
+			require.True(t, offer.ServerIdentifier().Equal(net.IPv4(192, 0, 2, 1)), "DHCPv4 plugins did not run")
+		})
+	}
+}
+
+// TestProcess4Unconfirmed checks that a DHCPACK without an address is sent as
+// the plugins answered it: remaining silent for unknown INIT-REBOOT clients is
+// up to the plugins granting leases
+func TestProcess4Unconfirmed(t *testing.T) {
+	passthrough := []handler.Handler4{func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		return resp, false
+	}}
+	deadline := time.Now().Add(time.Minute)
+	inst := newInstance("")
+
+	initReboot, _ := testpackets.V4RequestInitReboot(t, nil, net.IPv4(192, 0, 2, 100))
+	resp, ok := inst.process4(passthrough, newTimerCheck(config.TimersFix), initReboot, deadline)
+	require.True(t, ok)
+	require.NotNil(t, resp, "the server dropped a response of the plugins")
+}
+
+// TestProcess4V6Only checks that the DHCPACKs of the v6only plugin, which carry
+// no address, are sent to clients in the SELECTING and INIT-REBOOT states
+func TestProcess4V6Only(t *testing.T) {
+	// The IPv6-Only Preferred option, RFC8925
+	const optionIPv6OnlyPreferred = dhcpv4.GenericOptionCode(108)
+	h, err := v6only.Plugin.ChainSetup4(&plugins.Chain{}, "30m")
+	require.NoError(t, err)
+	handlers := []handler.Handler4{h}
+	deadline := time.Now().Add(time.Minute)
+	prl := dhcpv4.WithRequestedOptions(optionIPv6OnlyPreferred)
+	inst := newInstance("")
+
+	selecting, _ := testpackets.V4RequestSelecting(t, nil, net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 100), prl)
+	initReboot, _ := testpackets.V4RequestInitReboot(t, nil, net.IPv4(192, 0, 2, 100), prl)
+	for _, req := range []*dhcpv4.DHCPv4{selecting, initReboot} {
+		resp, ok := inst.process4(handlers, newTimerCheck(config.TimersFix), req, deadline)
+		require.True(t, ok)
+		require.NotNil(t, resp, "the DHCPACK with the IPv6-Only Preferred option was dropped")
+		require.Equal(t, dhcpv4.MessageTypeAck, resp.MessageType())
+		require.True(t, resp.Options.Has(optionIPv6OnlyPreferred))
+	}
+}
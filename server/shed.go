@@ -0,0 +1,140 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+
+	"github.com/coredhcp/coredhcp/config"
+)
+
+// loadShedder counts the requests being handled by the listeners of a server,
+// and decides which DISCOVER and SOLICIT to drop or delay when there are too
+// many. A nil *loadShedder never sheds
+type loadShedder struct {
+	// dropped and delayed are updated atomically, and kept first for
+	// alignment on 32-bit platforms
+	dropped  uint64
+	delayed  uint64
+	inFlight int32
+	// resumed is the number of requests in flight that were held back, and
+	// handled after their delay. They do not count against maxInFlight when
+	// other held requests resume, see shouldShed
+	resumed     int32
+	maxInFlight int32
+	minSecs     time.Duration
+	action      config.ShedAction
+	delay       time.Duration
+}
+
+// ShedCounts are the numbers of requests from new clients shed by a server
+// while it was overloaded, by what happened to them
+type ShedCounts struct {
+	// Dropped is the number of requests dropped
+	Dropped uint64
+	// Delayed is the number of requests delayed and then handled, see
+	// config.ShedDelay
+	Delayed uint64
+}
+
+func newLoadShedder(conf *config.LoadSheddingConfig) *loadShedder {
+	if conf == nil {
+		return nil
+	}
+	return &loadShedder{
+		maxInFlight: int32(conf.MaxInFlight),
+		minSecs:     conf.MinSecs,
+		action:      conf.Action,
+		delay:       conf.Delay,
+	}
+}
+
+// counts returns the numbers of requests shed so far
+func (s *loadShedder) counts() ShedCounts {
+	if s == nil {
+		return ShedCounts{}
+	}
+	return ShedCounts{Dropped: atomic.LoadUint64(&s.dropped), Delayed: atomic.LoadUint64(&s.delayed)}
+}
+
+// enter records a new request being handled, and returns the number of
+// requests being handled including this one
+func (s *loadShedder) enter() int32 {
+	if s == nil {
+		return 0
+	}
+	return atomic.AddInt32(&s.inFlight, 1)
+}
+
+// leave records the end of the handling of a request, resumed if it was
+// held back then handled
+func (s *loadShedder) leave(resumed bool) {
+	if s == nil {
+		return
+	}
+	if resumed {
+		atomic.AddInt32(&s.resumed, -1)
+	}
+	atomic.AddInt32(&s.inFlight, -1)
+}
+
+// shouldShed tells whether a request from a client that started trying elapsed
+// ago should be dropped, given the number of requests in flight when it was
+// received. With ShedDelay, it holds the request back first, unless that would
+// take it past deadline, and only drops it if the server is still overloaded
+// after the delay. Held requests do not count as load while they wait, nor
+// once they resume, so that a burst of them is not dropped for its own sake.
+// resumed tells whether the request was held then let through, for leave
+func (s *loadShedder) shouldShed(inFlight int32, elapsed time.Duration, deadline time.Time) (shed, resumed bool) {
+	if s == nil || inFlight <= s.maxInFlight || elapsed >= s.minSecs {
+		return false, false
+	}
+	if s.action == config.ShedDelay && time.Now().Add(s.delay).Before(deadline) {
+		s.leave(false)
+		time.Sleep(s.delay)
+		// The requests handled meanwhile, other than the held ones
+		now := atomic.LoadInt32(&s.inFlight) - atomic.LoadInt32(&s.resumed)
+		s.enter()
+		if now < s.maxInFlight {
+			atomic.AddInt32(&s.resumed, 1)
+			n := atomic.AddUint64(&s.delayed, 1)
+			log.Debugf("Delayed request from new client (%d in flight, then %d, elapsed %s, %d delayed so far)", inFlight, now, elapsed, n)
+			return false, true
+		}
+	}
+	n := atomic.AddUint64(&s.dropped, 1)
+	log.Debugf("Shedding request from new client (%d in flight, elapsed %s, %d shed so far)", inFlight, elapsed, n)
+	return true, false
+}
+
+// shed4 tells whether req should be dropped, see shouldShed
+func (s *loadShedder) shed4(req *dhcpv4.DHCPv4, inFlight int32, deadline time.Time) (shed, resumed bool) {
+	if s == nil || req.MessageType() != dhcpv4.MessageTypeDiscover {
+		return false, false
+	}
+	return s.shouldShed(inFlight, time.Duration(req.NumSeconds)*time.Second, deadline)
+}
+
+// shed6 tells whether msg, the innermost message of a request, should be
+// dropped, see shouldShed
+func (s *loadShedder) shed6(msg *dhcpv6.Message, inFlight int32, deadline time.Time) (shed, resumed bool) {
+	if s == nil || msg.MessageType != dhcpv6.MessageTypeSolicit {
+		return false, false
+	}
+	// The elapsed time is expressed in hundredths of a second, RFC8415 §21.9.
+	// A client that does not send it is considered new
+	var elapsed time.Duration
+	if opt := msg.GetOneOption(dhcpv6.OptionElapsedTime); opt != nil {
+		if b := opt.ToBytes(); len(b) == 2 {
+			elapsed = time.Duration(binary.BigEndian.Uint16(b)) * 10 * time.Millisecond
+		}
+	}
+	return s.shouldShed(inFlight, elapsed, deadline)
+}
@@ -0,0 +1,220 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/internal/testpackets"
+)
+
+func TestShouldShed(t *testing.T) {
+	s := newLoadShedder(&config.LoadSheddingConfig{MaxInFlight: 10, MinSecs: 4 * time.Second})
+	deadline := time.Now().Add(time.Minute)
+	for _, tc := range []struct {
+		inFlight int32
+		elapsed  time.Duration
+		shed     bool
+	}{
+		{1, 0, false},
+		{10, 0, false},
+		{11, 0, true},
+		{11, 3 * time.Second, true},
+		{11, 4 * time.Second, false},
+		{1000, time.Minute, false},
+	} {
+		shed, resumed := s.shouldShed(tc.inFlight, tc.elapsed, deadline)
+		assert.Equal(t, tc.shed, shed, "%d in flight, elapsed %s", tc.inFlight, tc.elapsed)
+		assert.False(t, resumed)
+	}
+	assert.Equal(t, ShedCounts{Dropped: 2}, s.counts())
+
+	var disabled *loadShedder
+	assert.Equal(t, int32(0), disabled.enter())
+	shed, _ := disabled.shouldShed(1000, 0, deadline)
+	assert.False(t, shed)
+	assert.Equal(t, ShedCounts{}, disabled.counts())
+}
+
+// sentIDs returns the transaction IDs of the responses conn sent until it sent
+// none for wait
+func sentIDs(t *testing.T, sent func(time.Duration) ([]byte, *net.UDPAddr, int, error), wait time.Duration, parse func([]byte) (string, error)) map[string]bool {
+	ids := make(map[string]bool)
+	for {
+		b, _, _, err := sent(wait)
+		if err == ErrMemConnTimeout {
+			return ids
+		}
+		require.NoError(t, err)
+		id, err := parse(b)
+		require.NoError(t, err)
+		ids[id] = true
+	}
+}
+
+// TestMemShedMessageTypes overloads the servers with a slow plugin chain, and
+// checks that only the DISCOVERs and SOLICITs of new clients are shed, and
+// counted by server
+func TestMemShedMessageTypes(t *testing.T) {
+	registerTestPlugins(t)
+
+	shedding := &config.LoadSheddingConfig{MaxInFlight: 1, MinSecs: 4 * time.Second}
+	conf := config.Config{
+		Server6: &config.ServerConfig{
+			Plugins: []config.PluginConfig{
+				{Name: "server_id", Args: []string{"LL", "11:22:33:44:55:66"}},
+				{Name: "sleep", Args: []string{"200ms"}},
+			},
+			LoadShedding: shedding,
+		},
+		Server4: &config.ServerConfig{
+			Plugins: []config.PluginConfig{
+				{Name: "server_id", Args: []string{"192.0.2.1"}},
+				{Name: "sleep", Args: []string{"200ms"}},
+			},
+			LoadShedding: shedding,
+		},
+	}
+	conn6 := NewMemConn6(&net.UDPAddr{IP: dhcpv6.AllDHCPRelayAgentsAndServers, Port: dhcpv6.DefaultServerPort})
+	conn4 := NewMemConn4(&net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ServerPort})
+	srv, err := StartConns(&conf, []PacketConn4{conn4}, []PacketConn6{conn6})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	t.Run("v4", func(t *testing.T) {
+		busy, _ := testpackets.V4Discover(t, nil, dhcpv4.WithBroadcast(true))
+		shed, _ := testpackets.V4Discover(t, nil, dhcpv4.WithBroadcast(true))
+		retrying, _ := testpackets.V4Discover(t, nil, dhcpv4.WithBroadcast(true))
+		retrying.NumSeconds = 4
+		request, _ := testpackets.V4RequestRenewing(t, nil, net.IPv4(192, 0, 2, 100))
+		client := &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ClientPort}
+		for _, m := range []*dhcpv4.DHCPv4{busy, shed, retrying, request} {
+			require.NoError(t, conn4.Inject(m.ToBytes(), client, 1))
+		}
+
+		served := sentIDs(t, conn4.Sent, 500*time.Millisecond, func(b []byte) (string, error) {
+			resp, err := dhcpv4.FromBytes(b)
+			if err != nil {
+				return "", err
+			}
+			return resp.TransactionID.String(), nil
+		})
+		assert.Equal(t, map[string]bool{
+			busy.TransactionID.String():     true,
+			retrying.TransactionID.String(): true,
+			request.TransactionID.String():  true,
+		}, served)
+		v4, v6 := srv.Shed()
+		assert.Equal(t, ShedCounts{Dropped: 1}, v4)
+		assert.Equal(t, ShedCounts{}, v6)
+	})
+
+	t.Run("v6", func(t *testing.T) {
+		busy, _ := testpackets.V6Solicit(t, nil)
+		shed, _ := testpackets.V6Solicit(t, nil)
+		retrying, _ := testpackets.V6Solicit(t, nil, dhcpv6.WithOption(dhcpv6.OptElapsedTime(5*time.Second)))
+		info, _ := testpackets.V6InformationRequest(t, nil)
+		client := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: dhcpv6.DefaultClientPort}
+		for _, m := range []*dhcpv6.Message{busy, shed, retrying, info} {
+			require.NoError(t, conn6.Inject(m.ToBytes(), client, 1))
+		}
+
+		served := sentIDs(t, conn6.Sent, 500*time.Millisecond, func(b []byte) (string, error) {
+			resp, err := dhcpv6.MessageFromBytes(b)
+			if err != nil {
+				return "", err
+			}
+			return resp.TransactionID.String(), nil
+		})
+		assert.Equal(t, map[string]bool{
+			busy.TransactionID.String():     true,
+			retrying.TransactionID.String(): true,
+			info.TransactionID.String():     true,
+		}, served)
+		v4, v6 := srv.Shed()
+		assert.Equal(t, ShedCounts{Dropped: 1}, v4)
+		assert.Equal(t, ShedCounts{Dropped: 1}, v6)
+	})
+}
+
+// TestMemShedDelay checks that the DISCOVERs shed with the delay action are
+// handled if the server is no longer overloaded after the delay, and dropped
+// otherwise
+func TestMemShedDelay(t *testing.T) {
+	registerTestPlugins(t)
+
+	for _, tc := range []struct {
+		name    string
+		sleep   string
+		delay   time.Duration
+		timeout time.Duration
+		// held is the number of DISCOVERs sent while the server is busy
+		held   int
+		counts ShedCounts
+	}{
+		{"load gone", "100ms", 300 * time.Millisecond, 0, 1, ShedCounts{Delayed: 1}},
+		{"still overloaded", "500ms", 100 * time.Millisecond, 0, 1, ShedCounts{Dropped: 1}},
+		{"delay past the deadline", "100ms", 300 * time.Millisecond, 200 * time.Millisecond, 1, ShedCounts{Dropped: 1}},
+		// More held requests than max_in_flight do not overload the server
+		// by themselves
+		{"burst", "100ms", 300 * time.Millisecond, 0, 5, ShedCounts{Delayed: 5}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conf := config.Config{
+				Server4: &config.ServerConfig{
+					Plugins: []config.PluginConfig{
+						{Name: "server_id", Args: []string{"192.0.2.1"}},
+						{Name: "sleep", Args: []string{tc.sleep}},
+					},
+					LoadShedding: &config.LoadSheddingConfig{
+						MaxInFlight: 1,
+						MinSecs:     4 * time.Second,
+						Action:      config.ShedDelay,
+						Delay:       tc.delay,
+					},
+					RequestTimeout: tc.timeout,
+				},
+			}
+			conn := NewMemConn4(&net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ServerPort})
+			srv, err := StartConns(&conf, []PacketConn4{conn}, nil)
+			require.NoError(t, err)
+			defer srv.Close()
+
+			busy, _ := testpackets.V4Discover(t, nil, dhcpv4.WithBroadcast(true))
+			client := &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ClientPort}
+			require.NoError(t, conn.Inject(busy.ToBytes(), client, 1))
+			var held []*dhcpv4.DHCPv4
+			for i := 0; i < tc.held; i++ {
+				m, _ := testpackets.V4Discover(t, nil, dhcpv4.WithBroadcast(true))
+				require.NoError(t, conn.Inject(m.ToBytes(), client, 1))
+				held = append(held, m)
+			}
+
+			served := sentIDs(t, conn.Sent, time.Second, func(b []byte) (string, error) {
+				resp, err := dhcpv4.FromBytes(b)
+				if err != nil {
+					return "", err
+				}
+				return resp.TransactionID.String(), nil
+			})
+			for _, m := range held {
+				assert.Equal(t, tc.counts.Delayed > 0, served[m.TransactionID.String()], "delayed request handled")
+			}
+			v4, _ := srv.Shed()
+			assert.Equal(t, tc.counts, v4)
+			assert.Zero(t, atomic.LoadInt32(&srv.load4.inFlight), "requests still counted in flight")
+			assert.Zero(t, atomic.LoadInt32(&srv.load4.resumed), "requests still counted as resumed")
+		})
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// +build linux
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/coredhcp/coredhcp/config"
+)
+
+// dropsInterval is how often the kernel drop counters of the sockets are read
+const dropsInterval = time.Minute
+
+// setSocketOptions4 applies the socket options of a DHCPv4 server to the socket
+// of one of its listeners
+func setSocketOptions4(conn *net.UDPConn, pc *ipv4.PacketConn, o config.SocketOptions) error {
+	if o.ReceiveBuffer > 0 {
+		if err := setReceiveBuffer(conn, o.ReceiveBuffer); err != nil {
+			return err
+		}
+	}
+	if o.TrafficClass > 0 {
+		if err := pc.SetTOS(o.TrafficClass); err != nil {
+			return fmt.Errorf("DHCPv4: could not set the ToS of %s to %#x: %w", conn.LocalAddr(), o.TrafficClass, err)
+		}
+	}
+	return nil
+}
+
+// setSocketOptions6 applies the socket options of a DHCPv6 server to the socket
+// of one of its listeners
+func setSocketOptions6(conn *net.UDPConn, pc *ipv6.PacketConn, o config.SocketOptions) error {
+	if o.ReceiveBuffer > 0 {
+		if err := setReceiveBuffer(conn, o.ReceiveBuffer); err != nil {
+			return err
+		}
+	}
+	if o.TrafficClass > 0 {
+		if err := pc.SetTrafficClass(o.TrafficClass); err != nil {
+			return fmt.Errorf("DHCPv6: could not set the traffic class of %s to %#x: %w", conn.LocalAddr(), o.TrafficClass, err)
+		}
+	}
+	if o.MulticastHopLimit > 0 {
+		if err := pc.SetMulticastHopLimit(o.MulticastHopLimit); err != nil {
+			return fmt.Errorf("DHCPv6: could not set the multicast hop limit of %s to %d: %w", conn.LocalAddr(), o.MulticastHopLimit, err)
+		}
+	}
+	return nil
+}
+
+// setReceiveBuffer sets the receive buffer size of conn, and logs the size the
+// kernel actually gave it
+func setReceiveBuffer(conn *net.UDPConn, size int) error {
+	if err := conn.SetReadBuffer(size); err != nil {
+		return fmt.Errorf("could not set the receive buffer of %s to %d bytes: %w", conn.LocalAddr(), size, err)
+	}
+	effective, err := receiveBuffer(conn)
+	if err != nil {
+		return fmt.Errorf("could not read the receive buffer size of %s: %w", conn.LocalAddr(), err)
+	}
+	// Linux doubles the requested size to account for its bookkeeping, and
+	// caps it to net.core.rmem_max
+	if effective/2 < size {
+		log.Warningf("Receive buffer of %s is %d bytes instead of %d, raise net.core.rmem_max", conn.LocalAddr(), effective/2, size)
+	} else {
+		log.Printf("Receive buffer of %s is %d bytes", conn.LocalAddr(), effective/2)
+	}
+	return nil
+}
+
+// receiveBuffer returns the receive buffer size of conn, as reported by the
+// kernel
+func receiveBuffer(conn *net.UDPConn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var size int
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		size, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	}); err != nil {
+		return 0, err
+	}
+	return size, serr
+}
+
+// socketInode returns the inode of the socket of conn, which identifies it in
+// /proc/net
+func socketInode(conn *net.UDPConn) (uint64, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var st syscall.Stat_t
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		serr = syscall.Fstat(int(fd), &st)
+	}); err != nil {
+		return 0, err
+	}
+	return st.Ino, serr
+}
+
+// parseUDPDrops returns the number of datagrams the kernel dropped on the
+// socket with the given inode, from a table in the format of /proc/net/udp
+func parseUDPDrops(r io.Reader, inode uint64) (drops uint64, found bool, err error) {
+	sc := bufio.NewScanner(r)
+	// Skip the header
+	sc.Scan()
+	want := strconv.FormatUint(inode, 10)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		// sl local rem st tx:rx tr:when retrnsmt uid timeout inode ref pointer drops
+		if len(fields) < 13 || fields[9] != want {
+			continue
+		}
+		drops, err = strconv.ParseUint(fields[12], 10, 64)
+		return drops, err == nil, err
+	}
+	return 0, false, sc.Err()
+}
+
+// udpDrops returns the number of datagrams the kernel dropped on the UDP
+// socket with the given inode, and false if there is no such socket anymore
+func udpDrops(inode uint64) (uint64, bool, error) {
+	for _, table := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		f, err := os.Open(table)
+		if err != nil {
+			return 0, false, err
+		}
+		drops, found, err := parseUDPDrops(f, inode)
+		f.Close()
+		if err != nil || found {
+			return drops, found, err
+		}
+	}
+	return 0, false, nil
+}
+
+// watchDrops periodically logs the datagrams the kernel dropped on the socket
+// of conn, usually because its receive buffer was full, until it is closed
+func watchDrops(conn *net.UDPConn) {
+	inode, err := socketInode(conn)
+	if err != nil {
+		log.Debugf("Not watching drops on %s: %v", conn.LocalAddr(), err)
+		return
+	}
+	last, _, err := udpDrops(inode)
+	if err != nil {
+		log.Debugf("Not watching drops on %s: %v", conn.LocalAddr(), err)
+		return
+	}
+	addr := conn.LocalAddr().String()
+	go func() {
+		t := time.NewTicker(dropsInterval)
+		defer t.Stop()
+		for range t.C {
+			drops, found, err := udpDrops(inode)
+			if err != nil || !found {
+				return
+			}
+			if drops > last {
+				limited.Limited("drops "+addr).Warningf("The kernel dropped %d requests on %s in the last %s (%d in total), the receive buffer may be too small", drops-last, addr, dropsInterval, drops)
+				last = drops
+			}
+		}
+	}()
+}
@@ -0,0 +1,70 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// +build integration,linux
+
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+	"github.com/insomniacslk/dhcp/dhcpv6/server6"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/coredhcp/coredhcp/config"
+)
+
+// The requested receive buffer is below the default net.core.rmem_max, so
+// the kernel does not clamp it, and reports twice its size
+const testReceiveBuffer = 65536
+
+func TestSocketOptions4(t *testing.T) {
+	conn, err := server4.NewIPv4UDPConn("", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer conn.Close()
+	pc := ipv4.NewPacketConn(conn)
+
+	require.NoError(t, setSocketOptions4(conn, pc, config.SocketOptions{ReceiveBuffer: testReceiveBuffer, TrafficClass: 0x10}))
+	size, err := receiveBuffer(conn)
+	require.NoError(t, err)
+	require.Equal(t, 2*testReceiveBuffer, size)
+	tos, err := pc.TOS()
+	require.NoError(t, err)
+	require.Equal(t, 0x10, tos)
+
+	inode, err := socketInode(conn)
+	require.NoError(t, err)
+	drops, found, err := udpDrops(inode)
+	require.NoError(t, err)
+	require.True(t, found, "socket not found in /proc/net/udp")
+	require.Equal(t, uint64(0), drops)
+}
+
+func TestSocketOptions6(t *testing.T) {
+	conn, err := server6.NewIPv6UDPConn("", &net.UDPAddr{IP: net.IPv6loopback})
+	require.NoError(t, err)
+	defer conn.Close()
+	pc := ipv6.NewPacketConn(conn)
+
+	require.NoError(t, setSocketOptions6(conn, pc, config.SocketOptions{ReceiveBuffer: testReceiveBuffer, TrafficClass: 0xb8, MulticastHopLimit: 8}))
+	size, err := receiveBuffer(conn)
+	require.NoError(t, err)
+	require.Equal(t, 2*testReceiveBuffer, size)
+	tclass, err := pc.TrafficClass()
+	require.NoError(t, err)
+	require.Equal(t, 0xb8, tclass)
+	hops, err := pc.MulticastHopLimit()
+	require.NoError(t, err)
+	require.Equal(t, 8, hops)
+
+	inode, err := socketInode(conn)
+	require.NoError(t, err)
+	_, found, err := udpDrops(inode)
+	require.NoError(t, err)
+	require.True(t, found, "socket not found in /proc/net/udp6")
+}
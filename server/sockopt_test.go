@@ -0,0 +1,40 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// +build linux
+
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const procNetUDP = `   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  123: 00000000:0043 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 41230 2 0000000000000000 0
+  456: 0100007F:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000   101        0 41231 2 0000000000000000 17
+`
+
+func TestParseUDPDrops(t *testing.T) {
+	drops, found, err := parseUDPDrops(strings.NewReader(procNetUDP), 41231)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, uint64(17), drops)
+
+	drops, found, err = parseUDPDrops(strings.NewReader(procNetUDP), 41230)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, uint64(0), drops)
+
+	// The header is not a socket
+	_, found, err = parseUDPDrops(strings.NewReader(procNetUDP), 0)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	_, found, err = parseUDPDrops(strings.NewReader(procNetUDP), 1)
+	require.NoError(t, err)
+	require.False(t, found)
+}
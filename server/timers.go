@@ -0,0 +1,184 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+
+	"github.com/coredhcp/coredhcp/config"
+)
+
+// timerCheck makes the renewal timers of the responses of a server consistent
+// with their lease times, once the plugins ran, whichever plugins set them
+type timerCheck struct {
+	// fixed and dropped count the responses whose timers were clamped or
+	// removed. They are updated atomically, and kept first for alignment on
+	// 32-bit platforms
+	fixed   uint64
+	dropped uint64
+	action  config.TimersAction
+}
+
+func newTimerCheck(action config.TimersAction) *timerCheck {
+	return &timerCheck{action: action}
+}
+
+// count records that the timers of a response were inconsistent
+func (c *timerCheck) count() {
+	if c.action == config.TimersFix {
+		atomic.AddUint64(&c.fixed, 1)
+	} else {
+		atomic.AddUint64(&c.dropped, 1)
+	}
+}
+
+// counts returns the number of responses whose timers were fixed or dropped
+func (c *timerCheck) counts() (fixed, dropped uint64) {
+	return atomic.LoadUint64(&c.fixed), atomic.LoadUint64(&c.dropped)
+}
+
+// check4 enforces T1 (option 58) < T2 (option 59) < lease time (option 51) in
+// resp
+func (c *timerCheck) check4(resp *dhcpv4.DHCPv4) {
+	fix, inconsistent := c.action == config.TimersFix, false
+	hasLease := resp.Options.Has(dhcpv4.OptionIPAddressLeaseTime)
+	lease := resp.IPAddressLeaseTime(0)
+
+	// The T2 used by the client: the one we send or the RFC2131 default
+	var t2 time.Duration
+	hasT2 := resp.Options.Has(dhcpv4.OptionRebindingTimeValue)
+	if hasT2 {
+		t2 = resp.IPAddressRebindingTime(0)
+		if hasLease && t2 >= lease {
+			log.Warningf("%s: rebinding time %s not shorter than lease time %s", resp.ClientHWAddr, t2, lease)
+			inconsistent = true
+			if fix {
+				t2 = lease * 7 / 8
+				resp.UpdateOption(dhcpv4.Option{Code: dhcpv4.OptionRebindingTimeValue, Value: dhcpv4.Duration(t2)})
+			} else {
+				delete(resp.Options, dhcpv4.OptionRebindingTimeValue.Code())
+				hasT2 = false
+			}
+		}
+	}
+	if !hasT2 && hasLease {
+		hasT2, t2 = true, lease*7/8
+	}
+
+	if resp.Options.Has(dhcpv4.OptionRenewTimeValue) && hasT2 {
+		if t1 := resp.IPAddressRenewalTime(0); t1 >= t2 {
+			log.Warningf("%s: renewal time %s not shorter than rebinding time %s", resp.ClientHWAddr, t1, t2)
+			inconsistent = true
+			if fix {
+				resp.UpdateOption(dhcpv4.Option{Code: dhcpv4.OptionRenewTimeValue, Value: dhcpv4.Duration(t2 * 4 / 7)})
+			} else {
+				delete(resp.Options, dhcpv4.OptionRenewTimeValue.Code())
+			}
+		}
+	}
+	if inconsistent {
+		c.count()
+	}
+}
+
+// lifetimes points to the lifetimes of one address or prefix in an IA
+type lifetimes struct {
+	opt              dhcpv6.Option
+	preferred, valid *time.Duration
+}
+
+// checkIA enforces preferred <= valid for each address or prefix in an IA, and
+// T1 <= T2 <= the shortest preferred lifetime. It returns the options to
+// remove from the IA, if fix is false, and whether anything was inconsistent
+func checkIA(t1, t2 *time.Duration, lts []lifetimes, fix bool) (drop []dhcpv6.Option, inconsistent bool) {
+	var minPreferred time.Duration
+	for _, lt := range lts {
+		if *lt.preferred > *lt.valid {
+			log.Warningf("preferred lifetime %s longer than valid lifetime %s", *lt.preferred, *lt.valid)
+			inconsistent = true
+			if !fix {
+				drop = append(drop, lt.opt)
+				continue
+			}
+			*lt.preferred = *lt.valid
+		}
+		// A lifetime of 0 is used to tell the client to stop using a lease,
+		// don't base the timers on those
+		if *lt.preferred != 0 && (minPreferred == 0 || *lt.preferred < minPreferred) {
+			minPreferred = *lt.preferred
+		}
+	}
+
+	// T1 and T2 of 0 let the client choose, and are always consistent
+	if minPreferred != 0 && *t2 > minPreferred {
+		log.Warningf("T2 %s longer than preferred lifetime %s", *t2, minPreferred)
+		if !fix {
+			*t1, *t2 = 0, 0
+			return drop, true
+		}
+		inconsistent = true
+		*t2 = minPreferred * 4 / 5
+	}
+	if *t1 != 0 && *t2 != 0 && *t1 > *t2 {
+		log.Warningf("T1 %s longer than T2 %s", *t1, *t2)
+		if !fix {
+			*t1, *t2 = 0, 0
+			return drop, true
+		}
+		inconsistent = true
+		*t1 = *t2 * 5 / 8
+	}
+	return drop, inconsistent
+}
+
+// removeOptions returns opts without the elements of drop
+func removeOptions(opts []dhcpv6.Option, drop []dhcpv6.Option) []dhcpv6.Option {
+	if len(drop) == 0 {
+		return opts
+	}
+	kept := opts[:0]
+outer:
+	for _, o := range opts {
+		for _, d := range drop {
+			if o == d {
+				continue outer
+			}
+		}
+		kept = append(kept, o)
+	}
+	return kept
+}
+
+// check6 enforces consistent T1/T2 and lifetimes in the IA_NA and IA_PD
+// options of msg. Without fixing, inconsistent timers are zeroed, and
+// addresses or prefixes with inconsistent lifetimes are removed
+func (c *timerCheck) check6(msg *dhcpv6.Message) {
+	fix, inconsistent := c.action == config.TimersFix, false
+	for _, iana := range msg.Options.IANA() {
+		var lts []lifetimes
+		for _, a := range iana.Options.Addresses() {
+			lts = append(lts, lifetimes{a, &a.PreferredLifetime, &a.ValidLifetime})
+		}
+		drop, bad := checkIA(&iana.T1, &iana.T2, lts, fix)
+		iana.Options.Options = removeOptions(iana.Options.Options, drop)
+		inconsistent = inconsistent || bad
+	}
+	for _, iapd := range msg.Options.IAPD() {
+		var lts []lifetimes
+		for _, p := range iapd.Options.Prefixes() {
+			lts = append(lts, lifetimes{p, &p.PreferredLifetime, &p.ValidLifetime})
+		}
+		drop, bad := checkIA(&iapd.T1, &iapd.T2, lts, fix)
+		iapd.Options.Options = removeOptions(iapd.Options.Options, drop)
+		inconsistent = inconsistent || bad
+	}
+	if inconsistent {
+		c.count()
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/internal/testpackets"
+)
+
+func action(fix bool) config.TimersAction {
+	if fix {
+		return config.TimersFix
+	}
+	return config.TimersDrop
+}
+
+func TestCheck4(t *testing.T) {
+	const none = time.Duration(-1)
+	for _, tt := range []struct {
+		name           string
+		fix            bool
+		lease, t1, t2  time.Duration
+		wantT1, wantT2 time.Duration
+	}{
+		{"consistent", true, time.Hour, 30 * time.Minute, 45 * time.Minute, 30 * time.Minute, 45 * time.Minute},
+		{"no timers", true, time.Hour, none, none, none, none},
+		{"no lease time", true, none, 30 * time.Minute, 45 * time.Minute, 30 * time.Minute, 45 * time.Minute},
+		{"T2 past lease, fix", true, 8 * time.Hour, 2 * time.Hour, 9 * time.Hour, 2 * time.Hour, 7 * time.Hour},
+		{"T2 past lease, drop", false, 8 * time.Hour, 2 * time.Hour, 9 * time.Hour, 2 * time.Hour, none},
+		{"T1 past T2, fix", true, 8 * time.Hour, 7 * time.Hour, 7 * time.Hour, 4 * time.Hour, 7 * time.Hour},
+		{"T1 past T2, drop", false, 8 * time.Hour, 7 * time.Hour, 7 * time.Hour, none, 7 * time.Hour},
+		{"T1 past lease without T2, fix", true, 8 * time.Hour, 9 * time.Hour, none, 4 * time.Hour, none},
+		{"T1 past lease without T2, drop", false, 8 * time.Hour, 9 * time.Hour, none, none, none},
+		{"all inverted, fix", true, 8 * time.Hour, 10 * time.Hour, 9 * time.Hour, 4 * time.Hour, 7 * time.Hour},
+		{"all inverted, drop", false, 8 * time.Hour, 10 * time.Hour, 9 * time.Hour, none, none},
+		{"T1 past T2 without lease, fix", true, none, 8 * time.Hour, 7 * time.Hour, 4 * time.Hour, 7 * time.Hour},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := dhcpv4.New()
+			require.NoError(t, err)
+			if tt.lease != none {
+				resp.UpdateOption(dhcpv4.OptIPAddressLeaseTime(tt.lease))
+			}
+			if tt.t1 != none {
+				resp.UpdateOption(dhcpv4.Option{Code: dhcpv4.OptionRenewTimeValue, Value: dhcpv4.Duration(tt.t1)})
+			}
+			if tt.t2 != none {
+				resp.UpdateOption(dhcpv4.Option{Code: dhcpv4.OptionRebindingTimeValue, Value: dhcpv4.Duration(tt.t2)})
+			}
+
+			c := newTimerCheck(action(tt.fix))
+			c.check4(resp)
+			result := resp
+			fixed, dropped := c.counts()
+			if tt.wantT1 != tt.t1 || tt.wantT2 != tt.t2 {
+				assert.Equal(t, uint64(1), fixed+dropped, "inconsistent timers not counted")
+			} else {
+				assert.Zero(t, fixed+dropped)
+			}
+
+			if tt.wantT1 == none {
+				assert.False(t, result.Options.Has(dhcpv4.OptionRenewTimeValue), "T1 not removed")
+			} else {
+				assert.Equal(t, tt.wantT1, result.IPAddressRenewalTime(0))
+			}
+			if tt.wantT2 == none {
+				assert.False(t, result.Options.Has(dhcpv4.OptionRebindingTimeValue), "T2 not removed")
+			} else {
+				assert.Equal(t, tt.wantT2, result.IPAddressRebindingTime(0))
+			}
+		})
+	}
+}
+
+func TestCheck6(t *testing.T) {
+	for _, tt := range []struct {
+		name             string
+		fix              bool
+		t1, t2           time.Duration
+		preferred, valid time.Duration
+		wantT1, wantT2   time.Duration
+		wantPreferred    time.Duration
+		wantDropped      bool
+	}{
+		{"consistent", true, time.Hour, 2 * time.Hour, 4 * time.Hour, 8 * time.Hour, time.Hour, 2 * time.Hour, 4 * time.Hour, false},
+		{"client chooses timers", true, 0, 0, 4 * time.Hour, 8 * time.Hour, 0, 0, 4 * time.Hour, false},
+		{"T1 past T2, fix", true, 2 * time.Hour, time.Hour, 4 * time.Hour, 8 * time.Hour, 5 * time.Hour / 8, time.Hour, 4 * time.Hour, false},
+		{"T1 past T2, drop", false, 2 * time.Hour, time.Hour, 4 * time.Hour, 8 * time.Hour, 0, 0, 4 * time.Hour, false},
+		{"T2 past preferred, fix", true, time.Hour, 5 * time.Hour, 4 * time.Hour, 8 * time.Hour, time.Hour, 16 * time.Hour / 5, 4 * time.Hour, false},
+		{"T2 past preferred, drop", false, time.Hour, 5 * time.Hour, 4 * time.Hour, 8 * time.Hour, 0, 0, 4 * time.Hour, false},
+		{"both past preferred, fix", true, 6 * time.Hour, 5 * time.Hour, 4 * time.Hour, 8 * time.Hour, 2 * time.Hour, 16 * time.Hour / 5, 4 * time.Hour, false},
+		{"preferred past valid, fix", true, time.Hour, 2 * time.Hour, 8 * time.Hour, 4 * time.Hour, time.Hour, 2 * time.Hour, 4 * time.Hour, false},
+		{"preferred past valid, drop", false, time.Hour, 2 * time.Hour, 8 * time.Hour, 4 * time.Hour, time.Hour, 2 * time.Hour, 0, true},
+		{"released lease", true, 0, 0, 0, 0, 0, 0, 0, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := dhcpv6.NewMessage()
+			require.NoError(t, err)
+			resp.AddOption(&dhcpv6.OptIANA{
+				IaId: [4]byte{0, 0, 0, 1},
+				T1:   tt.t1,
+				T2:   tt.t2,
+				Options: dhcpv6.IdentityOptions{Options: []dhcpv6.Option{
+					&dhcpv6.OptIAAddress{
+						IPv6Addr:          net.ParseIP("2001:db8::1"),
+						PreferredLifetime: tt.preferred,
+						ValidLifetime:     tt.valid,
+					},
+				}},
+			})
+			_, prefix, err := net.ParseCIDR("2001:db8:1::/56")
+			require.NoError(t, err)
+			resp.AddOption(&dhcpv6.OptIAPD{
+				IaId: [4]byte{0, 0, 0, 2},
+				T1:   tt.t1,
+				T2:   tt.t2,
+				Options: dhcpv6.PDOptions{Options: []dhcpv6.Option{
+					&dhcpv6.OptIAPrefix{
+						Prefix:            prefix,
+						PreferredLifetime: tt.preferred,
+						ValidLifetime:     tt.valid,
+					},
+				}},
+			})
+
+			c := newTimerCheck(action(tt.fix))
+			c.check6(resp)
+			opts := resp.Options
+			fixed, dropped := c.counts()
+			if tt.wantT1 != tt.t1 || tt.wantT2 != tt.t2 || tt.wantPreferred != tt.preferred || tt.wantDropped {
+				assert.Equal(t, uint64(1), fixed+dropped, "inconsistent timers not counted")
+			} else {
+				assert.Zero(t, fixed+dropped)
+			}
+
+			iana := opts.OneIANA()
+			require.NotNil(t, iana)
+			assert.Equal(t, tt.wantT1, iana.T1, "IA_NA T1")
+			assert.Equal(t, tt.wantT2, iana.T2, "IA_NA T2")
+			iapd := opts.OneIAPD()
+			require.NotNil(t, iapd)
+			assert.Equal(t, tt.wantT1, iapd.T1, "IA_PD T1")
+			assert.Equal(t, tt.wantT2, iapd.T2, "IA_PD T2")
+
+			if tt.wantDropped {
+				assert.Empty(t, iana.Options.Addresses(), "address not removed")
+				assert.Empty(t, iapd.Options.Prefixes(), "prefix not removed")
+				return
+			}
+			require.Len(t, iana.Options.Addresses(), 1)
+			assert.Equal(t, tt.wantPreferred, iana.Options.Addresses()[0].PreferredLifetime)
+			require.Len(t, iapd.Options.Prefixes(), 1)
+			assert.Equal(t, tt.wantPreferred, iapd.Options.Prefixes()[0].PreferredLifetime)
+		})
+	}
+}
+
+// TestProcess4Timers checks that the timers are checked when a plugin stops the
+// chain, before the plugins that would have set the lease time
+func TestProcess4Timers(t *testing.T) {
+	static := []handler.Handler4{func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		resp.YourIPAddr = net.IPv4(192, 0, 2, 100)
+		resp.UpdateOption(dhcpv4.OptIPAddressLeaseTime(time.Hour))
+		resp.UpdateOption(dhcpv4.Option{Code: dhcpv4.OptionRebindingTimeValue, Value: dhcpv4.Duration(2 * time.Hour)})
+		return resp, true
+	}, func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		t.Fatal("the chain was not stopped")
+		return resp, false
+	}}
+	c := newTimerCheck(config.TimersFix)
+
+	discover, _ := testpackets.V4Discover(t, nil)
+	resp, ok := newInstance("").process4(static, c, discover, time.Now().Add(time.Minute))
+	require.True(t, ok)
+	require.NotNil(t, resp)
+	assert.Equal(t, 7*time.Hour/8, resp.IPAddressRebindingTime(0))
+	fixed, dropped := c.counts()
+	assert.Equal(t, uint64(1), fixed)
+	assert.Zero(t, dropped)
+}
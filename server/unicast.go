@@ -0,0 +1,72 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package server
+
+import (
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	"golang.org/x/net/ipv6"
+)
+
+// receivedUnicast tells whether a datagram was sent to a unicast address of
+// the server. If the destination is unknown, it is assumed to be multicast
+func receivedUnicast(oob *ipv6.ControlMessage) bool {
+	return oob != nil && oob.Dst != nil && !oob.Dst.IsMulticast()
+}
+
+// refuseUnicast tells whether a message of type t received by unicast must be
+// answered with UseMulticast. This only concerns the messages addressed to a
+// specific server, which clients may unicast once that server sent them the
+// Server Unicast option (RFC8415 §18.4)
+func refuseUnicast(t dhcpv6.MessageType, unicast net.IP) bool {
+	switch t {
+	case dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew,
+		dhcpv6.MessageTypeRelease, dhcpv6.MessageTypeDecline:
+		return unicast == nil
+	}
+	return false
+}
+
+// newUseMulticastReply builds the reply to a message a client was not allowed
+// to unicast, or returns nil if the message must be dropped. The plugins are
+// not run for such messages, so the server identifier is checked here against
+// serverID, the DUID of the server: messages for other servers are discarded
+// (RFC8415 §16), as are all of them if the server has no DUID
+func newUseMulticastReply(msg *dhcpv6.Message, serverID *dhcpv6.Duid) *dhcpv6.Message {
+	sid := msg.Options.ServerID()
+	clientID := msg.GetOneOption(dhcpv6.OptionClientID)
+	if sid == nil || clientID == nil {
+		// Only messages carrying both identifiers may be unicast
+		return nil
+	}
+	if serverID == nil || !sid.Equal(*serverID) {
+		return nil
+	}
+	resp := &dhcpv6.Message{
+		MessageType:   dhcpv6.MessageTypeReply,
+		TransactionID: msg.TransactionID,
+	}
+	resp.AddOption(clientID)
+	resp.AddOption(dhcpv6.OptServerID(*serverID))
+	resp.UpdateOption(&dhcpv6.OptStatusCode{
+		StatusCode:    iana.StatusUseMulticast,
+		StatusMessage: "use multicast",
+	})
+	return resp
+}
+
+// addUnicastOption tells the client it may unicast its next messages to the
+// server at addr, on the responses where the option is allowed
+func addUnicastOption(resp dhcpv6.DHCPv6, addr net.IP) {
+	switch resp.Type() {
+	case dhcpv6.MessageTypeAdvertise, dhcpv6.MessageTypeReply:
+		resp.UpdateOption(&dhcpv6.OptionGeneric{
+			OptionCode: dhcpv6.OptionUnicast,
+			OptionData: addr.To16(),
+		})
+	}
+}